@@ -0,0 +1,83 @@
+// Command import loads reservations or owner blocks from a CSV file, the same way the admin import page does.
+// Every row is checked and the problems listed; nothing is written unless -commit is given.
+//
+//	go run ./cmd/import -dbname=bookings -dbuser=... -dbpass=... -kind=reservations -commit old-bookings.csv
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aparkinlot/Bookings/internal/config"
+	"github.com/aparkinlot/Bookings/internal/driver"
+	"github.com/aparkinlot/Bookings/internal/importer"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository/dbrepo"
+)
+
+func main() {
+	dbHost := flag.String("dbhost", "localhost", "Database host")
+	dbName := flag.String("dbname", "", "Database name")
+	dbUser := flag.String("dbuser", "", "Database username")
+	dbPass := flag.String("dbpass", "", "Database password")
+	dbPort := flag.String("dbport", "5432", "Database port")
+	dbSSL := flag.String("dbssl", "disable", "Database ssl settings (disable, prefer, require)")
+	kind := flag.String("kind", importer.KindReservations, "What the file holds (reservations, blocks)")
+	commit := flag.Bool("commit", false, "Import the rows that pass; without it the file is only checked")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: import [flags] file.csv\n\ncolumns for reservations: %s\ncolumns for blocks: %s\n\n",
+			strings.Join(importer.Columns[importer.KindReservations], ", "), strings.Join(importer.Columns[importer.KindBlocks], ", "))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *dbName == "" || *dbUser == "" || *dbPass == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	dbConnString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s", *dbHost, *dbPort, *dbName, *dbUser, *dbPass, *dbSSL)
+	db, err := driver.ConnectSql(dbConnString)
+	if err != nil {
+		log.Fatal("Cannot connect to database: ", err)
+	}
+	defer db.SQL.Close()
+
+	var app config.AppConfig
+	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	app.ErrorLog = log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	imports := importer.NewService(dbrepo.NewPostgresRepo(db.SQL, &app))
+
+	report, err := imports.Check(*kind, file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, row := range report.Rows {
+		for _, p := range row.Problems {
+			fmt.Printf("line %d: %s\n", row.Line, p)
+		}
+	}
+	valid := report.Valid()
+	fmt.Printf("Checked %d rows of %s: %d can be imported, %d can't\n", len(report.Rows), report.Kind, valid, len(report.Rows)-valid)
+
+	if !*commit || valid == 0 {
+		return
+	}
+
+	err = imports.Import(report.Batch(), models.ActorImportCommand)
+	if err != nil {
+		log.Fatal("Nothing was imported: ", err)
+	}
+	fmt.Printf("Imported %d %s\n", valid, report.Kind)
+}
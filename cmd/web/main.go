@@ -14,7 +14,9 @@ import (
 	"github.com/aparkinlot/Bookings/internal/driver"
 	"github.com/aparkinlot/Bookings/internal/handlers"
 	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/importer"
 	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/payments"
 	"github.com/aparkinlot/Bookings/internal/render"
 )
 
@@ -38,6 +40,14 @@ func main() {
 	fmt.Println("Starting mail listener...")
 	listenForMail()
 
+	fmt.Println("Starting hold sweeper...")
+	sweepHolds(handlers.Repo.DB)
+
+	if app.ICalSync > 0 {
+		fmt.Println("Starting calendar sync...")
+		syncCalendars(handlers.Repo.Calendars, app.ICalSync)
+	}
+
 	fmt.Println(fmt.Sprintf("Staring application on port %s", portNumber))
 
 	srv := &http.Server{
@@ -57,7 +67,9 @@ func run() (*driver.DB, error) {
 	gob.Register(models.User{})
 	gob.Register(models.Room{})
 	gob.Register(models.RoomRestriction{})
+	gob.Register(models.BookingGroup{})
 	gob.Register(map[string]int{})
+	gob.Register(importer.Batch{})
 
 	// flags for type of production
 	inProduction := flag.Bool("production", true, "Application is in production")
@@ -68,6 +80,15 @@ func run() (*driver.DB, error) {
 	dbPass := flag.String("dbpass", "", "Database password")
 	dbPort := flag.String("dbport", "5432", "Database port")
 	dbSSL := flag.String("dbssl", "disable", "Database ssl settings (disable, prefer, require)")
+	taxRate := flag.Int("taxrate", 0, "Tax rate in basis points, e.g. 1200 for 12%")
+	cleaningFee := flag.Int("cleaningfee", 0, "Cleaning fee charged once per stay, in cents")
+	depositRate := flag.Int("deposit", 2500, "Deposit held when booking, in basis points of the total")
+	holdTTL := flag.Duration("holdttl", 15*time.Minute, "How long a room is held while a guest checks out, 0 to turn holds off")
+	fakePayments := flag.Bool("fakepayments", false, "Take deposits through the in-memory fake payment provider, for development and tests only")
+	paymentSecret := flag.String("paymentsecret", "", "Secret the payment provider signs webhooks with")
+	uploadPath := flag.String("uploads", "./uploads", "Directory uploaded room photos are stored in")
+	baseURL := flag.String("baseurl", "http://localhost"+portNumber, "Address guests reach the site at, used for links in emails")
+	icalSync := flag.Duration("icalsync", 15*time.Minute, "How often calendars imported from other channels are synced, 0 to only sync them by hand")
 
 	flag.Parse()
 
@@ -76,12 +97,31 @@ func run() (*driver.DB, error) {
 		os.Exit(1)
 	}
 
+	// webhooks are checked against the secret, so without one anyone could mark a deposit captured or refunded
+	if *fakePayments && *paymentSecret == "" {
+		fmt.Println("-fakepayments needs a -paymentsecret to check webhooks with")
+		os.Exit(1)
+	}
+
 	mailChan := make(chan models.MailData)
 	app.MailChan = mailChan
 
 	// change this to true when in production
 	app.InProduction = *inProduction
 	app.UseCache = *useCache
+	app.TaxRate = *taxRate
+	app.CleaningFee = *cleaningFee
+	app.DepositRate = *depositRate
+	app.HoldTTL = *holdTTL
+	app.UploadPath = *uploadPath
+	app.ICalSync = *icalSync
+	app.BaseURL = *baseURL
+
+	// the fake provider holds payments in memory, so they're lost on restart, and accepts any card number.
+	// Without it no deposit is taken and no card asked for; swap in a real gateway here
+	if *fakePayments {
+		app.Payments = payments.NewFakeProvider(*paymentSecret)
+	}
 
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	app.InfoLog = infoLog
@@ -119,6 +159,7 @@ func run() (*driver.DB, error) {
 	handlers.NewHandlers(repo)
 
 	render.NewRenderer(&app)
+	render.NewRoomSource(repo.DB)
 
 	helpers.NewHelpers(&app)
 
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"net/http"
+	"strings"
 
+	"github.com/aparkinlot/Bookings/internal/handlers"
 	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/tokens"
 	"github.com/justinas/nosurf"
 )
 
@@ -17,6 +23,23 @@ func NoSurf(next http.Handler) http.Handler {
 		Secure:   app.InProduction,
 		SameSite: http.SameSiteLaxMode,
 	})
+
+	// browsers never attach an Authorization header on their own, so token clients
+	// can't be forged cross-site and have no csrf cookie to send anyway
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		return helpers.BearerToken(r) != ""
+	})
+
+	// the payment provider calls us server to server and signs its requests instead
+	csrfHandler.ExemptPath("/webhooks/payments")
+
+	csrfHandler.SetFailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			helpers.ErrorJSON(w, http.StatusForbidden, "Missing or invalid CSRF token", nil)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	}))
 	return csrfHandler
 }
 
@@ -25,13 +48,173 @@ func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
+// Auth protects admin routes; clients need a logged in session or a valid "Authorization: Bearer" token
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if plaintext := helpers.BearerToken(r); plaintext != "" {
+			t, ok := authenticateToken(plaintext)
+			if !ok {
+				helpers.ClientError(w, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, helpers.WithAPIToken(r, t))
+			return
+		}
+
 		if !helpers.IsAuthenticated(r) {
 			session.Put(r.Context(), "error", "Log in first!")
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
 		}
+
+		ok, err := refreshAccessLevel(r)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		if !ok {
+			_ = session.Destroy(r.Context())
+			session.Put(r.Context(), "error", "Log in first!")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APIAuth protects api routes, answering with a json error instead of redirecting to the login page
+// Requests carrying a bearer token skip csrf checks, so they are never authenticated from the session cookie
+func APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if plaintext := helpers.BearerToken(r); plaintext != "" {
+			t, ok := authenticateToken(plaintext)
+			if !ok {
+				helpers.ErrorJSON(w, http.StatusUnauthorized, "Invalid or revoked token", nil)
+				return
+			}
+			next.ServeHTTP(w, helpers.WithAPIToken(r, t))
+			return
+		}
+
+		if !helpers.IsAuthenticated(r) {
+			helpers.ErrorJSON(w, http.StatusUnauthorized, "Authentication required", nil)
+			return
+		}
+
+		ok, err := refreshAccessLevel(r)
+		if err != nil {
+			helpers.ErrorJSON(w, http.StatusInternalServerError, "Error querying the database", nil)
+			return
+		}
+		if !ok {
+			_ = session.Destroy(r.Context())
+			helpers.ErrorJSON(w, http.StatusUnauthorized, "Authentication required", nil)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// FeedAuth protects calendar feeds. Calendar apps can't send an Authorization header, so the api token
+// may also be given in the token query parameter; grant such tokens only the calendar:read scope
+func FeedAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plaintext := helpers.BearerToken(r)
+		if plaintext == "" {
+			plaintext = r.URL.Query().Get("token")
+		}
+
+		if plaintext != "" {
+			t, ok := authenticateToken(plaintext)
+			if !ok {
+				helpers.ClientError(w, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, helpers.WithAPIToken(r, t))
+			return
+		}
+
+		if !helpers.IsAuthenticated(r) {
+			helpers.ClientError(w, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope stops token clients that were not granted scope
+// Logged in users are not limited by scopes
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := helpers.APITokenFromRequest(r)
+			if ok && !t.HasScope(scope) {
+				forbidden(w, r, "Token is missing the "+scope+" scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession stops token clients, for pages only a logged in user may use (e.g. managing tokens)
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := helpers.APITokenFromRequest(r); ok {
+			forbidden(w, r, "This page is not available to api tokens")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole stops users below the given access level (see the models.Access constants)
+func RequireRole(accessLevel int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if helpers.AccessLevel(r) < accessLevel {
+				forbidden(w, r, "You need the "+models.RoleName(accessLevel)+" role to do that")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// refreshAccessLevel reads the logged in user's access level from the database on every request, so a
+// change to their role applies straight away rather than at their next login. It returns false if the user is gone
+func refreshAccessLevel(r *http.Request) (bool, error) {
+	u, err := handlers.Repo.DB.GetUserByID(session.GetInt(r.Context(), "user_id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	session.Put(r.Context(), "access_level", u.AccessLevel)
+	return true, nil
+}
+
+// authenticateToken looks up a plaintext bearer token, recording its use
+func authenticateToken(plaintext string) (models.APIToken, bool) {
+	t, err := handlers.Repo.DB.GetAPITokenByHash(tokens.Hash(plaintext))
+	if err != nil {
+		return t, false
+	}
+
+	err = handlers.Repo.DB.UpdateAPITokenLastUsed(t.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	return t, true
+}
+
+// forbidden answers with a 403, as json for api routes
+func forbidden(w http.ResponseWriter, r *http.Request, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		helpers.ErrorJSON(w, http.StatusForbidden, message, nil)
+		return
+	}
+	helpers.ClientError(w, http.StatusForbidden)
+}
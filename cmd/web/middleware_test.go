@@ -1,8 +1,17 @@
 package main
 
 import (
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/aparkinlot/Bookings/internal/handlers"
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/tokens"
 )
 
 func TestNoSurf(t *testing.T) {
@@ -28,3 +37,135 @@ func TestSessionLoad(t *testing.T) {
 		t.Errorf("type is not http.Handler, but is %T", v)
 	}
 }
+
+// TestAuthRereadsAccessLevel tests that a logged in user's role is read from the database on every request,
+// so a demoted user loses access straight away, and that a user who no longer exists is logged out
+func TestAuthRereadsAccessLevel(t *testing.T) {
+	session = scs.New()
+	app.Session = session
+	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime)
+	helpers.NewHelpers(&app)
+	handlers.NewHandlers(handlers.NewTestRepo(&app))
+
+	var mh *myHandler
+
+	for _, e := range []struct {
+		name          string
+		userID        int
+		sessionLevel  int
+		expectedCode  int
+		expectedLevel int
+	}{
+		{"promoted-since-login", 1, models.AccessReadOnly, http.StatusOK, models.AccessOwner},
+		{"demoted-since-login", 4, models.AccessOwner, http.StatusForbidden, models.AccessReadOnly},
+		{"removed-user", 101, models.AccessReadOnly, http.StatusSeeOther, 0},
+	} {
+		var level int
+		h := session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the session still holds the role the user logged in with
+			session.Put(r.Context(), "user_id", e.userID)
+			session.Put(r.Context(), "access_level", e.sessionLevel)
+
+			// a manager-only page
+			Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				level = helpers.AccessLevel(r)
+				RequireRole(models.AccessManager)(mh).ServeHTTP(w, r)
+			})).ServeHTTP(w, r)
+		}))
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/rooms", nil))
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expectedCode, rr.Code)
+		}
+		if level != e.expectedLevel {
+			t.Errorf("%s: expected access level %d but got %d", e.name, e.expectedLevel, level)
+		}
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	var mh *myHandler
+	h := APIAuth(mh)
+
+	switch v := h.(type) {
+	case http.Handler:
+		// do nothing
+	default:
+		t.Errorf("type is not http.Handler, but is %T", v)
+	}
+}
+
+func TestFeedAuth(t *testing.T) {
+	var mh *myHandler
+	h := FeedAuth(mh)
+
+	switch v := h.(type) {
+	case http.Handler:
+		// do nothing
+	default:
+		t.Errorf("type is not http.Handler, but is %T", v)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	var mh *myHandler
+	h := RequireScope(tokens.ScopeWriteReservations)(mh)
+
+	// logged in users are not limited by scopes
+	r := httptest.NewRequest("POST", "/api/v1/reservations", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Errorf("request without token: expected %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	readOnly := models.APIToken{Scopes: []string{tokens.ScopeReadReservations}}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, helpers.WithAPIToken(r, readOnly))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("token without scope: expected %d but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	readWrite := models.APIToken{Scopes: []string{tokens.ScopeReadReservations, tokens.ScopeWriteReservations}}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, helpers.WithAPIToken(r, readWrite))
+	if rr.Code != http.StatusOK {
+		t.Errorf("token with scope: expected %d but got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	var mh *myHandler
+	h := RequireSession(mh)
+
+	r := httptest.NewRequest("GET", "/api/v1/tokens", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, helpers.WithAPIToken(r, models.APIToken{}))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("token request: expected %d but got %d", http.StatusForbidden, rr.Code)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	var mh *myHandler
+	h := RequireRole(models.AccessManager)(mh)
+
+	r := httptest.NewRequest("DELETE", "/api/v1/reservations/1", nil)
+
+	frontDesk := models.APIToken{User: models.User{AccessLevel: models.AccessFrontDesk}}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, helpers.WithAPIToken(r, frontDesk))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("front desk: expected %d but got %d", http.StatusForbidden, rr.Code)
+	}
+
+	owner := models.APIToken{User: models.User{AccessLevel: models.AccessOwner}}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, helpers.WithAPIToken(r, owner))
+	if rr.Code != http.StatusOK {
+		t.Errorf("owner: expected %d but got %d", http.StatusOK, rr.Code)
+	}
+}
@@ -5,6 +5,8 @@ import (
 
 	"github.com/aparkinlot/Bookings/internal/config"
 	"github.com/aparkinlot/Bookings/internal/handlers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/tokens"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 )
@@ -18,18 +20,31 @@ func routes(app *config.AppConfig) http.Handler {
 
 	mux.Get("/", handlers.Repo.Home)
 	mux.Get("/about", handlers.Repo.About)
-	mux.Get("/generals-quarters", handlers.Repo.Generals)
-	mux.Get("/majors-suite", handlers.Repo.Majors)
+	mux.Get("/rooms/{slug}", handlers.Repo.Room)
+
+	// the room pages used to live at fixed addresses
+	mux.Handle("/generals-quarters", http.RedirectHandler("/rooms/generals-quarters", http.StatusMovedPermanently))
+	mux.Handle("/majors-suite", http.RedirectHandler("/rooms/majors-suite", http.StatusMovedPermanently))
 
 	mux.Get("/make-reservation", handlers.Repo.Reservation)
 	mux.Post("/make-reservation", handlers.Repo.PostReservation)
 	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
 
+	mux.Get("/my-reservation/lookup", handlers.Repo.GuestLookup)
+	mux.Post("/my-reservation/lookup", handlers.Repo.PostGuestLookup)
+	mux.Get("/my-reservation", handlers.Repo.GuestReservation)
+	mux.Post("/my-reservation/change-dates", handlers.Repo.PostGuestChangeDates)
+	mux.Post("/my-reservation/cancel", handlers.Repo.PostGuestCancel)
+
 	mux.Get("/search-availability", handlers.Repo.Availability)
 	mux.Post("/search-availability", handlers.Repo.PostAvailability)
 	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
 	mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
 	mux.Get("/book-room", handlers.Repo.BookRoom)
+	mux.Get("/choose-rooms", handlers.Repo.ChooseRooms)
+	mux.Get("/make-group-reservation", handlers.Repo.GroupReservation)
+	mux.Post("/make-group-reservation", handlers.Repo.PostGroupReservation)
+	mux.Get("/group-reservation-summary", handlers.Repo.GroupReservationSummary)
 
 	mux.Get("/contact", handlers.Repo.Contact)
 
@@ -37,25 +52,112 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Post("/user/login", handlers.Repo.PostShowLogin)
 	mux.Get("/user/logout", handlers.Repo.Logout)
 
+	mux.Post("/webhooks/payments", handlers.Repo.PaymentWebhook)
+
+	mux.With(FeedAuth, RequireScope(tokens.ScopeReadCalendar)).Get("/ical/all.ics", handlers.Repo.AllRoomsFeed)
+	mux.Get("/ical/{slug}.ics", handlers.Repo.RoomFeed)
+
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
-	mux.Route("/admin", func(mux chi.Router) {
-		mux.Use(Auth)
+	mux.Handle("/uploads/*", http.StripPrefix("/uploads", uploadServer(app)))
 
-		mux.Get("/dashboard", handlers.Repo.AdminDashboard)
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Get("/rooms", handlers.Repo.APIRooms)
+		mux.Get("/rooms/{id}/availability", handlers.Repo.APIRoomAvailability)
 
-		mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
-		mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
-		mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)
-		mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(APIAuth)
 
-		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
-		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+			mux.With(RequireScope(tokens.ScopeReadReservations)).Get("/reservations/{id}", handlers.Repo.APIGetReservation)
 
-		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
-		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+			mux.Group(func(mux chi.Router) {
+				mux.Use(RequireScope(tokens.ScopeWriteReservations))
+
+				mux.With(RequireRole(models.AccessFrontDesk)).Post("/reservations", handlers.Repo.APICreateReservation)
+				mux.With(RequireRole(models.AccessFrontDesk)).Patch("/reservations/{id}", handlers.Repo.APIUpdateReservation)
+				mux.With(RequireRole(models.AccessManager)).Delete("/reservations/{id}", handlers.Repo.APIDeleteReservation)
+			})
+		})
+	})
+
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(Auth)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(tokens.ScopeReadReservations))
+
+			mux.Get("/dashboard", handlers.Repo.AdminDashboard)
+
+			mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
+			mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
+			mux.Get("/reservations-{src}/export.{format}", handlers.Repo.AdminExportReservations)
+			mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)
+			mux.With(RequireRole(models.AccessManager)).Get("/reservations-trash", handlers.Repo.AdminTrash)
+			mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
+			mux.Get("/groups/{id}/show", handlers.Repo.AdminShowBookingGroup)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(tokens.ScopeManageBlocks))
+			mux.Use(RequireRole(models.AccessManager))
+
+			mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
+			mux.Post("/blocks", handlers.Repo.AdminPostBlock)
+			mux.Get("/delete-block/{id}/do", handlers.Repo.AdminDeleteBlock)
+			mux.Post("/ical-feeds/sync", handlers.Repo.AdminSyncICalFeeds)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(tokens.ScopeWriteReservations))
+
+			mux.With(RequireRole(models.AccessFrontDesk)).Get("/reservation-status/{src}/{id}/{status}/do", handlers.Repo.AdminReservationStatus)
+			mux.With(RequireRole(models.AccessFrontDesk)).Get("/confirm-group/{id}/do", handlers.Repo.AdminConfirmBookingGroup)
+			mux.With(RequireRole(models.AccessFrontDesk)).Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+			mux.With(RequireRole(models.AccessManager)).Get("/reprice-reservation/{src}/{id}/do", handlers.Repo.AdminRepriceReservation)
+			mux.With(RequireRole(models.AccessManager)).Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+			mux.With(RequireRole(models.AccessManager)).Get("/restore-reservation/{src}/{id}/do", handlers.Repo.AdminRestoreReservation)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireSession)
+			mux.Use(RequireRole(models.AccessManager))
+
+			mux.Get("/rooms", handlers.Repo.AdminRooms)
+			mux.Get("/rooms/{id}", handlers.Repo.AdminShowRoom)
+			mux.Post("/rooms/{id}", handlers.Repo.AdminPostRoom)
+			mux.Post("/rooms/{id}/photos", handlers.Repo.AdminPostRoomPhoto)
+			mux.Get("/delete-room/{id}/do", handlers.Repo.AdminDeleteRoom)
+			mux.Get("/delete-room-photo/{id}/do", handlers.Repo.AdminDeleteRoomPhoto)
+			mux.Post("/rooms/{id}/rules", handlers.Repo.AdminPostBookingRule)
+			mux.Get("/delete-booking-rule/{id}/do", handlers.Repo.AdminDeleteBookingRule)
+			mux.Post("/rooms/{id}/recurring-blocks", handlers.Repo.AdminPostRecurringBlock)
+			mux.Get("/delete-recurring-block/{id}/do", handlers.Repo.AdminDeleteRecurringBlock)
+			mux.Post("/rooms/{id}/feed-token", handlers.Repo.AdminPostRoomFeedToken)
+			mux.Post("/rooms/{id}/ical-feeds", handlers.Repo.AdminPostICalFeed)
+			mux.Get("/delete-ical-feed/{id}/do", handlers.Repo.AdminDeleteICalFeed)
+			mux.Get("/import", handlers.Repo.AdminImport)
+			mux.Post("/import", handlers.Repo.AdminPostImport)
+			mux.Post("/import/commit", handlers.Repo.AdminPostImportCommit)
+			mux.Get("/audit", handlers.Repo.AdminAudit)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireSession)
+			mux.Use(RequireRole(models.AccessOwner))
+
+			mux.Get("/tokens", handlers.Repo.AdminAPITokens)
+			mux.Post("/tokens", handlers.Repo.AdminPostAPIToken)
+			mux.Get("/revoke-token/{id}/do", handlers.Repo.AdminRevokeAPIToken)
+		})
 	})
 
 	return mux
 }
+
+// uploadServer serves files from the upload directory, which is only known once the app is configured
+func uploadServer(app *config.AppConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(http.Dir(app.UploadPath)).ServeHTTP(w, r)
+	})
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
 
+	"github.com/alexedwards/scs/v2"
 	"github.com/aparkinlot/Bookings/internal/config"
+	"github.com/aparkinlot/Bookings/internal/handlers"
+	"github.com/aparkinlot/Bookings/internal/helpers"
 	"github.com/go-chi/chi"
 )
 
@@ -19,3 +26,23 @@ func TestRoutes(t *testing.T) {
 		t.Errorf("type is not *chi.Mux, but is %T", v)
 	}
 }
+
+// TestDashboardNeedsReadScope tests that api tokens can only read the dashboard with the reservations:read scope
+func TestDashboardNeedsReadScope(t *testing.T) {
+	session = scs.New()
+	app.Session = session
+	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime)
+	helpers.NewHelpers(&app)
+	handlers.NewHandlers(handlers.NewTestRepo(&app))
+
+	mux := routes(&app)
+
+	r := httptest.NewRequest("GET", "/admin/dashboard", nil)
+	r.Header.Set("Authorization", "Bearer calendar-token")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, r)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("calendar token: expected %d but got %d", http.StatusForbidden, rr.Code)
+	}
+}
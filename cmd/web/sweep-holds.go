@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/repository"
+)
+
+// holdSweepInterval is how often lapsed holds are cleared out
+const holdSweepInterval = time.Minute
+
+// sweepHolds deletes holds left behind by guests who abandoned checkout
+func sweepHolds(db repository.DatabaseRepo) {
+	go func() {
+		ticker := time.NewTicker(holdSweepInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			n, err := db.DeleteExpiredHolds()
+			if err != nil {
+				errorLog.Println(err)
+				continue
+			}
+			if n > 0 {
+				infoLog.Printf("Released %d expired room hold(s)", n)
+			}
+		}
+	}()
+}
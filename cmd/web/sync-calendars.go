@@ -0,0 +1,23 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/icalsync"
+)
+
+// syncCalendars imports the calendars of other channels every interval, so rooms booked there are blocked here
+func syncCalendars(calendars *icalsync.Service, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		// sync straight away, then every interval; failures are also recorded on each feed for the dashboard
+		for ; ; <-ticker.C {
+			err := calendars.SyncAll()
+			if err != nil {
+				errorLog.Println(err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,223 @@
+// Package audit describes the history of the changes made to reservations and rooms: who made each one,
+// to which reservation or room, and the fields it changed. The repository writes it along with each change
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/pricing"
+)
+
+// the changes a history records; the ones to a room also cover its photos, rules, blocks and calendars
+const (
+	ActionCreate         = "create"
+	ActionUpdate         = "update"
+	ActionDelete         = "delete"
+	ActionRestore        = "restore"
+	ActionImport         = "import"
+	ActionStatus         = "change status"
+	ActionReprice        = "reprice"
+	ActionBlock          = "block"
+	ActionMoveBlock      = "move block"
+	ActionUnblock        = "unblock"
+	ActionAddPhoto       = "add photo"
+	ActionRemovePhoto    = "remove photo"
+	ActionAddRule        = "add rule"
+	ActionRemoveRule     = "remove rule"
+	ActionAddClosure     = "add recurring block"
+	ActionRemoveClosure  = "remove recurring block"
+	ActionAddCalendar    = "add calendar"
+	ActionRemoveCalendar = "remove calendar"
+	ActionNewFeedAddress = "new feed address"
+
+	// ActionProcess was recorded when a reservation was marked processed, before reservations had a status.
+	// Nothing records it now, but the history from then still has it
+	ActionProcess = "process"
+)
+
+// Actions lists every action, for filtering the history by
+var Actions = []string{
+	ActionCreate, ActionUpdate, ActionDelete, ActionRestore, ActionImport, ActionStatus, ActionReprice,
+	ActionBlock, ActionMoveBlock, ActionUnblock, ActionAddPhoto, ActionRemovePhoto, ActionAddRule, ActionRemoveRule, ActionAddClosure, ActionRemoveClosure,
+	ActionAddCalendar, ActionRemoveCalendar, ActionNewFeedAddress, ActionProcess,
+}
+
+// dateLayout is how dates are kept in a history
+const dateLayout = "2006-01-02"
+
+// Fields is a snapshot of the fields of a reservation, room or block worth keeping in a history
+type Fields map[string]interface{}
+
+// Event makes the event recording that actor did action to a reservation or room. before and after are
+// snapshots of what was changed either side of the change; before is nil when it was created and after when
+// it was removed. ok is false for an update that changed nothing, which isn't worth recording
+func Event(actor models.Actor, action, entity string, entityID int, before, after Fields) (e models.AuditEvent, ok bool, err error) {
+	changes, err := Diff(before, after)
+	if err != nil {
+		return e, false, err
+	}
+	if len(changes) == 0 && before != nil && after != nil {
+		return e, false, nil
+	}
+
+	e = models.AuditEvent{
+		UserID:   actor.UserID,
+		Actor:    actor.Name,
+		Action:   action,
+		Entity:   entity,
+		EntityID: entityID,
+		Changes:  changes,
+	}
+	return e, true, nil
+}
+
+// Diff lists the fields that differ between two snapshots, in name order, with their values as JSON.
+// Either snapshot may be nil, listing every field of the other
+func Diff(before, after Fields) ([]models.FieldChange, error) {
+	names := make(map[string]bool)
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var changes []models.FieldChange
+	for _, name := range sorted {
+		from, err := encode(before, name)
+		if err != nil {
+			return nil, err
+		}
+		to, err := encode(after, name)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(from, to) {
+			changes = append(changes, models.FieldChange{Field: name, Before: from, After: to})
+		}
+	}
+	return changes, nil
+}
+
+// encode returns a field of a snapshot as JSON, or nil if the snapshot doesn't have it
+func encode(f Fields, name string) (json.RawMessage, error) {
+	v, ok := f[name]
+	if !ok {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// Reservation takes a snapshot of a reservation
+func Reservation(res models.Reservation) Fields {
+	f := Fields{
+		"room_id":    res.RoomID,
+		"first_name": res.FirstName,
+		"last_name":  res.LastName,
+		"email":      res.Email,
+		"phone":      res.Phone,
+		"start_date": res.StartDate.Format(dateLayout),
+		"end_date":   res.EndDate.Format(dateLayout),
+		"adults":     res.Adults,
+		"children":   res.Children,
+		"status":     res.Status,
+		"total":      pricing.FormatMoney(res.Total),
+	}
+	if !res.CancelledAt.IsZero() {
+		f["cancelled_at"] = res.CancelledAt.Format(dateLayout)
+	}
+	if res.IsDeleted() {
+		f["deleted_at"] = res.DeletedAt.Format(dateLayout)
+		f["delete_reason"] = res.DeleteReason
+	}
+	return f
+}
+
+// Room takes a snapshot of a room, leaving out the secret in its feed address
+func Room(room models.Room) Fields {
+	return Fields{
+		"room_name":         room.RoomName,
+		"slug":              room.Slug,
+		"description":       room.Description,
+		"max_occupancy":     room.MaxOccupancy,
+		"bed_configuration": room.BedConfiguration,
+		"amenities":         strings.Join(room.Amenities, ", "),
+		"nightly_rate":      pricing.FormatMoney(room.NightlyRate),
+		"weekend_surcharge": pricing.FormatMoney(room.WeekendSurcharge),
+		"min_nights":        room.MinNights,
+	}
+}
+
+// Block takes a snapshot of an owner block, leaving out what isn't known of it
+func Block(b models.RoomRestriction) Fields {
+	f := Fields{"block_id": b.ID}
+	if !b.StartDate.IsZero() {
+		f["start_date"] = b.StartDate.Format(dateLayout)
+		f["end_date"] = b.EndDate.Format(dateLayout)
+	}
+	if b.Reason != "" {
+		f["reason"] = b.Reason
+	}
+	if b.Notes != "" {
+		f["notes"] = b.Notes
+	}
+	return f
+}
+
+// Photo takes a snapshot of a room photo
+func Photo(p models.RoomPhoto) Fields {
+	return Fields{"photo_id": p.ID, "url": p.URL, "caption": p.Caption}
+}
+
+// BookingRule takes a snapshot of a booking rule, leaving out the limits it doesn't set
+func BookingRule(b models.BookingRule) Fields {
+	f := Fields{"rule_id": b.ID}
+	if !b.IsYearRound() {
+		f["start_date"] = b.StartDate.Format(dateLayout)
+		f["end_date"] = b.EndDate.Format(dateLayout)
+	}
+	limits := map[string]int{
+		"min_nights":   b.MinNights,
+		"max_nights":   b.MaxNights,
+		"lead_days":    b.LeadDays,
+		"horizon_days": b.HorizonDays,
+	}
+	for name, n := range limits {
+		if n > 0 {
+			f[name] = n
+		}
+	}
+	if b.ArrivalDays != 0 {
+		f["arrival_days"] = b.ArrivalDays.String()
+	}
+	if b.DepartureDays != 0 {
+		f["departure_days"] = b.DepartureDays.String()
+	}
+	return f
+}
+
+// RecurringBlock takes a snapshot of a recurring block
+func RecurringBlock(b models.RecurringBlock) Fields {
+	return Fields{
+		"recurring_block_id": b.ID,
+		"start_date":         b.StartDate.Format(dateLayout),
+		"nights":             b.Nights,
+		"rrule":              b.RRule,
+		"reason":             b.Reason,
+	}
+}
+
+// Calendar takes a snapshot of a calendar imported from another channel
+func Calendar(f models.ICalFeed) Fields {
+	return Fields{"calendar_id": f.ID, "name": f.Name, "url": f.URL}
+}
@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/models"
+)
+
+func TestDiff(t *testing.T) {
+	before := Fields{"email": "john@smith.com", "adults": 2, "processed": false}
+	after := Fields{"email": "john@example.com", "adults": 2, "processed": true, "phone": "555-555-5555"}
+
+	changes, err := Diff(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []models.FieldChange{
+		{Field: "email", Before: []byte(`"john@smith.com"`), After: []byte(`"john@example.com"`)},
+		{Field: "phone", After: []byte(`"555-555-5555"`)},
+		{Field: "processed", Before: []byte("false"), After: []byte("true")},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes but got %d: %+v", len(expected), len(changes), changes)
+	}
+	for i, c := range changes {
+		e := expected[i]
+		if c.Field != e.Field || string(c.Before) != string(e.Before) || string(c.After) != string(e.After) {
+			t.Errorf("change %d: expected %s %s -> %s, got %s %s -> %s", i, e.Field, e.Before, e.After, c.Field, c.Before, c.After)
+		}
+	}
+
+	if changes[0].From() != "john@smith.com" || changes[2].To() != "true" || changes[1].From() != "" {
+		t.Errorf("expected the values to display without quotes, got %q, %q and %q", changes[0].From(), changes[2].To(), changes[1].From())
+	}
+}
+
+func TestEvent(t *testing.T) {
+	res := models.Reservation{
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@smith.com",
+		RoomID:    1,
+		StartDate: time.Date(2050, 7, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 7, 4, 0, 0, 0, 0, time.UTC),
+		Total:     45000,
+	}
+
+	// saving without changing anything isn't worth a line in the history
+	_, ok, err := Event(models.Actor{UserID: 1}, ActionUpdate, models.EntityReservation, 7, Reservation(res), Reservation(res))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected an unchanged reservation not to be recorded")
+	}
+
+	changed := res
+	changed.Email = "john@example.com"
+	update, ok, err := Event(models.Actor{UserID: 1}, ActionUpdate, models.EntityReservation, 7, Reservation(res), Reservation(changed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || update.UserID != 1 || update.Action != ActionUpdate || update.Entity != models.EntityReservation || update.EntityID != 7 {
+		t.Errorf("update recorded wrong: %+v", update)
+	}
+	if len(update.Changes) != 1 || update.Changes[0].Field != "email" || update.Changes[0].To() != "john@example.com" {
+		t.Errorf("expected only the email to have changed, got %+v", update.Changes)
+	}
+
+	// a removed reservation keeps every field it had
+	removed, ok, err := Event(models.ActorGuest, ActionDelete, models.EntityReservation, 7, Reservation(changed), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || removed.UserID != 0 || removed.Actor != "Guest" {
+		t.Errorf("expected the removal to be the guest's, got %+v", removed)
+	}
+	if len(removed.Changes) != len(Reservation(changed)) {
+		t.Errorf("expected every field of the removed reservation, got %+v", removed.Changes)
+	}
+	for _, c := range removed.Changes {
+		if c.After != nil {
+			t.Errorf("expected nothing after the removal, got %s for %s", c.After, c.Field)
+		}
+		if c.Field == "total" && c.From() != "$450.00" {
+			t.Errorf("expected the total as money, got %s", c.From())
+		}
+	}
+
+	// new feed addresses are secret, so there is nothing to show but that one was made
+	feed, ok, err := Event(models.Actor{UserID: 1}, ActionNewFeedAddress, models.EntityRoom, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || feed.Changes != nil {
+		t.Errorf("expected a new feed address to be recorded without changes, got %+v", feed)
+	}
+}
+
+func TestBookingRule(t *testing.T) {
+	var weekends models.Weekdays
+	weekends = weekends.Add(time.Friday).Add(time.Saturday)
+
+	f := BookingRule(models.BookingRule{ID: 4, MinNights: 2, ArrivalDays: weekends})
+
+	if len(f) != 3 || f["min_nights"] != 2 || f["arrival_days"] != "Fri, Sat" || f["rule_id"] != 4 {
+		t.Errorf("expected only the limits the rule sets, got %v", f)
+	}
+}
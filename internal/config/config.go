@@ -3,9 +3,11 @@ package config
 import (
 	"html/template"
 	"log"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/payments"
 )
 
 // AppConfig holds the application config
@@ -17,4 +19,12 @@ type AppConfig struct {
 	InProduction  bool
 	Session       *scs.SessionManager
 	MailChan      chan models.MailData
+	TaxRate       int // basis points, 1200 is 12%
+	CleaningFee   int // cents, charged once per stay
+	DepositRate   int // basis points of the total held when booking, 2500 is 25%
+	Payments      payments.Provider
+	HoldTTL       time.Duration // how long a room is held while a guest checks out
+	UploadPath    string        // directory uploaded files are stored in, served at /uploads
+	ICalSync      time.Duration // how often imported calendar feeds are synced, 0 to only sync them by hand
+	BaseURL       string        // address guests reach the site at, e.g. https://bookings.example.com
 }
@@ -3,7 +3,9 @@ package forms
 import (
 	"fmt"
 	"net/url"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 )
@@ -63,3 +65,84 @@ func (f *Form) IsEmail(field string) {
 		f.Errors.Add(field, "Invalid email address")
 	}
 }
+
+// DateLayout is the format date fields are posted in
+const DateLayout = "2006-01-02"
+
+// now is the clock NotInPast checks against, replaced in tests
+var now = time.Now
+
+// phoneChars are the characters besides digits a phone number may be written with
+var phoneChars = regexp.MustCompile(`^\+?[0-9 ().-]+$`)
+
+// IsDate checks that a field holds a date in DateLayout
+func (f *Form) IsDate(field string) bool {
+	if _, err := time.Parse(DateLayout, strings.TrimSpace(f.Get(field))); err != nil {
+		f.Errors.Add(field, "Invalid date")
+		return false
+	}
+	return true
+}
+
+// Date returns the parsed date in a field, or the zero time if it doesn't hold one
+func (f *Form) Date(field string) time.Time {
+	t, _ := time.Parse(DateLayout, strings.TrimSpace(f.Get(field)))
+	return t
+}
+
+// DateRange checks that the end date comes after the start date, adding the error to the end field.
+// Fields that don't hold a date are left to IsDate
+func (f *Form) DateRange(startField, endField string) bool {
+	start, end := f.Date(startField), f.Date(endField)
+	if start.IsZero() || end.IsZero() {
+		return false
+	}
+	if !end.After(start) {
+		f.Errors.Add(endField, "End date must be after start date")
+		return false
+	}
+	return true
+}
+
+// NotInPast checks that a date field isn't before today
+func (f *Form) NotInPast(field string) bool {
+	d := f.Date(field)
+	if d.IsZero() {
+		return false
+	}
+	today, _ := time.Parse(DateLayout, now().Format(DateLayout))
+	if d.Before(today) {
+		f.Errors.Add(field, "Date can't be in the past")
+		return false
+	}
+	return true
+}
+
+// MaxSpan checks that the end date is at most days after the start date
+func (f *Form) MaxSpan(startField, endField string, days int) bool {
+	start, end := f.Date(startField), f.Date(endField)
+	if start.IsZero() || end.IsZero() {
+		return false
+	}
+	if end.Sub(start) > time.Duration(days)*24*time.Hour {
+		f.Errors.Add(endField, fmt.Sprintf("Dates can be at most %d days apart", days))
+		return false
+	}
+	return true
+}
+
+// IsPhone checks for a phone number of 7 to 15 digits, allowing spaces, dots, dashes, brackets and a leading +
+func (f *Form) IsPhone(field string) bool {
+	x := strings.TrimSpace(f.Get(field))
+	digits := 0
+	for _, c := range x {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	if !phoneChars.MatchString(x) || digits < 7 || digits > 15 {
+		f.Errors.Add(field, "Invalid phone number")
+		return false
+	}
+	return true
+}
@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestValidForm(t *testing.T) {
@@ -126,3 +127,88 @@ func TestValidEmailForm(t *testing.T) {
 		t.Error("got valid for invalid email address")
 	}
 }
+
+func TestIsDateForm(t *testing.T) {
+	form := New(url.Values{"d": {"2050-01-31"}, "bad": {"31/01/2050"}})
+
+	if !form.IsDate("d") {
+		t.Error("got invalid for a valid date")
+	}
+	if form.Date("d") != time.Date(2050, 1, 31, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("parsed the wrong date: %s", form.Date("d"))
+	}
+
+	if form.IsDate("bad") || form.IsDate("missing") {
+		t.Error("got valid for a badly formatted or missing date")
+	}
+	if !form.Date("bad").IsZero() {
+		t.Error("expected the zero time for a bad date")
+	}
+	if form.Errors.Get("bad") == "" || form.Errors.Get("missing") == "" {
+		t.Error("expected errors for the bad and missing dates")
+	}
+}
+
+func TestDateRangeForm(t *testing.T) {
+	form := New(url.Values{"start": {"2050-01-01"}, "end": {"2050-01-02"}})
+	if !form.DateRange("start", "end") || !form.Valid() {
+		t.Error("got invalid for an end after the start")
+	}
+
+	form = New(url.Values{"start": {"2050-01-02"}, "end": {"2050-01-02"}})
+	if form.DateRange("start", "end") || form.Errors.Get("end") == "" {
+		t.Error("got valid for an end on the start")
+	}
+
+	// bad dates are for IsDate to report
+	form = New(url.Values{"start": {"x"}, "end": {"2050-01-02"}})
+	if form.DateRange("start", "end") || !form.Valid() {
+		t.Error("expected a bad date to fail without an error")
+	}
+}
+
+func TestNotInPastForm(t *testing.T) {
+	now = func() time.Time { return time.Date(2050, 6, 15, 23, 0, 0, 0, time.Local) }
+	defer func() { now = time.Now }()
+
+	form := New(url.Values{"today": {"2050-06-15"}, "yesterday": {"2050-06-14"}})
+	if !form.NotInPast("today") {
+		t.Error("got today as in the past")
+	}
+	if form.NotInPast("yesterday") || form.Errors.Get("yesterday") == "" {
+		t.Error("got yesterday as not in the past")
+	}
+}
+
+func TestMaxSpanForm(t *testing.T) {
+	form := New(url.Values{"start": {"2050-01-01"}, "end": {"2050-01-31"}})
+	if !form.MaxSpan("start", "end", 30) {
+		t.Error("got too long for a span of exactly 30 days")
+	}
+	if form.MaxSpan("start", "end", 29) || form.Errors.Get("end") == "" {
+		t.Error("got valid for a span over 29 days")
+	}
+}
+
+func TestIsPhoneForm(t *testing.T) {
+	tests := []struct {
+		phone string
+		valid bool
+	}{
+		{"555-555-5555", true},
+		{"+44 (0)20 7946 0958", true},
+		{"555.5555", true},
+		{"", false},
+		{"12345", false},
+		{"call me", false},
+		{"555-555-5555 ext 2", false},
+		{"1234567890123456", false},
+	}
+
+	for _, e := range tests {
+		form := New(url.Values{"phone": {e.phone}})
+		if form.IsPhone("phone") != e.valid {
+			t.Errorf("%q: expected valid to be %t", e.phone, e.valid)
+		}
+	}
+}
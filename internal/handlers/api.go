@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/forms"
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/pricing"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/aparkinlot/Bookings/internal/rules"
+	"github.com/aparkinlot/Bookings/internal/tokens"
+	"github.com/go-chi/chi"
+)
+
+// apiRoom is the json representation of a room
+type apiRoom struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// apiAvailability is the json representation of an availability check
+type apiAvailability struct {
+	RoomID    int            `json:"room_id"`
+	StartDate string         `json:"start_date"`
+	EndDate   string         `json:"end_date"`
+	Available bool           `json:"available"`
+	Quote     *pricing.Quote `json:"quote,omitempty"`
+}
+
+// apiReservation is the json representation of a reservation
+type apiReservation struct {
+	ID        int       `json:"id"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email"`
+	Phone     string    `json:"phone"`
+	StartDate string    `json:"start_date"`
+	EndDate   string    `json:"end_date"`
+	RoomID    int       `json:"room_id"`
+	RoomName  string    `json:"room_name"`
+	Adults    int       `json:"adults"`
+	Children  int       `json:"children"`
+	Status    string    `json:"status"`
+	Processed bool      `json:"processed"` // from before reservations had a status; see processed
+	Code      string    `json:"confirmation_code"`
+	Cancelled bool      `json:"cancelled"`
+	Currency  string    `json:"currency"`
+	Total     int       `json:"total"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// apiReservationRequest is the body accepted by POST /api/v1/reservations
+type apiReservationRequest struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	RoomID    int    `json:"room_id"`
+	Adults    *int   `json:"adults"`
+	Children  int    `json:"children"`
+}
+
+// apiReservationPatch is the body accepted by PATCH /api/v1/reservations/{id}; omitted fields are left unchanged
+type apiReservationPatch struct {
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Email     *string `json:"email"`
+	Phone     *string `json:"phone"`
+	Status    *string `json:"status"`
+	Processed *bool   `json:"processed"` // true confirms a pending reservation, for clients from before status
+}
+
+// processed is what the processed flag reservations had before their status would say: whether
+// the reservation was ever confirmed
+func processed(res models.Reservation) bool {
+	return !res.ConfirmedAt.IsZero() || (res.Status != models.StatusPending && !res.IsCancelled())
+}
+
+func toAPIReservation(res models.Reservation) apiReservation {
+	return apiReservation{
+		ID:        res.ID,
+		FirstName: res.FirstName,
+		LastName:  res.LastName,
+		Email:     res.Email,
+		Phone:     res.Phone,
+		StartDate: res.StartDate.Format("2006-01-02"),
+		EndDate:   res.EndDate.Format("2006-01-02"),
+		RoomID:    res.RoomID,
+		RoomName:  res.Room.RoomName,
+		Adults:    res.Adults,
+		Children:  res.Children,
+		Status:    res.Status,
+		Processed: processed(res),
+		Code:      res.ConfirmationCode,
+		Cancelled: res.IsCancelled(),
+		Currency:  res.Currency,
+		Total:     res.Total,
+		CreatedAt: res.CreatedAt,
+		UpdatedAt: res.UpdatedAt,
+	}
+}
+
+// APIRooms lists every room
+func (m *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error querying the database", nil)
+		return
+	}
+
+	out := []apiRoom{}
+	for _, x := range rooms {
+		out = append(out, apiRoom{ID: x.ID, Name: x.RoomName})
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, out)
+}
+
+// APIRoomAvailability reports whether a room is free between the start and end query params
+func (m *Repository) APIRoomAvailability(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusBadRequest, "Invalid room id", nil)
+		return
+	}
+
+	sd := r.URL.Query().Get("start")
+	ed := r.URL.Query().Get("end")
+
+	form := forms.New(r.URL.Query())
+	if !stayDates(form, "start", "end") {
+		helpers.ErrorJSON(w, http.StatusBadRequest, "Invalid dates", form.Errors)
+		return
+	}
+	startDate := form.Date("start")
+	endDate := form.Date("end")
+
+	if _, err := m.DB.GetRoomByID(roomID); err != nil {
+		helpers.ErrorJSON(w, http.StatusNotFound, "Room not found", nil)
+		return
+	}
+
+	available, err := m.DB.SearchAvailibilityByDatesAndRoomID(startDate, endDate, roomID)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error querying the database", nil)
+		return
+	}
+
+	resp := apiAvailability{
+		RoomID:    roomID,
+		StartDate: sd,
+		EndDate:   ed,
+		Available: available,
+	}
+
+	if available {
+		quote, err := m.Pricing.Quote(roomID, startDate, endDate)
+		if err != nil {
+			helpers.ErrorJSON(w, http.StatusInternalServerError, "Error getting a price", nil)
+			return
+		}
+		resp.Quote = &quote
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, resp)
+}
+
+// APICreateReservation books a room from a json body
+func (m *Repository) APICreateReservation(w http.ResponseWriter, r *http.Request) {
+	var req apiReservationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusBadRequest, "Request body must be valid json", nil)
+		return
+	}
+
+	// bookings that don't say who's staying are for one adult
+	adults := 1
+	if req.Adults != nil {
+		adults = *req.Adults
+	}
+
+	// run the body through the same validation as the reservation form
+	form := forms.New(url.Values{
+		"first_name": {req.FirstName},
+		"last_name":  {req.LastName},
+		"email":      {req.Email},
+		"phone":      {req.Phone},
+		"start_date": {req.StartDate},
+		"end_date":   {req.EndDate},
+		"adults":     {strconv.Itoa(adults)},
+		"children":   {strconv.Itoa(req.Children)},
+	})
+	form.Required("first_name", "last_name", "email")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+	if form.Has("phone") {
+		form.IsPhone("phone")
+	}
+	stayDates(form, "start_date", "end_date")
+	startDate := form.Date("start_date")
+	endDate := form.Date("end_date")
+
+	if !form.Valid() {
+		helpers.ErrorJSON(w, http.StatusUnprocessableEntity, "Validation failed", form.Errors)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(req.RoomID)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusNotFound, "Room not found", nil)
+		return
+	}
+
+	adults, children := guestCounts(form, room)
+
+	violations, err := m.Rules.Check(room, startDate, endDate)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error checking the booking rules", nil)
+		return
+	}
+	addViolations(form, violations, rules.FieldStart, rules.FieldEnd)
+
+	if !form.Valid() {
+		helpers.ErrorJSON(w, http.StatusUnprocessableEntity, "Validation failed", form.Errors)
+		return
+	}
+
+	reservation := models.Reservation{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Email:     req.Email,
+		Phone:     req.Phone,
+		StartDate: startDate,
+		EndDate:   endDate,
+		RoomID:    req.RoomID,
+		Adults:    adults,
+		Children:  children,
+		Room:      room,
+	}
+
+	quote, err := m.Pricing.Quote(req.RoomID, startDate, endDate)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error getting a price", nil)
+		return
+	}
+	quote.ApplyTo(&reservation)
+
+	reservation.ConfirmationCode, err = tokens.ConfirmationCode()
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error saving reservation", nil)
+		return
+	}
+
+	// bookings made through the api are taken by staff, who collect payment themselves
+	newID, err := m.DB.InsertReservationWithRestriction(reservation, 0, true)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		helpers.ErrorJSON(w, http.StatusConflict, "Room is not available for those dates", nil)
+		return
+	}
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error saving reservation", nil)
+		return
+	}
+	reservation.ID = newID
+
+	m.sendReservationEmails(reservation)
+
+	w.Header().Set("Location", "/api/v1/reservations/"+strconv.Itoa(newID))
+	helpers.WriteJSON(w, http.StatusCreated, toAPIReservation(reservation))
+}
+
+// APIGetReservation returns one reservation
+func (m *Repository) APIGetReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.apiReservationFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, toAPIReservation(res))
+}
+
+// APIUpdateReservation changes the guest details or status of a reservation. A status can only be
+// moved along the reservation lifecycle, so asking for one it can't reach fails validation.
+// The status is changed first, so a deposit that can't be taken leaves the reservation as it was
+func (m *Repository) APIUpdateReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.apiReservationFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var patch apiReservationPatch
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusBadRequest, "Request body must be valid json", nil)
+		return
+	}
+
+	if patch.FirstName != nil {
+		res.FirstName = *patch.FirstName
+	}
+	if patch.LastName != nil {
+		res.LastName = *patch.LastName
+	}
+	if patch.Email != nil {
+		res.Email = *patch.Email
+	}
+	if patch.Phone != nil {
+		res.Phone = *patch.Phone
+	}
+
+	form := forms.New(url.Values{
+		"first_name": {res.FirstName},
+		"last_name":  {res.LastName},
+		"email":      {res.Email},
+		"phone":      {res.Phone},
+	})
+	form.Required("first_name", "last_name", "email")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+	if form.Has("phone") {
+		form.IsPhone("phone")
+	}
+	status := res.Status
+	switch {
+	case patch.Status != nil:
+		status = *patch.Status
+	case patch.Processed != nil && *patch.Processed && res.Status == models.StatusPending:
+		status = models.StatusConfirmed
+	case patch.Processed != nil && !*patch.Processed && processed(res):
+		form.Errors.Add("processed", "A processed reservation can't be unprocessed; change its status instead")
+	}
+	if status != res.Status && !models.CanChangeStatus(res.Status, status) {
+		form.Errors.Add("status", statusError(res, status, repository.ErrStatusChange))
+	}
+	if !form.Valid() {
+		helpers.ErrorJSON(w, http.StatusUnprocessableEntity, "Validation failed", form.Errors)
+		return
+	}
+
+	if status != res.Status {
+		err = m.changeStatus(r, res, status)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+			helpers.ErrorJSON(w, http.StatusInternalServerError, statusError(res, status, err), nil)
+			return
+		}
+		res.Status = status
+	}
+
+	if patch.FirstName != nil || patch.LastName != nil || patch.Email != nil || patch.Phone != nil {
+		err = m.DB.UpdateReservation(res, helpers.Actor(r))
+		if err != nil {
+			helpers.ErrorJSON(w, http.StatusInternalServerError, "Error saving reservation", nil)
+			return
+		}
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, toAPIReservation(res))
+}
+
+// APIDeleteReservation moves a reservation to the trash and frees its room. The optional reason
+// query param says why, for whoever looks through the trash
+func (m *Repository) APIDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.apiReservationFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	reason := strings.TrimSpace(r.URL.Query().Get("reason"))
+	err := m.DB.DeleteReservation(res.ID, helpers.Actor(r), reason)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error deleting reservation", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiReservationFromURL loads the reservation named by the {id} url param,
+// writing the error response itself and returning false if it can't
+func (m *Repository) apiReservationFromURL(w http.ResponseWriter, r *http.Request) (models.Reservation, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusBadRequest, "Invalid reservation id", nil)
+		return models.Reservation{}, false
+	}
+
+	// reservations in the trash are only seen in the admin
+	res, err := m.DB.GetReservationByID(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && res.IsDeleted()) {
+		helpers.ErrorJSON(w, http.StatusNotFound, "Reservation not found", nil)
+		return res, false
+	}
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error querying the database", nil)
+		return res, false
+	}
+
+	return res, true
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/aparkinlot/Bookings/internal/audit"
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/render"
+)
+
+// auditPerPage is how many changes a page of history shows
+const auditPerPage = 50
+
+// AdminAudit shows the history of changes made to reservations and rooms, newest first, filtered by the query:
+// entity and id pick a reservation or room, user who made the changes, action what was done,
+// and before pages back from an event
+func (m *Repository) AdminAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	f := models.AuditFilter{Limit: auditPerPage + 1}
+	if entity := q.Get("entity"); entity == models.EntityReservation || entity == models.EntityRoom {
+		f.Entity = entity
+		f.EntityID, _ = strconv.Atoi(q.Get("id"))
+	}
+	f.UserID, _ = strconv.Atoi(q.Get("user"))
+	f.Before, _ = strconv.Atoi(q.Get("before"))
+	for _, action := range audit.Actions {
+		if q.Get("action") == action {
+			f.Action = action
+		}
+	}
+
+	events, err := m.DB.AuditEvents(f)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["subject"] = m.auditSubject(f)
+
+	// the extra event only shows there are older ones
+	if len(events) > auditPerPage {
+		events = events[:auditPerPage]
+		older := auditQuery(f)
+		older.Set("before", strconv.Itoa(events[len(events)-1].ID))
+		stringMap["older"] = "/admin/audit?" + older.Encode()
+	}
+
+	data := make(map[string]interface{})
+	data["events"] = events
+	data["filter"] = f
+	data["actions"] = audit.Actions
+
+	render.Template(w, r, "admin-audit.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// auditSubject names the reservation or room whose history is shown. Removed ones are named by their id
+func (m *Repository) auditSubject(f models.AuditFilter) string {
+	switch {
+	case f.EntityID == 0 && f.Entity == models.EntityReservation:
+		return "reservations"
+	case f.EntityID == 0 && f.Entity == models.EntityRoom:
+		return "rooms"
+	case f.EntityID == 0:
+		return "reservations and rooms"
+	case f.Entity == models.EntityReservation:
+		if res, err := m.DB.GetReservationByID(f.EntityID); err == nil {
+			return fmt.Sprintf("reservation %d, %s %s", f.EntityID, res.FirstName, res.LastName)
+		}
+	case f.Entity == models.EntityRoom:
+		if room, err := m.DB.GetRoomByID(f.EntityID); err == nil {
+			return room.RoomName
+		}
+	}
+	return fmt.Sprintf("%s %d", f.Entity, f.EntityID)
+}
+
+// auditQuery is the query that shows the history the filter picks, from the newest event
+func auditQuery(f models.AuditFilter) url.Values {
+	q := url.Values{}
+	if f.Entity != "" {
+		q.Set("entity", f.Entity)
+	}
+	if f.EntityID > 0 {
+		q.Set("id", strconv.Itoa(f.EntityID))
+	}
+	if f.UserID > 0 {
+		q.Set("user", strconv.Itoa(f.UserID))
+	}
+	if f.Action != "" {
+		q.Set("action", f.Action)
+	}
+	return q
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aparkinlot/Bookings/internal/forms"
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/go-chi/chi"
+)
+
+// calendarURL is the reservations calendar for the given year and month, or the current month if they're blank
+func calendarURL(year, month string) string {
+	if year == "" || month == "" {
+		return "/admin/reservations-calendar"
+	}
+	return fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month)
+}
+
+// AdminPostBlock blocks a room for a range of dates, e.g. while it's being renovated
+func (m *Repository) AdminPostBlock(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	redirect := calendarURL(r.Form.Get("y"), r.Form.Get("m"))
+
+	form := forms.New(r.PostForm)
+	roomID, err := strconv.Atoi(form.Get("room_id"))
+
+	var problem string
+	switch {
+	case err != nil:
+		problem = "Pick the room to block"
+	case !form.IsDate("block_start") || !form.IsDate("block_end"):
+		problem = "Give the dates of the block as yyyy-mm-dd"
+	case !form.DateRange("block_start", "block_end"):
+		problem = "The block must end after it starts"
+	case strings.TrimSpace(form.Get("reason")) == "":
+		problem = "Give a reason for the block"
+	}
+	if problem != "" {
+		m.App.Session.Put(r.Context(), "error", problem)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	block := models.RoomRestriction{
+		RoomID:    roomID,
+		StartDate: form.Date("block_start"),
+		EndDate:   form.Date("block_end"),
+		Reason:    strings.TrimSpace(form.Get("reason")),
+		Notes:     strings.TrimSpace(form.Get("notes")),
+	}
+
+	block.ID, err = m.DB.InsertBlockForRoom(block, helpers.Actor(r))
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "The room is already booked for some of those dates")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Room blocked for %d nights", block.Nights()))
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminDeleteBlock removes an owner block, freeing every night it covers
+func (m *Repository) AdminDeleteBlock(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	redirect := calendarURL(r.URL.Query().Get("y"), r.URL.Query().Get("m"))
+
+	err := m.DB.DeleteBlockByID(id, helpers.Actor(r))
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "That block has already been removed")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Block removed")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/go-chi/chi"
+)
+
+// AdminPostICalFeed adds the calendar another channel publishes for a room and syncs it straight away
+func (m *Repository) AdminPostICalFeed(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	redirect := fmt.Sprintf("/admin/rooms/%d", id)
+
+	err = r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	f := models.ICalFeed{
+		RoomID: id,
+		Name:   strings.TrimSpace(r.Form.Get("feed_name")),
+		URL:    strings.TrimSpace(r.Form.Get("feed_url")),
+	}
+
+	var problem string
+	switch {
+	case f.Name == "":
+		problem = "Name the channel the calendar comes from, e.g. Airbnb"
+	case f.URL == "":
+		problem = "Give the address of the channel's calendar"
+	case !strings.HasPrefix(f.URL, "https://"):
+		problem = "The calendar's address must start with https://"
+	}
+	if problem != "" {
+		m.App.Session.Put(r.Context(), "error", problem)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	f.ID, err = m.DB.InsertICalFeed(f, helpers.Actor(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	result, err := m.Calendars.Sync(f)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "The calendar was added but couldn't be synced: "+err.Error())
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	// stays that clash were booked twice before the calendar was added, and need sorting out by hand
+	if len(result.Conflicts) > 0 {
+		m.App.Session.Put(r.Context(), "warning", syncMessage(result))
+	} else {
+		m.App.Session.Put(r.Context(), "flash", syncMessage(result))
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminDeleteICalFeed stops importing a calendar, freeing the nights that were blocked from it
+func (m *Repository) AdminDeleteICalFeed(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	f, err := m.DB.GetICalFeedByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteICalFeed(id, helpers.Actor(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Imported calendar removed")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", f.RoomID), http.StatusSeeOther)
+}
+
+// AdminSyncICalFeeds syncs every imported calendar now, rather than waiting for the next scheduled sync
+func (m *Repository) AdminSyncICalFeeds(w http.ResponseWriter, r *http.Request) {
+	err := m.Calendars.SyncAll()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Some calendars couldn't be synced; see below for why")
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "Calendars synced")
+	}
+
+	http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+}
+
+// syncMessage sums up what a sync did for the flash message
+func syncMessage(s models.ICalSync) string {
+	msg := fmt.Sprintf("Calendar synced: %d added, %d changed, %d removed", s.Added, s.Updated, s.Removed)
+	switch len(s.Conflicts) {
+	case 0:
+	case 1:
+		msg += ". 1 stay clashes with a booking here: " + s.Conflicts[0]
+	default:
+		msg += fmt.Sprintf(". %d stays clash with bookings here: %s", len(s.Conflicts), strings.Join(s.Conflicts, ", "))
+	}
+	return msg
+}
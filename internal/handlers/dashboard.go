@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/render"
+)
+
+// the dashboard charts the six months gone and the six to come, this month included in the second half
+const (
+	dashboardMonthsBack = 6
+	dashboardMonths     = 12
+)
+
+// occupancySeries is the share of nights a room was taken in each month charted, as a percentage
+type occupancySeries struct {
+	Room  string
+	Rates []float64
+}
+
+// AdminDashboard shows how full the rooms are, what they earn, who is coming and going, and how guests book
+func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	firstMonth := time.Date(now.Year(), now.Month()-dashboardMonthsBack, 1, 0, 0, 0, 0, time.UTC)
+	endMonth := firstMonth.AddDate(0, dashboardMonths, 0)
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	nights, err := m.DB.NightsBookedByRoomAndMonth(firstMonth, endMonth)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	revenue, err := m.DB.RevenueByMonth(firstMonth, endMonth)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	arrivals, err := m.DB.ArrivalsBetween(today, today.AddDate(0, 0, 7))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	departures, err := m.DB.DeparturesBetween(today, today.AddDate(0, 0, 7))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	pending, err := m.DB.CountNewReservations()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// booked over the last year, so a quiet or busy month doesn't skew them
+	stats, err := m.DB.BookingStatsSince(today.AddDate(-1, 0, 0))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	feeds, err := m.DB.AllICalFeeds()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var months []string
+	booked := make(map[int]map[string]int)
+	for _, n := range nights {
+		if booked[n.RoomID] == nil {
+			booked[n.RoomID] = make(map[string]int)
+		}
+		booked[n.RoomID][n.Month.Format("2006-01")] = n.Nights
+	}
+	earned := make(map[string]int)
+	for _, x := range revenue {
+		earned[x.Month.Format("2006-01")] = x.Total
+	}
+
+	var occupancy []occupancySeries
+	for _, room := range rooms {
+		occupancy = append(occupancy, occupancySeries{Room: room.RoomName})
+	}
+	var totals []float64
+	for month := firstMonth; month.Before(endMonth); month = month.AddDate(0, 1, 0) {
+		key := month.Format("2006-01")
+		days := month.AddDate(0, 1, -1).Day()
+
+		months = append(months, month.Format("Jan 2006"))
+		for i, room := range rooms {
+			occupancy[i].Rates = append(occupancy[i].Rates, percentage(booked[room.ID][key], days))
+		}
+		// Chart.js is given whole units, as the axis reads better without cents
+		totals = append(totals, float64(earned[key])/100)
+	}
+
+	data := make(map[string]interface{})
+	data["months"] = months
+	data["occupancy"] = occupancy
+	data["revenue"] = totals
+	data["arrivals_today"] = onDay(arrivals, today, func(res models.Reservation) time.Time { return res.StartDate })
+	data["departures_today"] = onDay(departures, today, func(res models.Reservation) time.Time { return res.EndDate })
+	data["stats"] = stats
+	data["ical_feeds"] = feeds
+
+	intMap := make(map[string]int)
+	intMap["pending"] = pending
+	intMap["arrivals_week"] = len(arrivals)
+	intMap["departures_week"] = len(departures)
+
+	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// percentage is part of whole as a percentage, to one decimal place
+func percentage(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return math.Round(float64(part)*1000/float64(whole)) / 10
+}
+
+// onDay keeps the reservations whose date, as given by date, falls on day
+func onDay(reservations []models.Reservation, day time.Time, date func(models.Reservation) time.Time) []models.Reservation {
+	var kept []models.Reservation
+	for _, res := range reservations {
+		y, m, d := date(res).Date()
+		if y == day.Year() && m == day.Month() && d == day.Day() {
+			kept = append(kept, res)
+		}
+	}
+	return kept
+}
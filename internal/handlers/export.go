@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/xlsx"
+	"github.com/go-chi/chi"
+)
+
+// exportBatch is how many reservations are read at a time while an export is written
+const exportBatch = 500
+
+// exportHeadings head the columns of a reservations export
+var exportHeadings = []interface{}{
+	"ID", "Confirmation Code", "First Name", "Last Name", "Email", "Phone", "Room",
+	"Arrival", "Departure", "Nights", "Adults", "Children", "Status", "Cancelled", "Total", "Currency", "Booked",
+}
+
+// exportWriter writes the rows of an export in one format
+type exportWriter interface {
+	Write(row []interface{}) error
+	Close() error
+}
+
+// AdminExportReservations downloads the new or all reservations list as CSV or XLSX, filtered and sorted as
+// the list is, e.g. /admin/reservations-all/export.csv?q=smith. Every match is exported, not just one page
+func (m *Repository) AdminExportReservations(w http.ResponseWriter, r *http.Request) {
+	src := chi.URLParam(r, "src")
+	format := chi.URLParam(r, "format")
+
+	var list func(models.ReservationFilter) ([]models.Reservation, error)
+	switch src {
+	case "new":
+		list = m.DB.AllNewReservations
+	case "all":
+		list = m.DB.AllReservations
+	}
+	if list == nil || (format != "csv" && format != "xlsx") {
+		http.NotFound(w, r)
+		return
+	}
+
+	f := reservationFilter(r.URL.Query(), src)
+	f.Cursor = models.Cursor{}
+	f.Limit = exportBatch
+
+	// the first batch is read before anything is sent, so a failure can still be reported
+	reservations, err := list(f)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	name := fmt.Sprintf("reservations-%s-%s.%s", src, time.Now().Format("2006-01-02"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+
+	var out exportWriter
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", xlsx.ContentType)
+		out, err = xlsx.NewWriter(w, "Reservations")
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+			return
+		}
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		out = &csvExport{w: csv.NewWriter(w)}
+	}
+
+	err = out.Write(exportHeadings)
+	for err == nil && len(reservations) > 0 {
+		for _, res := range reservations {
+			err = out.Write(exportRow(res))
+			if err != nil {
+				break
+			}
+		}
+		if err != nil || len(reservations) < exportBatch {
+			break
+		}
+
+		last := reservations[len(reservations)-1]
+		f.Cursor = models.Cursor{Value: f.SortValue(last), ID: last.ID}
+		reservations, err = list(f)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		// the file has been partly sent, so all that can be done is to stop; the download won't open cleanly
+		m.App.ErrorLog.Println(err)
+	}
+}
+
+// exportRow is one reservation as a row of an export
+func exportRow(res models.Reservation) []interface{} {
+	return []interface{}{
+		res.ID,
+		res.ConfirmationCode,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		res.Room.RoomName,
+		res.StartDate,
+		res.EndDate,
+		res.Nights(),
+		res.Adults,
+		res.Children,
+		res.StatusName(),
+		res.CancelledAt,
+		xlsx.Money(res.Total),
+		res.Currency,
+		res.CreatedAt,
+	}
+}
+
+// csvExport writes an export as CSV, with dates as yyyy-mm-dd and amounts in whole units
+type csvExport struct {
+	w *csv.Writer
+}
+
+// Write writes one row
+func (c *csvExport) Write(row []interface{}) error {
+	record := make([]string, len(row))
+	for i, cell := range row {
+		switch v := cell.(type) {
+		case string:
+			record[i] = defuse(v)
+		case int:
+			record[i] = strconv.Itoa(v)
+		case bool:
+			record[i] = "no"
+			if v {
+				record[i] = "yes"
+			}
+		case time.Time:
+			if !v.IsZero() {
+				record[i] = v.Format("2006-01-02")
+			}
+		case xlsx.Money:
+			record[i] = fmt.Sprintf("%.2f", float64(v)/100)
+		default:
+			return fmt.Errorf("csv: can't write a %T to a cell", cell)
+		}
+	}
+	return c.w.Write(record)
+}
+
+// defuse stops spreadsheet apps reading a guest's text as a formula when the CSV is opened,
+// by starting it with an apostrophe. Phone numbers such as +1 555 0100 are left alone
+func defuse(s string) string {
+	if s == "" || !strings.ContainsRune("=+-@", rune(s[0])) {
+		return s
+	}
+	if strings.Trim(s, "+-0123456789 ().") == "" {
+		return s
+	}
+	return "'" + s
+}
+
+// Close sends what's left of the file
+func (c *csvExport) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
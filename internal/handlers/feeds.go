@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/ical"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/tokens"
+	"github.com/go-chi/chi"
+)
+
+// calendar feeds list the nights from a year ago to two years ahead
+const (
+	feedYearsBack  = 1
+	feedYearsAhead = 2
+)
+
+// RoomFeed serves the calendar feed of one room at /ical/{slug}.ics, for channel managers and owners' phones.
+// The address carries the room's feed token and is handed outside the business, so guests' details are left out
+func (m *Repository) RoomFeed(w http.ResponseWriter, r *http.Request) {
+	room, err := m.DB.GetRoomBySlug(chi.URLParam(r, "slug"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if room.FeedToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(room.FeedToken)) != 1 {
+		helpers.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	events, err := m.roomEvents(room, false)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	writeFeed(w, ical.Calendar{Name: room.RoomName, Events: events})
+}
+
+// AllRoomsFeed serves a calendar of every room for staff at /ical/all.ics, with who is staying in each
+func (m *Repository) AllRoomsFeed(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var events []ical.Event
+	for _, room := range rooms {
+		roomEvents, err := m.roomEvents(room, true)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		events = append(events, roomEvents...)
+	}
+
+	writeFeed(w, ical.Calendar{Name: "All rooms", Events: events})
+}
+
+// roomEvents lists the reservations, owner blocks and recurring blocks of a room as events.
+// Staff see who is staying and why the room is blocked; anyone else only sees that it's taken
+func (m *Repository) roomEvents(room models.Room, staff bool) ([]ical.Event, error) {
+	now := time.Now()
+	restrictions, err := m.DB.FeedRestrictionsForRoom(room.ID, now.AddDate(-feedYearsBack, 0, 0), now.AddDate(feedYearsAhead, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	var events []ical.Event
+	for _, x := range restrictions {
+		e := ical.Event{Start: x.StartDate, End: x.EndDate, Modified: x.UpdatedAt}
+
+		if x.ReservationID > 0 {
+			// a reservation keeps its uid when its dates change
+			e.UID = fmt.Sprintf("reservation-%d@bookings", x.ReservationID)
+			e.Summary = "Reserved"
+			if staff {
+				res := x.Reservation
+				e.Summary = fmt.Sprintf("%s: %s %s", room.RoomName, res.FirstName, res.LastName)
+				e.Description = fmt.Sprintf("Confirmation code %s\n%s", res.ConfirmationCode, res.GuestSummary())
+			}
+		} else if x.RestrictionID == models.RestrictionExternal {
+			// passed on, so each channel hears of the stays booked on the others
+			e.UID = fmt.Sprintf("block-%d@bookings", x.ID)
+			e.Summary = "Not available"
+			if staff {
+				e.Summary = fmt.Sprintf("%s: Booked on %s", room.RoomName, x.Reason)
+				e.Description = x.Notes
+			}
+		} else {
+			e.UID = fmt.Sprintf("block-%d@bookings", x.ID)
+			e.Summary = "Not available"
+			if staff {
+				e.Summary = room.RoomName + ": Blocked"
+				if x.Reason != "" {
+					e.Summary += " - " + x.Reason
+				}
+				e.Description = x.Notes
+			}
+		}
+
+		events = append(events, e)
+	}
+
+	recurringBlocks, err := m.DB.RecurringBlocksForRoom(room.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range recurringBlocks {
+		rule, err := b.Rule()
+		if err != nil {
+			// rules are checked when they're saved, so this one was changed by hand
+			m.App.ErrorLog.Println(err)
+			continue
+		}
+
+		e := ical.Event{
+			UID:      fmt.Sprintf("recurring-block-%d@bookings", b.ID),
+			Start:    b.StartDate,
+			End:      b.StartDate.AddDate(0, 0, b.Nights),
+			RRule:    rule.String(),
+			Summary:  "Not available",
+			Modified: b.UpdatedAt,
+		}
+		if staff {
+			e.Summary = room.RoomName + ": Closed"
+			if b.Reason != "" {
+				e.Summary += " - " + b.Reason
+			}
+			e.Description = b.Describe()
+		}
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// writeFeed sends a calendar to the client
+func writeFeed(w http.ResponseWriter, c ical.Calendar) {
+	var b bytes.Buffer
+	err := c.Write(&b, time.Now())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ical.ContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(b.Bytes())
+}
+
+// feedURL is the address calendar apps subscribe to for a room's feed
+func (m *Repository) feedURL(room models.Room) string {
+	return m.siteURL("/ical/" + room.Slug + ".ics?token=" + room.FeedToken)
+}
+
+// AdminPostRoomFeedToken gives a room a new calendar feed address; the old one stops working
+func (m *Repository) AdminPostRoomFeedToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	token, err := tokens.FeedToken()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.UpdateRoomFeedToken(room.ID, token, helpers.Actor(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if room.FeedToken == "" {
+		m.App.Session.Put(r.Context(), "flash", "Calendar feed created")
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "Calendar feed address changed; the old address no longer works")
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", room.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,504 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aparkinlot/Bookings/internal/forms"
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/payments"
+	"github.com/aparkinlot/Bookings/internal/pricing"
+	"github.com/aparkinlot/Bookings/internal/render"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/aparkinlot/Bookings/internal/tokens"
+	"github.com/go-chi/chi"
+)
+
+// maxRoomOptions caps how many combinations of rooms a guest is offered
+const maxRoomOptions = 10
+
+// roomOption is a set of rooms that together satisfy a group search
+type roomOption struct {
+	Rooms []models.Room
+	Total int
+	IDs   string
+}
+
+// roomCombinations returns every way of picking n of rooms, keeping their order
+func roomCombinations(rooms []models.Room, n int) [][]models.Room {
+	var combos [][]models.Room
+
+	var pick func(start int, chosen []models.Room)
+	pick = func(start int, chosen []models.Room) {
+		if len(chosen) == n {
+			combos = append(combos, append([]models.Room(nil), chosen...))
+			return
+		}
+		for i := start; i <= len(rooms)-(n-len(chosen)); i++ {
+			pick(i+1, append(chosen, rooms[i]))
+		}
+	}
+
+	if n > 0 && n <= len(rooms) {
+		pick(0, nil)
+	}
+
+	return combos
+}
+
+// sleeps is how many guests a set of rooms can take between them
+func sleeps(rooms []models.Room) int {
+	total := 0
+	for _, room := range rooms {
+		total += room.MaxOccupancy
+	}
+	return total
+}
+
+// assignGuests spreads the group's adults and children over the rooms, filling each room in turn
+// and putting an adult in every room first; it returns false if the rooms can't take everyone
+func assignGuests(reservations []models.Reservation, adults, children int) bool {
+	if adults < len(reservations) {
+		return false
+	}
+
+	for i := range reservations {
+		res := &reservations[i]
+		res.Adults, res.Children = 1, 0
+		adults--
+	}
+
+	for i := range reservations {
+		res := &reservations[i]
+		for res.Guests() < res.Room.MaxOccupancy && adults > 0 {
+			res.Adults++
+			adults--
+		}
+		for res.Guests() < res.Room.MaxOccupancy && children > 0 {
+			res.Children++
+			children--
+		}
+	}
+
+	return adults == 0 && children == 0
+}
+
+// renderRoomOptions shows the combinations of available rooms that can house a group, cheapest first
+func (m *Repository) renderRoomOptions(w http.ResponseWriter, r *http.Request, rooms []models.Room, quotes map[int]pricing.Quote, numRooms, guests int) {
+	var options []roomOption
+	for _, combo := range roomCombinations(rooms, numRooms) {
+		if sleeps(combo) < guests {
+			continue
+		}
+
+		option := roomOption{Rooms: combo}
+
+		var ids []string
+		for _, room := range combo {
+			option.Total += quotes[room.ID].Total
+			ids = append(ids, strconv.Itoa(room.ID))
+		}
+		option.IDs = strings.Join(ids, ",")
+
+		options = append(options, option)
+	}
+
+	if len(options) == 0 {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Sorry, we don't have %d rooms free for %d guests on those dates", numRooms, guests))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Total < options[j].Total
+	})
+	if len(options) > maxRoomOptions {
+		options = options[:maxRoomOptions]
+	}
+
+	data := make(map[string]interface{})
+	data["options"] = options
+
+	intMap := make(map[string]int)
+	intMap["num_rooms"] = numRooms
+
+	render.Template(w, r, "choose-rooms.page.tmpl", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// ChooseRooms starts a group booking for the rooms the guest picked, /choose-rooms?ids=1,2
+func (m *Repository) ChooseRooms(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "can't get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	var group models.BookingGroup
+	seen := make(map[int]bool)
+
+	for _, s := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		roomID, err := strconv.Atoi(s)
+		if err != nil || seen[roomID] {
+			m.App.Session.Put(r.Context(), "error", "invalid data!")
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return
+		}
+		seen[roomID] = true
+
+		room, err := m.DB.GetRoomByID(roomID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get room from database")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		group.Reservations = append(group.Reservations, models.Reservation{
+			StartDate: res.StartDate,
+			EndDate:   res.EndDate,
+			RoomID:    roomID,
+			Room:      room,
+		})
+	}
+
+	if len(group.Reservations) < 2 {
+		m.App.Session.Put(r.Context(), "error", "Pick at least two rooms to book them together")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	if !assignGuests(group.Reservations, res.Adults, res.Children) {
+		m.App.Session.Put(r.Context(), "error", "Those rooms don't sleep everyone in your group")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	if !m.holdRooms(w, r, group.Reservations) {
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "booking_group", group)
+	http.Redirect(w, r, "/make-group-reservation", http.StatusSeeOther)
+}
+
+// GroupReservation shows the form for booking several rooms together
+func (m *Repository) GroupReservation(w http.ResponseWriter, r *http.Request) {
+	group, ok := m.App.Session.Get(r.Context(), "booking_group").(models.BookingGroup)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "can't get the rooms you picked from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	quotes, ok := m.quoteGroup(w, r, group)
+	if !ok {
+		return
+	}
+
+	m.renderGroupReservation(w, r, forms.New(nil), group, quotes)
+}
+
+// PostGroupReservation books every room in the group, all or none
+func (m *Repository) PostGroupReservation(w http.ResponseWriter, r *http.Request) {
+	group, ok := m.App.Session.Get(r.Context(), "booking_group").(models.BookingGroup)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "can't get the rooms you picked from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	quotes, ok := m.quoteGroup(w, r, group)
+	if !ok {
+		return
+	}
+
+	group.FirstName = r.Form.Get("first_name")
+	group.LastName = r.Form.Get("last_name")
+	group.Email = r.Form.Get("email")
+	group.Phone = r.Form.Get("phone")
+
+	deposit := 0
+	for i := range group.Reservations {
+		res := &group.Reservations[i]
+		res.FirstName = group.FirstName
+		res.LastName = group.LastName
+		res.Email = group.Email
+		res.Phone = group.Phone
+
+		quotes[i].ApplyTo(res)
+		deposit += m.depositFor(res.Total)
+	}
+
+	form := forms.New(r.PostForm)
+
+	form.Required("first_name", "last_name", "email")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+	if form.Has("phone") {
+		form.IsPhone("phone")
+	}
+	if deposit > 0 {
+		form.Required("card_number")
+	}
+
+	if !form.Valid() {
+		m.renderGroupReservation(w, r, form, group, quotes)
+		return
+	}
+
+	group.ConfirmationCode, err = tokens.ConfirmationCode()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	for i := range group.Reservations {
+		group.Reservations[i].ConfirmationCode, err = tokens.ConfirmationCode()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	// each room's hold becomes its reservation's restriction, as for a single room
+	holdIDs, _ := m.App.Session.Get(r.Context(), "hold_ids").([]int)
+	group, err = m.DB.InsertBookingGroup(group, holdIDs, deposit == 0)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, one of those rooms just got booked for those dates. Please search again.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	m.App.Session.Remove(r.Context(), "hold_ids")
+
+	if deposit > 0 {
+		err = m.holdGroupDeposits(group, r.Form.Get("card_number"))
+		if err != nil {
+			// the booking never went through, so free the rooms again
+			if delErr := m.DB.DeleteBookingGroup(group.ID); delErr != nil {
+				m.App.ErrorLog.Println(delErr)
+			}
+
+			if errors.Is(err, payments.ErrDeclined) {
+				form.Errors.Add("card_number", "Your card was declined")
+				m.renderGroupReservation(w, r, form, group, quotes)
+				return
+			}
+
+			m.App.Session.Put(r.Context(), "error", "can't take the deposit for your reservation!")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+	}
+
+	m.sendGroupEmails(group)
+
+	m.App.Session.Put(r.Context(), "booking_group", group)
+	http.Redirect(w, r, "/group-reservation-summary", http.StatusSeeOther)
+}
+
+// GroupReservationSummary shows the guest what they booked for the group
+func (m *Repository) GroupReservationSummary(w http.ResponseWriter, r *http.Request) {
+	group, ok := m.App.Session.Get(r.Context(), "booking_group").(models.BookingGroup)
+	if !ok || group.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "Can't get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Remove(r.Context(), "booking_group")
+
+	deposit := 0
+	for _, res := range group.Reservations {
+		deposit += m.depositFor(res.Total)
+	}
+
+	data := make(map[string]interface{})
+	data["group"] = group
+	data["deposit"] = deposit
+
+	render.Template(w, r, "group-reservation-summary.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// quoteGroup prices every room in the group, redirecting and returning false if one can't be booked
+func (m *Repository) quoteGroup(w http.ResponseWriter, r *http.Request, group models.BookingGroup) ([]pricing.Quote, bool) {
+	var quotes []pricing.Quote
+
+	for _, res := range group.Reservations {
+		violations, err := m.Rules.Check(res.Room, res.StartDate, res.EndDate)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't check the booking rules for that stay")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return nil, false
+		}
+		if len(violations) > 0 {
+			m.App.Session.Put(r.Context(), "error", violationMessage(res.Room.RoomName, violations))
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return nil, false
+		}
+
+		quote, err := m.Pricing.Quote(res.RoomID, res.StartDate, res.EndDate)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get a price for that stay")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return nil, false
+		}
+		quotes = append(quotes, quote)
+	}
+
+	return quotes, true
+}
+
+// renderGroupReservation shows the group booking form with the price of each room
+func (m *Repository) renderGroupReservation(w http.ResponseWriter, r *http.Request, form *forms.Form, group models.BookingGroup, quotes []pricing.Quote) {
+	total, deposit := 0, 0
+	for _, q := range quotes {
+		total += q.Total
+		deposit += m.depositFor(q.Total)
+	}
+
+	data := make(map[string]interface{})
+	data["group"] = group
+	data["quotes"] = quotes
+	data["total"] = total
+	data["deposit"] = deposit
+	if m.App.Session.Exists(r.Context(), "hold_ids") {
+		data["hold_minutes"] = int(m.App.HoldTTL.Minutes())
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = group.Reservations[0].StartDate.Format("2006-01-02")
+	stringMap["end_date"] = group.Reservations[0].EndDate.Format("2006-01-02")
+
+	render.Template(w, r, "make-group-reservation.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// sendGroupEmails queues one confirmation covering every room to the guest, and one notification to the owner
+func (m *Repository) sendGroupEmails(group models.BookingGroup) {
+	var rooms strings.Builder
+	for _, res := range group.Reservations {
+		fmt.Fprintf(&rooms, "%s: %s (confirmation code <strong>%s</strong>)<br>",
+			res.Room.RoomName, pricing.FormatMoney(res.Total), res.ConfirmationCode)
+	}
+
+	start := group.Reservations[0].StartDate.Format("2006-01-02")
+	end := group.Reservations[0].EndDate.Format("2006-01-02")
+
+	htmlMessage := fmt.Sprintf(`
+		<strong>Reservation Confirmation</strong><br>
+		Dear %s: <br>
+		This is to confirm your booking of %d rooms from %s to %s.<br>
+		%s
+		The total for your stay is %s.<br>
+		Your group confirmation code is <strong>%s</strong>. Each room's own code can be used with your
+		email address to view, change or cancel it at <a href="%[7]s">%[7]s</a>.
+	`, group.FirstName, len(group.Reservations), start, end, rooms.String(),
+		pricing.FormatMoney(group.Total()), group.ConfirmationCode, m.siteURL("/my-reservation/lookup"))
+
+	m.App.MailChan <- models.MailData{
+		To:       group.Email,
+		From:     "me@here.com",
+		Subject:  "Reservation Confirmation",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+
+	htmlMessage = fmt.Sprintf(`
+		<strong>Group Reservation Notification</strong><br>
+		%s %s has booked %d rooms from %s to %s.<br>
+		%s
+	`, group.FirstName, group.LastName, len(group.Reservations), start, end, rooms.String())
+
+	m.App.MailChan <- models.MailData{
+		To:      "me@here.com",
+		From:    "me@here.com",
+		Subject: "Group Reservation Notification",
+		Content: htmlMessage,
+	}
+}
+
+// AdminShowBookingGroup shows every reservation in a booking group
+func (m *Repository) AdminShowBookingGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	group, err := m.DB.GetBookingGroupByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["group"] = group
+
+	render.Template(w, r, "admin-booking-group-show.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminConfirmBookingGroup confirms every reservation in a booking group still waiting for it, taking their deposits
+func (m *Repository) AdminConfirmBookingGroup(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	group, err := m.DB.GetBookingGroupByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the ones already confirmed or cancelled are left as they are. A room that can't be confirmed
+	// doesn't stop the rest, and stays pending so confirming the group again retries only it
+	var confirmed, failed []string
+	for _, res := range group.Reservations {
+		if res.Status != models.StatusPending {
+			continue
+		}
+
+		err = m.changeStatus(r, res, models.StatusConfirmed)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+			failed = append(failed, fmt.Sprintf("%s: %s", res.Room.RoomName, statusError(res, models.StatusConfirmed, err)))
+			continue
+		}
+		confirmed = append(confirmed, res.Room.RoomName)
+	}
+
+	switch {
+	case len(failed) > 0 && len(confirmed) > 0:
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Confirmed %s, but not %s",
+			strings.Join(confirmed, ", "), strings.Join(failed, "; ")))
+	case len(failed) > 0:
+		m.App.Session.Put(r.Context(), "error", "Couldn't confirm "+strings.Join(failed, "; "))
+	default:
+		m.App.Session.Put(r.Context(), "flash", "Group confirmed")
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/groups/%d/show", id), http.StatusSeeOther)
+}
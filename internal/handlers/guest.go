@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aparkinlot/Bookings/internal/forms"
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/render"
+	"github.com/aparkinlot/Bookings/internal/repository"
+)
+
+// GuestLookup shows the form guests use to find their booking
+func (m *Repository) GuestLookup(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "reservation-lookup.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostGuestLookup finds a booking by confirmation code and email and remembers it in the session
+func (m *Repository) PostGuestLookup(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form!")
+		http.Redirect(w, r, "/my-reservation/lookup", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("confirmation_code", "email")
+	form.IsEmail("email")
+
+	if form.Valid() {
+		res, err := m.DB.GetReservationByConfirmationCode(form.Get("confirmation_code"), form.Get("email"))
+		if errors.Is(err, sql.ErrNoRows) {
+			form.Errors.Add("confirmation_code", "We couldn't find a booking with that code and email")
+		} else if err != nil {
+			helpers.ServerError(w, err)
+			return
+		} else {
+			// the guest is now acting on a booking, so give them a fresh session
+			_ = m.App.Session.RenewToken(r.Context())
+			m.App.Session.Put(r.Context(), "manage_reservation_id", res.ID)
+			http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+			return
+		}
+	}
+
+	render.Template(w, r, "reservation-lookup.page.tmpl", &models.TemplateData{
+		Form: form,
+	})
+}
+
+// GuestReservation shows the booking the guest looked up
+func (m *Repository) GuestReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.guestReservationFromSession(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderGuestReservation(w, r, res, forms.New(nil))
+}
+
+// PostGuestChangeDates moves the guest's booking to new dates if the room is free
+func (m *Repository) PostGuestChangeDates(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.guestReservationFromSession(w, r)
+	if !ok {
+		return
+	}
+
+	if res.IsCancelled() {
+		m.App.Session.Put(r.Context(), "error", "This booking has been cancelled and can't be changed")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return
+	}
+	if !res.IsUpcoming() {
+		m.App.Session.Put(r.Context(), "error", "This booking can no longer be changed online; please contact us")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form!")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	if !stayDates(form, "start", "end") {
+		m.renderGuestReservation(w, r, res, form)
+		return
+	}
+	startDate := form.Date("start")
+	endDate := form.Date("end")
+
+	room, err := m.DB.GetRoomByID(res.RoomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	violations, err := m.Rules.Check(room, startDate, endDate)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	addViolations(form, violations, "start", "end")
+	if !form.Valid() {
+		m.renderGuestReservation(w, r, res, form)
+		return
+	}
+
+	// the price and deposit stay as booked; the update flags the booking for an admin to re-price
+	// the availability check runs inside the update, leaving out the booking's own restriction
+	err = m.DB.UpdateReservationDates(res.ID, startDate, endDate, models.ActorGuest)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, the room isn't available for those dates")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.sendGuestNotice(res, "Reservation Changed", fmt.Sprintf(
+		"Your booking %s has been changed. You are now staying from %s to %s. We'll be in touch if the price of your stay changes.",
+		res.ConfirmationCode, startDate.Format(forms.DateLayout), endDate.Format(forms.DateLayout),
+	))
+
+	m.App.Session.Put(r.Context(), "flash", "Your booking dates have been changed")
+	http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+}
+
+// PostGuestCancel cancels the guest's booking and frees the room
+func (m *Repository) PostGuestCancel(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.guestReservationFromSession(w, r)
+	if !ok {
+		return
+	}
+
+	if res.IsCancelled() {
+		m.App.Session.Put(r.Context(), "error", "This booking has already been cancelled")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return
+	}
+	if !res.IsUpcoming() {
+		m.App.Session.Put(r.Context(), "error", "This booking can no longer be cancelled online; please contact us")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return
+	}
+
+	err := m.refundPayments(res.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.UpdateReservationStatus(res.ID, models.StatusCancelled, models.ActorGuest)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.sendGuestNotice(res, "Reservation Cancelled", fmt.Sprintf(
+		"Your booking %s from %s to %s has been cancelled.",
+		res.ConfirmationCode, res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"),
+	))
+
+	m.App.Session.Put(r.Context(), "flash", "Your booking has been cancelled")
+	http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+}
+
+// guestReservationFromSession loads the booking the guest looked up, sending them
+// back to the lookup form and returning false if there isn't one
+func (m *Repository) guestReservationFromSession(w http.ResponseWriter, r *http.Request) (models.Reservation, bool) {
+	id, ok := m.App.Session.Get(r.Context(), "manage_reservation_id").(int)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Please look up your booking first")
+		http.Redirect(w, r, "/my-reservation/lookup", http.StatusSeeOther)
+		return models.Reservation{}, false
+	}
+
+	res, err := m.DB.GetReservationByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Remove(r.Context(), "manage_reservation_id")
+		m.App.Session.Put(r.Context(), "error", "Please look up your booking first")
+		http.Redirect(w, r, "/my-reservation/lookup", http.StatusSeeOther)
+		return res, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return res, false
+	}
+
+	return res, true
+}
+
+func (m *Repository) renderGuestReservation(w http.ResponseWriter, r *http.Request, res models.Reservation, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["reservation"] = res
+
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = res.StartDate.Format("2006-01-02")
+	stringMap["end_date"] = res.EndDate.Format("2006-01-02")
+
+	render.Template(w, r, "my-reservation.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// sendGuestNotice emails the guest about a change they made to their booking, copying the owner
+func (m *Repository) sendGuestNotice(res models.Reservation, subject, message string) {
+	htmlMessage := fmt.Sprintf(`
+		<strong>%s</strong><br>
+		Dear %s: <br>
+		%s
+	`, subject, res.FirstName, message)
+
+	m.App.MailChan <- models.MailData{
+		To:       res.Email,
+		From:     "me@here.com",
+		Subject:  subject,
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+
+	m.App.MailChan <- models.MailData{
+		To:      "me@here.com",
+		From:    "me@here.com",
+		Subject: subject,
+		Content: htmlMessage,
+	}
+}
@@ -1,20 +1,36 @@
 package handlers
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aparkinlot/Bookings/internal/audit"
 	"github.com/aparkinlot/Bookings/internal/driver"
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/ical"
 	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/payments"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/aparkinlot/Bookings/internal/xlsx"
+	"github.com/go-chi/chi"
 )
 
 type postData struct {
@@ -32,6 +48,8 @@ var theTests = []struct {
 	{"about", "/about", "GET", http.StatusOK},
 	{"gq", "/generals-quarters", "GET", http.StatusOK},
 	{"ms", "/majors-suite", "GET", http.StatusOK},
+	{"room", "/rooms/generals-quarters", "GET", http.StatusOK},
+	{"room missing", "/rooms/presidential-suite", "GET", http.StatusNotFound},
 	{"sa", "/search-availability", "GET", http.StatusOK},
 	{"contact", "/contact", "GET", http.StatusOK},
 	{"non-existent", "/green/eggs/and/ham", "GET", http.StatusNotFound},
@@ -40,9 +58,36 @@ var theTests = []struct {
 	{"dashboard", "/admin/dashboard", "GET", http.StatusOK},
 	{"new res", "/admin/reservations-new", "GET", http.StatusOK},
 	{"all res", "/admin/reservations-all", "GET", http.StatusOK},
+	{"export csv", "/admin/reservations-all/export.csv", "GET", http.StatusOK},
+	{"export xlsx", "/admin/reservations-new/export.xlsx", "GET", http.StatusOK},
+	{"export unknown format", "/admin/reservations-all/export.pdf", "GET", http.StatusNotFound},
+	{"export unknown list", "/admin/reservations-old/export.csv", "GET", http.StatusNotFound},
+	{"import", "/admin/import", "GET", http.StatusOK},
+	{"history", "/admin/audit", "GET", http.StatusOK},
+	{"history of a reservation", "/admin/audit?entity=reservation&id=1&action=update", "GET", http.StatusOK},
+	{"history failing", "/admin/audit?entity=room&id=1000", "GET", http.StatusInternalServerError},
 	{"show res", "/admin/reservations/new/1/show", "GET", http.StatusOK},
+	{"trash", "/admin/reservations-trash", "GET", http.StatusOK},
+	{"show res in trash", "/admin/reservations/trash/96/show", "GET", http.StatusOK},
 	{"show res cal", "/admin/reservations-calendar", "GET", http.StatusOK},
 	{"show res cal with params", "/admin/reservations-calendar?y=2020&m=1", "GET", http.StatusOK},
+	{"api rooms", "/api/v1/rooms", "GET", http.StatusOK},
+	{"api availability", "/api/v1/rooms/1/availability?start=2040-01-01&end=2040-01-02", "GET", http.StatusOK},
+	{"api availability bad date", "/api/v1/rooms/1/availability?start=invalid&end=2040-01-02", "GET", http.StatusBadRequest},
+	{"api availability backwards dates", "/api/v1/rooms/1/availability?start=2040-01-02&end=2040-01-01", "GET", http.StatusBadRequest},
+	{"api availability unknown room", "/api/v1/rooms/5/availability?start=2040-01-01&end=2040-01-02", "GET", http.StatusNotFound},
+	{"api availability past dates", "/api/v1/rooms/1/availability?start=2000-01-01&end=2000-01-02", "GET", http.StatusBadRequest},
+	{"api availability db error", "/api/v1/rooms/1/availability?start=2060-01-01&end=2060-01-02", "GET", http.StatusInternalServerError},
+	{"api get res", "/api/v1/reservations/1", "GET", http.StatusOK},
+	{"api get res missing", "/api/v1/reservations/500", "GET", http.StatusNotFound},
+	{"api get res bad id", "/api/v1/reservations/fish", "GET", http.StatusBadRequest},
+	{"api tokens", "/admin/tokens", "GET", http.StatusOK},
+	{"show group", "/admin/groups/1/show", "GET", http.StatusOK},
+	{"show group missing", "/admin/groups/500/show", "GET", http.StatusInternalServerError},
+	{"admin rooms", "/admin/rooms", "GET", http.StatusOK},
+	{"admin show room", "/admin/rooms/1", "GET", http.StatusOK},
+	{"admin new room", "/admin/rooms/new", "GET", http.StatusOK},
+	{"admin show room missing", "/admin/rooms/5", "GET", http.StatusInternalServerError},
 }
 
 // TestHandlers tests all routes that don't require extra tests (gets)
@@ -75,14 +120,36 @@ var reservationTests = []struct {
 	{
 		name: "reservation-in-session",
 		reservation: models.Reservation{
-			RoomID: 1,
+			RoomID:    1,
+			StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
 			Room: models.Room{
 				ID:       1,
 				RoomName: "General's Quarters",
 			},
 		},
 		expectedStatusCode: http.StatusOK,
-		expectedHTML:       `action="/make-reservation"`,
+		expectedHTML:       "2 night(s)",
+	},
+	{
+		name: "stay-shorter-than-minimum",
+		reservation: models.Reservation{
+			RoomID:    1,
+			StartDate: time.Date(2046, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2046, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/search-availability",
+	},
+	{
+		name: "pricing-fails",
+		reservation: models.Reservation{
+			RoomID:    1,
+			StartDate: time.Date(2045, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2045, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/",
 	},
 	{
 		name:               "reservation-not-in-session",
@@ -154,13 +221,15 @@ var postReservationTests = []struct {
 	{
 		name: "valid-data",
 		postedData: url.Values{
-			"start_date": {"2050-01-01"},
-			"end_date":   {"2050-01-02"},
-			"first_name": {"John"},
-			"last_name":  {"Smith"},
-			"email":      {"john@smith.com"},
-			"phone":      {"555-555-5555"},
-			"room_id":    {"1"},
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1"},
 		},
 		expectedResponseCode: http.StatusSeeOther,
 		expectedHTML:         "",
@@ -176,13 +245,15 @@ var postReservationTests = []struct {
 	{
 		name: "invalid-start-date",
 		postedData: url.Values{
-			"start_date": {"invalid"},
-			"end_date":   {"2050-01-02"},
-			"first_name": {"John"},
-			"last_name":  {"Smith"},
-			"email":      {"john@smith.com"},
-			"phone":      {"555-555-5555"},
-			"room_id":    {"1"},
+			"start_date":  {"invalid"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1"},
 		},
 		expectedResponseCode: http.StatusSeeOther,
 		expectedHTML:         "",
@@ -191,13 +262,15 @@ var postReservationTests = []struct {
 	{
 		name: "invalid-end-date",
 		postedData: url.Values{
-			"start_date": {"2050-01-01"},
-			"end_date":   {"end"},
-			"first_name": {"John"},
-			"last_name":  {"Smith"},
-			"email":      {"john@smith.com"},
-			"phone":      {"555-555-5555"},
-			"room_id":    {"1"},
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"end"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1"},
 		},
 		expectedResponseCode: http.StatusSeeOther,
 		expectedHTML:         "",
@@ -206,13 +279,15 @@ var postReservationTests = []struct {
 	{
 		name: "invalid-room-id",
 		postedData: url.Values{
-			"start_date": {"2050-01-01"},
-			"end_date":   {"2050-01-02"},
-			"first_name": {"John"},
-			"last_name":  {"Smith"},
-			"email":      {"john@smith.com"},
-			"phone":      {"555-555-5555"},
-			"room_id":    {"invalid"},
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"invalid"},
 		},
 		expectedResponseCode: http.StatusSeeOther,
 		expectedHTML:         "",
@@ -221,13 +296,15 @@ var postReservationTests = []struct {
 	{
 		name: "invalid-data",
 		postedData: url.Values{
-			"start_date": {"2050-01-01"},
-			"end_date":   {"2050-01-02"},
-			"first_name": {"J"},
-			"last_name":  {"Smith"},
-			"email":      {"john@smith.com"},
-			"phone":      {"555-555-5555"},
-			"room_id":    {"1"},
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"J"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1"},
 		},
 		expectedResponseCode: http.StatusOK,
 		expectedHTML:         `action="/make-reservation"`,
@@ -236,13 +313,15 @@ var postReservationTests = []struct {
 	{
 		name: "database-insert-fails-reservation",
 		postedData: url.Values{
-			"start_date": {"2050-01-01"},
-			"end_date":   {"2050-01-02"},
-			"first_name": {"John"},
-			"last_name":  {"Smith"},
-			"email":      {"john@smith.com"},
-			"phone":      {"555-555-5555"},
-			"room_id":    {"2"},
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"2"},
 		},
 		expectedResponseCode: http.StatusSeeOther,
 		expectedHTML:         "",
@@ -250,6 +329,57 @@ var postReservationTests = []struct {
 	},
 	{
 		name: "database-insert-fails-restriction",
+		postedData: url.Values{
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1000"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedHTML:         "",
+		expectedLocation:     "/",
+	},
+	{
+		name: "room-booked-by-someone-else",
+		postedData: url.Values{
+			"start_date":  {"2055-01-01"},
+			"end_date":    {"2055-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedHTML:         "",
+		expectedLocation:     "/search-availability",
+	},
+	{
+		name: "stay-shorter-than-minimum",
+		postedData: url.Values{
+			"start_date":  {"2046-01-01"},
+			"end_date":    {"2046-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1"},
+		},
+		expectedResponseCode: http.StatusOK,
+		expectedHTML:         "This room has a minimum stay of 3 nights",
+		expectedLocation:     "",
+	},
+	{
+		name: "missing-card-number",
 		postedData: url.Values{
 			"start_date": {"2050-01-01"},
 			"end_date":   {"2050-01-02"},
@@ -257,12 +387,117 @@ var postReservationTests = []struct {
 			"last_name":  {"Smith"},
 			"email":      {"john@smith.com"},
 			"phone":      {"555-555-5555"},
-			"room_id":    {"1000"},
+			"adults":     {"2"},
+			"room_id":    {"1"},
+		},
+		expectedResponseCode: http.StatusOK,
+		expectedHTML:         `id="card_number"`,
+		expectedLocation:     "",
+	},
+	{
+		name: "card-declined",
+		postedData: url.Values{
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {payments.DeclinedCard},
+			"adults":      {"2"},
+			"room_id":     {"1"},
+		},
+		expectedResponseCode: http.StatusOK,
+		expectedHTML:         "Your card was declined",
+		expectedLocation:     "",
+	},
+	{
+		name: "invalid-phone",
+		postedData: url.Values{
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"call me"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1"},
+		},
+		expectedResponseCode: http.StatusOK,
+		expectedHTML:         "Invalid phone number",
+		expectedLocation:     "",
+	},
+	{
+		name: "arrival-in-past",
+		postedData: url.Values{
+			"start_date":  {"2000-01-01"},
+			"end_date":    {"2000-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1"},
 		},
 		expectedResponseCode: http.StatusSeeOther,
 		expectedHTML:         "",
 		expectedLocation:     "/",
 	},
+	{
+		name: "arrival-day-not-allowed",
+		postedData: url.Values{
+			"start_date":  {"2041-01-01"},
+			"end_date":    {"2041-01-03"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"room_id":     {"1"},
+		},
+		expectedResponseCode: http.StatusOK,
+		expectedHTML:         "Arrivals are only possible on Sat",
+		expectedLocation:     "",
+	},
+	{
+		name: "more-guests-than-room-sleeps",
+		postedData: url.Values{
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"2"},
+			"children":    {"1"},
+			"room_id":     {"1"},
+		},
+		expectedResponseCode: http.StatusOK,
+		expectedHTML:         "This room sleeps at most 2 guests",
+		expectedLocation:     "",
+	},
+	{
+		name: "no-adults",
+		postedData: url.Values{
+			"start_date":  {"2050-01-01"},
+			"end_date":    {"2050-01-02"},
+			"first_name":  {"John"},
+			"last_name":   {"Smith"},
+			"email":       {"john@smith.com"},
+			"phone":       {"555-555-5555"},
+			"card_number": {"4242424242424242"},
+			"adults":      {"0"},
+			"children":    {"2"},
+			"room_id":     {"2"},
+		},
+		expectedResponseCode: http.StatusOK,
+		expectedHTML:         "At least one adult must be staying",
+		expectedLocation:     "",
+	},
 }
 
 // TestPostReservation tests the PostReservation handler
@@ -323,6 +558,7 @@ var testAvailabilityJSONData = []struct {
 	postedData      url.Values
 	expectedOK      bool
 	expectedMessage string
+	expectedTotal   int
 }{
 	{
 		name: "rooms not available",
@@ -339,13 +575,54 @@ var testAvailabilityJSONData = []struct {
 			"end":     {"2040-01-02"},
 			"room_id": {"1"},
 		},
-		expectedOK: true,
+		expectedOK:    true,
+		expectedTotal: 13750,
+	},
+	{
+		name: "stay shorter than minimum",
+		postedData: url.Values{
+			"start":   {"2046-01-01"},
+			"end":     {"2046-01-02"},
+			"room_id": {"1"},
+		},
+		expectedOK:      false,
+		expectedMessage: "This room has a minimum stay of 3 nights",
+	},
+	{
+		name: "departure before arrival",
+		postedData: url.Values{
+			"start":   {"2040-01-03"},
+			"end":     {"2040-01-01"},
+			"room_id": {"1"},
+		},
+		expectedOK:      false,
+		expectedMessage: "End date must be after start date",
+	},
+	{
+		name: "bad date",
+		postedData: url.Values{
+			"start":   {"2040-01-01"},
+			"end":     {"soon"},
+			"room_id": {"1"},
+		},
+		expectedOK:      false,
+		expectedMessage: "Invalid date",
+	},
+	{
+		name: "arrival day not allowed",
+		postedData: url.Values{
+			"start":   {"2041-01-01"},
+			"end":     {"2041-01-03"},
+			"room_id": {"1"},
+		},
+		expectedOK:      false,
+		expectedMessage: "Arrivals are only possible on Sat",
 	},
 	{
 		name:            "empty post body",
 		postedData:      nil,
 		expectedOK:      false,
-		expectedMessage: "Internal Server Error",
+		expectedMessage: "Internal server error",
 	},
 	{
 		name: "database query fails",
@@ -355,7 +632,7 @@ var testAvailabilityJSONData = []struct {
 			"room_id": {"1"},
 		},
 		expectedOK:      false,
-		expectedMessage: "Error querying database",
+		expectedMessage: "Error querying the database",
 	},
 }
 
@@ -387,6 +664,14 @@ func TestAvailabilityJSON(t *testing.T) {
 		if j.OK != e.expectedOK {
 			t.Errorf("%s: expected %v but got %v", e.name, e.expectedOK, j.OK)
 		}
+
+		if e.expectedTotal > 0 && (j.Quote == nil || j.Quote.Total != e.expectedTotal) {
+			t.Errorf("%s: expected a quote totalling %d but got %+v", e.name, e.expectedTotal, j.Quote)
+		}
+
+		if e.expectedMessage != "" && j.Message != e.expectedMessage {
+			t.Errorf("%s: expected message %q but got %q", e.name, e.expectedMessage, j.Message)
+		}
 	}
 }
 
@@ -396,12 +681,14 @@ var testPostAvailabilityData = []struct {
 	postedData         url.Values
 	expectedStatusCode int
 	expectedLocation   string
+	expectedHTML       string
 }{
 	{
 		name: "rooms not available",
 		postedData: url.Values{
-			"start": {"2050-01-01"},
-			"end":   {"2050-01-02"},
+			"start":  {"2050-01-01"},
+			"end":    {"2050-01-02"},
+			"adults": {"2"},
 		},
 		expectedStatusCode: http.StatusSeeOther,
 	},
@@ -410,37 +697,147 @@ var testPostAvailabilityData = []struct {
 		postedData: url.Values{
 			"start":   {"2040-01-01"},
 			"end":     {"2040-01-02"},
+			"adults":  {"2"},
 			"room_id": {"1"},
 		},
 		expectedStatusCode: http.StatusOK,
 	},
+	{
+		name: "two rooms available together",
+		postedData: url.Values{
+			"start":  {"2040-01-01"},
+			"end":    {"2040-01-02"},
+			"adults": {"2"},
+			"rooms":  {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "not enough rooms for group",
+		postedData: url.Values{
+			"start":  {"2040-01-01"},
+			"end":    {"2040-01-02"},
+			"adults": {"2"},
+			"rooms":  {"3"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "booking rules rule out every room",
+		postedData: url.Values{
+			"start":  {"2041-01-01"},
+			"end":    {"2041-01-20"},
+			"adults": {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "This room has a maximum stay of 7 nights",
+	},
+	{
+		name: "no room sleeps that many",
+		postedData: url.Values{
+			"start":    {"2040-01-01"},
+			"end":      {"2040-01-02"},
+			"adults":   {"4"},
+			"children": {"1"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/search-availability",
+	},
+	{
+		name: "group fits across two rooms",
+		postedData: url.Values{
+			"start":    {"2040-01-01"},
+			"end":      {"2040-01-02"},
+			"adults":   {"4"},
+			"children": {"2"},
+			"rooms":    {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "group too big for two rooms",
+		postedData: url.Values{
+			"start":  {"2040-01-01"},
+			"end":    {"2040-01-02"},
+			"adults": {"7"},
+			"rooms":  {"2"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/search-availability",
+	},
+	{
+		name: "no adults",
+		postedData: url.Values{
+			"start":    {"2040-01-01"},
+			"end":      {"2040-01-02"},
+			"adults":   {"0"},
+			"children": {"1"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/search-availability",
+	},
 	{
 		name:               "empty post body",
 		postedData:         url.Values{},
-		expectedStatusCode: http.StatusSeeOther,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Invalid date",
 	},
 	{
 		name: "start date wrong format",
 		postedData: url.Values{
 			"start":   {"invalid"},
 			"end":     {"2040-01-02"},
+			"adults":  {"2"},
 			"room_id": {"1"},
 		},
-		expectedStatusCode: http.StatusSeeOther,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Invalid date",
 	},
 	{
 		name: "end date wrong format",
 		postedData: url.Values{
-			"start": {"2040-01-01"},
-			"end":   {"invalid"},
+			"start":  {"2040-01-01"},
+			"end":    {"invalid"},
+			"adults": {"2"},
 		},
-		expectedStatusCode: http.StatusSeeOther,
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Invalid date",
+	},
+	{
+		name: "arrival in the past",
+		postedData: url.Values{
+			"start":  {"2000-01-01"},
+			"end":    {"2000-01-02"},
+			"adults": {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Date can&#39;t be in the past",
+	},
+	{
+		name: "stay too long",
+		postedData: url.Values{
+			"start":  {"2040-01-01"},
+			"end":    {"2040-06-01"},
+			"adults": {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Dates can be at most 90 days apart",
 	},
 	{
 		name: "database query fails",
 		postedData: url.Values{
-			"start": {"2060-01-01"},
-			"end":   {"2060-01-02"},
+			"start":  {"2060-01-01"},
+			"end":    {"2060-01-02"},
+			"adults": {"2"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "pricing fails",
+		postedData: url.Values{
+			"start":  {"2045-01-01"},
+			"end":    {"2045-01-02"},
+			"adults": {"2"},
 		},
 		expectedStatusCode: http.StatusSeeOther,
 	},
@@ -466,6 +863,17 @@ func TestPostAvailability(t *testing.T) {
 		if rr.Code != e.expectedStatusCode {
 			t.Errorf("%s gave wrong status code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
 		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("%s: expected location %s but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: expected to find %q but did not", e.name, e.expectedHTML)
+		}
 	}
 }
 
@@ -549,6 +957,28 @@ var chooseRoomTests = []struct {
 		expectedStatusCode: http.StatusSeeOther,
 		expectedLocation:   "/make-reservation",
 	},
+	{
+		name: "room-held-by-someone-else",
+		reservation: models.Reservation{
+			RoomID:    1,
+			StartDate: time.Date(2055, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2055, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		url:                "/choose-room/1",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/search-availability",
+	},
+	{
+		name: "hold-fails",
+		reservation: models.Reservation{
+			RoomID:    1,
+			StartDate: time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2060, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		url:                "/choose-room/1",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/",
+	},
 	{
 		name:               "reservation-not-in-session",
 		reservation:        models.Reservation{},
@@ -595,6 +1025,23 @@ func TestChooseRoom(t *testing.T) {
 	}
 }
 
+// TestChooseRoomHoldsRoom tests that picking a room holds it and remembers the hold in the session
+func TestChooseRoomHoldsRoom(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/choose-room/1", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.RequestURI = "/choose-room/1"
+
+	session.Put(ctx, "reservation", models.Reservation{RoomID: 1})
+
+	rr := httptest.NewRecorder()
+	Repo.ChooseRoom(rr, req)
+
+	if session.GetInt(ctx, "hold_id") != 1 {
+		t.Errorf("expected hold 1 in the session but got %d", session.GetInt(ctx, "hold_id"))
+	}
+}
+
 // bookRoomTests is the data for the BookRoom handler tests
 var bookRoomTests = []struct {
 	name               string
@@ -611,6 +1058,11 @@ var bookRoomTests = []struct {
 		url:                "/book-room?s=2040-01-01&e=2040-01-02&id=4",
 		expectedStatusCode: http.StatusSeeOther,
 	},
+	{
+		name:               "bad-dates",
+		url:                "/book-room?s=2040-01-02&e=2040-01-01&id=1",
+		expectedStatusCode: http.StatusSeeOther,
+	},
 }
 
 // TestBookRoom tests the BookRoom handler
@@ -749,6 +1201,33 @@ var adminPostShowReservationTests = []struct {
 		expectedLocation:     "/admin/reservations-all",
 		expectedHTML:         "",
 	},
+	{
+		name: "invalid-phone",
+		url:  "/admin/reservations/all/1/show",
+		postedData: url.Values{
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"call me"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedLocation:     "/admin/reservations/all/1/show",
+		expectedHTML:         "",
+	},
+	{
+		name: "valid-data-from-filtered-list",
+		url:  "/admin/reservations/all/1/show",
+		postedData: url.Values{
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"555-555-5555"},
+			"list":       {"q=Smith&sort=last_name&dir=asc"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedLocation:     "/admin/reservations-all?dir=asc&q=Smith&sort=last_name",
+		expectedHTML:         "",
+	},
 	{
 		name: "valid-data-from-cal",
 		url:  "/admin/reservations/cal/1/show",
@@ -894,39 +1373,204 @@ func TestPostReservationCalendar(t *testing.T) {
 	}
 }
 
-var adminProcessReservationTests = []struct {
-	name                 string
-	queryParams          string
-	expectedResponseCode int
-	expectedLocation     string
-}{
-	{
-		name:                 "process-reservation",
-		queryParams:          "",
-		expectedResponseCode: http.StatusSeeOther,
-		expectedLocation:     "",
-	},
-	{
-		name:                 "process-reservation-back-to-cal",
-		queryParams:          "?y=2021&m=12",
-		expectedResponseCode: http.StatusSeeOther,
-		expectedLocation:     "",
+// TestAdminReservationsCalendarBlocks tests that blocks are listed on the calendar with their reasons
+func TestAdminReservationsCalendarBlocks(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/reservations-calendar", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "user_id", 1)
+	session.Put(ctx, "access_level", models.AccessManager)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminReservationsCalendar(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code %d but got %d", http.StatusOK, rr.Code)
+	}
+	for _, want := range []string{"Renovation", "New bathroom", `action="/admin/blocks"`} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected to find %s but did not", want)
+		}
+	}
+}
+
+// TestAdminReservationsCalendarRecurringBlocks tests that recurring blocks are expanded onto the calendar
+func TestAdminReservationsCalendarRecurringBlocks(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/reservations-calendar?y=2020&m=1", nil)
+	req = req.WithContext(getCtx(req))
+
+	rr := httptest.NewRecorder()
+	Repo.AdminReservationsCalendar(rr, req)
+
+	// january 2020 has four mondays, and both rooms are closed on them
+	closed := strings.Count(rr.Body.String(), `title="Closed on Mondays">C</span>`)
+	if closed != 8 {
+		t.Errorf("expected 8 closed days but got %d", closed)
+	}
+}
+
+func TestAdminReservationsCalendarExternal(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/reservations-calendar?y=2050&m=7", nil)
+	req = req.WithContext(getCtx(req))
+
+	rr := httptest.NewRecorder()
+	Repo.AdminReservationsCalendar(rr, req)
+
+	// three nights booked on airbnb, which can't be unblocked from here
+	external := strings.Count(rr.Body.String(), `title="Booked on Airbnb">E</span>`)
+	if external != 3 {
+		t.Errorf("expected 3 nights booked elsewhere but got %d", external)
+	}
+}
+
+var adminPostBlockTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+	expectedError      string
+}{
+	{
+		"valid",
+		url.Values{"room_id": {"1"}, "block_start": {"2050-03-01"}, "block_end": {"2050-03-15"}, "reason": {"Renovation"}, "y": {"2050"}, "m": {"03"}},
+		http.StatusSeeOther, "/admin/reservations-calendar?y=2050&m=03", "",
+	},
+	{
+		"no-month",
+		url.Values{"room_id": {"1"}, "block_start": {"2050-03-01"}, "block_end": {"2050-03-15"}, "reason": {"Renovation"}},
+		http.StatusSeeOther, "/admin/reservations-calendar", "",
+	},
+	{
+		"no-room",
+		url.Values{"block_start": {"2050-03-01"}, "block_end": {"2050-03-15"}, "reason": {"Renovation"}},
+		http.StatusSeeOther, "/admin/reservations-calendar", "Pick the room to block",
+	},
+	{
+		"bad-date",
+		url.Values{"room_id": {"1"}, "block_start": {"March"}, "block_end": {"2050-03-15"}, "reason": {"Renovation"}},
+		http.StatusSeeOther, "/admin/reservations-calendar", "Give the dates of the block as yyyy-mm-dd",
+	},
+	{
+		"ends-before-start",
+		url.Values{"room_id": {"1"}, "block_start": {"2050-03-15"}, "block_end": {"2050-03-01"}, "reason": {"Renovation"}},
+		http.StatusSeeOther, "/admin/reservations-calendar", "The block must end after it starts",
+	},
+	{
+		"no-reason",
+		url.Values{"room_id": {"1"}, "block_start": {"2050-03-01"}, "block_end": {"2050-03-15"}, "reason": {" "}},
+		http.StatusSeeOther, "/admin/reservations-calendar", "Give a reason for the block",
+	},
+	{
+		"room-booked",
+		url.Values{"room_id": {"1"}, "block_start": {"2055-01-01"}, "block_end": {"2055-01-15"}, "reason": {"Renovation"}},
+		http.StatusSeeOther, "/admin/reservations-calendar", "The room is already booked for some of those dates",
+	},
+	{
+		"database-fails",
+		url.Values{"room_id": {"1"}, "block_start": {"2060-01-01"}, "block_end": {"2060-01-15"}, "reason": {"Renovation"}},
+		http.StatusInternalServerError, "", "",
 	},
 }
 
-func TestAdminProcessReservation(t *testing.T) {
-	for _, e := range adminProcessReservationTests {
-		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/process-reservation/cal/1/do%s", e.queryParams), nil)
+// TestAdminPostBlock tests blocking a room for a range of dates
+func TestAdminPostBlock(t *testing.T) {
+	for _, e := range adminPostBlockTests {
+		req, _ := http.NewRequest("POST", "/admin/blocks", strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		ctx := getCtx(req)
 		req = req.WithContext(ctx)
 
+		rr := httptest.NewRecorder()
+		Repo.AdminPostBlock(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected code %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("%s: expected location %s but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+		if session.GetString(ctx, "error") != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, session.GetString(ctx, "error"))
+		}
+	}
+}
+
+// TestAdminDeleteBlock tests removing a block and going back to the month it was in
+func TestAdminDeleteBlock(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/delete-block/3/do?y=2050&m=03", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"id": "3"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDeleteBlock(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/reservations-calendar?y=2050&m=03" {
+		t.Errorf("expected redirect to the calendar but got %d %s", rr.Code, actualLoc)
+	}
+	if session.GetString(ctx, "flash") != "Block removed" {
+		t.Errorf("expected the block to be removed")
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/delete-block/101/do", nil)
+	ctx = withURLParams(getCtx(req), map[string]string{"id": "101"})
+	req = req.WithContext(ctx)
+
+	rr = httptest.NewRecorder()
+	Repo.AdminDeleteBlock(rr, req)
+
+	if rr.Code != http.StatusSeeOther || session.GetString(ctx, "error") != "That block has already been removed" {
+		t.Errorf("expected a missing block to be reported, got %d and error %q", rr.Code, session.GetString(ctx, "error"))
+	}
+}
+
+var adminReservationStatusTests = []struct {
+	name             string
+	id               string
+	status           string
+	queryParams      string
+	expectedLocation string
+	expectedFlash    string
+	expectedError    string
+}{
+	{"confirm", "1", models.StatusConfirmed, "", "/admin/reservations-cal", "Reservation confirmed", ""},
+	{"back-to-cal", "1", models.StatusCancelled, "?y=2021&m=12", "/admin/reservations-calendar?y=2021&m=12", "Reservation cancelled", ""},
+	{"check-in", "4", models.StatusCheckedIn, "", "/admin/reservations-cal", "Guest checked in", ""},
+	{"no-show", "4", models.StatusNoShow, "", "/admin/reservations-cal", "Reservation marked as a no-show", ""},
+	{"check-out", "5", models.StatusCheckedOut, "", "/admin/reservations-cal", "Guest checked out", ""},
+	{"skip-confirming", "1", models.StatusCheckedIn, "", "/admin/reservations-cal", "", "A reservation that is Pending can't be marked Checked In"},
+	{"already-cancelled", "99", models.StatusConfirmed, "", "/admin/reservations-cal", "", "A reservation that is Cancelled can't be marked Confirmed"},
+	{"unknown-status", "1", "lost", "", "/admin/reservations-cal", "", "A reservation that is Pending can't be marked lost"},
+	{"missing", "101", models.StatusConfirmed, "", "/admin/reservations-cal", "", "Couldn't mark the reservation Confirmed"},
+}
+
+// TestAdminReservationStatus tests moving a reservation along its lifecycle, and that it can't skip a step
+func TestAdminReservationStatus(t *testing.T) {
+	for _, e := range adminReservationStatusTests {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/reservation-status/cal/%s/%s/do%s", e.id, e.status, e.queryParams), nil)
+		ctx := withURLParams(getCtx(req), map[string]string{"src": "cal", "id": e.id, "status": e.status})
+		req = req.WithContext(ctx)
+
 		rr := httptest.NewRecorder()
 
-		handler := http.HandlerFunc(Repo.AdminProcessReservation)
+		handler := http.HandlerFunc(Repo.AdminReservationStatus)
 		handler.ServeHTTP(rr, req)
 
 		if rr.Code != http.StatusSeeOther {
-			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc)
+		}
+		if flash := session.GetString(ctx, "flash"); flash != e.expectedFlash {
+			t.Errorf("failed %s: expected flash %q, but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := session.GetString(ctx, "error"); msg != e.expectedError {
+			t.Errorf("failed %s: expected error %q, but got %q", e.name, e.expectedError, msg)
 		}
 	}
 }
@@ -953,7 +1597,7 @@ var adminDeleteReservationTests = []struct {
 
 func TestAdminDeleteReservation(t *testing.T) {
 	for _, e := range adminDeleteReservationTests {
-		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/process-reservation/cal/1/do%s", e.queryParams), nil)
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/delete-reservation/cal/1/do%s", e.queryParams), nil)
 		ctx := getCtx(req)
 		req = req.WithContext(ctx)
 
@@ -968,11 +1612,2499 @@ func TestAdminDeleteReservation(t *testing.T) {
 	}
 }
 
-// gets the context
-func getCtx(req *http.Request) context.Context {
-	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
+// TestAdminDeleteReservationToTrash tests that a deleted reservation goes to the trash, leading back to the list
+// it was deleted from without the reason given for it
+func TestAdminDeleteReservationToTrash(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/delete-reservation/all/1/do?q=smith&reason=Booked+twice", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"src": "all", "id": "1"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDeleteReservation(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/reservations-all?q=smith" {
+		t.Errorf("expected redirect to the filtered list but got %d %s", rr.Code, actualLoc)
+	}
+	if session.GetString(ctx, "flash") != "Reservation moved to the trash" {
+		t.Errorf("expected the reservation to be moved to the trash, got flash %q", session.GetString(ctx, "flash"))
+	}
+}
+
+// TestAdminDeleteReservationFails tests that a manager is told when a reservation couldn't be moved to the trash
+func TestAdminDeleteReservationFails(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/delete-reservation/all/93/do", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"src": "all", "id": "93"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDeleteReservation(rr, req)
+
+	if session.GetString(ctx, "error") != "Couldn't move the reservation to the trash" || session.GetString(ctx, "flash") != "" {
+		t.Errorf("expected an error and no flash, got error %q and flash %q", session.GetString(ctx, "error"), session.GetString(ctx, "flash"))
+	}
+}
+
+// TestAdminDeleteReservationKeepsDeposit tests that a reservation moved to the trash keeps its deposit held,
+// so it can be restored as it was
+func TestAdminDeleteReservationKeepsDeposit(t *testing.T) {
+	provider := payments.NewFakeProvider("test-secret")
+	saved := app.Payments
+	app.Payments = provider
+	defer func() { app.Payments = saved }()
+
+	// reservation 2's deposit is stored as fake_1 for 2500
+	_, _ = provider.Authorize(payments.AuthorizeRequest{Amount: 2500, Currency: "USD", Source: "4242424242424242"})
+
+	req, _ := http.NewRequest("GET", "/admin/delete-reservation/all/2/do", nil)
+	req = req.WithContext(withURLParams(getCtx(req), map[string]string{"src": "all", "id": "2"}))
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDeleteReservation(rr, req)
+
+	_, err := provider.Capture("fake_1", 2500)
 	if err != nil {
-		log.Println(err)
+		t.Errorf("expected the deposit to still be held but got %s", err)
+	}
+}
+
+// adminRestoreReservationTests is the data for the AdminRestoreReservation handler tests
+var adminRestoreReservationTests = []struct {
+	name               string
+	id                 string
+	expectedStatusCode int
+	expectedFlash      string
+	expectedError      string
+}{
+	{"restored", "96", http.StatusSeeOther, "Reservation restored", ""},
+	{"room taken since", "95", http.StatusSeeOther, "", "The room has been booked or blocked for those dates since, so the reservation can't be restored"},
+	{"not in trash", "1", http.StatusSeeOther, "", "That reservation isn't in the trash"},
+	{"missing", "500", http.StatusInternalServerError, "", ""},
+}
+
+func TestAdminRestoreReservation(t *testing.T) {
+	for _, e := range adminRestoreReservationTests {
+		req, _ := http.NewRequest("GET", "/admin/restore-reservation/trash/"+e.id+"/do", nil)
+		ctx := withURLParams(getCtx(req), map[string]string{"src": "trash", "id": e.id})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		Repo.AdminRestoreReservation(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected code %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+		if rr.Code != http.StatusSeeOther {
+			continue
+		}
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != "/admin/reservations-trash" {
+			t.Errorf("%s: expected redirect to the trash but got %s", e.name, actualLoc)
+		}
+		if session.GetString(ctx, "flash") != e.expectedFlash || session.GetString(ctx, "error") != e.expectedError {
+			t.Errorf("%s: expected flash %q and error %q, got %q and %q", e.name, e.expectedFlash, e.expectedError,
+				session.GetString(ctx, "flash"), session.GetString(ctx, "error"))
+		}
+	}
+}
+
+// apiCreateReservationTests is the data for the APICreateReservation handler tests
+var apiCreateReservationTests = []struct {
+	name               string
+	body               string
+	expectedStatusCode int
+}{
+	{
+		name:               "valid-data",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555-555-5555","start_date":"2050-01-01","end_date":"2050-01-02","room_id":1}`,
+		expectedStatusCode: http.StatusCreated,
+	},
+	{
+		name:               "invalid-json",
+		body:               `{"first_name":`,
+		expectedStatusCode: http.StatusBadRequest,
+	},
+	{
+		name:               "invalid-data",
+		body:               `{"first_name":"J","last_name":"Smith","email":"john","start_date":"2050-01-01","end_date":"2050-01-02","room_id":1}`,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+	},
+	{
+		name:               "end-before-start",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","start_date":"2050-01-02","end_date":"2050-01-01","room_id":1}`,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+	},
+	{
+		name:               "with-guests",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","start_date":"2050-01-01","end_date":"2050-01-02","room_id":1,"adults":1,"children":1}`,
+		expectedStatusCode: http.StatusCreated,
+	},
+	{
+		name:               "too-many-guests",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","start_date":"2050-01-01","end_date":"2050-01-02","room_id":1,"adults":2,"children":1}`,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+	},
+	{
+		name:               "no-adults",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","start_date":"2050-01-01","end_date":"2050-01-02","room_id":1,"adults":0}`,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+	},
+	{
+		name:               "invalid-phone",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"call me","start_date":"2050-01-01","end_date":"2050-01-02","room_id":1}`,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+	},
+	{
+		name:               "stay-too-long",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","start_date":"2050-01-01","end_date":"2050-12-01","room_id":1}`,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+	},
+	{
+		name:               "breaks-booking-rules",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","start_date":"2041-01-01","end_date":"2041-01-03","room_id":1}`,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+	},
+	{
+		name:               "unknown-room",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","start_date":"2050-01-01","end_date":"2050-01-02","room_id":5}`,
+		expectedStatusCode: http.StatusNotFound,
+	},
+	{
+		name:               "room-taken",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","start_date":"2055-01-01","end_date":"2055-01-02","room_id":1}`,
+		expectedStatusCode: http.StatusConflict,
+	},
+	{
+		name:               "database-insert-fails",
+		body:               `{"first_name":"John","last_name":"Smith","email":"john@smith.com","start_date":"2050-01-01","end_date":"2050-01-02","room_id":2}`,
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+}
+
+// TestAPICreateReservation tests the APICreateReservation handler
+func TestAPICreateReservation(t *testing.T) {
+	for _, e := range apiCreateReservationTests {
+		req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(e.body))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.APICreateReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+
+		var j helpers.APIResponse
+		err := json.Unmarshal(rr.Body.Bytes(), &j)
+		if err != nil {
+			t.Errorf("%s: failed to parse json!", e.name)
+		}
+
+		if j.OK != (rr.Code == http.StatusCreated) {
+			t.Errorf("%s: envelope ok is %v for status %d", e.name, j.OK, rr.Code)
+		}
+	}
+}
+
+// apiUpdateReservationTests is the data for the APIUpdateReservation and APIDeleteReservation handler tests
+var apiUpdateReservationTests = []struct {
+	name               string
+	method             string
+	id                 string
+	body               string
+	expectedStatusCode int
+}{
+	{"patch-valid", "PATCH", "1", `{"first_name":"Jane","status":"confirmed"}`, http.StatusOK},
+	{"patch-same-status", "PATCH", "4", `{"status":"confirmed"}`, http.StatusOK},
+	{"patch-skipped-status", "PATCH", "1", `{"status":"checked-out"}`, http.StatusUnprocessableEntity},
+	{"patch-unknown-status", "PATCH", "1", `{"status":"lost"}`, http.StatusUnprocessableEntity},
+	{"patch-processed", "PATCH", "1", `{"processed":true}`, http.StatusOK},
+	{"patch-processed-again", "PATCH", "4", `{"processed":true}`, http.StatusOK},
+	{"patch-unprocessed", "PATCH", "4", `{"processed":false}`, http.StatusUnprocessableEntity},
+	{"patch-still-unprocessed", "PATCH", "1", `{"processed":false}`, http.StatusOK},
+	{"patch-invalid-email", "PATCH", "1", `{"email":"jane"}`, http.StatusUnprocessableEntity},
+	{"patch-invalid-phone", "PATCH", "1", `{"phone":"call me"}`, http.StatusUnprocessableEntity},
+	{"patch-invalid-json", "PATCH", "1", `{`, http.StatusBadRequest},
+	{"patch-missing", "PATCH", "500", `{}`, http.StatusNotFound},
+	{"delete-valid", "DELETE", "1", "", http.StatusNoContent},
+	{"delete-missing", "DELETE", "500", "", http.StatusNotFound},
+	{"delete-in-trash", "DELETE", "96", "", http.StatusNotFound},
+	{"patch-in-trash", "PATCH", "96", `{"first_name":"Jane"}`, http.StatusNotFound},
+	{"delete-bad-id", "DELETE", "fish", "", http.StatusBadRequest},
+}
+
+// TestAPIUpdateReservation tests the APIUpdateReservation and APIDeleteReservation handlers
+func TestAPIUpdateReservation(t *testing.T) {
+	for _, e := range apiUpdateReservationTests {
+		req, _ := http.NewRequest(e.method, "/api/v1/reservations/"+e.id, strings.NewReader(e.body))
+		ctx := withURLParams(getCtx(req), map[string]string{"id": e.id})
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.APIUpdateReservation)
+		if e.method == "DELETE" {
+			handler = Repo.APIDeleteReservation
+		}
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+	}
+}
+
+// TestAPIUpdateReservationFailedCapture tests that a status change that fails leaves the guest details alone
+func TestAPIUpdateReservationFailedCapture(t *testing.T) {
+	saved := app.Payments
+	app.Payments = payments.NewFakeProvider("test-secret")
+	defer func() { app.Payments = saved }()
+
+	recorder := &actorRecorder{DatabaseRepo: Repo.DB}
+	savedDB := Repo.DB
+	Repo.DB = recorder
+	defer func() { Repo.DB = savedDB }()
+
+	// the provider has never seen reservation 2's deposit, so it can't be captured
+	req, _ := http.NewRequest("PATCH", "/api/v1/reservations/2", strings.NewReader(`{"first_name":"Jane","processed":true}`))
+	req = req.WithContext(withURLParams(getCtx(req), map[string]string{"id": "2"}))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	Repo.APIUpdateReservation(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected code %d but got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Couldn't capture the deposit") {
+		t.Errorf("expected the failed capture to be reported, got %s", rr.Body.String())
+	}
+	if len(recorder.changes) != 0 {
+		t.Errorf("expected nothing to be saved, got %v", recorder.changes)
+	}
+}
+
+// TestAPIReservationProcessed tests that reservations still say whether they were processed
+func TestAPIReservationProcessed(t *testing.T) {
+	tests := []struct {
+		status    string
+		confirmed bool
+		expected  bool
+	}{
+		{models.StatusPending, false, false},
+		{models.StatusConfirmed, true, true},
+		{models.StatusCheckedIn, true, true},
+		{models.StatusCancelled, false, false},
+		{models.StatusCancelled, true, true},
+	}
+
+	for _, e := range tests {
+		res := models.Reservation{Status: e.status}
+		if e.confirmed {
+			res.ConfirmedAt = time.Date(2050, 6, 1, 0, 0, 0, 0, time.UTC)
+		}
+		if got := toAPIReservation(res).Processed; got != e.expected {
+			t.Errorf("%s (confirmed %v): expected processed %v but got %v", e.status, e.confirmed, e.expected, got)
+		}
+	}
+}
+
+// adminPostAPITokenTests is the data for the AdminPostAPIToken handler tests
+var adminPostAPITokenTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
+}{
+	{
+		name: "valid-data",
+		postedData: url.Values{
+			"name":   {"channel manager"},
+			"scopes": {"reservations:read", "blocks:manage"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "it will not be shown again",
+	},
+	{
+		name: "missing-name",
+		postedData: url.Values{
+			"scopes": {"reservations:read"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "This field cannot be blank",
+	},
+	{
+		name: "missing-scopes",
+		postedData: url.Values{
+			"name": {"channel manager"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Choose at least one scope",
+	},
+	{
+		name: "unknown-scope",
+		postedData: url.Values{
+			"name":   {"channel manager"},
+			"scopes": {"everything"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Unknown scope everything",
+	},
+	{
+		name: "database-insert-fails",
+		postedData: url.Values{
+			"name":   {"fail"},
+			"scopes": {"reservations:read"},
+		},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+}
+
+// TestAdminPostAPIToken tests the AdminPostAPIToken handler
+func TestAdminPostAPIToken(t *testing.T) {
+	for _, e := range adminPostAPITokenTests {
+		req, _ := http.NewRequest("POST", "/admin/tokens", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostAPIToken)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+
+		if e.expectedHTML != "" {
+			html := rr.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+			}
+		}
+	}
+}
+
+// TestAdminRevokeAPIToken tests the AdminRevokeAPIToken handler
+func TestAdminRevokeAPIToken(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/revoke-token/1/do", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.AdminRevokeAPIToken)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("revoke token returned wrong response code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+
+	actualLoc, _ := rr.Result().Location()
+	if actualLoc.String() != "/admin/tokens" {
+		t.Errorf("revoke token: expected location /admin/tokens, but got location %s", actualLoc.String())
+	}
+}
+
+var adminRepriceReservationTests = []struct {
+	name               string
+	id                 string
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{"reprice", "1", http.StatusSeeOther, "/admin/reservations/new/1/show"},
+	{"reservation-not-found", "101", http.StatusInternalServerError, ""},
+	{"save-fails", "97", http.StatusInternalServerError, ""},
+}
+
+// TestAdminRepriceReservation tests the AdminRepriceReservation handler
+func TestAdminRepriceReservation(t *testing.T) {
+	for _, e := range adminRepriceReservationTests {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/reprice-reservation/new/%s/do", e.id), nil)
+		ctx := withURLParams(getCtx(req), map[string]string{"src": "new", "id": e.id})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminRepriceReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+	}
+}
+
+// adminShowReservationRoleTests checks which buttons each role sees on the reservation page
+var adminShowReservationRoleTests = []struct {
+	name        string
+	accessLevel int
+	shown       []string
+	hidden      []string
+}{
+	{"read-only", models.AccessReadOnly, []string{"Nightly rate"}, []string{`value="Save"`, "Mark as Confirmed", "Re-price", "Delete Reservation"}},
+	{"front-desk", models.AccessFrontDesk, []string{`value="Save"`, "Mark as Confirmed", "Mark as Cancelled"}, []string{"Re-price", "Delete Reservation", "Mark as Checked In"}},
+	{"manager", models.AccessManager, []string{`value="Save"`, "Mark as Confirmed", "Re-price", "Delete Reservation"}, nil},
+}
+
+// TestAdminShowReservationRoles tests that the reservation page hides actions a role can't perform
+func TestAdminShowReservationRoles(t *testing.T) {
+	for _, e := range adminShowReservationRoleTests {
+		req, _ := http.NewRequest("GET", "/admin/reservations/new/1/show", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.RequestURI = "/admin/reservations/new/1/show"
+		session.Put(ctx, "access_level", e.accessLevel)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminShowReservation)
+		handler.ServeHTTP(rr, req)
+
+		html := rr.Body.String()
+		for _, x := range e.shown {
+			if !strings.Contains(html, x) {
+				t.Errorf("%s: expected to find %s but did not", e.name, x)
+			}
+		}
+		for _, x := range e.hidden {
+			if strings.Contains(html, x) {
+				t.Errorf("%s: found %s but should not have", e.name, x)
+			}
+		}
+	}
+}
+
+var adminReservationListTests = []struct {
+	name               string
+	url                string
+	expectedStatusCode int
+	shown              []string
+	hidden             []string
+}{
+	{
+		"latest-arrivals-first", "/admin/reservations-all", http.StatusOK,
+		[]string{
+			"Smith",
+			`<a href="/admin/reservations-all?dir=asc&amp;sort=start_date">Arrival</a>`,
+			"&darr;",
+			`href="/admin/reservations/all/1/show?dir=desc&amp;sort=start_date"`,
+		},
+		[]string{"Previous", "Next"},
+	},
+	{
+		"soonest-new-first", "/admin/reservations-new", http.StatusOK,
+		[]string{`href="/admin/reservations/new/1/show?dir=asc&amp;sort=start_date"`, "&uarr;"},
+		[]string{`name="status"`},
+	},
+	{
+		"filtered", "/admin/reservations-all?q=Smith&room=1&from=2050-07-01&to=2050-07-31&status=checked-in&sort=last_name&dir=asc", http.StatusOK,
+		[]string{
+			`value="Smith"`,
+			`<option value="1" selected>`,
+			`value="2050-07-01"`,
+			`value="2050-07-31"`,
+			`<option value="checked-in" selected>`,
+			`<a href="/admin/reservations-all?dir=desc&amp;from=2050-07-01&amp;q=Smith&amp;room=1&amp;sort=last_name&amp;status=checked-in&amp;to=2050-07-31">Last Name</a>`,
+		},
+		nil,
+	},
+	{"no-matches", "/admin/reservations-all?q=nobody", http.StatusOK, []string{"No reservations match."}, []string{"Next"}},
+	{
+		"first-page", "/admin/reservations-all?q=many", http.StatusOK,
+		[]string{`href="/admin/reservations-all?after=50%3A2050-07-01&amp;dir=desc&amp;q=many&amp;sort=start_date" class`},
+		[]string{"Previous"},
+	},
+	{
+		"next-page", "/admin/reservations-all?q=many&after=50:2050-07-01", http.StatusOK,
+		[]string{
+			`href="/admin/reservations-all?before=51%3A2050-07-01&amp;dir=desc&amp;q=many&amp;sort=start_date" class`,
+			`href="/admin/reservations-all?after=100%3A2050-07-01&amp;dir=desc&amp;q=many&amp;sort=start_date" class`,
+		},
+		nil,
+	},
+	{
+		"last-page", "/admin/reservations-all?after=50:2050-07-01", http.StatusOK,
+		[]string{`href="/admin/reservations-all?before=51%3A2050-07-01&amp;dir=desc&amp;sort=start_date" class`},
+		[]string{"Next"},
+	},
+	{"bad-page", "/admin/reservations-all?after=nonsense", http.StatusOK, []string{"Smith"}, []string{"Previous"}},
+	{"database-error", "/admin/reservations-all?q=fail", http.StatusInternalServerError, nil, nil},
+}
+
+// TestAdminReservationLists tests filtering, sorting and paging the reservation lists
+func TestAdminReservationLists(t *testing.T) {
+	for _, e := range adminReservationListTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		req = req.WithContext(getCtx(req))
+
+		rr := httptest.NewRecorder()
+		if strings.HasPrefix(e.url, "/admin/reservations-new") {
+			Repo.AdminNewReservations(rr, req)
+		} else {
+			Repo.AdminAllReservations(rr, req)
+		}
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+
+		html := rr.Body.String()
+		for _, x := range e.shown {
+			if !strings.Contains(html, x) {
+				t.Errorf("%s: expected to find %s but did not", e.name, x)
+			}
+		}
+		for _, x := range e.hidden {
+			if strings.Contains(html, x) {
+				t.Errorf("%s: found %s but should not have", e.name, x)
+			}
+		}
+	}
+}
+
+// TestAdminShowReservationFromList tests that a reservation opened from a filtered list leads back to it
+func TestAdminShowReservationFromList(t *testing.T) {
+	uri := "/admin/reservations/all/1/show?q=Smith&sort=last_name&dir=asc"
+	req, _ := http.NewRequest("GET", uri, nil)
+	req = req.WithContext(getCtx(req))
+	req.RequestURI = uri
+
+	rr := httptest.NewRecorder()
+	Repo.AdminShowReservation(rr, req)
+
+	html := rr.Body.String()
+	for _, x := range []string{
+		`href="/admin/reservations-all?dir=asc&amp;q=Smith&amp;sort=last_name"`,
+		`name="list" value="dir=asc&amp;q=Smith&amp;sort=last_name"`,
+	} {
+		if !strings.Contains(html, x) {
+			t.Errorf("expected to find %s but did not", x)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/reservation-status/all/1/confirmed/do?q=Smith&sort=last_name&dir=asc", nil)
+	req = req.WithContext(withURLParams(getCtx(req), map[string]string{"src": "all", "id": "1", "status": models.StatusConfirmed}))
+
+	rr = httptest.NewRecorder()
+	Repo.AdminReservationStatus(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if actualLoc.String() != "/admin/reservations-all?dir=asc&q=Smith&sort=last_name" {
+		t.Errorf("expected confirming to lead back to the list, but got location %s", actualLoc.String())
+	}
+}
+
+// TestReservationFilter tests reading a reservation list's filter from its query
+func TestReservationFilter(t *testing.T) {
+	q, _ := url.ParseQuery("q=+Smith+&room=2&from=2050-07-01&to=bad&status=maybe&sort=guests&dir=desc&before=7:3")
+	f := reservationFilter(q, "new")
+
+	if f.Search != "Smith" || f.RoomID != 2 || f.From.Format("2006-01-02") != "2050-07-01" || !f.To.IsZero() {
+		t.Errorf("filter read wrong: %+v", f)
+	}
+	if f.Status != "" {
+		t.Errorf("expected an unknown status to be dropped, got %q", f.Status)
+	}
+	if f.Sort != models.SortGuests || !f.Desc {
+		t.Errorf("expected to sort by guests, most first, got %s desc=%v", f.Sort, f.Desc)
+	}
+	if f.Cursor != (models.Cursor{Value: "3", ID: 7, Backward: true}) {
+		t.Errorf("cursor read wrong: %+v", f.Cursor)
+	}
+
+	// reading the filter's own values gives it back
+	if again := reservationFilter(f.Values(), "new"); again != f {
+		t.Errorf("expected %+v but got %+v", f, again)
+	}
+
+	f = reservationFilter(url.Values{"sort": {"password"}, "dir": {"asc"}}, "all")
+	if f.Sort != models.SortArrival || !f.Desc {
+		t.Errorf("expected an unknown sort to show the latest arrivals first, got %s desc=%v", f.Sort, f.Desc)
+	}
+}
+
+// TestAdminExportReservations tests downloading the reservations list as CSV and XLSX
+func TestAdminExportReservations(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/reservations-all/export.csv?q=Smith&after=9:2050-07-01", nil)
+	req = req.WithContext(withURLParams(getCtx(req), map[string]string{"src": "all", "format": "csv"}))
+
+	rr := httptest.NewRecorder()
+	Repo.AdminExportReservations(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("export returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Disposition"), `attachment; filename="reservations-all-`) {
+		t.Errorf("expected the export to download, got %q", rr.Header().Get("Content-Disposition"))
+	}
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected a heading and 1 reservation, got %d rows", len(records))
+	}
+	// the whole list is exported, not the page the list was on
+	expected := []string{"1", "", "John", "Smith", "john@smith.com", "", "General's Quarters",
+		"2050-07-01", "2050-07-04", "3", "2", "0", "Confirmed", "", "0.00", "", ""}
+	if strings.Join(records[1], "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %v but got %v", expected, records[1])
+	}
+
+	// every batch is written, until the list runs out
+	req, _ = http.NewRequest("GET", "/admin/reservations-all/export.xlsx?q=many", nil)
+	req = req.WithContext(withURLParams(getCtx(req), map[string]string{"src": "all", "format": "xlsx"}))
+
+	rr = httptest.NewRecorder()
+	Repo.AdminExportReservations(rr, req)
+
+	if rr.Header().Get("Content-Type") != xlsx.ContentType {
+		t.Errorf("expected an xlsx file, got %q", rr.Header().Get("Content-Type"))
+	}
+	z, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range z.File {
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		r, _ := f.Open()
+		sheet, _ := io.ReadAll(r)
+		if n := strings.Count(string(sheet), "<row "); n != 1001 {
+			t.Errorf("expected a heading and 1000 reservations, got %d rows", n)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/reservations-all/export.csv?q=fail", nil)
+	req = req.WithContext(withURLParams(getCtx(req), map[string]string{"src": "all", "format": "csv"}))
+
+	rr = httptest.NewRecorder()
+	Repo.AdminExportReservations(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("export with a database error returned wrong response code: got %d, wanted %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+// TestDefuse tests that text in a CSV export can't be read as a formula
+func TestDefuse(t *testing.T) {
+	tests := map[string]string{
+		"Smith":             "Smith",
+		"=HYPERLINK(\"x\")": "'=HYPERLINK(\"x\")",
+		"@SUM(A1)":          "'@SUM(A1)",
+		"-2+3":              "-2+3",
+		"+1 (555) 555-5555": "+1 (555) 555-5555",
+		"+cmd":              "'+cmd",
+		"":                  "",
+	}
+
+	for s, expected := range tests {
+		if got := defuse(s); got != expected {
+			t.Errorf("defuse(%q): expected %q but got %q", s, expected, got)
+		}
+	}
+}
+
+// importUpload builds a request uploading a CSV file of the kind given to the import page
+func importUpload(kind, contents string) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	_ = mw.WriteField("kind", kind)
+	if contents != "" {
+		fw, _ := mw.CreateFormFile("file", "bookings.csv")
+		_, _ = fw.Write([]byte(contents))
+	}
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", "/admin/import", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req.WithContext(getCtx(req))
+}
+
+// TestAdminPostImport tests checking a file to import and then importing it
+func TestAdminPostImport(t *testing.T) {
+	file := "room,first_name,last_name,email,start_date,end_date\n" +
+		"1,John,Smith,john@smith.com,2019-07-01,2019-07-04\n" +
+		"1,Jane,Doe,jane@doe.com,2019-07-02,2019-07-05\n"
+
+	req := importUpload("reservations", file)
+	rr := httptest.NewRecorder()
+	Repo.AdminPostImport(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("checking the file returned wrong response code: got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+	html := rr.Body.String()
+	for _, want := range []string{"Checked 2 rows of reservations", "1 can be imported", "Clash with line 2", `value="Import 1 reservations"`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("expected the report to show %q", want)
+		}
+	}
+
+	// the rows that passed wait in the session to be imported
+	ctx := req.Context()
+	req, _ = http.NewRequest("POST", "/admin/import/commit", nil)
+	req = req.WithContext(ctx)
+	rr = httptest.NewRecorder()
+	Repo.AdminPostImportCommit(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if actualLoc.String() != "/admin/reservations-all" || session.GetString(ctx, "flash") != "Imported 1 reservations" {
+		t.Errorf("expected the reservation to be imported, got %s and flash %q", actualLoc, session.GetString(ctx, "flash"))
+	}
+
+	// a second import finds nothing waiting
+	rr = httptest.NewRecorder()
+	Repo.AdminPostImportCommit(rr, req)
+
+	actualLoc, _ = rr.Result().Location()
+	if actualLoc.String() != "/admin/import" || session.GetString(ctx, "error") != "There's nothing to import; check the file again" {
+		t.Errorf("expected nothing to import, got %s and error %q", actualLoc, session.GetString(ctx, "error"))
+	}
+}
+
+func TestAdminPostImportErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		kind          string
+		file          string
+		expectedError string
+	}{
+		{"no file", "reservations", "", "Choose a CSV file to import"},
+		{"missing column", "blocks", "room,start_date\n", "The file couldn't be read: the file has no end_date column; it needs room, start_date, end_date, reason"},
+	}
+
+	for _, e := range tests {
+		req := importUpload(e.kind, e.file)
+		rr := httptest.NewRecorder()
+		Repo.AdminPostImport(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != "/admin/import" || session.GetString(req.Context(), "error") != e.expectedError {
+			t.Errorf("%s: expected error %q, got %s and error %q", e.name, e.expectedError, actualLoc, session.GetString(req.Context(), "error"))
+		}
+	}
+
+	// a block whose nights were taken after the file was checked stops the whole import
+	req := importUpload("blocks", "room,start_date,end_date,reason\n2,2048-01-01,2048-01-04,Closed\n")
+	Repo.AdminPostImport(httptest.NewRecorder(), req)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminPostImportCommit(rr, req)
+
+	expected := "Nothing was imported. line 2: the room was booked after the file was checked"
+	if session.GetString(req.Context(), "error") != expected {
+		t.Errorf("expected error %q, got %q", expected, session.GetString(req.Context(), "error"))
+	}
+}
+
+var postGuestLookupTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+	expectedHTML       string
+}{
+	{
+		name: "found",
+		postedData: url.Values{
+			"confirmation_code": {"ABC123"},
+			"email":             {"john@smith.com"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation",
+	},
+	{
+		name: "wrong-email",
+		postedData: url.Values{
+			"confirmation_code": {"ABC123"},
+			"email":             {"jane@smith.com"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "We couldn&#39;t find a booking",
+	},
+	{
+		name: "missing-code",
+		postedData: url.Values{
+			"email": {"john@smith.com"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "This field cannot be blank",
+	},
+}
+
+// TestPostGuestLookup tests the PostGuestLookup handler
+func TestPostGuestLookup(t *testing.T) {
+	for _, e := range postGuestLookupTests {
+		req, _ := http.NewRequest("POST", "/my-reservation/lookup", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostGuestLookup)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := rr.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+			}
+		}
+	}
+}
+
+var guestReservationTests = []struct {
+	name               string
+	url                string
+	handler            func(*Repository, http.ResponseWriter, *http.Request)
+	reservationID      int
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+	expectedHTML       string
+}{
+	{"show", "/my-reservation", (*Repository).GuestReservation, 1, nil, http.StatusOK, "", "ABC123"},
+	{"show-cancelled", "/my-reservation", (*Repository).GuestReservation, 99, nil, http.StatusOK, "", "This booking was cancelled"},
+	{"show-not-looked-up", "/my-reservation", (*Repository).GuestReservation, 0, nil, http.StatusSeeOther, "/my-reservation/lookup", ""},
+	{"show-missing-reservation", "/my-reservation", (*Repository).GuestReservation, 101, nil, http.StatusSeeOther, "/my-reservation/lookup", ""},
+	{
+		"change-dates", "/my-reservation/change-dates", (*Repository).PostGuestChangeDates, 1,
+		url.Values{"start": {"2050-01-01"}, "end": {"2050-01-03"}},
+		http.StatusSeeOther, "/my-reservation", "",
+	},
+	{
+		"change-dates-unavailable", "/my-reservation/change-dates", (*Repository).PostGuestChangeDates, 1,
+		url.Values{"start": {"2055-01-01"}, "end": {"2055-01-03"}},
+		http.StatusSeeOther, "/my-reservation", "",
+	},
+	{
+		"change-dates-too-short", "/my-reservation/change-dates", (*Repository).PostGuestChangeDates, 1,
+		url.Values{"start": {"2046-01-01"}, "end": {"2046-01-02"}},
+		http.StatusOK, "", "This room has a minimum stay of 3 nights",
+	},
+	{
+		"change-dates-end-before-start", "/my-reservation/change-dates", (*Repository).PostGuestChangeDates, 1,
+		url.Values{"start": {"2050-01-03"}, "end": {"2050-01-01"}},
+		http.StatusOK, "", "End date must be after start date",
+	},
+	{
+		"change-dates-in-past", "/my-reservation/change-dates", (*Repository).PostGuestChangeDates, 1,
+		url.Values{"start": {"2000-01-01"}, "end": {"2000-01-03"}},
+		http.StatusOK, "", "Date can&#39;t be in the past",
+	},
+	{
+		"change-dates-invalid", "/my-reservation/change-dates", (*Repository).PostGuestChangeDates, 1,
+		url.Values{"start": {"invalid"}, "end": {"2050-01-03"}},
+		http.StatusOK, "", "Invalid date",
+	},
+	{"cancel", "/my-reservation/cancel", (*Repository).PostGuestCancel, 1, url.Values{}, http.StatusSeeOther, "/my-reservation", ""},
+	{"cancel-already-cancelled", "/my-reservation/cancel", (*Repository).PostGuestCancel, 99, url.Values{}, http.StatusSeeOther, "/my-reservation", ""},
+	{"cancel-not-looked-up", "/my-reservation/cancel", (*Repository).PostGuestCancel, 0, url.Values{}, http.StatusSeeOther, "/my-reservation/lookup", ""},
+}
+
+// TestGuestReservation tests the guest's view, change dates and cancel handlers
+func TestGuestReservation(t *testing.T) {
+	for _, e := range guestReservationTests {
+		var req *http.Request
+		if e.postedData != nil {
+			req, _ = http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req, _ = http.NewRequest("GET", e.url, nil)
+		}
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		if e.reservationID > 0 {
+			session.Put(ctx, "manage_reservation_id", e.reservationID)
+		}
+
+		rr := httptest.NewRecorder()
+
+		e.handler(Repo, rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := rr.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+			}
+		}
+	}
+}
+
+// datesRecorder keeps the dates a reservation was last moved to, and counts the writes to its price and payments
+type datesRecorder struct {
+	repository.DatabaseRepo
+	start, end    time.Time
+	priceWrites   int
+	paymentWrites int
+}
+
+func (r *datesRecorder) UpdateReservationDates(id int, start, end time.Time, actor models.Actor) error {
+	r.start, r.end = start, end
+	return r.DatabaseRepo.UpdateReservationDates(id, start, end, actor)
+}
+
+func (r *datesRecorder) RepriceReservation(res models.Reservation, actor models.Actor) error {
+	r.priceWrites++
+	return r.DatabaseRepo.RepriceReservation(res, actor)
+}
+
+func (r *datesRecorder) ConfirmReservationPayment(p models.Payment) (int, error) {
+	r.paymentWrites++
+	return r.DatabaseRepo.ConfirmReservationPayment(p)
+}
+
+func (r *datesRecorder) UpdatePayment(p models.Payment) error {
+	r.paymentWrites++
+	return r.DatabaseRepo.UpdatePayment(p)
+}
+
+// TestGuestChangeDatesKeepsPrice tests that a stay moved by the guest keeps the price and deposit it was booked at
+func TestGuestChangeDatesKeepsPrice(t *testing.T) {
+	recorder := &datesRecorder{DatabaseRepo: Repo.DB}
+	saved := Repo.DB
+	Repo.DB = recorder
+	defer func() { Repo.DB = saved }()
+
+	savedPayments := app.Payments
+	app.Payments = payments.NewFakeProvider("test-secret")
+	defer func() { app.Payments = savedPayments }()
+
+	// reservation 2 is booked at 10000 with a deposit of 2500 held as fake_1
+	postedData := url.Values{"start": {"2046-01-01"}, "end": {"2046-01-04"}}
+	req, _ := http.NewRequest("POST", "/my-reservation/change-dates", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	session.Put(ctx, "manage_reservation_id", 2)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.PostGuestChangeDates(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect but got %d", rr.Code)
+	}
+
+	start := time.Date(2046, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2046, 1, 4, 0, 0, 0, 0, time.UTC)
+	if !recorder.start.Equal(start) || !recorder.end.Equal(end) {
+		t.Errorf("expected the stay to move to 2046-01-01 - 2046-01-04 but got %s - %s", recorder.start, recorder.end)
+	}
+	if recorder.priceWrites != 0 {
+		t.Errorf("expected the price to be left for an admin to re-price but it was written %d times", recorder.priceWrites)
+	}
+	if recorder.paymentWrites != 0 {
+		t.Errorf("expected the deposit to be left as held but payments were written %d times", recorder.paymentWrites)
+	}
+
+	res, _ := Repo.DB.GetReservationByID(2)
+	resPayments, _ := Repo.DB.PaymentsForReservation(2)
+	held := 0
+	for _, p := range resPayments {
+		if p.Status == payments.StatusAuthorized {
+			held += p.Amount
+		}
+	}
+	if held != 2500 || held != Repo.depositFor(res.Total) {
+		t.Errorf("expected the deposit of 2500 to still cover the total of %d but %d is held", res.Total, held)
+	}
+}
+
+// TestSiteURL tests that links leaving the site are absolute
+func TestSiteURL(t *testing.T) {
+	if got := Repo.siteURL("/my-reservation/lookup"); got != "https://bookings.example.com/my-reservation/lookup" {
+		t.Errorf("expected an absolute lookup address but got %s", got)
+	}
+}
+
+// TestFeedURL tests that a room's feed address is built from the site's address, not the request's host
+func TestFeedURL(t *testing.T) {
+	room := models.Room{Slug: "generals-quarters", FeedToken: "gq-feed"}
+	if got := Repo.feedURL(room); got != "https://bookings.example.com/ical/generals-quarters.ics?token=gq-feed" {
+		t.Errorf("expected the feed address on the site's address but got %s", got)
+	}
+}
+
+// TestAdminConfirmReservationCapturesDeposit tests that confirming takes the deposit held for the reservation
+func TestAdminConfirmReservationCapturesDeposit(t *testing.T) {
+	provider := payments.NewFakeProvider("test-secret")
+	saved := app.Payments
+	app.Payments = provider
+	defer func() { app.Payments = saved }()
+
+	confirm := func() (*httptest.ResponseRecorder, context.Context) {
+		req, _ := http.NewRequest("GET", "/admin/reservation-status/new/2/confirmed/do", nil)
+		ctx := withURLParams(getCtx(req), map[string]string{"src": "new", "id": "2", "status": models.StatusConfirmed})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		Repo.AdminReservationStatus(rr, req)
+		return rr, ctx
+	}
+
+	// the provider has never seen fake_1, so the capture fails and the reservation stays pending
+	rr, ctx := confirm()
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected redirect but got %d", rr.Code)
+	}
+	if msg := session.GetString(ctx, "error"); msg != "Couldn't capture the deposit, so the reservation wasn't confirmed" {
+		t.Errorf("expected the failed capture to be reported, got %q", msg)
+	}
+
+	// reservation 2's deposit is stored as fake_1 for 2500
+	_, _ = provider.Authorize(payments.AuthorizeRequest{Amount: 2500, Currency: "USD", Source: "4242424242424242"})
+
+	rr, ctx = confirm()
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected redirect but got %d", rr.Code)
+	}
+	if flash := session.GetString(ctx, "flash"); flash != "Reservation confirmed" {
+		t.Errorf("expected the reservation to be confirmed, error was %q", session.GetString(ctx, "error"))
+	}
+
+	_, err := provider.Refund("fake_1", 2500)
+	if err != nil {
+		t.Errorf("expected the captured deposit to be refundable but got %s", err)
+	}
+	_, err = provider.Capture("fake_1", 2500)
+	if !errors.Is(err, payments.ErrInvalidState) {
+		t.Errorf("expected the deposit to have been captured already but got %v", err)
+	}
+}
+
+// TestNoPaymentProvider tests that without a payment provider no deposit is asked for, and deposits already
+// recorded can't be settled
+func TestNoPaymentProvider(t *testing.T) {
+	saved := app.Payments
+	app.Payments = nil
+	defer func() { app.Payments = saved }()
+
+	if deposit := Repo.depositFor(10000); deposit != 0 {
+		t.Errorf("expected no deposit but got %d", deposit)
+	}
+
+	// reservation 2 has a deposit held, which can't be taken
+	req, _ := http.NewRequest("GET", "/admin/reservation-status/new/2/confirmed/do", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"src": "new", "id": "2", "status": models.StatusConfirmed})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminReservationStatus(rr, req)
+	if msg := session.GetString(ctx, "error"); msg != "Couldn't capture the deposit, so the reservation wasn't confirmed" {
+		t.Errorf("expected the capture to fail, got %q", msg)
+	}
+
+	req, _ = http.NewRequest("POST", "/webhooks/payments", strings.NewReader(`{"type":"payment.captured","reference":"fake_1"}`))
+	rr = httptest.NewRecorder()
+	Repo.PaymentWebhook(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected webhooks to be turned away but got %d", rr.Code)
+	}
+}
+
+// paymentWebhookTests is the test data for the PaymentWebhook handler test
+var paymentWebhookTests = []struct {
+	name               string
+	payload            string
+	signature          string
+	expectedStatusCode int
+}{
+	{"captured", `{"type":"payment.captured","reference":"fake_1","amount":2500}`, "", http.StatusOK},
+	{"refunded", `{"type":"payment.refunded","reference":"fake_1"}`, "", http.StatusOK},
+	{"ignored-event", `{"type":"payment.created","reference":"fake_1"}`, "", http.StatusOK},
+	{"unknown-payment", `{"type":"payment.captured","reference":"fake_99"}`, "", http.StatusNotFound},
+	{"bad-signature", `{"type":"payment.captured","reference":"fake_1"}`, "deadbeef", http.StatusUnauthorized},
+	{"bad-json", `not json`, "", http.StatusBadRequest},
+}
+
+// TestPaymentWebhook tests the PaymentWebhook handler
+func TestPaymentWebhook(t *testing.T) {
+	provider := app.Payments.(*payments.FakeProvider)
+
+	for _, e := range paymentWebhookTests {
+		signature := e.signature
+		if signature == "" {
+			signature = provider.SignWebhook([]byte(e.payload))
+		}
+
+		req, _ := http.NewRequest("POST", "/webhooks/payments", strings.NewReader(e.payload))
+		req.Header.Set("X-Payment-Signature", signature)
+
+		rr := httptest.NewRecorder()
+		Repo.PaymentWebhook(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+	}
+}
+
+// TestRoomCombinations tests picking every set of n rooms
+func TestRoomCombinations(t *testing.T) {
+	rooms := []models.Room{{ID: 1}, {ID: 2}, {ID: 3}}
+
+	if got := len(roomCombinations(rooms, 2)); got != 3 {
+		t.Errorf("expected 3 pairs of rooms but got %d", got)
+	}
+	if got := len(roomCombinations(rooms, 3)); got != 1 {
+		t.Errorf("expected 1 set of three rooms but got %d", got)
+	}
+	if got := len(roomCombinations(rooms, 4)); got != 0 {
+		t.Errorf("expected no sets of four rooms but got %d", got)
+	}
+}
+
+func TestAssignGuests(t *testing.T) {
+	group := []models.Reservation{
+		{Room: models.Room{MaxOccupancy: 2}},
+		{Room: models.Room{MaxOccupancy: 4}},
+	}
+
+	if !assignGuests(group, 3, 2) {
+		t.Fatal("expected 5 guests to fit in rooms sleeping 6")
+	}
+	if group[0].GuestSummary() != "2 adults" || group[1].GuestSummary() != "1 adult, 2 children" {
+		t.Errorf("unexpected split: %q and %q", group[0].GuestSummary(), group[1].GuestSummary())
+	}
+
+	if assignGuests(group, 1, 2) {
+		t.Error("expected every room to need an adult")
+	}
+	if assignGuests(group, 5, 2) {
+		t.Error("expected 7 guests not to fit in rooms sleeping 6")
+	}
+}
+
+// chooseRoomsTests is the data for the ChooseRooms handler test
+var chooseRoomsTests = []struct {
+	name             string
+	url              string
+	inSession        bool
+	adults           int
+	expectedLocation string
+}{
+	{"two-rooms", "/choose-rooms?ids=1,2", true, 2, "/make-group-reservation"},
+	{"one-room", "/choose-rooms?ids=1", true, 2, "/search-availability"},
+	{"same-room-twice", "/choose-rooms?ids=1,1", true, 2, "/search-availability"},
+	{"bad-id", "/choose-rooms?ids=1,fish", true, 2, "/search-availability"},
+	{"unknown-room", "/choose-rooms?ids=1,5", true, 2, "/"},
+	{"no-search-in-session", "/choose-rooms?ids=1,2", false, 2, "/"},
+	{"rooms-too-small", "/choose-rooms?ids=1,2", true, 7, "/search-availability"},
+}
+
+// TestChooseRooms tests the ChooseRooms handler
+func TestChooseRooms(t *testing.T) {
+	for _, e := range chooseRoomsTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		if e.inSession {
+			session.Put(ctx, "reservation", models.Reservation{
+				StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+				EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+				Adults:    e.adults,
+			})
+		}
+
+		rr := httptest.NewRecorder()
+		Repo.ChooseRooms(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if rr.Code != http.StatusSeeOther || actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected redirect to %s but got %d %s", e.name, e.expectedLocation, rr.Code, actualLoc)
+		}
+	}
+}
+
+// testGroup returns a booking group for two rooms, as ChooseRooms leaves it in the session
+func testGroup(start string, roomIDs ...int) models.BookingGroup {
+	startDate, _ := time.Parse("2006-01-02", start)
+
+	var g models.BookingGroup
+	for _, id := range roomIDs {
+		g.Reservations = append(g.Reservations, models.Reservation{
+			StartDate: startDate,
+			EndDate:   startDate.AddDate(0, 0, 2),
+			RoomID:    id,
+			Room:      models.Room{ID: id, RoomName: fmt.Sprintf("Room %d", id)},
+		})
+	}
+	return g
+}
+
+// validGroupForm is a completed group booking form
+var validGroupForm = url.Values{
+	"first_name":  {"John"},
+	"last_name":   {"Smith"},
+	"email":       {"john@smith.com"},
+	"phone":       {"555-555-5555"},
+	"card_number": {"4242424242424242"},
+}
+
+// postGroupReservationTests is the data for the PostGroupReservation handler test
+var postGroupReservationTests = []struct {
+	name               string
+	group              *models.BookingGroup
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+	expectedHTML       string
+}{
+	{"valid-data", &models.BookingGroup{}, validGroupForm, http.StatusSeeOther, "/group-reservation-summary", ""},
+	{"no-group-in-session", nil, validGroupForm, http.StatusSeeOther, "/", ""},
+	{"invalid-data", &models.BookingGroup{}, url.Values{"first_name": {"J"}}, http.StatusOK, "", `action="/make-group-reservation"`},
+	{
+		"card-declined", &models.BookingGroup{},
+		url.Values{"first_name": {"John"}, "last_name": {"Smith"}, "email": {"john@smith.com"}, "card_number": {payments.DeclinedCard}},
+		http.StatusOK, "", "Your card was declined",
+	},
+}
+
+// TestPostGroupReservation tests the PostGroupReservation handler
+func TestPostGroupReservation(t *testing.T) {
+	for _, e := range postGroupReservationTests {
+		req, _ := http.NewRequest("POST", "/make-group-reservation", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if e.group != nil {
+			session.Put(ctx, "booking_group", testGroup("2050-01-01", 1, 2))
+		}
+
+		rr := httptest.NewRecorder()
+		Repo.PostGroupReservation(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+		}
+
+		if e.name == "valid-data" {
+			group, ok := session.Get(ctx, "booking_group").(models.BookingGroup)
+			if !ok || group.ID == 0 || group.ConfirmationCode == "" || group.Reservations[1].Total == 0 {
+				t.Errorf("expected the booked group in the session but got %+v", group)
+			}
+		}
+	}
+}
+
+// TestPostGroupReservationRoomTaken tests that a group isn't booked if one of its rooms was taken
+func TestPostGroupReservationRoomTaken(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/make-group-reservation", strings.NewReader(validGroupForm.Encode()))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	session.Put(ctx, "booking_group", testGroup("2055-01-01", 1, 2))
+
+	rr := httptest.NewRecorder()
+	Repo.PostGroupReservation(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/search-availability" {
+		t.Errorf("expected redirect to /search-availability but got %d %s", rr.Code, actualLoc)
+	}
+}
+
+// TestGroupReservationSummary tests the GroupReservationSummary handler
+func TestGroupReservationSummary(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/group-reservation-summary", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	group := testGroup("2050-01-01", 1, 2)
+	group.ID = 1
+	group.ConfirmationCode = "GRP123"
+	session.Put(ctx, "booking_group", group)
+
+	rr := httptest.NewRecorder()
+	Repo.GroupReservationSummary(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "GRP123") {
+		t.Errorf("expected the summary with the group code but got %d", rr.Code)
+	}
+
+	// the group is only shown once
+	rr = httptest.NewRecorder()
+	Repo.GroupReservationSummary(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected redirect once the group was shown but got %d", rr.Code)
+	}
+}
+
+// TestAdminConfirmBookingGroup tests the AdminConfirmBookingGroup handler
+func TestAdminConfirmBookingGroup(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/confirm-group/1/do", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminConfirmBookingGroup(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/groups/1/show" {
+		t.Errorf("expected redirect to the group but got %d %s", rr.Code, actualLoc)
+	}
+	if session.GetString(ctx, "flash") != "Group confirmed" {
+		t.Errorf("expected the group to be confirmed, error was %q", session.GetString(ctx, "error"))
+	}
+}
+
+// TestAdminConfirmBookingGroupPartly tests that a room whose deposit can't be taken doesn't stop the rest,
+// and that the admin is told which rooms are still waiting
+func TestAdminConfirmBookingGroupPartly(t *testing.T) {
+	provider := payments.NewFakeProvider("test-secret")
+	saved := app.Payments
+	app.Payments = provider
+	defer func() { app.Payments = saved }()
+
+	recorder := &actorRecorder{DatabaseRepo: Repo.DB}
+	savedDB := Repo.DB
+	Repo.DB = recorder
+	defer func() { Repo.DB = savedDB }()
+
+	// the provider has never seen the deposit of group 2's second room, reservation 2
+	req, _ := http.NewRequest("GET", "/admin/confirm-group/2/do", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"id": "2"})
+	session.Put(ctx, "user_id", 3)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminConfirmBookingGroup(rr, req)
+
+	expected := "Confirmed Room 1, but not Room 2: Couldn't capture the deposit, so the reservation wasn't confirmed"
+	if got := session.GetString(ctx, "error"); got != expected {
+		t.Errorf("expected the error %q but got %q", expected, got)
+	}
+	if session.GetString(ctx, "flash") != "" {
+		t.Errorf("expected no flash but got %q", session.GetString(ctx, "flash"))
+	}
+	if len(recorder.changes) != 1 || !strings.HasPrefix(recorder.changes[0], "mark reservation 1 confirmed by 3") {
+		t.Errorf("expected only reservation 1 to be confirmed but got %v", recorder.changes)
+	}
+}
+
+// TestChooseRoomsHoldsRooms tests that picking rooms for a group holds every one of them
+func TestChooseRoomsHoldsRooms(t *testing.T) {
+	for _, e := range []struct {
+		start            time.Time
+		expectedLocation string
+		expectedHolds    int
+	}{
+		{time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC), "/make-group-reservation", 2},
+		// another guest is holding the rooms from 2055-01-01
+		{time.Date(2055, 1, 1, 0, 0, 0, 0, time.UTC), "/search-availability", 0},
+	} {
+		req, _ := http.NewRequest("GET", "/choose-rooms?ids=1,2", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "reservation", models.Reservation{StartDate: e.start, EndDate: e.start.AddDate(0, 0, 2), Adults: 2})
+
+		rr := httptest.NewRecorder()
+		Repo.ChooseRooms(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s but got %s", e.start.Format("2006-01-02"), e.expectedLocation, actualLoc)
+		}
+
+		holdIDs, _ := session.Get(ctx, "hold_ids").([]int)
+		if len(holdIDs) != e.expectedHolds {
+			t.Errorf("%s: expected %d holds in the session but got %v", e.start.Format("2006-01-02"), e.expectedHolds, holdIDs)
+		}
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"General's Quarters":   "generals-quarters",
+		"Major's Suite":        "majors-suite",
+		"  The  Loft (No. 3) ": "the-loft-no-3",
+		"???":                  "",
+	}
+
+	for name, expected := range tests {
+		if got := slugify(name); got != expected {
+			t.Errorf("slugify(%q): expected %q but got %q", name, expected, got)
+		}
+	}
+}
+
+var adminPostRoomTests = []struct {
+	name             string
+	id               string
+	postedData       url.Values
+	expectedCode     int
+	expectedLocation string
+	expectedError    string
+}{
+	{
+		name: "new room",
+		id:   "new",
+		postedData: url.Values{
+			"room_name":     {"Colonel's Cabin"},
+			"max_occupancy": {"3"},
+			"nightly_rate":  {"149.50"},
+			"min_nights":    {"1"},
+			"amenities":     {"Wi-Fi\r\n\r\nSea view"},
+		},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/rooms/3",
+	},
+	{
+		name: "edit room",
+		id:   "2",
+		postedData: url.Values{
+			"room_name":     {"Major's Suite"},
+			"slug":          {"majors-suite"},
+			"max_occupancy": {"4"},
+			"nightly_rate":  {"200"},
+			"min_nights":    {"2"},
+		},
+		expectedCode:     http.StatusSeeOther,
+		expectedLocation: "/admin/rooms/2",
+	},
+	{
+		name: "missing name",
+		id:   "new",
+		postedData: url.Values{
+			"max_occupancy": {"3"},
+			"nightly_rate":  {"149.50"},
+			"min_nights":    {"1"},
+		},
+		expectedCode:  http.StatusOK,
+		expectedError: "room_name",
+	},
+	{
+		name: "bad rate",
+		id:   "new",
+		postedData: url.Values{
+			"room_name":     {"Colonel's Cabin"},
+			"max_occupancy": {"3"},
+			"nightly_rate":  {"lots"},
+			"min_nights":    {"1"},
+		},
+		expectedCode:  http.StatusOK,
+		expectedError: "nightly_rate",
+	},
+	{
+		name: "zero occupancy",
+		id:   "new",
+		postedData: url.Values{
+			"room_name":     {"Colonel's Cabin"},
+			"max_occupancy": {"0"},
+			"nightly_rate":  {"149.50"},
+			"min_nights":    {"1"},
+		},
+		expectedCode:  http.StatusOK,
+		expectedError: "max_occupancy",
+	},
+	{
+		name: "bad slug",
+		id:   "new",
+		postedData: url.Values{
+			"room_name":     {"Colonel's Cabin"},
+			"slug":          {"Colonel's Cabin"},
+			"max_occupancy": {"3"},
+			"nightly_rate":  {"149.50"},
+			"min_nights":    {"1"},
+		},
+		expectedCode:  http.StatusOK,
+		expectedError: "slug",
+	},
+	{
+		name: "reserved slug",
+		id:   "new",
+		postedData: url.Values{
+			"room_name":     {"All"},
+			"slug":          {"all"},
+			"max_occupancy": {"3"},
+			"nightly_rate":  {"149.50"},
+			"min_nights":    {"1"},
+		},
+		expectedCode:  http.StatusOK,
+		expectedError: "slug",
+	},
+	{
+		name: "slug taken",
+		id:   "1",
+		postedData: url.Values{
+			"room_name":     {"General's Quarters"},
+			"slug":          {"majors-suite"},
+			"max_occupancy": {"2"},
+			"nightly_rate":  {"120"},
+			"min_nights":    {"1"},
+		},
+		expectedCode:  http.StatusOK,
+		expectedError: "slug",
+	},
+}
+
+func TestAdminPostRoom(t *testing.T) {
+	for _, e := range adminPostRoomTests {
+		req, _ := http.NewRequest("POST", "/admin/rooms/"+e.id, strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := withURLParams(getCtx(req), map[string]string{"id": e.id})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		Repo.AdminPostRoom(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected code %d but got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("%s: expected location %s but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if e.expectedError != "" {
+			invalid := regexp.MustCompile(`is-invalid[^>]*name='` + e.expectedError + `'`)
+			if !invalid.MatchString(rr.Body.String()) {
+				t.Errorf("%s: expected %s to be marked invalid", e.name, e.expectedError)
+			}
+		}
+	}
+}
+
+func TestAdminDeleteRoom(t *testing.T) {
+	tests := []struct {
+		id               string
+		expectedLocation string
+		expectedFlash    string
+	}{
+		{"3", "/admin/rooms", "Room deleted"},
+		{"1", "/admin/rooms/1", ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/delete-room/"+e.id+"/do", nil)
+		ctx := withURLParams(getCtx(req), map[string]string{"id": e.id})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		Repo.AdminDeleteRoom(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if rr.Code != http.StatusSeeOther || actualLoc.String() != e.expectedLocation {
+			t.Errorf("room %s: expected redirect to %s but got %d %s", e.id, e.expectedLocation, rr.Code, actualLoc)
+		}
+		if session.GetString(ctx, "flash") != e.expectedFlash {
+			t.Errorf("room %s: expected flash %q but got %q", e.id, e.expectedFlash, session.GetString(ctx, "flash"))
+		}
+	}
+}
+
+// a 1x1 png
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\rIDATx\x9cc\xf8\x0f\x00\x00\x01\x01\x00\x05\x18\xd8N\x00\x00\x00\x00IEND\xaeB`\x82")
+
+func TestAdminPostRoomPhoto(t *testing.T) {
+	tests := []struct {
+		name          string
+		contents      []byte
+		expectedFlash string
+		expectedError string
+		expectedFiles int
+	}{
+		{"png", testPNG, "Photo added", "", 1},
+		{"not an image", []byte("<?php echo 'hello'; ?>"), "", "Photos must be JPEG, PNG, GIF or WebP images", 0},
+	}
+
+	for _, e := range tests {
+		dir := filepath.Join(app.UploadPath, "rooms")
+		os.RemoveAll(dir)
+
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		_ = mw.WriteField("caption", "The view")
+		fw, _ := mw.CreateFormFile("photo", "view.png")
+		_, _ = fw.Write(e.contents)
+		mw.Close()
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/1/photos", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		Repo.AdminPostRoomPhoto(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/rooms/1" {
+			t.Errorf("%s: expected redirect to the room but got %d %s", e.name, rr.Code, actualLoc)
+		}
+		if session.GetString(ctx, "flash") != e.expectedFlash || session.GetString(ctx, "error") != e.expectedError {
+			t.Errorf("%s: unexpected flash %q, error %q", e.name, session.GetString(ctx, "flash"), session.GetString(ctx, "error"))
+		}
+
+		files, _ := filepath.Glob(filepath.Join(dir, "1-*.png"))
+		if len(files) != e.expectedFiles {
+			t.Errorf("%s: expected %d saved photos but found %d", e.name, e.expectedFiles, len(files))
+		}
+	}
+}
+
+func TestAdminDeleteRoomPhoto(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/delete-room-photo/1/do", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDeleteRoomPhoto(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/rooms/1" {
+		t.Errorf("expected redirect to the room but got %d %s", rr.Code, actualLoc)
+	}
+
+	// seeded photos are served from /static and must be left on disk
+	if _, err := os.Stat("./../../static/images/generals-quarters.png"); err != nil {
+		t.Errorf("expected the seeded photo to be kept: %v", err)
+	}
+}
+
+var adminPostBookingRuleTests = []struct {
+	name          string
+	postedData    url.Values
+	expectedFlash string
+	expectedError string
+}{
+	{
+		"year-round",
+		url.Values{"max_nights": {"14"}, "lead_days": {"1"}},
+		"Booking rule added", "",
+	},
+	{
+		"summer saturdays",
+		url.Values{"start_date": {"2041-06-01"}, "end_date": {"2041-09-01"}, "min_nights": {"7"}, "arrival_days": {"6"}, "departure_days": {"6"}},
+		"Booking rule added", "",
+	},
+	{
+		"padded dates",
+		url.Values{"start_date": {" 2041-06-01"}, "end_date": {"2041-09-01 "}, "min_nights": {"7"}},
+		"Booking rule added", "",
+	},
+	{
+		"one date",
+		url.Values{"start_date": {"2041-06-01"}, "min_nights": {"7"}},
+		"", "Give both dates of the rule as yyyy-mm-dd, or neither for a rule that applies all year",
+	},
+	{
+		"ends before it starts",
+		url.Values{"start_date": {"2041-09-01"}, "end_date": {"2041-06-01"}, "min_nights": {"7"}},
+		"", "The rule must end after it starts",
+	},
+	{
+		"negative nights",
+		url.Values{"min_nights": {"-1"}},
+		"", "Nights and days must be whole numbers",
+	},
+	{
+		"max below min",
+		url.Values{"min_nights": {"7"}, "max_nights": {"3"}},
+		"", "The maximum stay can't be shorter than the minimum",
+	},
+	{
+		"bad weekday",
+		url.Values{"arrival_days": {"7"}},
+		"", "Pick arrival days from the list",
+	},
+	{
+		"no limits",
+		url.Values{"start_date": {"2041-06-01"}, "end_date": {"2041-09-01"}},
+		"", "Set at least one limit for the rule",
+	},
+}
+
+func TestAdminPostBookingRule(t *testing.T) {
+	for _, e := range adminPostBookingRuleTests {
+		req, _ := http.NewRequest("POST", "/admin/rooms/1/rules", strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		Repo.AdminPostBookingRule(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/rooms/1" {
+			t.Errorf("%s: expected redirect to the room but got %d %s", e.name, rr.Code, actualLoc)
+		}
+		if session.GetString(ctx, "flash") != e.expectedFlash || session.GetString(ctx, "error") != e.expectedError {
+			t.Errorf("%s: unexpected flash %q, error %q", e.name, session.GetString(ctx, "flash"), session.GetString(ctx, "error"))
+		}
+	}
+}
+
+func TestAdminDeleteBookingRule(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/delete-booking-rule/1/do", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDeleteBookingRule(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/rooms/1" {
+		t.Errorf("expected redirect to the room but got %d %s", rr.Code, actualLoc)
+	}
+	if session.GetString(ctx, "flash") != "Booking rule removed" {
+		t.Errorf("expected the rule to be removed, error was %q", session.GetString(ctx, "error"))
+	}
+}
+
+var adminPostRecurringBlockTests = []struct {
+	name          string
+	postedData    url.Values
+	expectedFlash string
+	expectedError string
+}{
+	{
+		"weekly",
+		url.Values{"repeat": {"weekly"}, "recur_start": {"2041-01-07"}, "recur_days": {"1", "2"}, "recur_reason": {"Closed early in the week"}},
+		"Recurring block added", "",
+	},
+	{
+		"yearly",
+		url.Values{"repeat": {"yearly"}, "recur_start": {"2041-12-20"}, "recur_nights": {"17"}, "recur_reason": {"Christmas"}},
+		"Recurring block added", "",
+	},
+	{
+		"custom",
+		url.Values{"repeat": {"custom"}, "recur_start": {"2041-01-01"}, "rrule": {"FREQ=DAILY;BYMONTH=1"}, "recur_reason": {"Closed in January"}},
+		"Recurring block added", "",
+	},
+	{
+		"padded-start",
+		url.Values{"repeat": {"yearly"}, "recur_start": {" 2041-12-20 "}, "recur_reason": {"Christmas"}},
+		"Recurring block added", "",
+	},
+	{
+		"bad-start",
+		url.Values{"repeat": {"yearly"}, "recur_start": {"soon"}, "recur_reason": {"Christmas"}},
+		"", "Give the first night the block applies to as yyyy-mm-dd",
+	},
+	{
+		"bad-nights",
+		url.Values{"repeat": {"yearly"}, "recur_start": {"2041-12-20"}, "recur_nights": {"0"}, "recur_reason": {"Christmas"}},
+		"", "Each closure must be a whole number of nights, from 1 to 366",
+	},
+	{
+		"weekly-without-days",
+		url.Values{"repeat": {"weekly"}, "recur_start": {"2041-01-07"}, "recur_reason": {"Closed"}},
+		"", "Pick the days of the week the room is closed",
+	},
+	{
+		"bad-rule",
+		url.Values{"repeat": {"custom"}, "recur_start": {"2041-01-01"}, "rrule": {"FREQ=HOURLY"}, "recur_reason": {"Closed"}},
+		"", "The repeat rule can't be used: FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY, not HOURLY",
+	},
+	{
+		"no-repeat",
+		url.Values{"recur_start": {"2041-01-01"}, "recur_reason": {"Closed"}},
+		"", "Pick how often the block repeats",
+	},
+	{
+		"no-reason",
+		url.Values{"repeat": {"yearly"}, "recur_start": {"2041-12-20"}},
+		"", "Give a reason for the block",
+	},
+}
+
+func TestAdminPostRecurringBlock(t *testing.T) {
+	for _, e := range adminPostRecurringBlockTests {
+		req, _ := http.NewRequest("POST", "/admin/rooms/1/recurring-blocks", strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		Repo.AdminPostRecurringBlock(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/rooms/1" {
+			t.Errorf("%s: expected redirect to the room but got %d %s", e.name, rr.Code, actualLoc)
+		}
+		if session.GetString(ctx, "flash") != e.expectedFlash || session.GetString(ctx, "error") != e.expectedError {
+			t.Errorf("%s: unexpected flash %q, error %q", e.name, session.GetString(ctx, "flash"), session.GetString(ctx, "error"))
+		}
+	}
+}
+
+func TestAdminDeleteRecurringBlock(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/delete-recurring-block/1/do", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDeleteRecurringBlock(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/rooms/1" {
+		t.Errorf("expected redirect to the room but got %d %s", rr.Code, actualLoc)
+	}
+	if session.GetString(ctx, "flash") != "Recurring block removed" {
+		t.Errorf("expected the block to be removed, error was %q", session.GetString(ctx, "error"))
+	}
+
+	// a block that doesn't exist
+	req, _ = http.NewRequest("GET", "/admin/delete-recurring-block/101/do", nil)
+	req = req.WithContext(withURLParams(getCtx(req), map[string]string{"id": "101"}))
+
+	rr = httptest.NewRecorder()
+	Repo.AdminDeleteRecurringBlock(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected code %d for a missing block but got %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+func TestRoomFeed(t *testing.T) {
+	tests := []struct {
+		name         string
+		url          string
+		expectedCode int
+	}{
+		{"valid token", "/ical/generals-quarters.ics?token=gq-feed", http.StatusOK},
+		{"wrong token", "/ical/generals-quarters.ics?token=guess", http.StatusForbidden},
+		{"no token", "/ical/generals-quarters.ics", http.StatusForbidden},
+		{"feed not created", "/ical/majors-suite.ics?token=", http.StatusForbidden},
+		{"unknown room", "/ical/colonels-cabin.ics?token=gq-feed", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		slug := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/ical/"), ".ics")
+		req = req.WithContext(withURLParams(getCtx(req), map[string]string{"slug": slug}))
+
+		rr := httptest.NewRecorder()
+		Repo.RoomFeed(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected code %d but got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/ical/generals-quarters.ics?token=gq-feed", nil)
+	req = req.WithContext(withURLParams(getCtx(req), map[string]string{"slug": "generals-quarters"}))
+	rr := httptest.NewRecorder()
+	Repo.RoomFeed(rr, req)
+
+	body := rr.Body.String()
+	if rr.Header().Get("Content-Type") != "text/calendar; charset=utf-8" {
+		t.Errorf("expected a calendar but got %s", rr.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"UID:reservation-1@bookings\r\n",
+		"DTSTART;VALUE=DATE:20500701\r\nDTEND;VALUE=DATE:20500704\r\n",
+		"SUMMARY:Reserved\r\n",
+		"UID:block-3@bookings\r\n",
+		"UID:recurring-block-1@bookings\r\n",
+		"RRULE:FREQ=WEEKLY;BYDAY=MO\r\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the feed to contain %q", want)
+		}
+	}
+	// the feed is shared outside the business
+	for _, secret := range []string{"Smith", "ABC234", "Renovation", "New bathroom", "Mondays"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("expected the room feed to leave out %q", secret)
+		}
+	}
+}
+
+func TestAllRoomsFeed(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ical/all.ics", nil)
+	req = req.WithContext(getCtx(req))
+
+	rr := httptest.NewRecorder()
+	Repo.AllRoomsFeed(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		"X-WR-CALNAME:All rooms\r\n",
+		"SUMMARY:General's Quarters: John Smith\r\n",
+		"DESCRIPTION:Confirmation code ABC234\\n2 adults\r\n",
+		"SUMMARY:General's Quarters: Blocked - Renovation\r\n",
+		"SUMMARY:Major's Suite: Closed - Closed on Mondays\r\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the feed to contain %q", want)
+		}
+	}
+
+	// each room has a recurring block
+	if strings.Count(body, "BEGIN:VEVENT") != 4 {
+		t.Errorf("expected 4 events but got %d", strings.Count(body, "BEGIN:VEVENT"))
+	}
+}
+
+func TestAdminPostRoomFeedToken(t *testing.T) {
+	tests := []struct {
+		id            string
+		expectedCode  int
+		expectedFlash string
+	}{
+		{"2", http.StatusSeeOther, "Calendar feed created"},
+		{"1", http.StatusSeeOther, "Calendar feed address changed; the old address no longer works"},
+		{"5", http.StatusInternalServerError, ""},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin/rooms/"+e.id+"/feed-token", nil)
+		ctx := withURLParams(getCtx(req), map[string]string{"id": e.id})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		Repo.AdminPostRoomFeedToken(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("room %s: expected code %d but got %d", e.id, e.expectedCode, rr.Code)
+		}
+		if session.GetString(ctx, "flash") != e.expectedFlash {
+			t.Errorf("room %s: expected flash %q but got %q", e.id, e.expectedFlash, session.GetString(ctx, "flash"))
+		}
+	}
+}
+
+var adminPostICalFeedTests = []struct {
+	name            string
+	postedData      url.Values
+	expectedCode    int
+	expectedFlash   string
+	expectedWarning string
+	expectedError   string
+}{
+	{
+		"valid",
+		url.Values{"feed_name": {"Example"}, "feed_url": {"{channel}/listing.ics"}},
+		http.StatusSeeOther, "Calendar synced: 2 added, 0 changed, 0 removed", "", "",
+	},
+	{
+		"no name",
+		url.Values{"feed_url": {"{channel}/listing.ics"}},
+		http.StatusSeeOther, "", "", "Name the channel the calendar comes from, e.g. Airbnb",
+	},
+	{
+		"no address",
+		url.Values{"feed_name": {"Example"}},
+		http.StatusSeeOther, "", "", "Give the address of the channel's calendar",
+	},
+	{
+		"not the web",
+		url.Values{"feed_name": {"Example"}, "feed_url": {"ftp://example.com/listing.ics"}},
+		http.StatusSeeOther, "", "", "The calendar's address must start with https://",
+	},
+	{
+		"plain http",
+		url.Values{"feed_name": {"Example"}, "feed_url": {"http://example.com/listing.ics"}},
+		http.StatusSeeOther, "", "", "The calendar's address must start with https://",
+	},
+	{
+		"local file",
+		url.Values{"feed_name": {"Example"}, "feed_url": {"/etc/hostname"}},
+		http.StatusSeeOther, "", "", "The calendar's address must start with https://",
+	},
+	{
+		"file address",
+		url.Values{"feed_name": {"Example"}, "feed_url": {"file:///etc/hostname"}},
+		http.StatusSeeOther, "", "", "The calendar's address must start with https://",
+	},
+	{
+		"can't sync",
+		url.Values{"feed_name": {"Example"}, "feed_url": {"{channel}/missing.ics"}},
+		http.StatusSeeOther, "", "", "The calendar was added but couldn't be synced: the feed answered 404 Not Found",
+	},
+	{
+		"insert fails",
+		url.Values{"feed_name": {"fail"}, "feed_url": {"{channel}/listing.ics"}},
+		http.StatusInternalServerError, "", "", "",
+	},
+}
+
+// channelServer stands in for another channel, publishing the example calendar at /listing.ics and any
+// other calendars given at their paths. Calendars are only synced over https, so the server is too
+func channelServer(t *testing.T, feeds map[string]string) *httptest.Server {
+	listing, err := os.ReadFile("../icalsync/testdata/channel.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		feed, ok := feeds[r.URL.Path]
+		if r.URL.Path == "/listing.ics" {
+			feed, ok = string(listing), true
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", ical.ContentType)
+		_, _ = w.Write([]byte(feed))
+	}))
+
+	client := Repo.Calendars.Client
+	Repo.Calendars.Client = srv.Client()
+	t.Cleanup(func() {
+		Repo.Calendars.Client = client
+		srv.Close()
+	})
+	return srv
+}
+
+func TestAdminPostICalFeed(t *testing.T) {
+	srv := channelServer(t, nil)
+
+	for _, e := range adminPostICalFeedTests {
+		postedData := url.Values{}
+		for k, v := range e.postedData {
+			postedData.Set(k, strings.Replace(v[0], "{channel}", srv.URL, 1))
+		}
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/1/ical-feeds", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		Repo.AdminPostICalFeed(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected code %d but got %d", e.name, e.expectedCode, rr.Code)
+			continue
+		}
+		if rr.Code == http.StatusSeeOther {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/admin/rooms/1" {
+				t.Errorf("%s: expected redirect to the room but got %s", e.name, actualLoc)
+			}
+		}
+		if got := session.GetString(ctx, "flash"); got != e.expectedFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectedFlash, got)
+		}
+		if got := session.GetString(ctx, "warning"); got != e.expectedWarning {
+			t.Errorf("%s: expected warning %q but got %q", e.name, e.expectedWarning, got)
+		}
+		if got := session.GetString(ctx, "error"); got != e.expectedError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, got)
+		}
+	}
+}
+
+func TestAdminPostICalFeedConflicts(t *testing.T) {
+	feed := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:taken\r\nDTSTART;VALUE=DATE:20550101\r\n" +
+		"DTEND;VALUE=DATE:20550103\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	srv := channelServer(t, map[string]string{"/taken.ics": feed})
+
+	postedData := url.Values{"feed_name": {"Example"}, "feed_url": {srv.URL + "/taken.ics"}}
+	req, _ := http.NewRequest("POST", "/admin/rooms/1/ical-feeds", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminPostICalFeed(rr, req)
+
+	expected := "Calendar synced: 0 added, 0 changed, 0 removed. 1 stay clashes with a booking here: 2055-01-01 to 2055-01-03"
+	if got := session.GetString(ctx, "warning"); got != expected {
+		t.Errorf("expected warning %q but got %q", expected, got)
+	}
+}
+
+func TestAdminDeleteICalFeed(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/delete-ical-feed/1/do", nil)
+	ctx := withURLParams(getCtx(req), map[string]string{"id": "1"})
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDeleteICalFeed(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/rooms/1" {
+		t.Errorf("expected redirect to the room but got %d %s", rr.Code, actualLoc)
+	}
+	if session.GetString(ctx, "flash") != "Imported calendar removed" {
+		t.Errorf("expected the calendar to be removed, error was %q", session.GetString(ctx, "error"))
+	}
+
+	// a feed that doesn't exist
+	req, _ = http.NewRequest("GET", "/admin/delete-ical-feed/101/do", nil)
+	req = req.WithContext(withURLParams(getCtx(req), map[string]string{"id": "101"}))
+
+	rr = httptest.NewRecorder()
+	Repo.AdminDeleteICalFeed(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected code %d for a missing feed but got %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+// notFound answers every request with a 404, standing in for the other channels
+type notFound struct{}
+
+func (notFound) RoundTrip(r *http.Request) (*http.Response, error) {
+	rr := httptest.NewRecorder()
+	http.NotFound(rr, r)
+	return rr.Result(), nil
+}
+
+func TestAdminSyncICalFeeds(t *testing.T) {
+	client := Repo.Calendars.Client
+	Repo.Calendars.Client = &http.Client{Transport: notFound{}}
+	defer func() { Repo.Calendars.Client = client }()
+
+	req, _ := http.NewRequest("POST", "/admin/ical-feeds/sync", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	Repo.AdminSyncICalFeeds(rr, req)
+
+	actualLoc, _ := rr.Result().Location()
+	if rr.Code != http.StatusSeeOther || actualLoc.String() != "/admin/dashboard" {
+		t.Errorf("expected redirect to the dashboard but got %d %s", rr.Code, actualLoc)
+	}
+	if session.GetString(ctx, "error") != "Some calendars couldn't be synced; see below for why" {
+		t.Errorf("expected the failed feeds to be reported, got %q", session.GetString(ctx, "error"))
+	}
+}
+
+func TestAdminDashboardICalFeeds(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/dashboard", nil)
+	req = req.WithContext(getCtx(req))
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDashboard(rr, req)
+
+	body := rr.Body.String()
+	for _, want := range []string{"Double booked:", "2050-07-02 to 2050-07-05", "Failed: the feed answered 404 Not Found"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the dashboard to show %q", want)
+		}
+	}
+}
+
+func TestAdminDashboardMetrics(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/dashboard", nil)
+	req = req.WithContext(getCtx(req))
+
+	rr := httptest.NewRecorder()
+	Repo.AdminDashboard(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	// the test repo books room 1 for 15 nights in the first month charted
+	now := time.Now()
+	first := time.Date(now.Year(), now.Month()-dashboardMonthsBack, 1, 0, 0, 0, 0, time.UTC)
+	rate := fmt.Sprintf(`"Rates":[%g,0,`, percentage(15, first.AddDate(0, 1, -1).Day()))
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		`<a href="/admin/reservations-new">3</a>`,
+		"10.0%",
+		"John Smith",
+		"22 days ahead on average",
+		rate,
+		"[450,0,",
+		"[5,8,4,3]",
+		first.Format("Jan 2006"),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the dashboard to show %q", want)
+		}
+	}
+}
+
+func TestPercentage(t *testing.T) {
+	tests := []struct {
+		part, whole int
+		expected    float64
+	}{
+		{15, 30, 50},
+		{10, 31, 32.3},
+		{0, 30, 0},
+		{3, 0, 0},
+	}
+
+	for _, e := range tests {
+		if got := percentage(e.part, e.whole); got != e.expected {
+			t.Errorf("percentage(%d, %d): expected %v but got %v", e.part, e.whole, e.expected, got)
+		}
+	}
+}
+
+// adds chi url params to a context, as the router would
+func withURLParams(ctx context.Context, params map[string]string) context.Context {
+	rctx := chi.NewRouteContext()
+	for k, v := range params {
+		rctx.URLParams.Add(k, v)
+	}
+	return context.WithValue(ctx, chi.RouteCtxKey, rctx)
+}
+
+// gets the context
+func getCtx(req *http.Request) context.Context {
+	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
+	if err != nil {
+		log.Println(err)
+	}
+	return ctx
+}
+
+func TestAdminAudit(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		expected    []string
+		notExpected []string
+	}{
+		{
+			name:  "reservation",
+			query: "?entity=reservation&id=1",
+			expected: []string{
+				"History of reservation 1, John Smith",
+				"john@smith.com &rarr; john@example.com",
+				`<a href="/admin/audit?user=1">Admin User</a>`,
+				"A removed user",
+				"Guest",
+				`href="/admin/reservations/all/1/show"`,
+			},
+			notExpected: []string{"Older changes", "<th>Of</th>"},
+		},
+		{
+			name:     "room",
+			query:    "?entity=room&id=2",
+			expected: []string{"History of Major&#39;s Suite", `href="/admin/rooms/2"`},
+		},
+		{
+			name:     "removed reservation",
+			query:    "?entity=reservation&id=101",
+			expected: []string{"History of reservation 101"},
+		},
+		{
+			name:     "by a user",
+			query:    "?user=1",
+			expected: []string{"History of reservations and rooms", "<th>Of</th>", "Show every change"},
+		},
+		{
+			name:     "no changes",
+			query:    "?entity=room&id=1&action=delete",
+			expected: []string{"No changes have been recorded", `<option value="delete" selected>`},
+		},
+		{
+			name:        "unknown entity",
+			query:       "?entity=guest&id=1",
+			expected:    []string{"History of reservations and rooms"},
+			notExpected: []string{`name="entity"`},
+		},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/audit"+e.query, nil)
+		req = req.WithContext(getCtx(req))
+
+		rr := httptest.NewRecorder()
+		Repo.AdminAudit(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected code %d but got %d", e.name, http.StatusOK, rr.Code)
+			continue
+		}
+		html := rr.Body.String()
+		for _, want := range e.expected {
+			if !strings.Contains(html, want) {
+				t.Errorf("%s: expected the page to contain %s", e.name, want)
+			}
+		}
+		for _, unwanted := range e.notExpected {
+			if strings.Contains(html, unwanted) {
+				t.Errorf("%s: expected the page not to contain %s", e.name, unwanted)
+			}
+		}
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	q := auditQuery(models.AuditFilter{Entity: models.EntityRoom, EntityID: 2, Action: audit.ActionAddRule, Before: 40, Limit: 51})
+	if q.Encode() != "action=add+rule&entity=room&id=2" {
+		t.Errorf("expected the filter without its paging, got %s", q.Encode())
+	}
+}
+
+// actorRecorder keeps who each change handlers make is made by, the actor the history is written with
+type actorRecorder struct {
+	repository.DatabaseRepo
+	changes []string
+}
+
+func (r *actorRecorder) record(change string, actor models.Actor) {
+	r.changes = append(r.changes, fmt.Sprintf("%s by %d %s", change, actor.UserID, actor.Name))
+}
+
+func (r *actorRecorder) UpdateReservation(u models.Reservation, actor models.Actor) error {
+	r.record(fmt.Sprintf("update reservation %d", u.ID), actor)
+	return r.DatabaseRepo.UpdateReservation(u, actor)
+}
+
+func (r *actorRecorder) InsertBlockForRoom(b models.RoomRestriction, actor models.Actor) (int, error) {
+	r.record(fmt.Sprintf("block room %d", b.RoomID), actor)
+	return r.DatabaseRepo.InsertBlockForRoom(b, actor)
+}
+
+func (r *actorRecorder) DeleteReservation(id int, actor models.Actor, reason string) error {
+	r.record(fmt.Sprintf("delete reservation %d", id), actor)
+	return r.DatabaseRepo.DeleteReservation(id, actor, reason)
+}
+
+func (r *actorRecorder) RestoreReservation(id int, actor models.Actor) error {
+	r.record(fmt.Sprintf("restore reservation %d", id), actor)
+	return r.DatabaseRepo.RestoreReservation(id, actor)
+}
+
+func (r *actorRecorder) UpdateReservationDates(id int, start, end time.Time, actor models.Actor) error {
+	r.record(fmt.Sprintf("move reservation %d", id), actor)
+	return r.DatabaseRepo.UpdateReservationDates(id, start, end, actor)
+}
+
+func (r *actorRecorder) UpdateReservationStatus(id int, status string, actor models.Actor) error {
+	r.record(fmt.Sprintf("mark reservation %d %s", id, status), actor)
+	return r.DatabaseRepo.UpdateReservationStatus(id, status, actor)
+}
+
+// TestChangesAreRecorded tests that changes are made as whoever made them, so the history names them
+func TestChangesAreRecorded(t *testing.T) {
+	recorder := &actorRecorder{DatabaseRepo: Repo.DB}
+	saved := Repo.DB
+	Repo.DB = recorder
+	defer func() { Repo.DB = saved }()
+
+	// a front desk user changes a guest's email
+	postedData := url.Values{
+		"first_name": {"John"},
+		"last_name":  {"Smith"},
+		"email":      {"john@example.com"},
+		"phone":      {""},
+	}
+	req, _ := http.NewRequest("POST", "/admin/reservations/all/1", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := getCtx(req)
+	session.Put(ctx, "user_id", 7)
+	req = req.WithContext(ctx)
+	req.RequestURI = "/admin/reservations/all/1"
+	Repo.AdminPostShowReservation(httptest.NewRecorder(), req)
+
+	// then the manager closes a room for a fortnight and removes the reservation
+	postedData = url.Values{
+		"room_id":     {"2"},
+		"block_start": {"2050-08-01"},
+		"block_end":   {"2050-08-15"},
+		"reason":      {"Renovation"},
+	}
+	req, _ = http.NewRequest("POST", "/admin/blocks", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx = getCtx(req)
+	session.Put(ctx, "user_id", 3)
+	req = req.WithContext(ctx)
+	Repo.AdminPostBlock(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("GET", "/admin/delete-reservation/all/1/do?reason=Booked+twice", nil)
+	ctx = withURLParams(getCtx(req), map[string]string{"src": "all", "id": "1"})
+	session.Put(ctx, "user_id", 3)
+	req = req.WithContext(ctx)
+	Repo.AdminDeleteReservation(httptest.NewRecorder(), req)
+
+	// and restores another from the trash
+	req, _ = http.NewRequest("GET", "/admin/restore-reservation/trash/96/do", nil)
+	ctx = withURLParams(getCtx(req), map[string]string{"src": "trash", "id": "96"})
+	session.Put(ctx, "user_id", 3)
+	req = req.WithContext(ctx)
+	Repo.AdminRestoreReservation(httptest.NewRecorder(), req)
+
+	// then the guest moves their stay, and cancels it
+	postedData = url.Values{"start": {"2050-09-01"}, "end": {"2050-09-04"}}
+	req, _ = http.NewRequest("POST", "/my-reservation/change-dates", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx = getCtx(req)
+	session.Put(ctx, "manage_reservation_id", 1)
+	req = req.WithContext(ctx)
+	Repo.PostGuestChangeDates(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("POST", "/my-reservation/cancel", nil)
+	ctx = getCtx(req)
+	session.Put(ctx, "manage_reservation_id", 1)
+	req = req.WithContext(ctx)
+	Repo.PostGuestCancel(httptest.NewRecorder(), req)
+
+	expected := []string{
+		"update reservation 1 by 7 ",
+		"block room 2 by 3 ",
+		"delete reservation 1 by 3 ",
+		"restore reservation 96 by 3 ",
+		"move reservation 1 by 0 Guest",
+		"mark reservation 1 cancelled by 0 Guest",
+	}
+	if strings.Join(recorder.changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the changes\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(recorder.changes, "\n"))
 	}
-	return ctx
 }
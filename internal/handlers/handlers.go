@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -13,10 +16,16 @@ import (
 	"github.com/aparkinlot/Bookings/internal/driver"
 	"github.com/aparkinlot/Bookings/internal/forms"
 	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/icalsync"
+	"github.com/aparkinlot/Bookings/internal/importer"
 	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/payments"
+	"github.com/aparkinlot/Bookings/internal/pricing"
 	"github.com/aparkinlot/Bookings/internal/render"
 	"github.com/aparkinlot/Bookings/internal/repository"
 	"github.com/aparkinlot/Bookings/internal/repository/dbrepo"
+	"github.com/aparkinlot/Bookings/internal/rules"
+	"github.com/aparkinlot/Bookings/internal/tokens"
 	"github.com/go-chi/chi"
 )
 
@@ -25,25 +34,49 @@ var Repo *Repository
 
 // Repository is the repository type
 type Repository struct {
-	App *config.AppConfig
-	DB  repository.DatabaseRepo
+	App       *config.AppConfig
+	DB        repository.DatabaseRepo
+	Pricing   *pricing.Service
+	Rules     *rules.Service
+	Calendars *icalsync.Service
+	Imports   *importer.Service
 }
 
 // NewRepo creates a new repository
 func NewRepo(a *config.AppConfig, db *driver.DB) *Repository {
+	repo := dbrepo.NewPostgresRepo(db.SQL, a)
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewPostgresRepo(db.SQL, a),
+		App:       a,
+		DB:        repo,
+		Pricing:   newPricing(a, repo),
+		Rules:     rules.NewService(repo),
+		Calendars: icalsync.NewService(repo),
+		Imports:   importer.NewService(repo),
 	}
 }
 
 func NewTestRepo(a *config.AppConfig) *Repository {
+	repo := dbrepo.NewTestingRepo(a)
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewTestingRepo(a),
+		App:       a,
+		DB:        repo,
+		Pricing:   newPricing(a, repo),
+		Rules:     rules.NewService(repo),
+		Calendars: icalsync.NewService(repo),
+		Imports:   importer.NewService(repo),
 	}
 }
 
+// newPricing creates the pricing service with the taxes and fees from the app config
+func newPricing(a *config.AppConfig, db repository.DatabaseRepo) *pricing.Service {
+	var fees []pricing.Charge
+	if a.CleaningFee > 0 {
+		fees = append(fees, pricing.Charge{Description: "Cleaning fee", Amount: a.CleaningFee})
+	}
+
+	return pricing.NewService(db, a.TaxRate, fees...)
+}
+
 // NewHandlers sets the repository for the handlers
 func NewHandlers(r *Repository) {
 	Repo = r
@@ -51,7 +84,26 @@ func NewHandlers(r *Repository) {
 
 // Home is the handler for the home page
 func (m *Repository) Home(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "home.page.tmpl", &models.TemplateData{})
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	for i := range rooms {
+		rooms[i].Photos, err = m.DB.PhotosForRoom(rooms[i].ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.Template(w, r, "home.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
 }
 
 // About is the handler for the about page
@@ -76,20 +128,46 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 	}
 	res.Room.RoomName = room.RoomName
 
+	violations, err := m.Rules.Check(room, res.StartDate, res.EndDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't check the booking rules for that stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if len(violations) > 0 {
+		m.App.Session.Put(r.Context(), "error", violationMessage(room.RoomName, violations))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	quote, err := m.Pricing.Quote(res.RoomID, res.StartDate, res.EndDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get a price for that stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
-	sd := res.StartDate.Format("2006-01-02")
-	ed := res.EndDate.Format("2006-01-02")
+	m.renderMakeReservation(w, r, forms.New(nil), res, quote)
+}
 
+// renderMakeReservation shows the reservation form with the price of the stay and the deposit due
+func (m *Repository) renderMakeReservation(w http.ResponseWriter, r *http.Request, form *forms.Form, res models.Reservation, quote pricing.Quote) {
 	stringMap := make(map[string]string)
-	stringMap["start_date"] = sd
-	stringMap["end_date"] = ed
+	stringMap["start_date"] = res.StartDate.Format("2006-01-02")
+	stringMap["end_date"] = res.EndDate.Format("2006-01-02")
 
 	data := make(map[string]interface{})
 	data["reservation"] = res
+	data["quote"] = quote
+	data["deposit"] = m.depositFor(quote.Total)
+	if m.App.Session.Exists(r.Context(), "hold_id") {
+		data["hold_minutes"] = int(m.App.HoldTTL.Minutes())
+	}
 
 	render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
-		Form:      forms.New(nil),
+		Form:      form,
 		Data:      data,
 		StringMap: stringMap,
 	})
@@ -167,26 +245,15 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sd := r.Form.Get("start_date")
-	ed := r.Form.Get("end_date")
-
-	// 2020-01-01 -- 01/02 03:04:05PM '06 -0700
-
-	layout := "2006-01-02"
-
-	startDate, err := time.Parse(layout, sd)
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't parse start date")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
-	}
-
-	endDate, err := time.Parse(layout, ed)
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't get parse end date")
+	// the dates come from the search, so a guest can't fix them on this form
+	form := forms.New(r.PostForm)
+	if !stayDates(form, "start_date", "end_date") {
+		m.App.Session.Put(r.Context(), "error", "can't book those dates: "+dateError(form, "start_date", "end_date"))
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	startDate := form.Date("start_date")
+	endDate := form.Date("end_date")
 
 	roomID, err := strconv.Atoi(r.Form.Get("room_id"))
 	if err != nil {
@@ -202,6 +269,8 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	adults, children := guestCounts(form, room)
+
 	reservation := models.Reservation{
 		FirstName: r.Form.Get("first_name"),
 		LastName:  r.Form.Get("last_name"),
@@ -210,60 +279,109 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		StartDate: startDate,
 		EndDate:   endDate,
 		RoomID:    roomID,
+		Adults:    adults,
+		Children:  children,
 		Room:      room,
 	}
 
-	form := forms.New(r.PostForm)
+	violations, err := m.Rules.Check(room, startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't check the booking rules for that stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	addViolations(form, violations, rules.FieldStart, rules.FieldEnd)
+
+	quote, err := m.Pricing.Quote(roomID, startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get a price for that stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// the price the guest saw is stored with the booking and only changes if an admin re-prices it
+	quote.ApplyTo(&reservation)
+	deposit := m.depositFor(reservation.Total)
 
 	form.Required("first_name", "last_name", "email")
 	form.MinLength("first_name", 3)
 	form.IsEmail("email")
+	if form.Has("phone") {
+		form.IsPhone("phone")
+	}
+	if deposit > 0 {
+		form.Required("card_number")
+	}
 
 	if !form.Valid() {
-		data := make(map[string]interface{})
-		data["reservation"] = reservation
-		//http.Error(w, "my own error message", http.StatusSeeOther)
-
-		stringMap := make(map[string]string)
-		stringMap["start_date"] = sd
-		stringMap["end_date"] = ed
-
-		render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
-			Form:      form,
-			Data:      data,
-			StringMap: stringMap,
-		})
+		m.renderMakeReservation(w, r, form, reservation, quote)
 		return
 	}
 
-	newReservationID, err := m.DB.InsertReservation(reservation)
+	reservation.ConfirmationCode, err = tokens.ConfirmationCode()
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database!")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		helpers.ServerError(w, err)
 		return
 	}
 
-	restriction := models.RoomRestriction{
-		StartDate:     startDate,
-		EndDate:       endDate,
-		RoomID:        roomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1,
+	// the reservation and its room restriction are written together, so a guest
+	// who loses the race for the room never ends up with a half-written booking
+	// the room is held unconfirmed until the deposit has been authorized
+	holdID := m.App.Session.GetInt(r.Context(), "hold_id")
+	newReservationID, err := m.DB.InsertReservationWithRestriction(reservation, holdID, deposit == 0)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, that room just got booked for those dates. Please search again.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
 	}
-
-	err = m.DB.InsertRoomRestriction(restriction)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert room restriction!")
+		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	reservation.ID = newReservationID
+	m.App.Session.Remove(r.Context(), "hold_id")
+
+	if deposit > 0 {
+		err = m.holdDeposit(reservation, r.Form.Get("card_number"), deposit)
+		if err != nil {
+			// the booking never went through, so free the room again
+			if delErr := m.DB.PurgeReservation(newReservationID); delErr != nil {
+				m.App.ErrorLog.Println(delErr)
+			}
+
+			if errors.Is(err, payments.ErrDeclined) {
+				form.Errors.Add("card_number", "Your card was declined")
+				m.renderMakeReservation(w, r, form, reservation, quote)
+				return
+			}
+
+			m.App.Session.Put(r.Context(), "error", "can't take the deposit for your reservation!")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+	}
+
+	m.sendReservationEmails(reservation)
+
+	m.App.Session.Put(r.Context(), "reservation", reservation)
 
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+
+}
+
+// sendReservationEmails queues the confirmation to the guest and the notification to the owner
+func (m *Repository) sendReservationEmails(reservation models.Reservation) {
 	// send notifcaitons - first to guest
 	htmlMessage := fmt.Sprintf(`
 		<strong>Reservation Confirmation</strong><br>
 		Dear %s: <br>
-		This is to confirm your reservation from %s to %s.
-	`, reservation.FirstName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
+		This is to confirm your reservation from %s to %s.<br>
+		The total for your stay is %s.<br>
+		Your confirmation code is <strong>%s</strong>. You can use it with your email address
+		to view, change or cancel your booking at <a href="%[5]s">%[5]s</a>.
+	`, reservation.FirstName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"),
+		pricing.FormatMoney(reservation.Total), reservation.ConfirmationCode, m.siteURL("/my-reservation/lookup"))
 
 	msg := models.MailData{
 		To:       reservation.Email,
@@ -290,26 +408,80 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	m.App.MailChan <- msg
+}
 
-	m.App.Session.Put(r.Context(), "reservation", reservation)
+// maxStayNights is the longest stay that can be searched for or booked in one go
+const maxStayNights = 90
+
+// stayDates checks that a form's arrival and departure fields make a stay that can be booked:
+// both are dates, departure is after arrival, arrival isn't in the past and the stay isn't too long
+func stayDates(form *forms.Form, startField, endField string) bool {
+	startOK := form.IsDate(startField)
+	endOK := form.IsDate(endField)
+	return startOK && endOK &&
+		form.DateRange(startField, endField) &&
+		form.NotInPast(startField) &&
+		form.MaxSpan(startField, endField, maxStayNights)
+}
 
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+// dateError returns the first problem stayDates found with a form's dates
+func dateError(form *forms.Form, startField, endField string) string {
+	if msg := form.Errors.Get(startField); msg != "" {
+		return msg
+	}
+	return form.Errors.Get(endField)
+}
+
+// guestCounts reads the number of adults and children from the form, adding errors if they aren't
+// whole numbers, there's no adult, or there are more guests than the room sleeps
+func guestCounts(form *forms.Form, room models.Room) (adults, children int) {
+	adults, err := strconv.Atoi(strings.TrimSpace(form.Get("adults")))
+	if err != nil || adults < 1 {
+		form.Errors.Add("adults", "At least one adult must be staying")
+	}
+
+	if c := strings.TrimSpace(form.Get("children")); c != "" {
+		children, err = strconv.Atoi(c)
+		if err != nil || children < 0 {
+			form.Errors.Add("children", "Enter the number of children, or 0")
+		}
+	}
+
+	// a room without a known size can't be checked
+	if room.MaxOccupancy > 0 && adults+children > room.MaxOccupancy {
+		form.Errors.Add("adults", fmt.Sprintf("This room sleeps at most %d guests", room.MaxOccupancy))
+	}
 
+	return adults, children
 }
 
-// Generals renders a room page
-func (m *Repository) Generals(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "generals.page.tmpl", &models.TemplateData{})
+// addViolations reports the booking rules a stay breaks on the form, against the fields holding its dates
+func addViolations(form *forms.Form, violations []rules.Violation, startField, endField string) {
+	for _, v := range violations {
+		if v.Field == rules.FieldEnd {
+			form.Errors.Add(endField, v.Message)
+		} else {
+			form.Errors.Add(startField, v.Message)
+		}
+	}
 }
 
-// Majors renders a room page
-func (m *Repository) Majors(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "majors.page.tmpl", &models.TemplateData{})
+// siteURL returns the absolute address of a page on the site, for links that are followed
+// from outside it such as those in emails
+func (m *Repository) siteURL(path string) string {
+	return strings.TrimSuffix(m.App.BaseURL, "/") + path
+}
+
+// violationMessage tells the guest why a stay in a room can't be booked
+func violationMessage(roomName string, violations []rules.Violation) string {
+	return fmt.Sprintf("Sorry, %s can't be booked for those dates: %s", roomName, violations[0].Message)
 }
 
 // Availability renders the search availability page
 func (m *Repository) Availability(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{})
+	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
 }
 
 // PostAvailability renders the search availability page
@@ -321,57 +493,120 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	start := r.Form.Get("start") // strings -> cast to ...
-	end := r.Form.Get("end")     // string -> cast to ...
-
-	layout := "2006-01-02"
-	startDate, err := time.Parse(layout, start)
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't parse start date")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+	form := forms.New(r.PostForm)
+	if !stayDates(form, "start", "end") {
+		render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
 		return
 	}
-	endDate, err := time.Parse(layout, end)
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't end date")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+	startDate := form.Date("start")
+	endDate := form.Date("end")
+
+	adults, children := guestCounts(form, models.Room{})
+	if !form.Valid() {
+		m.App.Session.Put(r.Context(), "error", "Please enter at least one adult, and the number of children")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
 		return
 	}
 
-	rooms, err := m.DB.SearchAvailibilityForAllRooms(startDate, endDate)
+	// groups needing more than one room choose from combinations of rooms instead,
+	// so any room can take part as long as the combination sleeps everyone
+	numRooms, err := strconv.Atoi(r.Form.Get("rooms"))
+	if err != nil || numRooms < 1 {
+		numRooms = 1
+	}
+	minOccupancy := adults + children
+	if numRooms > 1 {
+		minOccupancy = 1
+	}
+
+	rooms, err := m.DB.SearchAvailibilityForAllRooms(startDate, endDate, minOccupancy)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't get availability for rooms")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
+	// rooms whose booking rules rule out the stay aren't offered
+	var bookable []models.Room
+	var violations []rules.Violation
+	seen := make(map[rules.Violation]bool)
+	for _, room := range rooms {
+		vs, err := m.Rules.Check(room, startDate, endDate)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't check the booking rules for rooms")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if len(vs) == 0 {
+			bookable = append(bookable, room)
+		}
+		for _, v := range vs {
+			if !seen[v] {
+				seen[v] = true
+				violations = append(violations, v)
+			}
+		}
+	}
+	rooms = bookable
+
+	// when the rules are the only reason nothing is free, tell the guest which ones
+	if len(rooms) == 0 && len(violations) > 0 {
+		addViolations(form, violations, "start", "end")
+		render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
 	if len(rooms) == 0 {
 		m.App.Session.Put(r.Context(), "error", "No availability")
 		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
 		return
 	}
 
-	data := make(map[string]interface{})
-	data["rooms"] = rooms
+	quotes := make(map[int]pricing.Quote)
+	for _, room := range rooms {
+		quote, err := m.Pricing.Quote(room.ID, startDate, endDate)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get prices for rooms")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		quotes[room.ID] = quote
+	}
 
 	res := models.Reservation{
 		StartDate: startDate,
 		EndDate:   endDate,
+		Adults:    adults,
+		Children:  children,
 	}
 
 	m.App.Session.Put(r.Context(), "reservation", res)
 
+	if numRooms > 1 {
+		m.renderRoomOptions(w, r, rooms, quotes, numRooms, res.Guests())
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+	data["quotes"] = quotes
+
 	render.Template(w, r, "choose-room.page.tmpl", &models.TemplateData{
 		Data: data,
 	})
 }
 
 type jsonResponse struct {
-	OK        bool   `json:"ok"`
-	Message   string `json:"message"`
-	RoomID    string `json:"room_id"`
-	StartDate string `json:"start_date"`
-	EndDate   string `json:"end_date"`
+	OK        bool           `json:"ok"`
+	Message   string         `json:"message"`
+	RoomID    string         `json:"room_id"`
+	StartDate string         `json:"start_date"`
+	EndDate   string         `json:"end_date"`
+	Quote     *pricing.Quote `json:"quote,omitempty"`
 }
 
 // AvailabilityJSON handles request for availability and send JSON response
@@ -392,9 +627,23 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 	sd := r.Form.Get("start")
 	ed := r.Form.Get("end")
 
-	layout := "2006-01-02"
-	startDate, _ := time.Parse(layout, sd)
-	endDate, _ := time.Parse(layout, ed)
+	form := forms.New(r.Form)
+	if !stayDates(form, "start", "end") {
+		resp := jsonResponse{
+			OK:        false,
+			Message:   dateError(form, "start", "end"),
+			StartDate: sd,
+			EndDate:   ed,
+			RoomID:    r.Form.Get("room_id"),
+		}
+
+		out, _ := json.MarshalIndent(resp, "", "     ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
+	startDate := form.Date("start")
+	endDate := form.Date("end")
 
 	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
 
@@ -419,6 +668,31 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		RoomID:    strconv.Itoa(roomID),
 	}
 
+	if available {
+		room, err := m.DB.GetRoomByID(roomID)
+		var violations []rules.Violation
+		if err == nil {
+			violations, err = m.Rules.Check(room, startDate, endDate)
+		}
+
+		switch {
+		case err != nil:
+			resp.OK = false
+			resp.Message = "Error checking the booking rules"
+		case len(violations) > 0:
+			resp.OK = false
+			resp.Message = violations[0].Message
+		default:
+			quote, err := m.Pricing.Quote(roomID, startDate, endDate)
+			if err != nil {
+				resp.OK = false
+				resp.Message = "Error getting a price"
+			} else {
+				resp.Quote = &quote
+			}
+		}
+	}
+
 	out, _ := json.MarshalIndent(resp, "", "     ")
 	// if err != nil {
 	// 	helpers.ServerError(w, err)
@@ -455,6 +729,8 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 	stringMap["start_date"] = sd
 	stringMap["end_date"] = ed
 
+	data["deposit"] = m.depositFor(reservation.Total)
+
 	render.Template(w, r, "reservation-summary.page.tmpl", &models.TemplateData{
 		Data:      data,
 		StringMap: stringMap,
@@ -481,6 +757,10 @@ func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 
 	res.RoomID = roomID
 
+	if !m.holdRoom(w, r, res) {
+		return
+	}
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
@@ -491,12 +771,15 @@ func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 	// from the redirection -> id, s, e
 	roomID, _ := strconv.Atoi(r.URL.Query().Get("id"))
-	sd := r.URL.Query().Get("s")
-	ed := r.URL.Query().Get("e")
 
-	layout := "2006-01-02"
-	startDate, _ := time.Parse(layout, sd)
-	endDate, _ := time.Parse(layout, ed)
+	form := forms.New(r.URL.Query())
+	if !stayDates(form, "s", "e") {
+		m.App.Session.Put(r.Context(), "error", "can't book those dates: "+dateError(form, "s", "e"))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	startDate := form.Date("s")
+	endDate := form.Date("e")
 
 	var res models.Reservation
 
@@ -512,6 +795,10 @@ func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 	res.StartDate = startDate
 	res.EndDate = endDate
 
+	if !m.holdRoom(w, r, res) {
+		return
+	}
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
 }
@@ -551,7 +838,16 @@ func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
+
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't load user")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
 	m.App.Session.Put(r.Context(), "user_id", id)
+	m.App.Session.Put(r.Context(), "access_level", user.AccessLevel)
 	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -566,43 +862,155 @@ func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// Shows Dashboard for Admin
-func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{})
-}
-
 // Shows all recent reservations (valid and/or upcomming)
 func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllNewReservations()
+	m.reservationList(w, r, "new", m.DB.AllNewReservations)
+}
+
+// Shows all reservations
+func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
+	m.reservationList(w, r, "all", m.DB.AllReservations)
+}
+
+// reservationsPerPage is how many reservations a list shows at a time
+const reservationsPerPage = 50
+
+// reservationSortLabels heads the columns of a reservation list
+var reservationSortLabels = map[string]string{
+	models.SortID:        "ID",
+	models.SortLastName:  "Last Name",
+	models.SortRoom:      "Room",
+	models.SortGuests:    "Guests",
+	models.SortArrival:   "Arrival",
+	models.SortDeparture: "Departure",
+	models.SortBooked:    "Booked",
+}
+
+// sortHeading is a column heading that sorts the list by its column
+type sortHeading struct {
+	Label  string
+	URL    string
+	Sorted bool // the list is sorted by this column
+	Desc   bool
+}
+
+// reservationList shows a page of the new or all reservations list, narrowed and sorted as the query asks
+func (m *Repository) reservationList(w http.ResponseWriter, r *http.Request, src string,
+	list func(models.ReservationFilter) ([]models.Reservation, error)) {
+	f := reservationFilter(r.URL.Query(), src)
+
+	// one more than a page is read, to learn whether there is another
+	f.Limit = reservationsPerPage + 1
+	reservations, err := list(f)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	data := make(map[string]interface{})
-	data["reservations"] = reservations
-
-	render.Template(w, r, "admin-new-reservations.page.tmpl", &models.TemplateData{
-		Data: data,
-	})
-}
+	more := len(reservations) > reservationsPerPage
+	if more {
+		if f.Cursor.Backward {
+			reservations = reservations[1:]
+		} else {
+			reservations = reservations[:reservationsPerPage]
+		}
+	}
 
-// Shows all reservations
-func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
+	rooms, err := m.DB.AllRooms()
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
+	path := "/admin/reservations-" + src
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+
+	// going back always leaves a page ahead; going forward, only when the page was full
+	hasNext := more || f.Cursor.Backward
+	hasPrev := !f.Cursor.IsZero() && (more || !f.Cursor.Backward)
+	if len(reservations) > 0 {
+		if hasNext {
+			next := f
+			last := reservations[len(reservations)-1]
+			next.Cursor = models.Cursor{Value: f.SortValue(last), ID: last.ID}
+			stringMap["next"] = path + "?" + next.Values().Encode()
+		}
+		if hasPrev {
+			prev := f
+			first := reservations[0]
+			prev.Cursor = models.Cursor{Value: f.SortValue(first), ID: first.ID, Backward: true}
+			stringMap["prev"] = path + "?" + prev.Values().Encode()
+		}
+	}
+
+	// each heading sorts by its column, or turns the order round when the list is sorted by it already
+	var headings []sortHeading
+	for _, column := range models.ReservationSorts {
+		sorted := f
+		sorted.Cursor = models.Cursor{}
+		sorted.Sort = column
+		sorted.Desc = f.Sort == column && !f.Desc
+		headings = append(headings, sortHeading{
+			Label:  reservationSortLabels[column],
+			URL:    path + "?" + sorted.Values().Encode(),
+			Sorted: f.Sort == column,
+			Desc:   f.Desc,
+		})
+	}
+
 	data := make(map[string]interface{})
 	data["reservations"] = reservations
+	data["rooms"] = rooms
+	data["filter"] = f
+	data["statuses"] = models.Statuses
+	data["headings"] = headings
+	// passed on to each reservation, so its page leads back to this one
+	data["query"] = template.URL(f.Values().Encode())
 
-	render.Template(w, r, "admin-all-reservations.page.tmpl", &models.TemplateData{
-		Data: data,
+	render.Template(w, r, fmt.Sprintf("admin-%s-reservations.page.tmpl", src), &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
 	})
 }
 
+// reservationFilter reads a reservation list's filter from its query. Anything that can't be read is left out,
+// so a mistyped address shows more rather than failing. With no sort given, the list of all reservations
+// shows the latest arrivals first and the list of new ones the soonest
+func reservationFilter(q url.Values, src string) models.ReservationFilter {
+	f := models.ReservationFilter{
+		Search: strings.TrimSpace(q.Get("q")),
+		Status: q.Get("status"),
+		Sort:   q.Get("sort"),
+		Desc:   q.Get("dir") == "desc",
+	}
+
+	f.RoomID, _ = strconv.Atoi(q.Get("room"))
+	f.From, _ = time.Parse("2006-01-02", q.Get("from"))
+	f.To, _ = time.Parse("2006-01-02", q.Get("to"))
+
+	if !models.IsStatus(f.Status) {
+		f.Status = ""
+	}
+
+	known := false
+	for _, column := range models.ReservationSorts {
+		known = known || f.Sort == column
+	}
+	if !known {
+		f.Sort = models.SortArrival
+		f.Desc = src == "all"
+	}
+
+	if after := q.Get("after"); after != "" {
+		f.Cursor, _ = models.ParseCursor(after, false)
+	} else if before := q.Get("before"); before != "" {
+		f.Cursor, _ = models.ParseCursor(before, true)
+	}
+
+	return f
+}
+
 // Displays the reservation calendar
 // Assumptions:
 //
@@ -653,9 +1061,22 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 
 	data["rooms"] = rooms
 
+	// the key to the colours on the calendar; cancelled reservations don't hold their room, so aren't on it
+	var statuses []string
+	for _, status := range models.Statuses {
+		if status != models.StatusCancelled {
+			statuses = append(statuses, status)
+		}
+	}
+	data["statuses"] = statuses
+
+	var blocks []models.RoomRestriction
 	for _, x := range rooms {
 		resMap := make(map[string]int)
+		statusMap := make(map[string]string)
 		blockMap := make(map[string]int)
+		reasonMap := make(map[string]string)
+		externalMap := make(map[string]string)
 
 		// looping through dates -> while we are not after the last day of the month
 		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
@@ -675,17 +1096,51 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 				// reservation
 				for d := y.StartDate; !d.After(y.EndDate); d = d.AddDate(0, 0, 1) {
 					resMap[d.Format("2006-01-2")] = y.ReservationID
+					statusMap[d.Format("2006-01-2")] = y.Reservation.Status
+				}
+			} else if y.RestrictionID == models.RestrictionExternal {
+				// booked on another channel -> only a sync can change it
+				for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+					externalMap[d.Format("2006-01-2")] = y.Reason
 				}
 			} else {
-				// block
-				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
+				// block -> every night up to its end, but only the days of this month get a checkbox
+				for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+					if _, ok := blockMap[d.Format("2006-01-2")]; ok {
+						blockMap[d.Format("2006-01-2")] = y.ID
+						reasonMap[d.Format("2006-01-2")] = y.Reason
+					}
+				}
+				y.Room = x
+				blocks = append(blocks, y)
 			}
 		}
 		data[fmt.Sprintf("reservation_map_%d", x.ID)] = resMap
+		data[fmt.Sprintf("status_map_%d", x.ID)] = statusMap
 		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
+		data[fmt.Sprintf("block_reasons_%d", x.ID)] = reasonMap
+		data[fmt.Sprintf("external_map_%d", x.ID)] = externalMap
+
+		// recurring blocks have no rows to read, so their nights are worked out for the month shown
+		recurring, err := m.DB.RecurringBlocksForRoom(x.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		closedMap := make(map[string]string)
+		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
+			for _, b := range recurring {
+				if b.Blocks(d) {
+					closedMap[d.Format("2006-01-2")] = b.Reason
+					break
+				}
+			}
+		}
+		data[fmt.Sprintf("closed_map_%d", x.ID)] = closedMap
 
 		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
 	}
+	data["blocks"] = blocks
 
 	render.Template(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
 		StringMap: stringMap,
@@ -719,8 +1174,24 @@ func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	res.LineItems, err = m.DB.LineItemsForReservation(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	resPayments, err := m.DB.PaymentsForReservation(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
 	data := make(map[string]interface{})
 	data["reservation"] = res
+	data["payments"] = resPayments
+	// the calendar month or the filtered list the reservation was opened from, passed on so each action leads back there
+	data["query"] = template.URL(r.URL.Query().Encode())
+	data["list"] = template.URL(listQuery(r.URL.Query()))
 
 	render.Template(w, r, "admin-reservations-show.page.tmpl", &models.TemplateData{
 		StringMap: stringMap,
@@ -754,12 +1225,25 @@ func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	form := forms.New(r.PostForm)
+	if form.Has("phone") && !form.IsPhone("phone") {
+		m.App.Session.Put(r.Context(), "error", form.Errors.Get("phone"))
+		back := fmt.Sprintf("/admin/reservations/%s/%d/show", src, id)
+		if r.Form.Get("year") != "" {
+			back += fmt.Sprintf("?y=%s&m=%s", r.Form.Get("year"), r.Form.Get("month"))
+		} else if list := formListQuery(r.Form.Get("list")); list != "" {
+			back += "?" + list
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
 	res.FirstName = r.Form.Get("first_name")
 	res.LastName = r.Form.Get("last_name")
 	res.Email = r.Form.Get("email")
 	res.Phone = r.Form.Get("phone")
 
-	err = m.DB.UpdateReservation(res)
+	err = m.DB.UpdateReservation(res, helpers.Actor(r))
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
@@ -770,53 +1254,97 @@ func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Req
 
 	m.App.Session.Put(r.Context(), "flash", "Changes saved")
 
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
-	}
+	http.Redirect(w, r, reservationsBackURL(src, year, month, formListQuery(r.Form.Get("list"))), http.StatusSeeOther)
 }
 
-// Marks a reservation as processed
-func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
+// Replaces the stored price of a reservation with the current rates for its dates
+func (m *Repository) AdminRepriceReservation(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
 	src := chi.URLParam(r, "src")
 
-	err := m.DB.UpdateProcessedForReservation(id, 1)
+	res, err := m.DB.GetReservationByID(id)
 	if err != nil {
-		log.Println(err)
+		helpers.ServerError(w, err)
+		return
 	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
-	m.App.Session.Put(r.Context(), "flash", "Reservation marked as processed")
+	// admins may re-price stays shorter than the current minimum, so that isn't checked here
+	quote, err := m.Pricing.Quote(res.RoomID, res.StartDate, res.EndDate)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	quote.ApplyTo(&res)
 
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	err = m.DB.RepriceReservation(res, helpers.Actor(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Reservation re-priced at %s", pricing.FormatMoney(res.Total)))
+
+	back := fmt.Sprintf("/admin/reservations/%s/%d/show", src, id)
+	if query := r.URL.Query().Encode(); query != "" {
+		back += "?" + query
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// reservationsBackURL is where a reservation's page leads back to: the calendar month it was opened from,
+// or else the list, filtered as it was
+func reservationsBackURL(src, year, month, list string) string {
+	if year != "" {
+		return fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month)
+	}
+	if list != "" {
+		return fmt.Sprintf("/admin/reservations-%s?%s", src, list)
+	}
+	return fmt.Sprintf("/admin/reservations-%s", src)
+}
+
+// listQuery keeps the filter of the list a reservation was opened from, leaving out the calendar month
+func listQuery(q url.Values) string {
+	list := url.Values{}
+	for key, values := range q {
+		if key != "y" && key != "m" {
+			list[key] = values
+		}
+	}
+	return list.Encode()
+}
+
+// formListQuery reads the list filter posted back from a reservation's page
+func formListQuery(posted string) string {
+	q, err := url.ParseQuery(posted)
+	if err != nil {
+		return ""
 	}
+	return listQuery(q)
 }
 
-// Removes a reservation from the database
+// Moves a reservation to the trash, freeing its room; the reason given for it is in the reason query param
 func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
 	src := chi.URLParam(r, "src")
 
-	err := m.DB.DeleteReservation(id)
+	q := r.URL.Query()
+	year := q.Get("y")
+	month := q.Get("m")
+	reason := strings.TrimSpace(q.Get("reason"))
+	q.Del("reason")
+
+	// the deposit stays held, so a reservation deleted by mistake can be restored as it was;
+	// cancelling a reservation is what gives the money back
+	err := m.DB.DeleteReservation(id, helpers.Actor(r), reason)
 	if err != nil {
 		log.Println(err)
-	}
-
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
-	m.App.Session.Put(r.Context(), "flash", "Reservation removed")
-
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "Couldn't move the reservation to the trash")
 	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "flash", "Reservation moved to the trash")
 	}
+
+	http.Redirect(w, r, reservationsBackURL(src, year, month, listQuery(q)), http.StatusSeeOther)
 }
 
 func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *http.Request) {
@@ -838,27 +1366,31 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 
 	form := forms.New(r.PostForm)
 
+	// a block over several days has a checkbox on each of them, and unticking any one removes it all
+	removed := make(map[int]bool)
 	for _, x := range rooms {
 		// grab the block map from the session
 		// loop through entire map
 		//   if we have an entry in the map that does not exist in our posted data
 		// 	 and if the restriction id > 0, then this is a block we need to remove.
 
-		currMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
+		// token clients have no block map in their session, so there is nothing to remove
+		currMap, _ := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
 
 		for name, value := range currMap {
 			// check to see if it exists in the map
 			if val, ok := currMap[name]; ok {
 				// only care about values > 0 -> blocks and not in the form post
 				// otherwise -> placeholders for days without blocks
-				if val > 0 {
+				if val > 0 && !removed[val] {
 					if !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, name)) {
 
 						// delete restriction by id
-						err := m.DB.DeleteBlockByID(value)
+						err := m.DB.DeleteBlockByID(value, helpers.Actor(r))
 						if err != nil {
 							log.Println(err)
 						}
+						removed[val] = true
 					}
 				}
 			}
@@ -872,8 +1404,12 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 			roomID, _ := strconv.Atoi(tokens[2])
 			t, _ := time.Parse("2006-01-2", tokens[3])
 
-			// insert a new block
-			err := m.DB.InsertBlockForRoom(roomID, t)
+			// insert a new block for the night
+			_, err := m.DB.InsertBlockForRoom(models.RoomRestriction{
+				RoomID:    roomID,
+				StartDate: t,
+				EndDate:   t.AddDate(0, 0, 1),
+			}, helpers.Actor(r))
 			if err != nil {
 				log.Println(err)
 			}
@@ -883,3 +1419,89 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 	m.App.Session.Put(r.Context(), "flash", "Changes saved")
 	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
 }
+
+// Shows the api tokens and the form to create a new one
+func (m *Repository) AdminAPITokens(w http.ResponseWriter, r *http.Request) {
+	m.renderAPITokens(w, r, forms.New(nil), "")
+}
+
+// Creates an api token; the plaintext token is only ever shown on this response
+func (m *Repository) AdminPostAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+
+	scopes := r.PostForm["scopes"]
+	for _, scope := range scopes {
+		if !tokens.IsValidScope(scope) {
+			form.Errors.Add("scopes", fmt.Sprintf("Unknown scope %s", scope))
+		}
+	}
+	if len(scopes) == 0 {
+		form.Errors.Add("scopes", "Choose at least one scope")
+	}
+
+	if !form.Valid() {
+		m.renderAPITokens(w, r, form, "")
+		return
+	}
+
+	plaintext, hash, err := tokens.Generate()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	_, err = m.DB.InsertAPIToken(models.APIToken{
+		UserID:    m.App.Session.GetInt(r.Context(), "user_id"),
+		Name:      r.Form.Get("name"),
+		TokenHash: hash,
+		Scopes:    scopes,
+	})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.renderAPITokens(w, r, forms.New(nil), plaintext)
+}
+
+// Revokes an api token
+func (m *Repository) AdminRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.RevokeAPIToken(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Token revoked")
+	http.Redirect(w, r, "/admin/tokens", http.StatusSeeOther)
+}
+
+// renderAPITokens shows the token page, with newToken displayed if one was just created
+func (m *Repository) renderAPITokens(w http.ResponseWriter, r *http.Request, form *forms.Form, newToken string) {
+	apiTokens, err := m.DB.AllAPITokens()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["tokens"] = apiTokens
+	data["scopes"] = tokens.AllScopes
+
+	stringMap := make(map[string]string)
+	stringMap["new_token"] = newToken
+
+	render.Template(w, r, "admin-tokens.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository"
+)
+
+// holdRoom holds the room the guest picked while they fill in their details, releasing
+// any room they were holding before. If the room can't be held it redirects and returns false
+func (m *Repository) holdRoom(w http.ResponseWriter, r *http.Request, res models.Reservation) bool {
+	m.releaseHold(r)
+
+	if m.App.HoldTTL <= 0 {
+		return true
+	}
+
+	holdID, err := m.DB.InsertHold(models.RoomRestriction{
+		StartDate: res.StartDate,
+		EndDate:   res.EndDate,
+		RoomID:    res.RoomID,
+		ExpiresAt: time.Now().Add(m.App.HoldTTL),
+	})
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, someone else is booking that room for those dates. Please search again.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return false
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't hold the room for you!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return false
+	}
+
+	m.App.Session.Put(r.Context(), "hold_id", holdID)
+	return true
+}
+
+// holdRooms holds every room a group picked while they fill in their details, releasing any
+// rooms held before. If one of the rooms can't be held none are, and it redirects and returns false
+func (m *Repository) holdRooms(w http.ResponseWriter, r *http.Request, reservations []models.Reservation) bool {
+	m.releaseHold(r)
+
+	if m.App.HoldTTL <= 0 {
+		return true
+	}
+
+	var holdIDs []int
+	for _, res := range reservations {
+		holdID, err := m.DB.InsertHold(models.RoomRestriction{
+			StartDate: res.StartDate,
+			EndDate:   res.EndDate,
+			RoomID:    res.RoomID,
+			ExpiresAt: time.Now().Add(m.App.HoldTTL),
+		})
+		if err != nil {
+			m.deleteHolds(holdIDs)
+
+			if errors.Is(err, repository.ErrRoomUnavailable) {
+				m.App.Session.Put(r.Context(), "error", "Sorry, someone else is booking one of those rooms for those dates. Please search again.")
+				http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+				return false
+			}
+
+			m.App.Session.Put(r.Context(), "error", "can't hold the rooms for you!")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return false
+		}
+		holdIDs = append(holdIDs, holdID)
+	}
+
+	m.App.Session.Put(r.Context(), "hold_ids", holdIDs)
+	return true
+}
+
+// releaseHold frees the rooms held for the guest, if any
+func (m *Repository) releaseHold(r *http.Request) {
+	holdIDs, _ := m.App.Session.Pop(r.Context(), "hold_ids").([]int)
+	if holdID := m.App.Session.PopInt(r.Context(), "hold_id"); holdID != 0 {
+		holdIDs = append(holdIDs, holdID)
+	}
+
+	m.deleteHolds(holdIDs)
+}
+
+// deleteHolds frees held rooms, logging rather than failing if one can't be freed
+func (m *Repository) deleteHolds(holdIDs []int) {
+	for _, id := range holdIDs {
+		if err := m.DB.DeleteHold(id); err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+	}
+}
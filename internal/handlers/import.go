@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/importer"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/render"
+)
+
+// maxImportSize is the largest file that can be imported
+const maxImportSize = 10 << 20
+
+// AdminImport shows the form for importing reservations or blocks from a CSV file
+func (m *Repository) AdminImport(w http.ResponseWriter, r *http.Request) {
+	m.renderImport(w, r, nil)
+}
+
+// AdminPostImport checks an uploaded file without writing anything, and shows what would be imported.
+// The rows that passed are kept in the session until they're imported or another file is checked
+func (m *Repository) AdminPostImport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize+1<<20)
+	err := r.ParseMultipartForm(maxImportSize)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Files must be smaller than 10MB")
+		http.Redirect(w, r, "/admin/import", http.StatusSeeOther)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Choose a CSV file to import")
+		http.Redirect(w, r, "/admin/import", http.StatusSeeOther)
+		return
+	}
+	defer file.Close()
+
+	report, err := m.Imports.Check(r.Form.Get("kind"), file)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "The file couldn't be read: "+err.Error())
+		http.Redirect(w, r, "/admin/import", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "import", report.Batch())
+	m.renderImport(w, r, &report)
+}
+
+// AdminPostImportCommit writes the rows of the file last checked, all of them or none
+func (m *Repository) AdminPostImportCommit(w http.ResponseWriter, r *http.Request) {
+	batch, ok := m.App.Session.Pop(r.Context(), "import").(importer.Batch)
+	if !ok || batch.Len() == 0 {
+		m.App.Session.Put(r.Context(), "error", "There's nothing to import; check the file again")
+		http.Redirect(w, r, "/admin/import", http.StatusSeeOther)
+		return
+	}
+
+	err := m.Imports.Import(batch, helpers.Actor(r))
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Nothing was imported. "+err.Error())
+		http.Redirect(w, r, "/admin/import", http.StatusSeeOther)
+		return
+	}
+
+	if batch.Kind == importer.KindBlocks {
+		m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Imported %d blocks", batch.Len()))
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Imported %d reservations", batch.Len()))
+	http.Redirect(w, r, "/admin/reservations-all", http.StatusSeeOther)
+}
+
+// renderImport shows the import page, with the report of the file just checked if there is one
+func (m *Repository) renderImport(w http.ResponseWriter, r *http.Request, report *importer.Report) {
+	data := make(map[string]interface{})
+	data["columns"] = importer.Columns
+	if report != nil {
+		data["report"] = report
+	}
+
+	render.Template(w, r, "admin-import.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
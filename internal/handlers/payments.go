@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/payments"
+)
+
+// maxWebhookBody limits how much of a webhook request is read
+const maxWebhookBody = 1 << 20
+
+// errNoPaymentProvider is returned when a reservation has payments but no provider is set up to settle them
+var errNoPaymentProvider = errors.New("no payment provider is set up")
+
+// depositFor returns the deposit held when booking a stay costing total
+func (m *Repository) depositFor(total int) int {
+	if m.App.Payments == nil {
+		return 0
+	}
+
+	return payments.DepositAmount(total, m.App.DepositRate)
+}
+
+// holdDeposit authorizes the deposit on the guest's card, records it and confirms the reservation
+func (m *Repository) holdDeposit(res models.Reservation, source string, amount int) error {
+	t, err := m.App.Payments.Authorize(payments.AuthorizeRequest{
+		Amount:      amount,
+		Currency:    res.Currency,
+		Source:      source,
+		Description: fmt.Sprintf("Deposit for reservation %s", res.ConfirmationCode),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ConfirmReservationPayment(models.Payment{
+		ReservationID: res.ID,
+		Provider:      m.App.Payments.Name(),
+		Reference:     t.Reference,
+		Status:        t.Status,
+		Amount:        t.Amount,
+		Currency:      res.Currency,
+	})
+	if err != nil {
+		// don't leave money held for a booking we couldn't record
+		if _, refundErr := m.App.Payments.Refund(t.Reference, t.Amount); refundErr != nil {
+			m.App.ErrorLog.Println(refundErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// holdGroupDeposits holds the deposit for each room in a booking group on the guest's card,
+// releasing those already held if one fails
+func (m *Repository) holdGroupDeposits(group models.BookingGroup, source string) error {
+	for i, res := range group.Reservations {
+		amount := m.depositFor(res.Total)
+		if amount == 0 {
+			continue
+		}
+
+		err := m.holdDeposit(res, source, amount)
+		if err != nil {
+			for _, held := range group.Reservations[:i] {
+				if refundErr := m.refundPayments(held.ID); refundErr != nil {
+					m.App.ErrorLog.Println(refundErr)
+				}
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// captureDeposits takes every deposit still held for a reservation
+func (m *Repository) captureDeposits(reservationID int) error {
+	resPayments, err := m.DB.PaymentsForReservation(reservationID)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range resPayments {
+		if p.Status != payments.StatusAuthorized {
+			continue
+		}
+		if m.App.Payments == nil {
+			return errNoPaymentProvider
+		}
+
+		t, err := m.App.Payments.Capture(p.Reference, p.Amount)
+		if err != nil {
+			return err
+		}
+
+		p.Status = t.Status
+		p.Amount = t.Amount
+		err = m.DB.UpdatePayment(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refundPayments gives back every deposit held or taken for a reservation
+func (m *Repository) refundPayments(reservationID int) error {
+	resPayments, err := m.DB.PaymentsForReservation(reservationID)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range resPayments {
+		if p.Status != payments.StatusAuthorized && p.Status != payments.StatusCaptured {
+			continue
+		}
+		if m.App.Payments == nil {
+			return errNoPaymentProvider
+		}
+
+		t, err := m.App.Payments.Refund(p.Reference, p.Amount)
+		if err != nil {
+			return err
+		}
+
+		p.Status = t.Status
+		err = m.DB.UpdatePayment(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PaymentWebhook receives payment status changes from the payment provider
+func (m *Repository) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if m.App.Payments == nil {
+		helpers.ErrorJSON(w, http.StatusNotFound, "Payments aren't taken here", nil)
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusBadRequest, "Can't read request body", nil)
+		return
+	}
+
+	event, err := m.App.Payments.VerifyWebhook(payload, r.Header.Get("X-Payment-Signature"))
+	if errors.Is(err, payments.ErrInvalidSignature) {
+		helpers.ErrorJSON(w, http.StatusUnauthorized, "Invalid signature", nil)
+		return
+	}
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusBadRequest, "Invalid event", nil)
+		return
+	}
+
+	status, ok := payments.StatusForEvent(event.Type)
+	if !ok {
+		// acknowledge events we don't act on so the provider stops sending them
+		helpers.WriteJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	p, err := m.DB.GetPaymentByReference(m.App.Payments.Name(), event.Reference)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ErrorJSON(w, http.StatusNotFound, "Payment not found", nil)
+		return
+	}
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error querying the database", nil)
+		return
+	}
+
+	p.Status = status
+	if event.Amount > 0 {
+		p.Amount = event.Amount
+	}
+
+	err = m.DB.UpdatePayment(p)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusInternalServerError, "Error saving payment", nil)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, nil)
+}
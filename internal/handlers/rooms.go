@@ -0,0 +1,649 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/forms"
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/pricing"
+	"github.com/aparkinlot/Bookings/internal/recurrence"
+	"github.com/aparkinlot/Bookings/internal/render"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/go-chi/chi"
+)
+
+// maxPhotoSize is the largest room photo that can be uploaded
+const maxPhotoSize = 10 << 20
+
+// photoExtensions maps the image types accepted for room photos to the extension they're saved with
+var photoExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// slugify turns a room name into the slug its page is found at, e.g. Major's Suite -> majors-suite
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+
+	for _, c := range strings.ToLower(strings.ReplaceAll(name, "'", "")) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+
+	return b.String()
+}
+
+// Room renders a room's page from the catalog
+func (m *Repository) Room(w http.ResponseWriter, r *http.Request) {
+	room, err := m.DB.GetRoomBySlug(chi.URLParam(r, "slug"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+
+	render.Template(w, r, "room.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRooms lists the rooms in the catalog
+func (m *Repository) AdminRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.Template(w, r, "admin-rooms.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminShowRoom shows the form for editing a room, or adding one when the id is "new"
+func (m *Repository) AdminShowRoom(w http.ResponseWriter, r *http.Request) {
+	room := models.Room{MaxOccupancy: 2, MinNights: 1}
+
+	if idParam := chi.URLParam(r, "id"); idParam != "new" {
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		room, err = m.DB.GetRoomByID(id)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		room.Photos, err = m.DB.PhotosForRoom(id)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	m.renderRoomForm(w, r, room, forms.New(nil))
+}
+
+// AdminPostRoom saves a new or edited room
+func (m *Repository) AdminPostRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var room models.Room
+	if idParam := chi.URLParam(r, "id"); idParam != "new" {
+		room.ID, err = strconv.Atoi(idParam)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("room_name", "max_occupancy", "nightly_rate", "min_nights")
+
+	room.RoomName = strings.TrimSpace(form.Get("room_name"))
+	room.Slug = strings.TrimSpace(form.Get("slug"))
+	if room.Slug == "" {
+		room.Slug = slugify(room.RoomName)
+	}
+	if !slugPattern.MatchString(room.Slug) {
+		form.Errors.Add("slug", "Use lowercase letters, numbers and dashes only")
+	} else if room.Slug == "all" {
+		// /ical/all.ics is the feed of every room
+		form.Errors.Add("slug", "This address is reserved; choose another")
+	}
+
+	room.Description = form.Get("description")
+	room.BedConfiguration = strings.TrimSpace(form.Get("bed_configuration"))
+	for _, a := range strings.Split(form.Get("amenities"), "\n") {
+		if a = strings.TrimSpace(a); a != "" {
+			room.Amenities = append(room.Amenities, a)
+		}
+	}
+
+	room.MaxOccupancy = m.formInt(form, "max_occupancy", 1)
+	room.MinNights = m.formInt(form, "min_nights", 1)
+	room.NightlyRate = m.formMoney(form, "nightly_rate")
+	room.WeekendSurcharge = 0
+	if form.Get("weekend_surcharge") != "" {
+		room.WeekendSurcharge = m.formMoney(form, "weekend_surcharge")
+	}
+
+	if !form.Valid() {
+		if room.ID > 0 {
+			room.Photos, _ = m.DB.PhotosForRoom(room.ID)
+		}
+		m.renderRoomForm(w, r, room, form)
+		return
+	}
+
+	if room.ID == 0 {
+		room.ID, err = m.DB.InsertRoom(room, helpers.Actor(r))
+	} else {
+		err = m.DB.UpdateRoom(room, helpers.Actor(r))
+	}
+	if errors.Is(err, repository.ErrSlugTaken) {
+		form.Errors.Add("slug", "Another room already uses this address")
+		m.renderRoomForm(w, r, room, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	render.InvalidateRooms()
+
+	m.App.Session.Put(r.Context(), "flash", "Room saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", room.ID), http.StatusSeeOther)
+}
+
+// AdminDeleteRoom removes a room from the catalog, as long as it has never been booked
+func (m *Repository) AdminDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	photos, err := m.DB.PhotosForRoom(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteRoom(id, helpers.Actor(r))
+	if errors.Is(err, repository.ErrRoomInUse) {
+		m.App.Session.Put(r.Context(), "error", "Rooms that have been booked can't be deleted")
+		http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", id), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	render.InvalidateRooms()
+
+	for _, p := range photos {
+		m.removePhotoFile(p)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room deleted")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminPostRoomPhoto uploads a photo to a room's gallery
+func (m *Repository) AdminPostRoomPhoto(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	redirect := fmt.Sprintf("/admin/rooms/%d", id)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPhotoSize+1<<20)
+	err = r.ParseMultipartForm(maxPhotoSize)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Photos must be smaller than 10MB")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	file, _, err := r.FormFile("photo")
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Choose a photo to upload")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	defer file.Close()
+
+	// trust the content, not the name or type the browser sent
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	ext, ok := photoExtensions[http.DetectContentType(head[:n])]
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Photos must be JPEG, PNG, GIF or WebP images")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	name, err := photoFilename(id, ext)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	dir := filepath.Join(m.App.UploadPath, "rooms")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	dst, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, io.MultiReader(bytes.NewReader(head[:n]), file))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	photo := models.RoomPhoto{
+		RoomID:  id,
+		URL:     "/uploads/rooms/" + name,
+		Caption: strings.TrimSpace(r.FormValue("caption")),
+	}
+	photo.ID, err = m.DB.InsertRoomPhoto(photo, helpers.Actor(r))
+	if err != nil {
+		m.removePhotoFile(photo)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Photo added")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminDeleteRoomPhoto removes a photo from a room's gallery
+func (m *Repository) AdminDeleteRoomPhoto(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	photo, err := m.DB.GetRoomPhotoByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteRoomPhoto(id, helpers.Actor(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.removePhotoFile(photo)
+
+	m.App.Session.Put(r.Context(), "flash", "Photo removed")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", photo.RoomID), http.StatusSeeOther)
+}
+
+// AdminPostBookingRule adds a booking rule to a room
+func (m *Repository) AdminPostBookingRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	redirect := fmt.Sprintf("/admin/rooms/%d", id)
+
+	err = r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	b, problem := bookingRuleFromForm(forms.New(r.PostForm))
+	if problem != "" {
+		m.App.Session.Put(r.Context(), "error", problem)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	b.RoomID = id
+
+	b.ID, err = m.DB.InsertBookingRule(b, helpers.Actor(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Booking rule added")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminDeleteBookingRule removes a booking rule from a room
+func (m *Repository) AdminDeleteBookingRule(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	b, err := m.DB.GetBookingRuleByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteBookingRule(id, helpers.Actor(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Booking rule removed")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", b.RoomID), http.StatusSeeOther)
+}
+
+// AdminPostRecurringBlock adds a recurring block, such as closing every Monday, to a room
+func (m *Repository) AdminPostRecurringBlock(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	redirect := fmt.Sprintf("/admin/rooms/%d", id)
+
+	err = r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	b, problem := recurringBlockFromForm(forms.New(r.PostForm))
+	if problem != "" {
+		m.App.Session.Put(r.Context(), "error", problem)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	b.RoomID = id
+
+	b.ID, err = m.DB.InsertRecurringBlock(b, helpers.Actor(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Recurring block added")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminDeleteRecurringBlock removes a recurring block from a room, freeing all its nights
+func (m *Repository) AdminDeleteRecurringBlock(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	b, err := m.DB.GetRecurringBlockByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteRecurringBlock(id, helpers.Actor(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Recurring block removed")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", b.RoomID), http.StatusSeeOther)
+}
+
+// recurringBlockFromForm reads a recurring block from the form on the room page,
+// returning what's wrong with it if it can't be saved
+func recurringBlockFromForm(form *forms.Form) (models.RecurringBlock, string) {
+	b := models.RecurringBlock{Nights: 1}
+
+	if !form.IsDate("recur_start") {
+		return b, "Give the first night the block applies to as yyyy-mm-dd"
+	}
+	b.StartDate = form.Date("recur_start")
+
+	var err error
+	if n := strings.TrimSpace(form.Get("recur_nights")); n != "" {
+		b.Nights, err = strconv.Atoi(n)
+		if err != nil || b.Nights < 1 || b.Nights > 366 {
+			return b, "Each closure must be a whole number of nights, from 1 to 366"
+		}
+	}
+
+	var rule recurrence.Rule
+	switch form.Get("repeat") {
+	case "weekly":
+		days, err := weekdaysFromForm(form.Values["recur_days"])
+		if err != nil {
+			return b, "Pick the days from the list"
+		}
+		var weekdays []time.Weekday
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if days.Has(d) {
+				weekdays = append(weekdays, d)
+			}
+		}
+		if len(weekdays) == 0 {
+			return b, "Pick the days of the week the room is closed"
+		}
+		rule = recurrence.WeeklyOn(weekdays...)
+	case "yearly":
+		rule = recurrence.Annually()
+	case "custom":
+		rule, err = recurrence.Parse(form.Get("rrule"))
+		if err != nil {
+			return b, "The repeat rule can't be used: " + err.Error()
+		}
+	default:
+		return b, "Pick how often the block repeats"
+	}
+	b.RRule = rule.String()
+
+	b.Reason = strings.TrimSpace(form.Get("recur_reason"))
+	if b.Reason == "" {
+		return b, "Give a reason for the block"
+	}
+
+	return b, ""
+}
+
+// bookingRuleFromForm reads a booking rule from the form on the room page,
+// returning what's wrong with it if it can't be saved
+func bookingRuleFromForm(form *forms.Form) (models.BookingRule, string) {
+	var b models.BookingRule
+
+	if form.Has("start_date") || form.Has("end_date") {
+		if !form.IsDate("start_date") || !form.IsDate("end_date") {
+			return b, "Give both dates of the rule as yyyy-mm-dd, or neither for a rule that applies all year"
+		}
+		if !form.DateRange("start_date", "end_date") {
+			return b, "The rule must end after it starts"
+		}
+		b.StartDate = form.Date("start_date")
+		b.EndDate = form.Date("end_date")
+	}
+
+	numbers := []struct {
+		field string
+		value *int
+	}{
+		{"min_nights", &b.MinNights},
+		{"max_nights", &b.MaxNights},
+		{"lead_days", &b.LeadDays},
+		{"horizon_days", &b.HorizonDays},
+	}
+	for _, n := range numbers {
+		v := strings.TrimSpace(form.Get(n.field))
+		if v == "" {
+			continue
+		}
+
+		var err error
+		*n.value, err = strconv.Atoi(v)
+		if err != nil || *n.value < 0 {
+			return b, "Nights and days must be whole numbers"
+		}
+	}
+	if b.MaxNights > 0 && b.MaxNights < b.MinNights {
+		return b, "The maximum stay can't be shorter than the minimum"
+	}
+
+	var err error
+	b.ArrivalDays, err = weekdaysFromForm(form.Values["arrival_days"])
+	if err != nil {
+		return b, "Pick arrival days from the list"
+	}
+	b.DepartureDays, err = weekdaysFromForm(form.Values["departure_days"])
+	if err != nil {
+		return b, "Pick departure days from the list"
+	}
+
+	if b == (models.BookingRule{StartDate: b.StartDate, EndDate: b.EndDate}) {
+		return b, "Set at least one limit for the rule"
+	}
+
+	return b, ""
+}
+
+// weekdaysFromForm turns the values of weekday checkboxes, 0 for Sunday to 6 for Saturday, into a set
+func weekdaysFromForm(values []string) (models.Weekdays, error) {
+	var w models.Weekdays
+	for _, v := range values {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 || d > 6 {
+			return 0, fmt.Errorf("invalid weekday %q", v)
+		}
+		w = w.Add(time.Weekday(d))
+	}
+	return w, nil
+}
+
+// renderRoomForm shows the room form with its photo gallery, booking rules and recurring blocks
+func (m *Repository) renderRoomForm(w http.ResponseWriter, r *http.Request, room models.Room, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["weekdays"] = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+
+	if room.ID > 0 {
+		bookingRules, err := m.DB.BookingRulesForRoom(room.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["rules"] = bookingRules
+
+		recurringBlocks, err := m.DB.RecurringBlocksForRoom(room.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["recurring_blocks"] = recurringBlocks
+
+		feeds, err := m.DB.ICalFeedsForRoom(room.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["ical_feeds"] = feeds
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["amenities"] = strings.Join(room.Amenities, "\n")
+	stringMap["nightly_rate"] = moneyInput(room.NightlyRate)
+	stringMap["weekend_surcharge"] = moneyInput(room.WeekendSurcharge)
+	if room.FeedToken != "" {
+		stringMap["feed_url"] = m.feedURL(room)
+	}
+
+	render.Template(w, r, "admin-room-show.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// formInt reads a whole number of at least min from the form, adding an error if it isn't one
+func (m *Repository) formInt(form *forms.Form, field string, min int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(form.Get(field)))
+	if err != nil || n < min {
+		form.Errors.Add(field, fmt.Sprintf("Enter a whole number of at least %d", min))
+	}
+	return n
+}
+
+// formMoney reads a dollar amount from the form in cents, adding an error if it isn't one
+func (m *Repository) formMoney(form *forms.Form, field string) int {
+	cents, err := pricing.ParseMoney(form.Get(field))
+	if err != nil {
+		form.Errors.Add(field, "Enter an amount in dollars, e.g. 129.50")
+	}
+	return cents
+}
+
+// moneyInput formats cents for a dollar input, e.g. 12950 -> 129.50
+func moneyInput(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// photoFilename returns a name for an uploaded photo that can't be guessed or collide
+func photoFilename(roomID int, ext string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d-%s%s", roomID, hex.EncodeToString(b), ext), nil
+}
+
+// removePhotoFile deletes an uploaded photo from disk; seeded photos under /static are left alone
+func (m *Repository) removePhotoFile(p models.RoomPhoto) {
+	name, ok := strings.CutPrefix(p.URL, "/uploads/rooms/")
+	if !ok || name != filepath.Base(name) {
+		return
+	}
+
+	err := os.Remove(filepath.Join(m.App.UploadPath, "rooms", name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		m.App.ErrorLog.Println(err)
+	}
+}
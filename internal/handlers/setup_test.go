@@ -13,7 +13,11 @@ import (
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/aparkinlot/Bookings/internal/config"
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/importer"
 	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/payments"
+	"github.com/aparkinlot/Bookings/internal/pricing"
 	"github.com/aparkinlot/Bookings/internal/render"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -29,6 +33,9 @@ var functions = template.FuncMap{
 	"formatDate":   render.FormatDate,
 	"iterate":      render.Iterate,
 	"add":          render.Add,
+	"formatMoney":  pricing.FormatMoney,
+	"statusName":   models.StatusName,
+	"statusColor":  render.StatusColor,
 }
 
 func TestMain(m *testing.M) {
@@ -36,7 +43,9 @@ func TestMain(m *testing.M) {
 	gob.Register(models.User{})
 	gob.Register(models.Room{})
 	gob.Register(models.Restriction{})
+	gob.Register(models.BookingGroup{})
 	gob.Register(map[string]int{})
+	gob.Register(importer.Batch{})
 
 	// change this to true when in production
 	app.InProduction = false
@@ -55,6 +64,19 @@ func TestMain(m *testing.M) {
 
 	app.Session = session
 
+	app.TaxRate = 1000
+	app.CleaningFee = 2500
+	app.DepositRate = 2500
+	app.HoldTTL = 15 * time.Minute
+	app.BaseURL = "https://bookings.example.com/"
+	app.Payments = payments.NewFakeProvider("test-secret")
+
+	uploadPath, err := os.MkdirTemp("", "bookings-uploads")
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.UploadPath = uploadPath
+
 	mailChan := make(chan models.MailData)
 	app.MailChan = mailChan
 	defer close(mailChan)
@@ -72,8 +94,12 @@ func TestMain(m *testing.M) {
 	repo := NewTestRepo(&app)
 	NewHandlers(repo)
 	render.NewRenderer(&app)
+	render.NewRoomSource(repo.DB)
+	helpers.NewHelpers(&app)
 
-	os.Exit(m.Run())
+	code := m.Run()
+	os.RemoveAll(uploadPath)
+	os.Exit(code)
 }
 
 func listenForMail() {
@@ -93,8 +119,9 @@ func getRoutes() http.Handler {
 
 	mux.Get("/", Repo.Home)
 	mux.Get("/about", Repo.About)
-	mux.Get("/generals-quarters", Repo.Generals)
-	mux.Get("/majors-suite", Repo.Majors)
+	mux.Get("/rooms/{slug}", Repo.Room)
+	mux.Handle("/generals-quarters", http.RedirectHandler("/rooms/generals-quarters", http.StatusMovedPermanently))
+	mux.Handle("/majors-suite", http.RedirectHandler("/rooms/majors-suite", http.StatusMovedPermanently))
 
 	mux.Get("/search-availability", Repo.Availability)
 	mux.Post("/search-availability", Repo.PostAvailability)
@@ -106,22 +133,71 @@ func getRoutes() http.Handler {
 	mux.Post("/make-reservation", Repo.PostReservation)
 	mux.Get("/reservation-summary", Repo.ReservationSummary)
 
+	mux.Get("/choose-rooms", Repo.ChooseRooms)
+	mux.Get("/make-group-reservation", Repo.GroupReservation)
+	mux.Post("/make-group-reservation", Repo.PostGroupReservation)
+	mux.Get("/group-reservation-summary", Repo.GroupReservationSummary)
+
+	mux.Get("/my-reservation/lookup", Repo.GuestLookup)
+	mux.Post("/my-reservation/lookup", Repo.PostGuestLookup)
+	mux.Get("/my-reservation", Repo.GuestReservation)
+	mux.Post("/my-reservation/change-dates", Repo.PostGuestChangeDates)
+	mux.Post("/my-reservation/cancel", Repo.PostGuestCancel)
+
 	mux.Get("/user/login", Repo.ShowLogin)
 	mux.Post("/user/login", Repo.PostShowLogin)
 	mux.Get("/user/logout", Repo.Logout)
 
+	mux.Post("/webhooks/payments", Repo.PaymentWebhook)
+
+	mux.Get("/ical/all.ics", Repo.AllRoomsFeed)
+	mux.Get("/ical/{slug}.ics", Repo.RoomFeed)
+
+	mux.Get("/api/v1/rooms", Repo.APIRooms)
+	mux.Get("/api/v1/rooms/{id}/availability", Repo.APIRoomAvailability)
+	mux.Get("/api/v1/reservations/{id}", Repo.APIGetReservation)
+
 	mux.Get("/admin/dashboard", Repo.AdminDashboard)
 
 	mux.Get("/admin/reservations-new", Repo.AdminNewReservations)
 	mux.Get("/admin/reservations-all", Repo.AdminAllReservations)
+	mux.Get("/admin/reservations-{src}/export.{format}", Repo.AdminExportReservations)
 	mux.Get("/admin/reservations-calendar", Repo.AdminReservationsCalendar)
 	mux.Post("/admin/reservations-calendar", Repo.AdminPostReservationsCalendar)
-	mux.Get("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
+	mux.Post("/admin/blocks", Repo.AdminPostBlock)
+	mux.Get("/admin/delete-block/{id}/do", Repo.AdminDeleteBlock)
+	mux.Get("/admin/reservation-status/{src}/{id}/{status}/do", Repo.AdminReservationStatus)
+	mux.Get("/admin/confirm-group/{id}/do", Repo.AdminConfirmBookingGroup)
+	mux.Get("/admin/reprice-reservation/{src}/{id}/do", Repo.AdminRepriceReservation)
 	mux.Get("/admin/delete-reservation/{src}/{id}/do", Repo.AdminDeleteReservation)
+	mux.Get("/admin/reservations-trash", Repo.AdminTrash)
+	mux.Get("/admin/restore-reservation/{src}/{id}/do", Repo.AdminRestoreReservation)
 
 	mux.Get("/admin/reservations/{src}/{id}/show", Repo.AdminShowReservation)
+	mux.Get("/admin/groups/{id}/show", Repo.AdminShowBookingGroup)
 	mux.Post("/admin/reservations/{src}/{id}", Repo.AdminPostShowReservation)
 
+	mux.Get("/admin/tokens", Repo.AdminAPITokens)
+
+	mux.Get("/admin/rooms", Repo.AdminRooms)
+	mux.Get("/admin/rooms/{id}", Repo.AdminShowRoom)
+	mux.Post("/admin/rooms/{id}", Repo.AdminPostRoom)
+	mux.Post("/admin/rooms/{id}/photos", Repo.AdminPostRoomPhoto)
+	mux.Get("/admin/delete-room/{id}/do", Repo.AdminDeleteRoom)
+	mux.Get("/admin/delete-room-photo/{id}/do", Repo.AdminDeleteRoomPhoto)
+	mux.Post("/admin/rooms/{id}/rules", Repo.AdminPostBookingRule)
+	mux.Get("/admin/delete-booking-rule/{id}/do", Repo.AdminDeleteBookingRule)
+	mux.Post("/admin/rooms/{id}/recurring-blocks", Repo.AdminPostRecurringBlock)
+	mux.Get("/admin/delete-recurring-block/{id}/do", Repo.AdminDeleteRecurringBlock)
+	mux.Post("/admin/rooms/{id}/feed-token", Repo.AdminPostRoomFeedToken)
+	mux.Post("/admin/rooms/{id}/ical-feeds", Repo.AdminPostICalFeed)
+	mux.Get("/admin/delete-ical-feed/{id}/do", Repo.AdminDeleteICalFeed)
+	mux.Get("/admin/import", Repo.AdminImport)
+	mux.Post("/admin/import", Repo.AdminPostImport)
+	mux.Post("/admin/import/commit", Repo.AdminPostImportCommit)
+	mux.Get("/admin/audit", Repo.AdminAudit)
+	mux.Post("/admin/ical-feeds/sync", Repo.AdminSyncICalFeeds)
+
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/go-chi/chi"
+)
+
+// errDeposit is returned when a status change is stopped because the deposit couldn't be taken or given back
+var errDeposit = errors.New("deposit couldn't be settled")
+
+// statusFlashes are shown once a reservation reaches each status
+var statusFlashes = map[string]string{
+	models.StatusConfirmed:  "Reservation confirmed",
+	models.StatusCheckedIn:  "Guest checked in",
+	models.StatusCheckedOut: "Guest checked out",
+	models.StatusCancelled:  "Reservation cancelled",
+	models.StatusNoShow:     "Reservation marked as a no-show",
+}
+
+// changeStatus moves a reservation to a new status and records the change. Confirming it takes the deposit
+// held when the guest booked, and cancelling it gives the deposit back
+func (m *Repository) changeStatus(r *http.Request, res models.Reservation, status string) error {
+	if !models.CanChangeStatus(res.Status, status) {
+		return repository.ErrStatusChange
+	}
+
+	var err error
+	switch status {
+	case models.StatusConfirmed:
+		err = m.captureDeposits(res.ID)
+	case models.StatusCancelled:
+		err = m.refundPayments(res.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDeposit, err)
+	}
+
+	err = m.DB.UpdateReservationStatus(res.ID, status, helpers.Actor(r))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// statusError says why a reservation couldn't be moved to a status, for the flash message
+func statusError(res models.Reservation, status string, err error) string {
+	switch {
+	case errors.Is(err, repository.ErrStatusChange):
+		return fmt.Sprintf("A reservation that is %s can't be marked %s", models.StatusName(res.Status), models.StatusName(status))
+	case errors.Is(err, errDeposit) && status == models.StatusCancelled:
+		return "Couldn't refund the deposit, so the reservation wasn't cancelled"
+	case errors.Is(err, errDeposit):
+		return "Couldn't capture the deposit, so the reservation wasn't confirmed"
+	}
+	return fmt.Sprintf("Couldn't mark the reservation %s", models.StatusName(status))
+}
+
+// AdminReservationStatus moves a reservation to the status in the url
+func (m *Repository) AdminReservationStatus(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	src := chi.URLParam(r, "src")
+	status := chi.URLParam(r, "status")
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	res, err := m.DB.GetReservationByID(id)
+	if err == nil {
+		err = m.changeStatus(r, res, status)
+	}
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", statusError(res, status, err))
+	} else {
+		m.App.Session.Put(r.Context(), "flash", statusFlashes[status])
+	}
+
+	http.Redirect(w, r, reservationsBackURL(src, year, month, listQuery(r.URL.Query())), http.StatusSeeOther)
+}
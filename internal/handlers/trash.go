@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/aparkinlot/Bookings/internal/helpers"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/render"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/go-chi/chi"
+)
+
+// AdminTrash lists the reservations deleted in the admin, most recently deleted first
+func (m *Repository) AdminTrash(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.DeletedReservations()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	render.Template(w, r, "admin-trash.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRestoreReservation takes a reservation out of the trash. Its room is held for it again,
+// so it's only restored if nobody has booked or blocked the room for its dates since
+func (m *Repository) AdminRestoreReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	src := chi.URLParam(r, "src")
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+	redirect := reservationsBackURL(src, year, month, listQuery(r.URL.Query()))
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if !res.IsDeleted() {
+		m.App.Session.Put(r.Context(), "error", "That reservation isn't in the trash")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.RestoreReservation(id, helpers.Actor(r))
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "The room has been booked or blocked for those dates since, so the reservation can't be restored")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Couldn't restore the reservation")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation restored")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
@@ -1,11 +1,15 @@
 package helpers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"runtime/debug"
+	"strings"
 
 	"github.com/aparkinlot/Bookings/internal/config"
+	"github.com/aparkinlot/Bookings/internal/models"
 )
 
 var app *config.AppConfig
@@ -27,6 +31,99 @@ func ServerError(w http.ResponseWriter, err error) {
 }
 
 func IsAuthenticated(r *http.Request) bool {
+	if _, ok := APITokenFromRequest(r); ok {
+		return true
+	}
 	exists := app.Session.Exists(r.Context(), "user_id")
 	return exists
 }
+
+// AccessLevel returns the access level of whoever made the request, or 0 if nobody is logged in
+// Token clients act with the access level of the user who created the token
+func AccessLevel(r *http.Request) int {
+	if t, ok := APITokenFromRequest(r); ok {
+		return t.User.AccessLevel
+	}
+	return app.Session.GetInt(r.Context(), "access_level")
+}
+
+// UserID returns the id of the user who made the request, or 0 if nobody is logged in
+// Token clients act as the user who created the token
+func UserID(r *http.Request) int {
+	if t, ok := APITokenFromRequest(r); ok {
+		return t.UserID
+	}
+	return app.Session.GetInt(r.Context(), "user_id")
+}
+
+// Actor returns who is making the changes a request asks for, for the history
+func Actor(r *http.Request) models.Actor {
+	return models.Actor{UserID: UserID(r)}
+}
+
+type contextKey string
+
+const apiTokenKey contextKey = "api_token"
+
+// WithAPIToken returns a copy of r that carries the api token it was authenticated with
+func WithAPIToken(r *http.Request, t models.APIToken) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiTokenKey, t))
+}
+
+// APITokenFromRequest returns the api token r was authenticated with, if any
+func APITokenFromRequest(r *http.Request) (models.APIToken, bool) {
+	t, ok := r.Context().Value(apiTokenKey).(models.APIToken)
+	return t, ok
+}
+
+// BearerToken returns the token from an "Authorization: Bearer" header, or "" if there is none
+func BearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// APIError describes what went wrong with an api request
+type APIError struct {
+	Status  int                 `json:"status"`
+	Message string              `json:"message"`
+	Fields  map[string][]string `json:"fields,omitempty"`
+}
+
+// APIResponse is the envelope every api response is wrapped in
+type APIResponse struct {
+	OK    bool        `json:"ok"`
+	Data  interface{} `json:"data,omitempty"`
+	Error *APIError   `json:"error,omitempty"`
+}
+
+// WriteJSON writes data to the client wrapped in the api envelope
+func WriteJSON(w http.ResponseWriter, status int, data interface{}) {
+	writeEnvelope(w, status, APIResponse{OK: true, Data: data})
+}
+
+// ErrorJSON writes an api error to the client; fields holds per-field validation messages, if any
+func ErrorJSON(w http.ResponseWriter, status int, message string, fields map[string][]string) {
+	writeEnvelope(w, status, APIResponse{
+		OK: false,
+		Error: &APIError{
+			Status:  status,
+			Message: message,
+			Fields:  fields,
+		},
+	})
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, resp APIResponse) {
+	out, err := json.MarshalIndent(resp, "", "    ")
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
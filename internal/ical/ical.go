@@ -0,0 +1,135 @@
+// Package ical reads and writes iCalendar (RFC 5545) feeds of whole-day events, the format phone
+// calendars and channel managers subscribe to
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+)
+
+// ContentType is the media type of an iCalendar feed
+const ContentType = "text/calendar; charset=utf-8"
+
+// dateLayout is an iCalendar DATE value
+const dateLayout = "20060102"
+
+// stampLayout is an iCalendar DATE-TIME value in UTC
+const stampLayout = "20060102T150405Z"
+
+// maxLineLength is the most octets a line may hold before it must be folded
+const maxLineLength = 75
+
+// Event is a whole-day event. End is exclusive, as DTEND is, so a stay ends on the departure date
+type Event struct {
+	UID         string // stays the same for the life of the event, so subscribers update it instead of adding another
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	RRule       string // repeats the event, e.g. FREQ=WEEKLY;BYDAY=MO
+	Status      string // StatusCancelled once the event is called off; only read from feeds
+	Modified    time.Time
+}
+
+// Calendar is a named list of events
+type Calendar struct {
+	Name   string
+	Events []Event
+}
+
+// Write writes the calendar to w. stamp is when the feed was generated, given to events
+// that don't know when they were last changed
+func (c Calendar) Write(w io.Writer, stamp time.Time) error {
+	b := bufio.NewWriter(w)
+	l := lineWriter{w: b}
+
+	l.line("BEGIN:VCALENDAR")
+	l.line("VERSION:2.0")
+	l.line("PRODID:-//Bookings//Room Calendar//EN")
+	l.line("CALSCALE:GREGORIAN")
+	l.line("METHOD:PUBLISH")
+	if c.Name != "" {
+		l.line("X-WR-CALNAME:" + Escape(c.Name))
+	}
+
+	for _, e := range c.Events {
+		modified := e.Modified
+		if modified.IsZero() {
+			modified = stamp
+		}
+
+		l.line("BEGIN:VEVENT")
+		l.line("UID:" + e.UID)
+		l.line("DTSTAMP:" + modified.UTC().Format(stampLayout))
+		l.line("DTSTART;VALUE=DATE:" + e.Start.Format(dateLayout))
+		l.line("DTEND;VALUE=DATE:" + e.End.Format(dateLayout))
+		if e.RRule != "" {
+			l.line("RRULE:" + e.RRule)
+		}
+		l.line("SUMMARY:" + Escape(e.Summary))
+		if e.Description != "" {
+			l.line("DESCRIPTION:" + Escape(e.Description))
+		}
+		// the room is taken, so free/busy lookups should see it as busy
+		l.line("TRANSP:OPAQUE")
+		l.line("END:VEVENT")
+	}
+
+	l.line("END:VCALENDAR")
+
+	if l.err != nil {
+		return l.err
+	}
+	return b.Flush()
+}
+
+// Escape escapes a TEXT value, so commas, semicolons and new lines survive
+func Escape(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// lineWriter writes content lines, keeping the first error
+type lineWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// line writes s ending in CRLF, folded so no line is longer than maxLineLength octets
+func (l *lineWriter) line(s string) {
+	if l.err != nil {
+		return
+	}
+	_, l.err = l.w.WriteString(fold(s) + "\r\n")
+}
+
+// fold splits a long line, starting each continuation with a space.
+// Lines are only split between characters, never inside a multi-byte one
+func fold(s string) string {
+	if len(s) <= maxLineLength {
+		return s
+	}
+
+	var b strings.Builder
+	limit := maxLineLength
+	n := 0
+	for _, r := range s {
+		size := len(string(r))
+		if n+size > limit {
+			b.WriteString("\r\n ")
+			// the leading space counts towards the length of the next line
+			limit = maxLineLength - 1
+			n = 0
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	return b.String()
+}
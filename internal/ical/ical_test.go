@@ -0,0 +1,194 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func TestWrite(t *testing.T) {
+	c := Calendar{
+		Name: "Major's Suite",
+		Events: []Event{
+			{
+				UID:         "reservation-7@bookings",
+				Start:       date("2025-07-01"),
+				End:         date("2025-07-04"),
+				Summary:     "Smith, John",
+				Description: "Code ABC123\nLate arrival; after 10pm",
+				Modified:    time.Date(2025, 6, 1, 9, 30, 0, 0, time.UTC),
+			},
+			{
+				UID:     "recurring-block-1@bookings",
+				Start:   date("2025-01-06"),
+				End:     date("2025-01-07"),
+				Summary: "Closed",
+				RRule:   "FREQ=WEEKLY;BYDAY=MO",
+			},
+		},
+	}
+
+	var b strings.Builder
+	err := c.Write(&b, time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\nVERSION:2.0\r\n",
+		"X-WR-CALNAME:Major's Suite\r\n",
+		"UID:reservation-7@bookings\r\nDTSTAMP:20250601T093000Z\r\nDTSTART;VALUE=DATE:20250701\r\nDTEND;VALUE=DATE:20250704\r\n",
+		"SUMMARY:Smith\\, John\r\n",
+		"DESCRIPTION:Code ABC123\\nLate arrival\\; after 10pm\r\n",
+		"DTSTAMP:20250602T000000Z\r\n",
+		"RRULE:FREQ=WEEKLY;BYDAY=MO\r\n",
+		"END:VEVENT\r\nEND:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected the feed to contain %q, got\n%s", want, out)
+		}
+	}
+
+	if strings.Count(out, "BEGIN:VEVENT") != 2 {
+		t.Errorf("expected 2 events, got\n%s", out)
+	}
+}
+
+func TestFold(t *testing.T) {
+	long := "DESCRIPTION:" + strings.Repeat("é", 100)
+	folded := fold(long)
+
+	for i, line := range strings.Split(folded, "\r\n") {
+		if len(line) > maxLineLength {
+			t.Errorf("line %d is %d octets long", i, len(line))
+		}
+		if i > 0 && !strings.HasPrefix(line, " ") {
+			t.Errorf("line %d doesn't start with a space", i)
+		}
+	}
+
+	unfolded := strings.ReplaceAll(folded, "\r\n ", "")
+	if unfolded != long {
+		t.Errorf("expected unfolding to give back the line, got %q", unfolded)
+	}
+
+	if fold("SUMMARY:short") != "SUMMARY:short" {
+		t.Error("expected a short line to be left alone")
+	}
+}
+
+func TestParse(t *testing.T) {
+	feed := "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"PRODID:-//Example//Listing//EN\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:abc-1@example.com\r\n" +
+		"DTSTART;VALUE=DATE:20250701\r\n" +
+		"DTEND;VALUE=DATE:20250704\r\n" +
+		"SUMMARY:Reserved\\, thanks\r\n" +
+		"DESCRIPTION:A long description that the feed has folded onto a second\r\n" +
+		"  line\\nand a new line\r\n" +
+		"BEGIN:VALARM\r\n" +
+		"UID:alarm-uid\r\n" +
+		"END:VALARM\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:abc-2@example.com\r\n" +
+		"DTSTART;TZID=\"Europe/London:Daylight\":20250801T150000\r\n" +
+		"DURATION:P1W\r\n" +
+		"STATUS:cancelled\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:abc-3@example.com\r\n" +
+		"DTSTART:20250901\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	events, err := Parse(strings.NewReader(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events but got %d", len(events))
+	}
+
+	first := events[0]
+	if first.UID != "abc-1@example.com" || !first.Start.Equal(date("2025-07-01")) || !first.End.Equal(date("2025-07-04")) {
+		t.Errorf("first event read wrong: %+v", first)
+	}
+	if first.Summary != "Reserved, thanks" {
+		t.Errorf("expected the summary to be unescaped, got %q", first.Summary)
+	}
+	if first.Description != "A long description that the feed has folded onto a second line\nand a new line" {
+		t.Errorf("expected the description to be unfolded, got %q", first.Description)
+	}
+
+	second := events[1]
+	if !second.Start.Equal(date("2025-08-01")) || !second.End.Equal(date("2025-08-08")) {
+		t.Errorf("expected the second event to last a week from 1 August, got %s to %s", second.Start, second.End)
+	}
+	if second.Status != StatusCancelled {
+		t.Errorf("expected the second event to be cancelled, got %q", second.Status)
+	}
+
+	if !events[2].End.Equal(date("2025-09-02")) {
+		t.Errorf("expected an event with no end to last a day, got %s", events[2].End)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		feed string
+	}{
+		{"empty", ""},
+		{"not a calendar", "<html></html>"},
+		{"not a vcalendar", "BEGIN:VCARD\r\nEND:VCARD\r\n"},
+		{"unfinished", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\n"},
+		{"no uid", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART:20250701\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+		{"no start", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+		{"bad date", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nDTSTART:2025-07-01\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+	}
+
+	for _, e := range tests {
+		_, err := Parse(strings.NewReader(e.feed))
+		if err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := Calendar{Events: []Event{{
+		UID:         "block-3@bookings",
+		Start:       date("2025-08-01"),
+		End:         date("2025-08-15"),
+		Summary:     "Renovation; new bathroom, tiles",
+		Description: strings.Repeat("Long notes ", 20),
+	}}}
+
+	var b strings.Builder
+	err := c.Write(&b, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := Parse(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event but got %d", len(events))
+	}
+	got, want := events[0], c.Events[0]
+	if got.UID != want.UID || got.Summary != want.Summary || got.Description != want.Description ||
+		!got.Start.Equal(want.Start) || !got.End.Equal(want.End) {
+		t.Errorf("expected %+v but got %+v", want, got)
+	}
+}
@@ -0,0 +1,200 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusCancelled marks an event the calendar it came from has cancelled
+const StatusCancelled = "CANCELLED"
+
+// Parse reads the events of an iCalendar feed, such as the ones booking sites publish for a listing.
+// Times are dropped, keeping only the dates. Events with no end last a day, as DATE events do in RFC 5545.
+// Alarms and time zones are skipped
+func Parse(r io.Reader) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	var e Event
+	var stack []string
+	var hasStart, hasEnd bool
+	var duration int
+
+	for n, line := range lines {
+		name, value, ok := splitLine(line)
+		if !ok {
+			return nil, fmt.Errorf("line %d isn't a NAME:VALUE line", n+1)
+		}
+
+		switch name {
+		case "BEGIN":
+			value = strings.ToUpper(value)
+			if len(stack) == 0 && value != "VCALENDAR" {
+				return nil, errors.New("the feed isn't an iCalendar file")
+			}
+			stack = append(stack, value)
+			if value == "VEVENT" {
+				e, hasStart, hasEnd, duration = Event{}, false, false, 0
+			}
+			continue
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1] != strings.ToUpper(value) {
+				return nil, fmt.Errorf("line %d ends %s, which wasn't begun", n+1, value)
+			}
+			stack = stack[:len(stack)-1]
+			if strings.ToUpper(value) != "VEVENT" {
+				continue
+			}
+
+			if e.UID == "" {
+				return nil, fmt.Errorf("the event ending on line %d has no UID", n+1)
+			}
+			if !hasStart {
+				return nil, fmt.Errorf("event %s has no DTSTART", e.UID)
+			}
+			if !hasEnd {
+				if duration < 1 {
+					duration = 1
+				}
+				e.End = e.Start.AddDate(0, 0, duration)
+			}
+			events = append(events, e)
+			continue
+		}
+
+		// only the properties of the event itself count, not those of its alarms
+		if len(stack) == 0 || stack[len(stack)-1] != "VEVENT" {
+			continue
+		}
+
+		switch name {
+		case "UID":
+			e.UID = value
+		case "DTSTART":
+			e.Start, err = parseDate(value)
+			hasStart = true
+		case "DTEND":
+			e.End, err = parseDate(value)
+			hasEnd = true
+		case "DURATION":
+			duration, err = parseDays(value)
+		case "SUMMARY":
+			e.Summary = unescape(value)
+		case "DESCRIPTION":
+			e.Description = unescape(value)
+		case "STATUS":
+			e.Status = strings.ToUpper(value)
+		case "RRULE":
+			e.RRule = value
+		case "LAST-MODIFIED":
+			// only used to date the event, so an odd one isn't worth failing the feed over
+			if t, err := time.Parse(stampLayout, value); err == nil {
+				e.Modified = t
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s is invalid: %w", n+1, name, err)
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("the feed ends before %s does", stack[len(stack)-1])
+	}
+	if lines == nil {
+		return nil, errors.New("the feed is empty")
+	}
+
+	return events, nil
+}
+
+// unfold reads the content lines of a feed, joining folded lines back together
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, s.Err()
+}
+
+// splitLine splits a content line into its upper cased name and its value, dropping any parameters.
+// Parameter values may be quoted, and a quoted colon doesn't end them
+func splitLine(line string) (name, value string, ok bool) {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ':' && !quoted:
+			name, _, _ = strings.Cut(line[:i], ";")
+			return strings.ToUpper(name), line[i+1:], name != ""
+		}
+	}
+	return "", "", false
+}
+
+// parseDate reads a DATE or DATE-TIME value, keeping the date
+func parseDate(value string) (time.Time, error) {
+	if len(value) < 8 {
+		return time.Time{}, errors.New("expected a date such as 20250701")
+	}
+	return time.Parse(dateLayout, value[:8])
+}
+
+// parseDays reads a DURATION of whole days or weeks, e.g. P3D or P1W
+func parseDays(value string) (int, error) {
+	v := strings.TrimPrefix(strings.ToUpper(value), "+")
+	if !strings.HasPrefix(v, "P") || len(v) < 3 {
+		return 0, errors.New("expected a duration such as P3D")
+	}
+
+	n, err := strconv.Atoi(v[1 : len(v)-1])
+	if err != nil {
+		return 0, errors.New("expected a duration of whole days or weeks")
+	}
+	switch v[len(v)-1] {
+	case 'D':
+		return n, nil
+	case 'W':
+		return n * 7, nil
+	}
+	return 0, errors.New("expected a duration of whole days or weeks")
+}
+
+// unescape reverses Escape
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
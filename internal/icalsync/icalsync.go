@@ -0,0 +1,159 @@
+// Package icalsync imports the calendar feeds other booking channels publish for our rooms,
+// blocking the nights booked there so they can't be booked here as well
+package icalsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/ical"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository"
+)
+
+// maxFeedSize is the most of a feed that is read; a listing's calendar is a few kilobytes
+const maxFeedSize = 5 << 20
+
+// fetchTimeout is how long a channel has to send its feed
+const fetchTimeout = 30 * time.Second
+
+// ErrLocalFeed is returned for a feed that isn't a web address, when feeds can't be read from files
+var ErrLocalFeed = errors.New("calendars can only be read from web addresses")
+
+// Service keeps the external blocks of each imported feed in step with the feed
+type Service struct {
+	DB repository.DatabaseRepo
+
+	// Client fetches the feeds given as web addresses
+	Client *http.Client
+
+	// Now tells the service what day it is
+	Now func() time.Time
+
+	// Dir is a directory feeds may also be read from as local files, which is how feeds are tested.
+	// It's empty in the app, so nothing but web addresses is ever read
+	Dir string
+}
+
+// NewService creates a calendar import service
+func NewService(db repository.DatabaseRepo) *Service {
+	return &Service{
+		DB:     db,
+		Client: &http.Client{Timeout: fetchTimeout},
+		Now:    time.Now,
+	}
+}
+
+// SyncAll syncs every feed, carrying on past the ones that fail. Each failure is also recorded on its feed
+func (s *Service) SyncAll() error {
+	feeds, err := s.DB.AllICalFeeds()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, f := range feeds {
+		_, err := s.Sync(f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s feed of %s: %w", f.Name, f.Room.RoomName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sync reads a feed and brings its external blocks up to date. The history has the changes as the
+// calendar sync's, whoever asked for it
+func (s *Service) Sync(f models.ICalFeed) (models.ICalSync, error) {
+	events, err := s.fetch(f.URL)
+	if err != nil {
+		if dbErr := s.DB.UpdateICalFeedError(f.ID, err.Error()); dbErr != nil {
+			return models.ICalSync{}, dbErr
+		}
+		return models.ICalSync{}, err
+	}
+
+	return s.DB.SyncICalFeed(f, Blocks(events, s.Now()), models.ActorCalendarSync)
+}
+
+// fetch reads the events of the feed at location
+func (s *Service) fetch(location string) ([]ical.Event, error) {
+	body, err := s.open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ical.Parse(io.LimitReader(body, maxFeedSize))
+}
+
+// open opens a feed. Web addresses are fetched; anything else is read as a file in Dir, if there is one
+func (s *Service) open(location string) (io.ReadCloser, error) {
+	if IsWebAddress(location) {
+		resp, err := s.Client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("the feed answered %s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+
+	name := strings.TrimPrefix(location, "file://")
+	if s.Dir == "" || !filepath.IsLocal(name) {
+		return nil, ErrLocalFeed
+	}
+	return os.Open(filepath.Join(s.Dir, name))
+}
+
+// IsWebAddress reports whether a feed is fetched over http rather than read from a file
+func IsWebAddress(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// Blocks turns the events of a feed into external blocks, keyed by their uid. Cancelled events and
+// stays that are over by today are left out, so syncing removes them. Where a uid is repeated the last event wins
+func Blocks(events []ical.Event, today time.Time) []models.RoomRestriction {
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+
+	var blocks []models.RoomRestriction
+	index := make(map[string]int)
+
+	for _, e := range events {
+		if e.Status == ical.StatusCancelled {
+			continue
+		}
+
+		end := e.End
+		if !end.After(e.Start) {
+			end = e.Start.AddDate(0, 0, 1)
+		}
+		if !end.After(today) {
+			continue
+		}
+
+		b := models.RoomRestriction{
+			StartDate:     e.Start,
+			EndDate:       end,
+			RestrictionID: models.RestrictionExternal,
+			ExternalUID:   e.UID,
+			Notes:         e.Summary,
+		}
+
+		if i, ok := index[e.UID]; ok {
+			blocks[i] = b
+			continue
+		}
+		index[e.UID] = len(blocks)
+		blocks = append(blocks, b)
+	}
+
+	return blocks
+}
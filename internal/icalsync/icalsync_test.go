@@ -0,0 +1,159 @@
+package icalsync
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/config"
+	"github.com/aparkinlot/Bookings/internal/ical"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository/dbrepo"
+)
+
+func date(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+func newTestService() *Service {
+	s := NewService(dbrepo.NewTestingRepo(&config.AppConfig{}))
+	s.Now = func() time.Time { return date("2025-07-01") }
+	s.Dir = "testdata"
+	return s
+}
+
+func TestBlocks(t *testing.T) {
+	events := []ical.Event{
+		{UID: "stay", Start: date("2025-07-10"), End: date("2025-07-12"), Summary: "Reserved"},
+		{UID: "cancelled", Start: date("2025-07-20"), End: date("2025-07-22"), Status: ical.StatusCancelled},
+		{UID: "over", Start: date("2025-06-28"), End: date("2025-07-01")},
+		{UID: "leaving today", Start: date("2025-06-30"), End: date("2025-07-02")},
+		{UID: "no nights", Start: date("2025-08-01"), End: date("2025-08-01")},
+		{UID: "stay", Start: date("2025-07-11"), End: date("2025-07-14"), Summary: "Reserved, moved"},
+	}
+
+	blocks := Blocks(events, date("2025-07-01"))
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks but got %d: %+v", len(blocks), blocks)
+	}
+
+	moved := blocks[0]
+	if moved.ExternalUID != "stay" || !moved.StartDate.Equal(date("2025-07-11")) || moved.Notes != "Reserved, moved" {
+		t.Errorf("expected the repeated uid to take the later event, got %+v", moved)
+	}
+	if moved.RestrictionID != models.RestrictionExternal {
+		t.Errorf("expected an external block, got restriction %d", moved.RestrictionID)
+	}
+
+	if blocks[1].ExternalUID != "leaving today" {
+		t.Errorf("expected a stay leaving today to be kept, got %s", blocks[1].ExternalUID)
+	}
+
+	if !blocks[2].EndDate.Equal(date("2025-08-02")) {
+		t.Errorf("expected an event with no nights to block one, got %s", blocks[2].EndDate)
+	}
+}
+
+func TestSyncFile(t *testing.T) {
+	s := newTestService()
+
+	result, err := s.Sync(models.ICalFeed{ID: 1, RoomID: 1, Name: "Example", URL: "channel.ics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the cancelled stay and the one in 2020 aren't blocked
+	if result.Added != 2 {
+		t.Errorf("expected 2 blocks to be added but got %d", result.Added)
+	}
+
+	_, err = s.Sync(models.ICalFeed{ID: 1, RoomID: 1, Name: "Example", URL: "file://channel.ics"})
+	if err != nil {
+		t.Errorf("expected a file:// address to be read, got %v", err)
+	}
+
+	_, err = s.Sync(models.ICalFeed{ID: 1, RoomID: 1, Name: "Example", URL: "missing.ics"})
+	if err == nil {
+		t.Error("expected an error for a missing file")
+	}
+
+	// files outside the directory are never read, and none are without one
+	_, err = s.Sync(models.ICalFeed{ID: 1, RoomID: 1, Name: "Example", URL: "file://../icalsync.go"})
+	if !errors.Is(err, ErrLocalFeed) {
+		t.Errorf("expected a file outside the directory to be refused, got %v", err)
+	}
+	s.Dir = ""
+	_, err = s.Sync(models.ICalFeed{ID: 1, RoomID: 1, Name: "Example", URL: "channel.ics"})
+	if !errors.Is(err, ErrLocalFeed) {
+		t.Errorf("expected files to be refused without a directory, got %v", err)
+	}
+}
+
+func TestSyncWeb(t *testing.T) {
+	feed, err := os.ReadFile("testdata/channel.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/listing.ics":
+			w.Header().Set("Content-Type", ical.ContentType)
+			_, _ = w.Write(feed)
+		case "/not-a-calendar":
+			_, _ = w.Write([]byte("<html><body>Log in</body></html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s := newTestService()
+
+	result, err := s.Sync(models.ICalFeed{ID: 1, RoomID: 1, URL: srv.URL + "/listing.ics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 2 {
+		t.Errorf("expected 2 blocks to be added but got %d", result.Added)
+	}
+
+	_, err = s.Sync(models.ICalFeed{ID: 1, RoomID: 1, URL: srv.URL + "/gone.ics"})
+	if err == nil || err.Error() != "the feed answered 404 Not Found" {
+		t.Errorf("expected a 404 to be reported, got %v", err)
+	}
+
+	_, err = s.Sync(models.ICalFeed{ID: 1, RoomID: 1, URL: srv.URL + "/not-a-calendar"})
+	if err == nil {
+		t.Error("expected an error for a page that isn't a calendar")
+	}
+}
+
+// notFound answers every request with a 404, standing in for channels in tests
+type notFound struct{}
+
+func (notFound) RoundTrip(r *http.Request) (*http.Response, error) {
+	rr := httptest.NewRecorder()
+	http.NotFound(rr, r)
+	return rr.Result(), nil
+}
+
+func TestSyncAll(t *testing.T) {
+	s := newTestService()
+	s.Client = &http.Client{Transport: notFound{}}
+
+	err := s.SyncAll()
+	if err == nil {
+		t.Fatal("expected the feeds that failed to be reported")
+	}
+	for _, want := range []string{"Airbnb feed of General's Quarters", "Booking.com feed of Major's Suite"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err.Error())
+		}
+	}
+}
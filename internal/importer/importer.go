@@ -0,0 +1,390 @@
+// Package importer reads reservations and owner blocks in bulk from CSV files, such as the spreadsheets
+// bookings were kept in before, checking every row before any of them is written
+package importer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/forms"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/pricing"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/aparkinlot/Bookings/internal/tokens"
+)
+
+// the kinds of file that can be imported
+const (
+	KindReservations = "reservations"
+	KindBlocks       = "blocks"
+)
+
+// Columns lists the columns of each kind of file in the order they're checked. The room may be given by
+// its name, slug or ID; dates are yyyy-mm-dd
+var Columns = map[string][]string{
+	KindReservations: {"room", "first_name", "last_name", "email", "phone", "start_date", "end_date",
+		"adults", "children", "total", "status"},
+	KindBlocks: {"room", "start_date", "end_date", "reason", "notes"},
+}
+
+// required lists the columns each kind of file must have; the others may be left out
+var required = map[string][]string{
+	KindReservations: {"room", "first_name", "last_name", "email", "start_date", "end_date"},
+	KindBlocks:       {"room", "start_date", "end_date", "reason"},
+}
+
+// maxRows is the most rows one file may hold
+const maxRows = 10000
+
+// ErrUnknownKind is returned when asked to import a kind of file there are no columns for
+var ErrUnknownKind = errors.New("importer: unknown kind of file")
+
+// Row is one line of a file and what checking it found
+type Row struct {
+	Line        int // in the file, counting the headings as line 1
+	Reservation models.Reservation
+	Block       models.RoomRestriction
+	Problems    []string // why the row can't be imported; none if it can
+}
+
+// Report is what checking a file found, row by row
+type Report struct {
+	Kind string
+	Rows []Row
+}
+
+// Valid counts the rows that can be imported
+func (r Report) Valid() int {
+	n := 0
+	for _, row := range r.Rows {
+		if len(row.Problems) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Batch returns the rows that can be imported, ready to write
+func (r Report) Batch() Batch {
+	b := Batch{Kind: r.Kind}
+	for _, row := range r.Rows {
+		if len(row.Problems) > 0 {
+			continue
+		}
+		b.Lines = append(b.Lines, row.Line)
+		if r.Kind == KindBlocks {
+			b.Blocks = append(b.Blocks, row.Block)
+		} else {
+			b.Reservations = append(b.Reservations, row.Reservation)
+		}
+	}
+	return b
+}
+
+// Batch is the checked rows of a file, kept between checking them and writing them
+type Batch struct {
+	Kind         string
+	Lines        []int // the line each row came from
+	Reservations []models.Reservation
+	Blocks       []models.RoomRestriction
+}
+
+// Len is the number of rows in the batch
+func (b Batch) Len() int {
+	return len(b.Reservations) + len(b.Blocks)
+}
+
+// Service checks and imports files
+type Service struct {
+	DB repository.DatabaseRepo
+}
+
+// NewService creates an import service
+func NewService(db repository.DatabaseRepo) *Service {
+	return &Service{DB: db}
+}
+
+// Check reads a file of the kind given and checks each row as the booking forms would, and that its room
+// is free and no other row in the file wants it. Nothing is written. Dates in the past are allowed, as
+// the rows are usually old bookings. An error is only returned when the file can't be read at all
+func (s *Service) Check(kind string, r io.Reader) (Report, error) {
+	report := Report{Kind: kind}
+
+	if _, ok := Columns[kind]; !ok {
+		return report, ErrUnknownKind
+	}
+
+	c := csv.NewReader(r)
+	c.TrimLeadingSpace = true
+
+	headings, err := c.Read()
+	if err == io.EOF {
+		return report, errors.New("the file is empty")
+	}
+	if err != nil {
+		return report, err
+	}
+	// spreadsheet apps may start the file with a byte order mark
+	for i := range headings {
+		headings[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(headings[i], "\ufeff")))
+	}
+	for _, column := range required[kind] {
+		if !contains(headings, column) {
+			return report, fmt.Errorf("the file has no %s column; it needs %s", column, strings.Join(required[kind], ", "))
+		}
+	}
+
+	rooms, err := s.rooms()
+	if err != nil {
+		return report, err
+	}
+
+	// the stays already accepted from the file, by room, so two rows can't both have a room
+	taken := make(map[int][]Row)
+
+	for {
+		record, err := c.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := c.FieldPos(0)
+		if err != nil {
+			return report, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(report.Rows) == maxRows {
+			return report, fmt.Errorf("the file has more than %d rows; split it up", maxRows)
+		}
+
+		values := url.Values{}
+		for i, heading := range headings {
+			values.Set(heading, strings.TrimSpace(record[i]))
+		}
+
+		row := Row{Line: line}
+		if kind == KindBlocks {
+			row.Block, row.Problems = checkBlock(values, rooms)
+		} else {
+			row.Reservation, row.Problems = checkReservation(values, rooms)
+		}
+
+		if len(row.Problems) == 0 {
+			row.Problems, err = s.checkFree(row, taken)
+			if err != nil {
+				return report, err
+			}
+		}
+		if len(row.Problems) == 0 {
+			roomID, _, _ := row.stay()
+			taken[roomID] = append(taken[roomID], row)
+		}
+
+		report.Rows = append(report.Rows, row)
+	}
+
+	return report, nil
+}
+
+// Import writes the rows of a batch in one go, giving each reservation a confirmation code.
+// If a row can't be written, because its room was booked after the file was checked, none are,
+// and the error names the line the row came from. Each row is kept in the history as actor's
+func (s *Service) Import(b Batch, actor models.Actor) error {
+	var err error
+	if b.Kind == KindBlocks {
+		err = s.DB.ImportBlocks(b.Blocks, actor)
+	} else {
+		for i := range b.Reservations {
+			b.Reservations[i].ConfirmationCode, err = tokens.ConfirmationCode()
+			if err != nil {
+				return err
+			}
+		}
+		err = s.DB.ImportReservations(b.Reservations, actor)
+	}
+
+	var rowErr *repository.ImportError
+	if errors.As(err, &rowErr) && rowErr.Index < len(b.Lines) {
+		if errors.Is(rowErr.Err, repository.ErrRoomUnavailable) {
+			return fmt.Errorf("line %d: the room was booked after the file was checked", b.Lines[rowErr.Index])
+		}
+		return fmt.Errorf("line %d: %w", b.Lines[rowErr.Index], rowErr.Err)
+	}
+	return err
+}
+
+// rooms looks up rooms by ID, slug and lower cased name
+func (s *Service) rooms() (map[string]models.Room, error) {
+	all, err := s.DB.AllRooms()
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := make(map[string]models.Room)
+	for _, room := range all {
+		rooms[strconv.Itoa(room.ID)] = room
+		rooms[strings.ToLower(room.RoomName)] = room
+		if room.Slug != "" {
+			rooms[room.Slug] = room
+		}
+	}
+	return rooms, nil
+}
+
+// checkReservation reads a reservation from a row, by the rules the booking form uses
+func checkReservation(values url.Values, rooms map[string]models.Room) (models.Reservation, []string) {
+	form := forms.New(values)
+	form.Required("first_name", "last_name", "email")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+	if form.Has("phone") {
+		form.IsPhone("phone")
+	}
+	checkDates(form)
+
+	res := models.Reservation{
+		FirstName: form.Get("first_name"),
+		LastName:  form.Get("last_name"),
+		Email:     form.Get("email"),
+		Phone:     form.Get("phone"),
+		StartDate: form.Date("start_date"),
+		EndDate:   form.Date("end_date"),
+		Adults:    1,
+		Status:    models.StatusConfirmed,
+	}
+
+	room, ok := findRoom(form, rooms)
+	res.RoomID = room.ID
+	res.Room = room
+
+	var err error
+	if form.Has("adults") {
+		res.Adults, err = strconv.Atoi(form.Get("adults"))
+		if err != nil || res.Adults < 1 {
+			form.Errors.Add("adults", "Must be a number, at least 1")
+		}
+	}
+	if form.Has("children") {
+		res.Children, err = strconv.Atoi(form.Get("children"))
+		if err != nil || res.Children < 0 {
+			form.Errors.Add("children", "Must be a number")
+		}
+	}
+	if ok && res.Guests() > room.MaxOccupancy && room.MaxOccupancy > 0 {
+		form.Errors.Add("adults", fmt.Sprintf("%s sleeps %d at most", room.RoomName, room.MaxOccupancy))
+	}
+	if form.Has("total") {
+		res.Total, err = pricing.ParseMoney(form.Get("total"))
+		if err != nil {
+			form.Errors.Add("total", "Must be an amount, e.g. 129.50")
+		}
+		res.Subtotal = res.Total
+	}
+	// the status may be written as it's shown, e.g. Checked In
+	status := strings.ReplaceAll(strings.ToLower(form.Get("status")), " ", "-")
+	switch {
+	case status == "":
+	case status == models.StatusCancelled:
+		form.Errors.Add("status", "Cancelled bookings don't hold a room, so aren't imported")
+	case models.IsStatus(status):
+		res.Status = status
+	default:
+		form.Errors.Add("status", "Must be one of "+strings.Join(models.Statuses, ", "))
+	}
+
+	return res, problems(form, KindReservations)
+}
+
+// checkBlock reads an owner block from a row, by the rules the block form uses
+func checkBlock(values url.Values, rooms map[string]models.Room) (models.RoomRestriction, []string) {
+	form := forms.New(values)
+	form.Required("reason")
+	checkDates(form)
+
+	room, _ := findRoom(form, rooms)
+	b := models.RoomRestriction{
+		StartDate:     form.Date("start_date"),
+		EndDate:       form.Date("end_date"),
+		RoomID:        room.ID,
+		RestrictionID: models.RestrictionOwnerBlock,
+		Reason:        form.Get("reason"),
+		Notes:         form.Get("notes"),
+		Room:          room,
+	}
+
+	return b, problems(form, KindBlocks)
+}
+
+// checkDates checks the dates of a stay or block
+func checkDates(form *forms.Form) {
+	startOK := form.IsDate("start_date")
+	endOK := form.IsDate("end_date")
+	if startOK && endOK {
+		form.DateRange("start_date", "end_date")
+	}
+}
+
+// findRoom looks up the room a row is for
+func findRoom(form *forms.Form, rooms map[string]models.Room) (models.Room, bool) {
+	name := form.Get("room")
+	room, ok := rooms[strings.ToLower(name)]
+	if !ok {
+		form.Errors.Add("room", fmt.Sprintf("There's no room called %q", name))
+	}
+	return room, ok
+}
+
+// problems lists a form's errors, column by column
+func problems(form *forms.Form, kind string) []string {
+	var list []string
+	for _, column := range Columns[kind] {
+		for _, e := range form.Errors[column] {
+			list = append(list, column+": "+e)
+		}
+	}
+	return list
+}
+
+// checkFree checks the room of a row is free for its dates, both in the database and in the rows taken before it
+func (s *Service) checkFree(row Row, taken map[int][]Row) ([]string, error) {
+	roomID, start, end := row.stay()
+
+	for _, other := range taken[roomID] {
+		_, otherStart, otherEnd := other.stay()
+		if start.Before(otherEnd) && otherStart.Before(end) {
+			return []string{fmt.Sprintf("dates: Clash with line %d for the same room", other.Line)}, nil
+		}
+	}
+
+	free, err := s.DB.SearchAvailibilityByDatesAndRoomID(start, end, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !free {
+		return []string{fmt.Sprintf("dates: The room is already booked or blocked for some nights from %s to %s",
+			start.Format(forms.DateLayout), end.Format(forms.DateLayout))}, nil
+	}
+	return nil, nil
+}
+
+// stay is the room and dates a row takes
+func (row Row) stay() (int, time.Time, time.Time) {
+	if row.Block.RoomID > 0 {
+		return row.Block.RoomID, row.Block.StartDate, row.Block.EndDate
+	}
+	return row.Reservation.RoomID, row.Reservation.StartDate, row.Reservation.EndDate
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
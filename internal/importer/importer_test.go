@@ -0,0 +1,153 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/config"
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository/dbrepo"
+)
+
+func newTestService() *Service {
+	return NewService(dbrepo.NewTestingRepo(&config.AppConfig{}))
+}
+
+func TestCheckReservations(t *testing.T) {
+	file := "\ufeffRoom,First_Name,Last_Name,Email,Phone,Start_Date,End_Date,Adults,Children,Total,Status\n" +
+		"generals-quarters,John,Smith,john@smith.com,555-555-5555,2019-07-01,2019-07-04,2,0,$450.00,Checked In\n" +
+		"Major's Suite,Jane,Doe,jane@doe.com,,2019-07-02,2019-07-05,,,,pending\n" +
+		"1,Mary,Jones,mary@jones.com,,2019-07-03,2019-07-05,1,,,\n" +
+		"3,Al,Brown,not an email,call me,2019-07-05,2019-07-01,x,,lots,maybe\n" +
+		"2,Bill,Green,bill@green.com,,2050-07-01,2050-07-04,5,,,\n" +
+		"1,Sue,White,sue@white.com,,2019-09-01,2019-09-03,1,,,cancelled\n"
+
+	report, err := newTestService().Check(KindReservations, strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rows) != 6 {
+		t.Fatalf("expected 6 rows but got %d", len(report.Rows))
+	}
+	if report.Valid() != 2 {
+		t.Errorf("expected 2 valid rows but got %d", report.Valid())
+	}
+
+	first := report.Rows[0].Reservation
+	if first.RoomID != 1 || first.Total != 45000 || first.Status != models.StatusCheckedIn || first.Adults != 2 ||
+		!first.StartDate.Equal(time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("first row read wrong: %+v", first)
+	}
+	second := report.Rows[1].Reservation
+	if second.RoomID != 2 || second.Status != models.StatusPending || second.Adults != 1 {
+		t.Errorf("second row read wrong: %+v", second)
+	}
+
+	clash := report.Rows[2]
+	if clash.Line != 4 || len(clash.Problems) != 1 || !strings.Contains(clash.Problems[0], "Clash with line 2") {
+		t.Errorf("expected line 4 to clash with line 2, got %+v", clash)
+	}
+
+	bad := strings.Join(report.Rows[3].Problems, "\n")
+	for _, want := range []string{
+		`room: There's no room called "3"`,
+		"first_name: This field must be at least 3 characters long",
+		"email: Invalid email address",
+		"phone: Invalid phone number",
+		"end_date: End date must be after start date",
+		"adults: Must be a number",
+		"total: Must be an amount",
+		"status: Must be one of pending, confirmed, checked-in, checked-out, cancelled, no-show",
+	} {
+		if !strings.Contains(bad, want) {
+			t.Errorf("expected line 5 to report %q, got\n%s", want, bad)
+		}
+	}
+
+	crowded := strings.Join(report.Rows[4].Problems, "\n")
+	if !strings.Contains(crowded, "adults: Major's Suite sleeps 4 at most") {
+		t.Errorf("expected line 6 to be too many guests, got\n%s", crowded)
+	}
+
+	cancelled := strings.Join(report.Rows[5].Problems, "\n")
+	if !strings.Contains(cancelled, "status: Cancelled bookings don't hold a room, so aren't imported") {
+		t.Errorf("expected line 7 not to be imported as it's cancelled, got\n%s", cancelled)
+	}
+
+	batch := report.Batch()
+	if batch.Len() != 2 || batch.Lines[0] != 2 || batch.Lines[1] != 3 {
+		t.Errorf("expected lines 2 and 3 in the batch, got %+v", batch.Lines)
+	}
+}
+
+func TestCheckBlocks(t *testing.T) {
+	file := "room,start_date,end_date,reason,notes\n" +
+		"1,2019-08-01,2019-08-15,Renovation,New bathroom\n" +
+		"1,2050-08-01,2050-08-15,Renovation,\n" +
+		"2,2019-08-01,2019-08-15,,\n"
+
+	report, err := newTestService().Check(KindBlocks, strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid() != 1 {
+		t.Fatalf("expected 1 valid row but got %d: %+v", report.Valid(), report.Rows)
+	}
+	if b := report.Rows[0].Block; b.Reason != "Renovation" || b.Notes != "New bathroom" || b.Nights() != 14 {
+		t.Errorf("first row read wrong: %+v", b)
+	}
+	if p := report.Rows[1].Problems; len(p) != 1 || !strings.Contains(p[0], "already booked or blocked") {
+		t.Errorf("expected line 3 to be taken, got %v", p)
+	}
+	if p := report.Rows[2].Problems; len(p) != 1 || p[0] != "reason: This field cannot be blank" {
+		t.Errorf("expected line 4 to need a reason, got %v", p)
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		kind string
+		file string
+	}{
+		{"unknown kind", "guests", "room\n"},
+		{"empty", KindBlocks, ""},
+		{"missing column", KindBlocks, "room,start_date,end_date\n"},
+		{"ragged row", KindBlocks, "room,start_date,end_date,reason\n1,2019-08-01\n"},
+		{"database error", KindBlocks, "room,start_date,end_date,reason\n1,2060-01-01,2060-01-04,Closed\n"},
+	}
+
+	for _, e := range tests {
+		_, err := newTestService().Check(e.kind, strings.NewReader(e.file))
+		if err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	s := newTestService()
+
+	file := "room,first_name,last_name,email,start_date,end_date\n" +
+		"1,John,Smith,john@smith.com,2019-07-01,2019-07-04\n" +
+		"2,Jane,Doe,jane@doe.com,2048-01-01,2048-01-04\n"
+	report, err := s.Check(KindReservations, strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := report.Batch()
+	err = s.Import(batch, models.Actor{UserID: 1})
+	if err == nil || err.Error() != "line 3: the room was booked after the file was checked" {
+		t.Errorf("expected line 3 to have been booked since, got %v", err)
+	}
+
+	batch.Lines, batch.Reservations = batch.Lines[:1], batch.Reservations[:1]
+	if err := s.Import(batch, models.Actor{UserID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Reservations[0].ConfirmationCode == "" {
+		t.Error("expected the reservation to be given a confirmation code")
+	}
+}
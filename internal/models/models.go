@@ -1,7 +1,14 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/aparkinlot/Bookings/internal/recurrence"
 )
 
 // Reservation data -> requests/json : this is temporarary until database is set up
@@ -24,14 +31,182 @@ type User struct {
 	UpdatedAt   time.Time
 }
 
+// Roles, stored in users.access_level
+// Each role can do everything the roles below it can
+const (
+	AccessReadOnly  = 1 // can look at reservations and the calendar
+	AccessFrontDesk = 2 // can edit guest details and move reservations through their statuses
+	AccessManager   = 3 // can delete reservations and manage owner blocks
+	AccessOwner     = 4 // can manage api tokens
+)
+
+// RoleName returns the display name of an access level
+func RoleName(accessLevel int) string {
+	switch {
+	case accessLevel >= AccessOwner:
+		return "Owner"
+	case accessLevel >= AccessManager:
+		return "Manager"
+	case accessLevel >= AccessFrontDesk:
+		return "Front Desk"
+	case accessLevel >= AccessReadOnly:
+		return "Read Only"
+	default:
+		return "None"
+	}
+}
+
 // Room model -> database
+// Rates are in cents
 type Room struct {
+	ID               int
+	RoomName         string
+	Slug             string
+	Description      string
+	MaxOccupancy     int
+	BedConfiguration string
+	Amenities        []string
+	NightlyRate      int
+	WeekendSurcharge int
+	MinNights        int
+	FeedToken        string // secret in the address of the room's calendar feed; blank until one is made
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	Photos           []RoomPhoto
+}
+
+// CoverPhoto returns the first photo of the room, or an empty photo if it has none
+func (r Room) CoverPhoto() RoomPhoto {
+	if len(r.Photos) == 0 {
+		return RoomPhoto{}
+	}
+	return r.Photos[0]
+}
+
+// RoomPhoto model -> database
+// URL is the path the photo is served from, e.g. /uploads/rooms/1-3f9a.jpg
+type RoomPhoto struct {
+	ID        int
+	RoomID    int
+	URL       string
+	Caption   string
+	SortOrder int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// SeasonalRate model -> database
+// Overrides a room's nightly rate for nights from StartDate up to, but not including, EndDate
+type SeasonalRate struct {
+	ID          int
+	RoomID      int
+	Name        string
+	StartDate   time.Time
+	EndDate     time.Time
+	NightlyRate int
+	MinNights   int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Covers reports whether the season prices the night starting on d
+func (s SeasonalRate) Covers(d time.Time) bool {
+	return !d.Before(s.StartDate) && d.Before(s.EndDate)
+}
+
+// BookingRule model -> database
+// Limits the stays that can be booked in a room for arrivals from StartDate up to, but not including,
+// EndDate, or all year if the dates are zero. Zero fields leave the room's other rules in force.
+type BookingRule struct {
+	ID            int
+	RoomID        int
+	StartDate     time.Time
+	EndDate       time.Time
+	MinNights     int
+	MaxNights     int
+	ArrivalDays   Weekdays
+	DepartureDays Weekdays
+	LeadDays      int // how many days ahead of arrival the stay must be booked
+	HorizonDays   int // how many days ahead of arrival the stay can be booked
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// IsYearRound reports whether the rule applies whatever the arrival date
+func (b BookingRule) IsYearRound() bool {
+	return b.StartDate.IsZero()
+}
+
+// Covers reports whether the rule applies to stays arriving on d
+func (b BookingRule) Covers(d time.Time) bool {
+	return b.IsYearRound() || (!d.Before(b.StartDate) && d.Before(b.EndDate))
+}
+
+// RecurringBlock model -> database
+// Closes a room for Nights nights at each occurrence of an RRULE, the first on StartDate,
+// so repeating closures never have to be stored night by night
+type RecurringBlock struct {
 	ID        int
-	RoomName  string
+	RoomID    int
+	StartDate time.Time
+	Nights    int
+	RRule     string
+	Reason    string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// Rule parses the block's RRULE
+func (b RecurringBlock) Rule() (recurrence.Rule, error) {
+	return recurrence.Parse(b.RRule)
+}
+
+// Describe says in words when the block closes the room
+func (b RecurringBlock) Describe() string {
+	r, err := b.Rule()
+	if err != nil {
+		return b.RRule
+	}
+	return r.Describe(b.StartDate, b.Nights)
+}
+
+// Blocks reports whether the block closes the room on the night of d; a rule that can't be read closes nothing
+func (b RecurringBlock) Blocks(d time.Time) bool {
+	r, err := b.Rule()
+	return err == nil && r.Blocks(b.StartDate, b.Nights, d)
+}
+
+// Overlaps reports whether the block closes the room for any night of a stay from start to end
+func (b RecurringBlock) Overlaps(start, end time.Time) bool {
+	r, err := b.Rule()
+	return err == nil && r.Overlaps(b.StartDate, b.Nights, start, end)
+}
+
+// Weekdays is a set of days of the week, stored as a bitmask with Sunday as bit 0
+type Weekdays int
+
+// Has reports whether d is in the set
+func (w Weekdays) Has(d time.Weekday) bool {
+	return w&(1<<uint(d)) != 0
+}
+
+// Add returns the set with d added
+func (w Weekdays) Add(d time.Weekday) Weekdays {
+	return w | 1<<uint(d)
+}
+
+// String lists the days in the set, Monday first, e.g. Fri, Sat
+func (w Weekdays) String() string {
+	var days []string
+	for i := 1; i <= 7; i++ {
+		d := time.Weekday(i % 7)
+		if w.Has(d) {
+			days = append(days, d.String()[:3])
+		}
+	}
+	return strings.Join(days, ", ")
+}
+
 // Restriction model -> database
 type Restriction struct {
 	ID              int
@@ -40,20 +215,340 @@ type Restriction struct {
 	UpdatedAt       time.Time
 }
 
+// Restriction ids, as seeded in the restrictions table
+const (
+	RestrictionReservation = 1
+	RestrictionOwnerBlock  = 2
+	RestrictionHold        = 3 // a guest is checking out; lapses at ExpiresAt
+	RestrictionExternal    = 4 // booked on another channel; kept in step with its calendar feed
+)
+
 // Reservaiton model -> database
 type Reservation struct {
-	ID        int
-	FirstName string
-	LastName  string
-	Email     string
-	Phone     string
-	StartDate time.Time
-	EndDate   time.Time
-	RoomID    int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Processed int
-	Room      Room
+	ID               int
+	FirstName        string
+	LastName         string
+	Email            string
+	Phone            string
+	StartDate        time.Time
+	EndDate          time.Time
+	RoomID           int
+	Adults           int
+	Children         int
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	Status           string
+	ConfirmedAt      time.Time
+	CheckedInAt      time.Time
+	CheckedOutAt     time.Time
+	CancelledAt      time.Time
+	NoShowAt         time.Time
+	ConfirmationCode string
+	Currency         string
+	Subtotal         int
+	FeeTotal         int
+	TaxTotal         int
+	Total            int
+	BookingGroupID   int
+	NeedsReprice     bool
+	DeletedAt        time.Time
+	DeletedBy        User
+	DeleteReason     string
+	Room             Room
+	LineItems        []ReservationLineItem
+}
+
+// IsCancelled reports whether the reservation was cancelled, by the guest or the front desk
+func (r Reservation) IsCancelled() bool {
+	return r.Status == StatusCancelled
+}
+
+// IsUpcoming reports whether the guest is still to arrive, so the booking may be changed or cancelled
+func (r Reservation) IsUpcoming() bool {
+	return r.Status == StatusPending || r.Status == StatusConfirmed
+}
+
+// StatusName returns the display name of the reservation's status
+func (r Reservation) StatusName() string {
+	return StatusName(r.Status)
+}
+
+// NextStatuses lists the statuses the reservation may move to from its own
+func (r Reservation) NextStatuses() []string {
+	return statusChanges[r.Status]
+}
+
+// StatusHistory lists when the reservation reached each status it has been through, earliest first
+func (r Reservation) StatusHistory() []StatusChange {
+	history := []StatusChange{{Status: StatusPending, At: r.CreatedAt}}
+	for _, c := range []StatusChange{
+		{StatusConfirmed, r.ConfirmedAt},
+		{StatusNoShow, r.NoShowAt},
+		{StatusCheckedIn, r.CheckedInAt},
+		{StatusCheckedOut, r.CheckedOutAt},
+		{StatusCancelled, r.CancelledAt},
+	} {
+		if !c.At.IsZero() {
+			history = append(history, c)
+		}
+	}
+	return history
+}
+
+// IsDeleted reports whether the reservation was deleted in the admin, and sits in the trash
+func (r Reservation) IsDeleted() bool {
+	return !r.DeletedAt.IsZero()
+}
+
+// Nights returns how many nights the guest stays
+func (r Reservation) Nights() int {
+	return int(r.EndDate.Sub(r.StartDate).Hours() / 24)
+}
+
+// Guests is the number of people staying, adults and children
+func (r Reservation) Guests() int {
+	return r.Adults + r.Children
+}
+
+// GuestSummary describes who's staying, e.g. 2 adults, 1 child
+func (r Reservation) GuestSummary() string {
+	s := plural(r.Adults, "adult", "adults")
+	if r.Children > 0 {
+		s += ", " + plural(r.Children, "child", "children")
+	}
+	return s
+}
+
+// plural formats a count with the singular or plural noun
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, one)
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
+
+// Reservation statuses, stored in reservations.status. A booking is pending until the front desk confirms it,
+// then the guest checks in and out; it may be cancelled before they arrive, or marked a no-show if they don't
+const (
+	StatusPending    = "pending"
+	StatusConfirmed  = "confirmed"
+	StatusCheckedIn  = "checked-in"
+	StatusCheckedOut = "checked-out"
+	StatusCancelled  = "cancelled"
+	StatusNoShow     = "no-show"
+)
+
+// Statuses lists every status, in the order a stay goes through them
+var Statuses = []string{StatusPending, StatusConfirmed, StatusCheckedIn, StatusCheckedOut, StatusCancelled, StatusNoShow}
+
+// statusChanges lists the statuses a reservation may move to from each status; checked out and cancelled are final
+var statusChanges = map[string][]string{
+	StatusPending:   {StatusConfirmed, StatusCancelled},
+	StatusConfirmed: {StatusCheckedIn, StatusNoShow, StatusCancelled},
+	StatusCheckedIn: {StatusCheckedOut},
+	StatusNoShow:    {StatusCheckedIn}, // the guest turned up late after all
+}
+
+// CanChangeStatus reports whether a reservation may move from one status to another
+func CanChangeStatus(from, to string) bool {
+	for _, next := range statusChanges[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStatus reports whether s is one of Statuses
+func IsStatus(s string) bool {
+	for _, status := range Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusName returns the display name of a status
+func StatusName(status string) string {
+	switch status {
+	case StatusPending:
+		return "Pending"
+	case StatusConfirmed:
+		return "Confirmed"
+	case StatusCheckedIn:
+		return "Checked In"
+	case StatusCheckedOut:
+		return "Checked Out"
+	case StatusCancelled:
+		return "Cancelled"
+	case StatusNoShow:
+		return "No-show"
+	default:
+		return status
+	}
+}
+
+// StatusChange is when a reservation reached a status
+type StatusChange struct {
+	Status string
+	At     time.Time
+}
+
+// the columns a list of reservations may be sorted by
+const (
+	SortID        = "id"
+	SortLastName  = "last_name"
+	SortRoom      = "room"
+	SortGuests    = "guests"
+	SortArrival   = "start_date"
+	SortDeparture = "end_date"
+	SortBooked    = "created_at"
+)
+
+// ReservationSorts lists the columns a list of reservations may be sorted by
+var ReservationSorts = []string{SortID, SortLastName, SortRoom, SortGuests, SortArrival, SortDeparture, SortBooked}
+
+// ReservationFilter narrows a list of reservations, orders it and picks the page to show
+type ReservationFilter struct {
+	Search string    // part of the guest's name or email
+	RoomID int       // 0 for every room
+	From   time.Time // stays with a night on or after From
+	To     time.Time // stays arriving on or before To
+	Status string    // one of Statuses, or empty for any
+	Sort   string    // one of ReservationSorts
+	Desc   bool
+	Cursor Cursor
+	Limit  int
+}
+
+// Cursor marks where a page of a list starts: just after, or when going back just before,
+// the reservation with the sort value and ID given. The zero Cursor is the first page
+type Cursor struct {
+	Value    string
+	ID       int
+	Backward bool
+}
+
+// IsZero reports whether the cursor is at the start of the list
+func (c Cursor) IsZero() bool {
+	return c.ID == 0
+}
+
+// SortValue is what the list is sorted by for res, as kept in a cursor
+func (f ReservationFilter) SortValue(res Reservation) string {
+	switch f.Sort {
+	case SortID:
+		return strconv.Itoa(res.ID)
+	case SortLastName:
+		return res.LastName
+	case SortRoom:
+		return res.Room.RoomName
+	case SortGuests:
+		return strconv.Itoa(res.Guests())
+	case SortDeparture:
+		return res.EndDate.Format("2006-01-02")
+	case SortBooked:
+		return res.CreatedAt.Format(time.RFC3339Nano)
+	}
+	return res.StartDate.Format("2006-01-02")
+}
+
+// Values gives the filter, its sort and its page as query parameters, so a list can be linked back to
+func (f ReservationFilter) Values() url.Values {
+	v := url.Values{}
+	if f.Search != "" {
+		v.Set("q", f.Search)
+	}
+	if f.RoomID > 0 {
+		v.Set("room", strconv.Itoa(f.RoomID))
+	}
+	if !f.From.IsZero() {
+		v.Set("from", f.From.Format("2006-01-02"))
+	}
+	if !f.To.IsZero() {
+		v.Set("to", f.To.Format("2006-01-02"))
+	}
+	if f.Status != "" {
+		v.Set("status", f.Status)
+	}
+	if f.Sort != "" {
+		v.Set("sort", f.Sort)
+		if f.Desc {
+			v.Set("dir", "desc")
+		} else {
+			v.Set("dir", "asc")
+		}
+	}
+	if !f.Cursor.IsZero() {
+		key := "after"
+		if f.Cursor.Backward {
+			key = "before"
+		}
+		v.Set(key, f.Cursor.String())
+	}
+	return v
+}
+
+// String gives the cursor as a query parameter, the ID first as the value may hold any character
+func (c Cursor) String() string {
+	return strconv.Itoa(c.ID) + ":" + c.Value
+}
+
+// ParseCursor reads a cursor given by String; backward is whether it came as the before parameter
+func ParseCursor(s string, backward bool) (Cursor, error) {
+	id, value, ok := strings.Cut(s, ":")
+	n, err := strconv.Atoi(id)
+	if !ok || err != nil || n < 1 {
+		return Cursor{}, fmt.Errorf("%q isn't a page of the list", s)
+	}
+	return Cursor{Value: value, ID: n, Backward: backward}, nil
+}
+
+// BookingGroup model -> database
+// Several rooms booked together by one guest for the same dates, one reservation per room
+type BookingGroup struct {
+	ID               int
+	FirstName        string
+	LastName         string
+	Email            string
+	Phone            string
+	ConfirmationCode string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	Reservations     []Reservation
+}
+
+// Total returns the price of every room in the group, in cents
+func (g BookingGroup) Total() int {
+	total := 0
+	for _, r := range g.Reservations {
+		total += r.Total
+	}
+	return total
+}
+
+// IsPending reports whether any reservation in the group is still waiting to be confirmed
+func (g BookingGroup) IsPending() bool {
+	for _, r := range g.Reservations {
+		if r.Status == StatusPending {
+			return true
+		}
+	}
+	return false
+}
+
+// ReservationLineItem model -> database
+// One night, fee or tax of the price agreed when the reservation was made, in cents
+type ReservationLineItem struct {
+	ID            int
+	ReservationID int
+	Kind          string
+	Description   string
+	Date          time.Time
+	Amount        int
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
 // Room Restrictions model -> database
@@ -64,6 +559,12 @@ type RoomRestriction struct {
 	RoomID        int
 	ReservationID int
 	RestrictionID int
+	Confirmed     bool
+	ExpiresAt     time.Time // zero unless the restriction is a hold
+	Reason        string    // why the owner blocked the room
+	Notes         string
+	ICalFeedID    int    // the feed an external block was imported from
+	ExternalUID   string // the uid of the event in that feed
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 	Room          Room
@@ -71,6 +572,187 @@ type RoomRestriction struct {
 	Restriction   Restriction
 }
 
+// Nights returns how many nights the restriction covers
+func (r RoomRestriction) Nights() int {
+	return int(r.EndDate.Sub(r.StartDate).Hours() / 24)
+}
+
+// ICalFeed model -> database
+// A calendar another channel publishes for one of our rooms. URL is a web address or, for testing, a local file
+type ICalFeed struct {
+	ID           int
+	RoomID       int
+	Name         string
+	URL          string
+	LastSyncedAt time.Time // zero until the feed is first synced
+	LastError    string    // why the last sync failed; blank if it worked
+	Events       int       // external blocks the last sync left in place
+	Conflicts    []string  // events the last sync couldn't block, as the room was already taken here
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	Room         Room
+}
+
+// Status sums up the last sync of the feed
+func (f ICalFeed) Status() string {
+	switch {
+	case f.LastSyncedAt.IsZero():
+		return "Not synced yet"
+	case f.LastError != "":
+		return "Failed"
+	case len(f.Conflicts) > 0:
+		return "Double booked"
+	}
+	return "OK"
+}
+
+// ICalSync is what syncing a feed changed
+type ICalSync struct {
+	Added     int
+	Updated   int
+	Removed   int
+	Conflicts []string
+}
+
+// RoomNights is how many nights a room was taken in a month, by guests here or on other channels
+type RoomNights struct {
+	RoomID int
+	Month  time.Time // the first of the month
+	Nights int
+}
+
+// MonthlyRevenue is the total of the stays arriving in a month, in cents
+type MonthlyRevenue struct {
+	Month time.Time // the first of the month
+	Total int
+}
+
+// BookingStats sums up the reservations made over a period
+type BookingStats struct {
+	Bookings        int
+	Cancelled       int
+	AverageLeadDays float64 // days from booking to arrival
+	LeadDays        [4]int  // bookings made up to a week, a month, three months and longer ahead
+}
+
+// CancellationRate is the percentage of bookings that were cancelled
+func (s BookingStats) CancellationRate() float64 {
+	if s.Bookings == 0 {
+		return 0
+	}
+	return float64(s.Cancelled) * 100 / float64(s.Bookings)
+}
+
+// Payment model -> database
+// Amount is in cents; Reference is the provider's id for the payment
+type Payment struct {
+	ID            int
+	ReservationID int
+	Provider      string
+	Reference     string
+	Status        string
+	Amount        int
+	Currency      string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// APIToken model -> database
+// Only the hash of the token is stored; the plaintext is shown to the user once when it is created
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	TokenHash  string
+	Scopes     []string
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	User       User
+}
+
+// HasScope reports whether the token was granted scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditEvent model -> database
+// Records a change made to a reservation or room: who made it, to which one, and the fields it changed
+type AuditEvent struct {
+	ID        int
+	UserID    int    // 0 if the change wasn't made by a user, or the user has since been removed
+	Actor     string // who made the change when it wasn't a user, e.g. "Guest"
+	Action    string // e.g. "update" or "block"
+	Entity    string // EntityReservation or EntityRoom
+	EntityID  int
+	Changes   []FieldChange
+	CreatedAt time.Time
+	User      User
+}
+
+// Actor is who made a change kept in the history: a user, or for a change made without one,
+// the guest, the calendar sync or the import command
+type Actor struct {
+	UserID int
+	Name   string // only when UserID is 0
+}
+
+// the actors of changes made without a user
+var (
+	ActorGuest         = Actor{Name: "Guest"}
+	ActorCalendarSync  = Actor{Name: "Calendar sync"}
+	ActorImportCommand = Actor{Name: "Import command"}
+)
+
+// the kinds of thing a history is kept of
+const (
+	EntityReservation = "reservation"
+	EntityRoom        = "room"
+)
+
+// FieldChange is a field an audit event changed, with its value before and after as JSON.
+// Before is empty when the thing was created and After when it was removed
+type FieldChange struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// From is the value before the change, for display
+func (c FieldChange) From() string {
+	return jsonText(c.Before)
+}
+
+// To is the value after the change, for display
+func (c FieldChange) To() string {
+	return jsonText(c.After)
+}
+
+// jsonText shows strings without their quotes and anything else as it was stored
+func jsonText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// AuditFilter picks the audit events to list, newest first
+type AuditFilter struct {
+	Entity   string // EntityReservation or EntityRoom, or empty for both
+	EntityID int    // 0 for every reservation or room
+	UserID   int    // 0 for changes by anybody
+	Action   string // empty for every action
+	Before   int    // only events older than this one, to page back through the history
+	Limit    int
+}
+
 // MaidData holds an email message
 type MailData struct {
 	To       string
@@ -14,4 +14,26 @@ type TemplateData struct {
 	Error           string
 	Form            *forms.Form
 	IsAuthenticated int
+	AccessLevel     int
+	Rooms           []Room // listed in the navigation on every page
+}
+
+// IsFrontDesk reports whether the logged in user is front desk staff or above
+func (td *TemplateData) IsFrontDesk() bool {
+	return td.AccessLevel >= AccessFrontDesk
+}
+
+// IsManager reports whether the logged in user is a manager or above
+func (td *TemplateData) IsManager() bool {
+	return td.AccessLevel >= AccessManager
+}
+
+// IsOwner reports whether the logged in user is an owner
+func (td *TemplateData) IsOwner() bool {
+	return td.AccessLevel >= AccessOwner
+}
+
+// Role returns the display name of the logged in user's role
+func (td *TemplateData) Role() string {
+	return RoleName(td.AccessLevel)
 }
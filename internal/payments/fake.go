@@ -0,0 +1,121 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// DeclinedCard is the card number the fake provider always declines
+const DeclinedCard = "4000000000000002"
+
+// FakeProvider keeps payments in memory, for tests and local development
+type FakeProvider struct {
+	secret []byte
+
+	mu       sync.Mutex
+	next     int
+	payments map[string]*Transaction
+}
+
+// NewFakeProvider creates a fake provider that signs webhooks with secret
+func NewFakeProvider(secret string) *FakeProvider {
+	return &FakeProvider{
+		secret:   []byte(secret),
+		payments: make(map[string]*Transaction),
+	}
+}
+
+// Name identifies the provider in stored payment records
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+// Authorize holds the amount unless the card is DeclinedCard
+func (p *FakeProvider) Authorize(req AuthorizeRequest) (Transaction, error) {
+	if req.Source == DeclinedCard || req.Source == "" {
+		return Transaction{Status: StatusFailed, Amount: req.Amount}, ErrDeclined
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.next++
+	t := &Transaction{
+		Reference: fmt.Sprintf("fake_%d", p.next),
+		Status:    StatusAuthorized,
+		Amount:    req.Amount,
+	}
+	p.payments[t.Reference] = t
+
+	return *t, nil
+}
+
+// Capture takes up to the authorized amount
+func (p *FakeProvider) Capture(reference string, amount int) (Transaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.payments[reference]
+	if !ok {
+		return Transaction{}, ErrUnknownPayment
+	}
+	if t.Status != StatusAuthorized || amount > t.Amount {
+		return *t, ErrInvalidState
+	}
+
+	t.Status = StatusCaptured
+	t.Amount = amount
+
+	return *t, nil
+}
+
+// Refund returns a captured payment or releases an authorized one
+func (p *FakeProvider) Refund(reference string, amount int) (Transaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.payments[reference]
+	if !ok {
+		return Transaction{}, ErrUnknownPayment
+	}
+	if (t.Status != StatusAuthorized && t.Status != StatusCaptured) || amount > t.Amount {
+		return *t, ErrInvalidState
+	}
+
+	t.Status = StatusRefunded
+
+	return *t, nil
+}
+
+// VerifyWebhook checks signature is the hex HMAC-SHA256 of payload
+func (p *FakeProvider) VerifyWebhook(payload []byte, signature string) (Event, error) {
+	var e Event
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, p.sign(payload)) {
+		return e, ErrInvalidSignature
+	}
+
+	err = json.Unmarshal(payload, &e)
+	if err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+// SignWebhook returns the signature VerifyWebhook expects for payload,
+// so tests and local tools can send webhooks
+func (p *FakeProvider) SignWebhook(payload []byte) string {
+	return hex.EncodeToString(p.sign(payload))
+}
+
+func (p *FakeProvider) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,99 @@
+package payments
+
+import (
+	"errors"
+)
+
+// Statuses of a payment, as stored in payments.status
+const (
+	StatusAuthorized = "authorized"
+	StatusCaptured   = "captured"
+	StatusRefunded   = "refunded"
+	StatusFailed     = "failed"
+)
+
+// Webhook event types sent by providers
+const (
+	EventCaptured = "payment.captured"
+	EventRefunded = "payment.refunded"
+	EventFailed   = "payment.failed"
+)
+
+var (
+	// ErrDeclined is returned when the guest's card is refused
+	ErrDeclined = errors.New("payment declined")
+
+	// ErrUnknownPayment is returned when a provider has no record of a reference
+	ErrUnknownPayment = errors.New("unknown payment")
+
+	// ErrInvalidState is returned when a payment can't move to the requested status,
+	// e.g. capturing a refunded payment
+	ErrInvalidState = errors.New("payment can't be changed from its current status")
+
+	// ErrInvalidSignature is returned when a webhook payload wasn't signed by the provider
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// AuthorizeRequest asks a provider to hold an amount on the guest's card
+type AuthorizeRequest struct {
+	Amount      int // cents
+	Currency    string
+	Source      string // card number or provider token
+	Description string
+}
+
+// Transaction is the provider's view of a payment after an operation
+type Transaction struct {
+	Reference string
+	Status    string
+	Amount    int
+}
+
+// Event is a verified webhook notification from a provider
+type Event struct {
+	Type      string `json:"type"`
+	Reference string `json:"reference"`
+	Amount    int    `json:"amount"`
+}
+
+// Provider is a payment gateway
+type Provider interface {
+	// Name identifies the provider in stored payment records
+	Name() string
+
+	// Authorize holds an amount on the guest's card without taking it
+	Authorize(req AuthorizeRequest) (Transaction, error)
+
+	// Capture takes up to the authorized amount of a held payment
+	Capture(reference string, amount int) (Transaction, error)
+
+	// Refund returns a captured payment, or releases a held one
+	Refund(reference string, amount int) (Transaction, error)
+
+	// VerifyWebhook checks a webhook was sent by the provider and decodes it
+	VerifyWebhook(payload []byte, signature string) (Event, error)
+}
+
+// StatusForEvent returns the payment status a webhook event moves a payment to
+func StatusForEvent(eventType string) (string, bool) {
+	switch eventType {
+	case EventCaptured:
+		return StatusCaptured, true
+	case EventRefunded:
+		return StatusRefunded, true
+	case EventFailed:
+		return StatusFailed, true
+	default:
+		return "", false
+	}
+}
+
+// DepositAmount returns the deposit held for a booking, at rate basis points of the total
+// (2500 is 25%), rounded up to the nearest cent
+func DepositAmount(total, rate int) int {
+	if total <= 0 || rate <= 0 {
+		return 0
+	}
+
+	return (total*rate + 9999) / 10000
+}
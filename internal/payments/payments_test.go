@@ -0,0 +1,96 @@
+package payments
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDepositAmount(t *testing.T) {
+	tests := []struct {
+		total    int
+		rate     int
+		expected int
+	}{
+		{10000, 2500, 2500},
+		{10001, 2500, 2501}, // 2500.25 rounds up
+		{10000, 0, 0},
+		{0, 2500, 0},
+		{10000, 10000, 10000},
+	}
+
+	for _, e := range tests {
+		if got := DepositAmount(e.total, e.rate); got != e.expected {
+			t.Errorf("DepositAmount(%d, %d): expected %d but got %d", e.total, e.rate, e.expected, got)
+		}
+	}
+}
+
+func TestStatusForEvent(t *testing.T) {
+	status, ok := StatusForEvent(EventCaptured)
+	if !ok || status != StatusCaptured {
+		t.Errorf("expected %s to move a payment to captured but got %s", EventCaptured, status)
+	}
+
+	_, ok = StatusForEvent("payment.created")
+	if ok {
+		t.Error("expected an unknown event to be ignored")
+	}
+}
+
+func TestFakeProviderLifecycle(t *testing.T) {
+	p := NewFakeProvider("secret")
+
+	_, err := p.Authorize(AuthorizeRequest{Amount: 2500, Source: DeclinedCard})
+	if !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected the declined card to be refused but got %v", err)
+	}
+
+	tr, err := p.Authorize(AuthorizeRequest{Amount: 2500, Source: "4242424242424242"})
+	if err != nil || tr.Status != StatusAuthorized || tr.Reference == "" {
+		t.Fatalf("expected an authorization but got %+v, %v", tr, err)
+	}
+
+	_, err = p.Capture(tr.Reference, 3000)
+	if !errors.Is(err, ErrInvalidState) {
+		t.Errorf("expected capturing more than was held to fail but got %v", err)
+	}
+
+	captured, err := p.Capture(tr.Reference, 2500)
+	if err != nil || captured.Status != StatusCaptured {
+		t.Errorf("expected a capture but got %+v, %v", captured, err)
+	}
+
+	_, err = p.Capture(tr.Reference, 2500)
+	if !errors.Is(err, ErrInvalidState) {
+		t.Errorf("expected a second capture to fail but got %v", err)
+	}
+
+	refunded, err := p.Refund(tr.Reference, 2500)
+	if err != nil || refunded.Status != StatusRefunded {
+		t.Errorf("expected a refund but got %+v, %v", refunded, err)
+	}
+
+	_, err = p.Refund("fake_99", 2500)
+	if !errors.Is(err, ErrUnknownPayment) {
+		t.Errorf("expected an unknown reference to fail but got %v", err)
+	}
+}
+
+func TestFakeProviderVerifyWebhook(t *testing.T) {
+	p := NewFakeProvider("secret")
+	payload := []byte(`{"type":"payment.captured","reference":"fake_1","amount":2500}`)
+
+	e, err := p.VerifyWebhook(payload, p.SignWebhook(payload))
+	if err != nil {
+		t.Fatalf("expected a valid signature but got %s", err)
+	}
+	if e.Type != EventCaptured || e.Reference != "fake_1" || e.Amount != 2500 {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	other := NewFakeProvider("other")
+	_, err = p.VerifyWebhook(payload, other.SignWebhook(payload))
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected a signature from another secret to fail but got %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository"
+)
+
+// Currency every price is quoted in
+const Currency = "USD"
+
+// Kinds of line item stored with a reservation
+const (
+	KindNight = "night"
+	KindFee   = "fee"
+	KindTax   = "tax"
+)
+
+// ErrInvalidDates is returned when asked to quote a stay that doesn't end after it starts
+var ErrInvalidDates = errors.New("departure must be after arrival")
+
+// Night is the price of one night of a stay, in cents
+type Night struct {
+	Date      time.Time `json:"date"`
+	Rate      int       `json:"rate"`
+	Surcharge int       `json:"weekend_surcharge"`
+	Season    string    `json:"season,omitempty"`
+}
+
+// Total returns the price of the night including any surcharge
+func (n Night) Total() int {
+	return n.Rate + n.Surcharge
+}
+
+// Charge is a fee or tax added on top of the nightly rates, in cents
+type Charge struct {
+	Description string `json:"description"`
+	Amount      int    `json:"amount"`
+}
+
+// Quote is the price of a stay in one room, in cents
+type Quote struct {
+	RoomID    int       `json:"room_id"`
+	StartDate time.Time `json:"start_date"`
+	EndDate   time.Time `json:"end_date"`
+	Currency  string    `json:"currency"`
+	Nights    []Night   `json:"nights"`
+	Subtotal  int       `json:"subtotal"`
+	Fees      []Charge  `json:"fees"`
+	Taxes     []Charge  `json:"taxes"`
+	Total     int       `json:"total"`
+}
+
+// NumNights returns the length of the stay
+func (q Quote) NumNights() int {
+	return len(q.Nights)
+}
+
+// AddCharges adds fees to the quote, then tax at taxRate basis points (1200 is 12%)
+// on the nights and fees together
+func (q *Quote) AddCharges(taxRate int, fees []Charge) {
+	taxable := q.Subtotal
+
+	for _, f := range fees {
+		q.Fees = append(q.Fees, f)
+		q.Total += f.Amount
+		taxable += f.Amount
+	}
+
+	if taxRate > 0 {
+		// round half up to the nearest cent
+		tax := (taxable*taxRate + 5000) / 10000
+		q.Taxes = append(q.Taxes, Charge{
+			Description: fmt.Sprintf("Tax (%s%%)", formatBasisPoints(taxRate)),
+			Amount:      tax,
+		})
+		q.Total += tax
+	}
+}
+
+// ApplyTo stores the quote on a reservation as the price the guest agreed to
+func (q Quote) ApplyTo(res *models.Reservation) {
+	res.Currency = q.Currency
+	res.Subtotal = q.Subtotal
+	res.FeeTotal = 0
+	res.TaxTotal = 0
+	res.Total = q.Total
+	res.LineItems = nil
+
+	for _, n := range q.Nights {
+		description := "Nightly rate"
+		if n.Season != "" {
+			description = n.Season + " rate"
+		}
+		if n.Surcharge > 0 {
+			description += " + weekend"
+		}
+
+		res.LineItems = append(res.LineItems, models.ReservationLineItem{
+			Kind:        KindNight,
+			Description: description,
+			Date:        n.Date,
+			Amount:      n.Total(),
+		})
+	}
+
+	for _, f := range q.Fees {
+		res.FeeTotal += f.Amount
+		res.LineItems = append(res.LineItems, models.ReservationLineItem{
+			Kind:        KindFee,
+			Description: f.Description,
+			Amount:      f.Amount,
+		})
+	}
+
+	for _, t := range q.Taxes {
+		res.TaxTotal += t.Amount
+		res.LineItems = append(res.LineItems, models.ReservationLineItem{
+			Kind:        KindTax,
+			Description: t.Description,
+			Amount:      t.Amount,
+		})
+	}
+}
+
+// IsWeekend reports whether the night starting on d is charged the weekend surcharge
+func IsWeekend(d time.Time) bool {
+	return d.Weekday() == time.Friday || d.Weekday() == time.Saturday
+}
+
+// Calculate prices a stay from start up to, but not including, the night of end.
+// Each night is charged the room's nightly rate, or the rate of the season covering it,
+// plus the room's weekend surcharge on Friday and Saturday nights.
+// Where seasons overlap, the one that starts latest wins.
+// A season's minimum stay is enforced by the booking rules, not here.
+func Calculate(room models.Room, seasons []models.SeasonalRate, start, end time.Time) (Quote, error) {
+	q := Quote{
+		RoomID:    room.ID,
+		StartDate: start,
+		EndDate:   end,
+		Currency:  Currency,
+	}
+
+	if !end.After(start) {
+		return q, ErrInvalidDates
+	}
+
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		n := Night{
+			Date: d,
+			Rate: room.NightlyRate,
+		}
+
+		if s, ok := SeasonFor(seasons, d); ok {
+			n.Rate = s.NightlyRate
+			n.Season = s.Name
+		}
+
+		if IsWeekend(d) {
+			n.Surcharge = room.WeekendSurcharge
+		}
+
+		q.Nights = append(q.Nights, n)
+		q.Subtotal += n.Total()
+	}
+	q.Total = q.Subtotal
+
+	return q, nil
+}
+
+// SeasonFor returns the season covering the night starting on d; where seasons overlap,
+// the one that starts latest wins
+func SeasonFor(seasons []models.SeasonalRate, d time.Time) (models.SeasonalRate, bool) {
+	var found models.SeasonalRate
+	ok := false
+
+	for _, s := range seasons {
+		if !s.Covers(d) {
+			continue
+		}
+		if !ok || s.StartDate.After(found.StartDate) {
+			found = s
+			ok = true
+		}
+	}
+
+	return found, ok
+}
+
+// FormatMoney formats an amount in cents as dollars, e.g. 12950 -> $129.50
+func FormatMoney(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+
+	return fmt.Sprintf("%s$%d.%02d", sign, cents/100, cents%100)
+}
+
+// ErrInvalidAmount is returned when a money amount can't be parsed
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ParseMoney parses dollars, with or without a $ sign and cents, into cents, e.g. $129.50 -> 12950
+func ParseMoney(s string) (int, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "$")
+	if s == "" {
+		return 0, ErrInvalidAmount
+	}
+
+	dollars, cents, hasCents := strings.Cut(s, ".")
+	if hasCents && (len(cents) == 0 || len(cents) > 2) {
+		return 0, ErrInvalidAmount
+	}
+	if len(cents) == 1 {
+		cents += "0"
+	}
+
+	d, err := strconv.Atoi(dollars)
+	if err != nil || d < 0 {
+		return 0, ErrInvalidAmount
+	}
+
+	c := 0
+	if hasCents {
+		c, err = strconv.Atoi(cents)
+		if err != nil || c < 0 {
+			return 0, ErrInvalidAmount
+		}
+	}
+
+	return d*100 + c, nil
+}
+
+// formatBasisPoints formats a rate in basis points as a percentage, e.g. 1250 -> 12.5
+func formatBasisPoints(bp int) string {
+	if bp%100 == 0 {
+		return fmt.Sprintf("%d", bp/100)
+	}
+
+	return strings.TrimRight(fmt.Sprintf("%d.%02d", bp/100, bp%100), "0")
+}
+
+// Service quotes stays using the rates stored in the database
+type Service struct {
+	DB repository.DatabaseRepo
+
+	// TaxRate is in basis points, 1200 is 12%
+	TaxRate int
+
+	// Fees are charged once per stay
+	Fees []Charge
+}
+
+// NewService creates a pricing service
+func NewService(db repository.DatabaseRepo, taxRate int, fees ...Charge) *Service {
+	return &Service{
+		DB:      db,
+		TaxRate: taxRate,
+		Fees:    fees,
+	}
+}
+
+// Quote prices a stay in a room
+func (s *Service) Quote(roomID int, start, end time.Time) (Quote, error) {
+	room, err := s.DB.GetRoomByID(roomID)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	seasons, err := s.DB.SeasonalRatesForRoom(roomID, start, end)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	q, err := Calculate(room, seasons, start, end)
+	if err != nil {
+		return q, err
+	}
+
+	q.AddCharges(s.TaxRate, s.Fees)
+	return q, nil
+}
@@ -0,0 +1,201 @@
+package pricing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/models"
+)
+
+var room = models.Room{
+	ID:               1,
+	NightlyRate:      10000,
+	WeekendSurcharge: 2500,
+}
+
+func date(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+var calculateTests = []struct {
+	name          string
+	seasons       []models.SeasonalRate
+	start         string
+	end           string
+	expectedTotal int
+	expectedRates []int
+}{
+	// 2025-06-02 is a Monday
+	{"weekdays", nil, "2025-06-02", "2025-06-04", 20000, []int{10000, 10000}},
+	{"over a weekend", nil, "2025-06-05", "2025-06-08", 35000, []int{10000, 12500, 12500}},
+	{
+		"season covers part of the stay",
+		[]models.SeasonalRate{{Name: "Summer", StartDate: date("2025-06-03"), EndDate: date("2025-06-10"), NightlyRate: 15000}},
+		"2025-06-02", "2025-06-04", 25000, []int{10000, 15000},
+	},
+	{
+		"season ends on the night of departure",
+		[]models.SeasonalRate{{Name: "Spring", StartDate: date("2025-05-01"), EndDate: date("2025-06-03"), NightlyRate: 8000}},
+		"2025-06-02", "2025-06-04", 18000, []int{8000, 10000},
+	},
+	{
+		"later season wins where seasons overlap",
+		[]models.SeasonalRate{
+			{Name: "Summer", StartDate: date("2025-06-01"), EndDate: date("2025-09-01"), NightlyRate: 15000},
+			{Name: "Festival", StartDate: date("2025-06-03"), EndDate: date("2025-06-05"), NightlyRate: 30000},
+		},
+		"2025-06-02", "2025-06-04", 45000, []int{15000, 30000},
+	},
+}
+
+func TestCalculate(t *testing.T) {
+	for _, e := range calculateTests {
+		q, err := Calculate(room, e.seasons, date(e.start), date(e.end))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+			continue
+		}
+
+		if q.Total != e.expectedTotal {
+			t.Errorf("%s: expected total %d but got %d", e.name, e.expectedTotal, q.Total)
+		}
+
+		if q.NumNights() != len(e.expectedRates) {
+			t.Errorf("%s: expected %d nights but got %d", e.name, len(e.expectedRates), q.NumNights())
+			continue
+		}
+
+		for i, n := range q.Nights {
+			if n.Total() != e.expectedRates[i] {
+				t.Errorf("%s: expected night %d to cost %d but got %d", e.name, i, e.expectedRates[i], n.Total())
+			}
+		}
+	}
+}
+
+func TestCalculateInvalidDates(t *testing.T) {
+	_, err := Calculate(room, nil, date("2025-06-04"), date("2025-06-04"))
+	if !errors.Is(err, ErrInvalidDates) {
+		t.Errorf("expected ErrInvalidDates but got %v", err)
+	}
+}
+
+func TestSeasonFor(t *testing.T) {
+	seasons := []models.SeasonalRate{
+		{Name: "Summer", StartDate: date("2025-06-01"), EndDate: date("2025-09-01")},
+		{Name: "Festival", StartDate: date("2025-06-03"), EndDate: date("2025-06-05")},
+	}
+
+	tests := map[string]string{
+		"2025-05-31": "",
+		"2025-06-02": "Summer",
+		"2025-06-04": "Festival",
+		"2025-06-05": "Summer",
+		"2025-09-01": "",
+	}
+
+	for d, expected := range tests {
+		s, ok := SeasonFor(seasons, date(d))
+		if s.Name != expected || ok != (expected != "") {
+			t.Errorf("%s: expected season %q but got %q", d, expected, s.Name)
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	tests := map[int]string{
+		0:      "$0.00",
+		5:      "$0.05",
+		12950:  "$129.50",
+		-2500:  "-$25.00",
+		100000: "$1000.00",
+	}
+
+	for cents, expected := range tests {
+		if got := FormatMoney(cents); got != expected {
+			t.Errorf("FormatMoney(%d): expected %s but got %s", cents, expected, got)
+		}
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	valid := map[string]int{
+		"129.50":  12950,
+		"$129.50": 12950,
+		"129.5":   12950,
+		"129":     12900,
+		" 0.05 ":  5,
+	}
+
+	for s, expected := range valid {
+		got, err := ParseMoney(s)
+		if err != nil || got != expected {
+			t.Errorf("ParseMoney(%q): expected %d but got %d, %v", s, expected, got, err)
+		}
+	}
+
+	for _, s := range []string{"", "abc", "1.234", "-5", "12.", "1.-5"} {
+		if _, err := ParseMoney(s); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("ParseMoney(%q): expected ErrInvalidAmount but got %v", s, err)
+		}
+	}
+}
+
+func TestAddCharges(t *testing.T) {
+	q, _ := Calculate(room, nil, date("2025-06-02"), date("2025-06-04"))
+	q.AddCharges(1250, []Charge{{Description: "Cleaning fee", Amount: 2500}})
+
+	if len(q.Fees) != 1 || q.Fees[0].Amount != 2500 {
+		t.Errorf("expected a single 2500 fee but got %+v", q.Fees)
+	}
+
+	// 12.5% of 22500 is 2812.5, rounded up
+	if len(q.Taxes) != 1 || q.Taxes[0].Amount != 2813 {
+		t.Errorf("expected tax of 2813 but got %+v", q.Taxes)
+	}
+
+	if q.Taxes[0].Description != "Tax (12.5%)" {
+		t.Errorf("unexpected tax description %s", q.Taxes[0].Description)
+	}
+
+	if q.Subtotal != 20000 || q.Total != 25313 {
+		t.Errorf("expected subtotal 20000 and total 25313 but got %d and %d", q.Subtotal, q.Total)
+	}
+}
+
+func TestApplyTo(t *testing.T) {
+	q, _ := Calculate(room, nil, date("2025-06-06"), date("2025-06-08"))
+	q.AddCharges(1000, []Charge{{Description: "Cleaning fee", Amount: 2500}})
+
+	res := models.Reservation{
+		LineItems: []models.ReservationLineItem{{Kind: KindNight, Amount: 1}},
+	}
+	q.ApplyTo(&res)
+
+	if res.Currency != Currency || res.Subtotal != 25000 || res.FeeTotal != 2500 || res.TaxTotal != 2750 || res.Total != 30250 {
+		t.Errorf("totals not copied to reservation: %+v", res)
+	}
+
+	// two nights, one fee, one tax, replacing anything already there
+	if len(res.LineItems) != 4 {
+		t.Fatalf("expected 4 line items but got %d", len(res.LineItems))
+	}
+
+	sum := 0
+	for _, i := range res.LineItems {
+		sum += i.Amount
+	}
+	if sum != res.Total {
+		t.Errorf("line items add up to %d, not the total %d", sum, res.Total)
+	}
+
+	if res.LineItems[0].Description != "Nightly rate + weekend" || !res.LineItems[0].Date.Equal(date("2025-06-06")) {
+		t.Errorf("unexpected first line item %+v", res.LineItems[0])
+	}
+
+	if res.LineItems[3].Kind != KindTax {
+		t.Errorf("expected the last line item to be tax but got %s", res.LineItems[3].Kind)
+	}
+}
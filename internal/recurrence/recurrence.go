@@ -0,0 +1,352 @@
+// Package recurrence evaluates the part of the iCalendar (RFC 5545) RRULE format used for
+// recurring owner blocks. Rules are checked one night at a time, so the nights they block
+// never have to be written out as rows.
+package recurrence
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequency is how often a rule repeats
+type Frequency string
+
+const (
+	Daily   Frequency = "DAILY"
+	Weekly  Frequency = "WEEKLY"
+	Monthly Frequency = "MONTHLY"
+	Yearly  Frequency = "YEARLY"
+)
+
+// dayCodes are the RRULE names of the weekdays, Sunday first as in time.Weekday
+var dayCodes = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// Rule is a parsed RRULE. Its first occurrence is the start date it's used with, as DTSTART is in iCalendar
+type Rule struct {
+	Freq       Frequency
+	Interval   int
+	ByDay      []time.Weekday
+	ByMonth    []time.Month
+	ByMonthDay []int // negative days count back from the end of the month
+	Until      time.Time
+}
+
+// WeeklyOn returns a rule repeating every week on the given days
+func WeeklyOn(days ...time.Weekday) Rule {
+	return Rule{Freq: Weekly, Interval: 1, ByDay: days}
+}
+
+// Annually returns a rule repeating every year on the month and day it starts
+func Annually() Rule {
+	return Rule{Freq: Yearly, Interval: 1}
+}
+
+// Parse reads a rule such as "FREQ=WEEKLY;BYDAY=MO,TU". A leading "RRULE:" is allowed
+func Parse(s string) (Rule, error) {
+	r := Rule{Interval: 1}
+
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	if s == "" {
+		return r, errors.New("the rule is empty")
+	}
+
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return r, fmt.Errorf("%q isn't a NAME=VALUE pair", part)
+		}
+
+		switch key {
+		case "FREQ":
+			switch f := Frequency(value); f {
+			case Daily, Weekly, Monthly, Yearly:
+				r.Freq = f
+			default:
+				return r, fmt.Errorf("FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY, not %s", value)
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return r, errors.New("INTERVAL must be a whole number of at least 1")
+			}
+			r.Interval = n
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				d := dayIndex(v)
+				if d < 0 {
+					return r, fmt.Errorf("%s isn't a day; use SU, MO, TU, WE, TH, FR or SA", v)
+				}
+				r.ByDay = append(r.ByDay, time.Weekday(d))
+			}
+		case "BYMONTH":
+			for _, v := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 || n > 12 {
+					return r, fmt.Errorf("%s isn't a month from 1 to 12", v)
+				}
+				r.ByMonth = append(r.ByMonth, time.Month(n))
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(v)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return r, fmt.Errorf("%s isn't a day of the month", v)
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		case "UNTIL":
+			// only the date matters, as blocks are whole nights
+			if len(value) < 8 {
+				return r, errors.New("UNTIL must be a date such as 20261231")
+			}
+			t, err := time.Parse("20060102", value[:8])
+			if err != nil {
+				return r, errors.New("UNTIL must be a date such as 20261231")
+			}
+			r.Until = t
+		default:
+			return r, fmt.Errorf("%s isn't supported", key)
+		}
+	}
+
+	if r.Freq == "" {
+		return r, errors.New("the rule needs a FREQ")
+	}
+
+	return r, nil
+}
+
+// dayIndex returns the time.Weekday for an RRULE day name, or -1
+func dayIndex(code string) int {
+	for i, c := range dayCodes {
+		if c == code {
+			return i
+		}
+	}
+	return -1
+}
+
+// String returns the rule in RRULE form, as Parse reads it
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + string(r.Freq)}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, d := range r.ByDay {
+			days = append(days, dayCodes[d])
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonth) > 0 {
+		var months []string
+		for _, m := range r.ByMonth {
+			months = append(months, strconv.Itoa(int(m)))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(months, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		var days []string
+		for _, d := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(d))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Occurs reports whether the rule, first occurring on start, has an occurrence on day
+func (r Rule) Occurs(start, day time.Time) bool {
+	start, day = dateOf(start), dateOf(day)
+	if day.Before(start) || (!r.Until.IsZero() && day.After(dateOf(r.Until))) {
+		return false
+	}
+
+	interval := r.Interval
+	if interval < 1 {
+		interval = 1
+	}
+
+	switch r.Freq {
+	case Daily:
+		if daysBetween(start, day)%interval != 0 {
+			return false
+		}
+	case Weekly:
+		// weeks run Monday to Sunday, the RRULE default
+		if daysBetween(weekOf(start), weekOf(day))/7%interval != 0 {
+			return false
+		}
+	case Monthly:
+		months := (day.Year()-start.Year())*12 + int(day.Month()-start.Month())
+		if months%interval != 0 {
+			return false
+		}
+	case Yearly:
+		if (day.Year()-start.Year())%interval != 0 {
+			return false
+		}
+	default:
+		return false
+	}
+
+	byDay, byMonth, byMonthDay := r.expand(start)
+	if len(byMonth) > 0 && !containsMonth(byMonth, day.Month()) {
+		return false
+	}
+	if len(byMonthDay) > 0 && !matchesMonthDay(byMonthDay, day) {
+		return false
+	}
+	if len(byDay) > 0 && !containsWeekday(byDay, day.Weekday()) {
+		return false
+	}
+	return true
+}
+
+// expand fills in the parts the rule leaves out from its start date, as iCalendar does
+func (r Rule) expand(start time.Time) (byDay []time.Weekday, byMonth []time.Month, byMonthDay []int) {
+	byDay, byMonth, byMonthDay = r.ByDay, r.ByMonth, r.ByMonthDay
+	switch r.Freq {
+	case Weekly:
+		if len(byDay) == 0 {
+			byDay = []time.Weekday{start.Weekday()}
+		}
+	case Monthly:
+		if len(byDay) == 0 && len(byMonthDay) == 0 {
+			byMonthDay = []int{start.Day()}
+		}
+	case Yearly:
+		if len(byDay) == 0 && len(byMonthDay) == 0 {
+			if len(byMonth) == 0 {
+				byMonth = []time.Month{start.Month()}
+			}
+			byMonthDay = []int{start.Day()}
+		}
+	}
+	return byDay, byMonth, byMonthDay
+}
+
+// Blocks reports whether the night of day is blocked when each occurrence of the rule,
+// first occurring on start, blocks the room for nights nights
+func (r Rule) Blocks(start time.Time, nights int, day time.Time) bool {
+	if nights < 1 {
+		nights = 1
+	}
+	for i := 0; i < nights; i++ {
+		if r.Occurs(start, day.AddDate(0, 0, -i)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Overlaps reports whether any night of a stay from arrival to departure is blocked
+func (r Rule) Overlaps(start time.Time, nights int, arrival, departure time.Time) bool {
+	for d := dateOf(arrival); d.Before(dateOf(departure)); d = d.AddDate(0, 0, 1) {
+		if r.Blocks(start, nights, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe says in words when the rule blocks the room, e.g. "Every week on Mon, Tue"
+func (r Rule) Describe(start time.Time, nights int) string {
+	units := map[Frequency]string{Daily: "day", Weekly: "week", Monthly: "month", Yearly: "year"}
+
+	var b strings.Builder
+	if r.Interval > 1 {
+		fmt.Fprintf(&b, "Every %d %ss", r.Interval, units[r.Freq])
+	} else {
+		fmt.Fprintf(&b, "Every %s", units[r.Freq])
+	}
+
+	byDay, byMonth, byMonthDay := r.expand(start)
+
+	// a single date each year reads best as a date
+	if r.Freq == Yearly && len(byDay) == 0 && len(byMonth) == 1 && len(byMonthDay) == 1 && byMonthDay[0] > 0 {
+		fmt.Fprintf(&b, " on %d %s", byMonthDay[0], byMonth[0].String()[:3])
+		byMonth, byMonthDay = nil, nil
+	}
+
+	if len(byDay) > 0 {
+		var days []string
+		for _, d := range byDay {
+			days = append(days, d.String()[:3])
+		}
+		b.WriteString(" on " + strings.Join(days, ", "))
+	}
+	if len(byMonthDay) > 0 {
+		var days []string
+		for _, d := range byMonthDay {
+			days = append(days, strconv.Itoa(d))
+		}
+		b.WriteString(" on day " + strings.Join(days, ", "))
+	}
+	if len(byMonth) > 0 {
+		var months []string
+		for _, m := range byMonth {
+			months = append(months, m.String()[:3])
+		}
+		b.WriteString(" in " + strings.Join(months, ", "))
+	}
+
+	if nights > 1 {
+		fmt.Fprintf(&b, " for %d nights", nights)
+	}
+	if !r.Until.IsZero() {
+		b.WriteString(" until " + r.Until.Format("2006-01-02"))
+	}
+	return b.String()
+}
+
+// dateOf drops the time of day, keeping the calendar date
+func dateOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// weekOf returns the Monday of the week holding d
+func weekOf(d time.Time) time.Time {
+	return d.AddDate(0, 0, -((int(d.Weekday()) + 6) % 7))
+}
+
+// daysBetween counts the whole days from a to b, both dates
+func daysBetween(a, b time.Time) int {
+	return int(b.Sub(a).Hours() / 24)
+}
+
+func containsWeekday(days []time.Weekday, d time.Weekday) bool {
+	for _, x := range days {
+		if x == d {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMonth(months []time.Month, m time.Month) bool {
+	for _, x := range months {
+		if x == m {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesMonthDay checks d against days of the month, negative ones counting back from the last
+func matchesMonthDay(days []int, d time.Time) bool {
+	last := time.Date(d.Year(), d.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, x := range days {
+		if x == d.Day() || (x < 0 && last+x+1 == d.Day()) {
+			return true
+		}
+	}
+	return false
+}
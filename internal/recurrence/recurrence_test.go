@@ -0,0 +1,123 @@
+package recurrence
+
+import (
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want string
+		ok   bool
+	}{
+		{"weekly", "FREQ=WEEKLY;BYDAY=MO,TU", "FREQ=WEEKLY;BYDAY=MO,TU", true},
+		{"prefix and case", "rrule:freq=daily;bymonth=1", "FREQ=DAILY;BYMONTH=1", true},
+		{"everything", "FREQ=MONTHLY;INTERVAL=2;BYMONTHDAY=1,-1;UNTIL=20301231T000000Z", "FREQ=MONTHLY;INTERVAL=2;BYMONTHDAY=1,-1;UNTIL=20301231", true},
+		{"empty", "", "", false},
+		{"no freq", "BYDAY=MO", "", false},
+		{"bad freq", "FREQ=HOURLY", "", false},
+		{"bad day", "FREQ=WEEKLY;BYDAY=1MO", "", false},
+		{"bad month", "FREQ=YEARLY;BYMONTH=13", "", false},
+		{"bad interval", "FREQ=DAILY;INTERVAL=0", "", false},
+		{"unsupported", "FREQ=DAILY;COUNT=3", "", false},
+		{"not a pair", "FREQ", "", false},
+	}
+
+	for _, e := range tests {
+		r, err := Parse(e.rule)
+		if (err == nil) != e.ok {
+			t.Errorf("%s: expected ok to be %t but got error %v", e.name, e.ok, err)
+			continue
+		}
+		if e.ok && r.String() != e.want {
+			t.Errorf("%s: expected %s but got %s", e.name, e.want, r.String())
+		}
+	}
+}
+
+func TestOccurs(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		start string
+		day   string
+		want  bool
+	}{
+		{"every monday", "FREQ=WEEKLY;BYDAY=MO", "2025-01-06", "2025-03-03", true},
+		{"not a monday", "FREQ=WEEKLY;BYDAY=MO", "2025-01-06", "2025-03-04", false},
+		{"before the start", "FREQ=WEEKLY;BYDAY=MO", "2025-01-06", "2024-12-30", false},
+		{"weekly defaults to the start day", "FREQ=WEEKLY", "2025-01-08", "2025-01-15", true},
+		{"fortnightly on", "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO", "2025-01-06", "2025-01-20", true},
+		{"fortnightly off", "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO", "2025-01-06", "2025-01-13", false},
+		{"all of january", "FREQ=DAILY;BYMONTH=1", "2025-01-01", "2027-01-17", true},
+		{"not january", "FREQ=DAILY;BYMONTH=1", "2025-01-01", "2027-02-01", false},
+		{"yearly on the start date", "FREQ=YEARLY", "2025-12-24", "2030-12-24", true},
+		{"yearly not the start date", "FREQ=YEARLY", "2025-12-24", "2030-12-25", false},
+		{"yearly in a month keeps the start day", "FREQ=YEARLY;BYMONTH=1", "2025-12-10", "2026-01-10", true},
+		{"last day of the month", "FREQ=MONTHLY;BYMONTHDAY=-1", "2025-01-01", "2028-02-29", true},
+		{"not the last day", "FREQ=MONTHLY;BYMONTHDAY=-1", "2025-01-01", "2028-02-28", false},
+		{"monthly defaults to the start day", "FREQ=MONTHLY", "2025-01-15", "2025-06-15", true},
+		{"until", "FREQ=DAILY;UNTIL=20250110", "2025-01-01", "2025-01-10", true},
+		{"after until", "FREQ=DAILY;UNTIL=20250110", "2025-01-01", "2025-01-11", false},
+	}
+
+	for _, e := range tests {
+		r, err := Parse(e.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if got := r.Occurs(date(e.start), date(e.day)); got != e.want {
+			t.Errorf("%s: expected %t but got %t", e.name, e.want, got)
+		}
+	}
+}
+
+func TestBlocksAndOverlaps(t *testing.T) {
+	// closed over christmas: 17 nights from the 20th of december each year
+	r := Annually()
+	start := date("2025-12-20")
+
+	if !r.Blocks(start, 17, date("2027-01-05")) {
+		t.Error("expected the last night of the closure to be blocked")
+	}
+	if r.Blocks(start, 17, date("2027-01-06")) {
+		t.Error("expected the room to be open again on the 6th")
+	}
+	if r.Blocks(start, 17, date("2025-01-02")) {
+		t.Error("expected nothing blocked before the first closure")
+	}
+
+	if !r.Overlaps(start, 17, date("2026-12-18"), date("2026-12-21")) {
+		t.Error("expected a stay into the closure to overlap it")
+	}
+	if r.Overlaps(start, 17, date("2026-12-17"), date("2026-12-20")) {
+		t.Error("expected a stay leaving the day the closure starts to be free")
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		rule   Rule
+		start  string
+		nights int
+		want   string
+	}{
+		{WeeklyOn(time.Monday, time.Tuesday), "2025-01-06", 1, "Every week on Mon, Tue"},
+		{Annually(), "2025-12-20", 17, "Every year on 20 Dec for 17 nights"},
+		{Rule{Freq: Daily, Interval: 1, ByMonth: []time.Month{time.January}}, "2025-01-01", 1, "Every day in Jan"},
+		{Rule{Freq: Weekly, Interval: 2, Until: date("2026-01-01")}, "2025-01-08", 1, "Every 2 weeks on Wed until 2026-01-01"},
+	}
+
+	for _, e := range tests {
+		if got := e.rule.Describe(date(e.start), e.nights); got != e.want {
+			t.Errorf("%s: expected %q but got %q", e.rule, e.want, got)
+		}
+	}
+}
@@ -7,10 +7,14 @@ import (
 	"html/template"
 	"net/http"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/aparkinlot/Bookings/internal/config"
+	"github.com/aparkinlot/Bookings/internal/helpers"
 	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/pricing"
+	"github.com/aparkinlot/Bookings/internal/repository"
 	"github.com/justinas/nosurf"
 )
 
@@ -19,16 +23,61 @@ var functions = template.FuncMap{
 	"formatDate":   FormatDate,
 	"iterate":      Iterate,
 	"add":          Add,
+	"formatMoney":  pricing.FormatMoney,
+	"statusName":   models.StatusName,
+	"statusColor":  StatusColor,
 }
 
 var app *config.AppConfig
 var pathToTemplates = "./templates"
+var roomSource repository.DatabaseRepo
 
 // NewRenderer sets the config for the template package
 func NewRenderer(a *config.AppConfig) {
 	app = a
 }
 
+// roomCache holds the rooms listed on every page between changes to the catalog
+var roomCache struct {
+	sync.Mutex
+	rooms  []models.Room
+	loaded bool
+}
+
+// NewRoomSource sets the database the rooms listed on every page are read from
+func NewRoomSource(db repository.DatabaseRepo) {
+	roomSource = db
+	InvalidateRooms()
+}
+
+// InvalidateRooms makes the next page rendered read the rooms again; call it when rooms change
+func InvalidateRooms() {
+	roomCache.Lock()
+	defer roomCache.Unlock()
+
+	roomCache.rooms = nil
+	roomCache.loaded = false
+}
+
+// cachedRooms returns the rooms listed on every page, reading them only when the cache is empty
+func cachedRooms() ([]models.Room, error) {
+	roomCache.Lock()
+	defer roomCache.Unlock()
+
+	if roomCache.loaded {
+		return roomCache.rooms, nil
+	}
+
+	rooms, err := roomSource.AllRooms()
+	if err != nil {
+		return nil, err
+	}
+	roomCache.rooms = rooms
+	roomCache.loaded = true
+
+	return rooms, nil
+}
+
 // Returns time in YYYY-MM-DD format
 func ReadableDate(t time.Time) string {
 	return t.Format("2006-01-02")
@@ -38,6 +87,21 @@ func FormatDate(t time.Time, f string) string {
 	return t.Format(f)
 }
 
+// StatusColor returns the bootstrap colour a reservation status is shown in
+func StatusColor(status string) string {
+	switch status {
+	case models.StatusPending:
+		return "warning"
+	case models.StatusConfirmed:
+		return "primary"
+	case models.StatusCheckedIn:
+		return "success"
+	case models.StatusNoShow:
+		return "danger"
+	}
+	return "secondary"
+}
+
 func Add(a, b int) int {
 	return a + b
 }
@@ -59,6 +123,18 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticated = 1
 	}
+	if t, ok := helpers.APITokenFromRequest(r); ok {
+		td.AccessLevel = t.User.AccessLevel
+	} else {
+		td.AccessLevel = app.Session.GetInt(r.Context(), "access_level")
+	}
+	if roomSource != nil {
+		rooms, err := cachedRooms()
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		td.Rooms = rooms
+	}
 	return td
 }
 
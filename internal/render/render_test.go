@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository"
 )
 
 func TestAddDefaultData(t *testing.T) {
@@ -15,12 +16,55 @@ func TestAddDefaultData(t *testing.T) {
 	}
 
 	session.Put(r.Context(), "flash", "123")
+	session.Put(r.Context(), "access_level", models.AccessManager)
 
 	result := AddDefaultData(&td, r)
 
 	if result.Flash != "123" {
 		t.Error("flash value of 123 not found in session storage")
 	}
+
+	if !result.IsManager() || result.IsOwner() {
+		t.Errorf("expected a manager, got access level %d", result.AccessLevel)
+	}
+}
+
+// countingRooms counts how often the rooms are read
+type countingRooms struct {
+	repository.DatabaseRepo
+	reads int
+}
+
+func (c *countingRooms) AllRooms() ([]models.Room, error) {
+	c.reads++
+	return []models.Room{{ID: 1, RoomName: "General's Quarters"}}, nil
+}
+
+func TestAddDefaultDataCachesRooms(t *testing.T) {
+	db := &countingRooms{}
+	NewRoomSource(db)
+	defer NewRoomSource(nil)
+
+	r, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		td := AddDefaultData(&models.TemplateData{}, r)
+		if len(td.Rooms) != 1 {
+			t.Fatalf("expected 1 room but got %d", len(td.Rooms))
+		}
+	}
+	if db.reads != 1 {
+		t.Errorf("expected the rooms to be read once but they were read %d times", db.reads)
+	}
+
+	InvalidateRooms()
+	AddDefaultData(&models.TemplateData{}, r)
+	if db.reads != 2 {
+		t.Errorf("expected the rooms to be read again after invalidating but they were read %d times", db.reads)
+	}
 }
 
 func TestRenderTemplate(t *testing.T) {
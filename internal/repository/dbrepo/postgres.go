@@ -2,14 +2,42 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/aparkinlot/Bookings/internal/audit"
 	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/jackc/pgconn"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// postgres error codes the repository turns into repository errors
+const (
+	exclusionViolation = "23P01" // the no-overlap constraint on room_restrictions failed
+	uniqueViolation    = "23505"
+)
+
+// isOverlapViolation reports whether err came from the room_restrictions no-overlap constraint
+func isOverlapViolation(err error) bool {
+	return hasPgCode(err, exclusionViolation)
+}
+
+// isUniqueViolation reports whether err came from a unique index
+func isUniqueViolation(err error) bool {
+	return hasPgCode(err, uniqueViolation)
+}
+
+func hasPgCode(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
+
 func (m *postgresDBRepo) AllUsers() bool {
 	return true
 }
@@ -69,455 +97,3131 @@ func (m *postgresDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
 	return nil
 }
 
-// returns true if availability exists for roomID and false otherwise
-func (m *postgresDBRepo) SearchAvailibilityByDatesAndRoomID(start, end time.Time, roomID int) (bool, error) {
+// Inserts a reservation and its room restriction in a single transaction
+// The guest's hold, if holdID is still live, becomes the reservation's restriction
+// If the room was booked or blocked for overlapping dates in the meantime, nothing is written
+// and repository.ErrRoomUnavailable is returned
+func (m *postgresDBRepo) InsertReservationWithRestriction(res models.Reservation, holdID int, confirmed bool) (int, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `
-		select
-			count(id)
-		from
-			room_restrictions
-		where
-			room_id = $1
-			and $2 < end_date and $3 > start_date`
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
-	row := m.DB.QueryRowContext(cntx, query, roomID, start, end)
+	newID, err := insertReservation(cntx, tx, res, holdID, confirmed)
+	if err != nil {
+		return 0, err
+	}
 
-	var numRows int
-	err := row.Scan(&numRows)
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// insertReservation writes a reservation, its line items and its room restriction as part of tx
+func insertReservation(cntx context.Context, tx *sql.Tx, res models.Reservation, holdID int, confirmed bool) (int, error) {
+	closed, err := closedByRecurringBlock(cntx, tx, res.RoomID, res.StartDate, res.EndDate)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
-	if numRows == 0 {
-		return true, nil
+	if closed {
+		return 0, repository.ErrRoomUnavailable
 	}
-	return false, nil
+
+	groupID := sql.NullInt64{Int64: int64(res.BookingGroupID), Valid: res.BookingGroupID > 0}
+
+	var newID int
+	stmt := `insert into reservations (first_name, last_name, email, phone, start_date,
+			end_date, room_id, adults, children, confirmation_code, currency, subtotal, fee_total, tax_total, total,
+			booking_group_id, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18) returning id`
+
+	err = tx.QueryRowContext(cntx, stmt,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		res.StartDate,
+		res.EndDate,
+		res.RoomID,
+		res.Adults,
+		res.Children,
+		res.ConfirmationCode,
+		res.Currency,
+		res.Subtotal,
+		res.FeeTotal,
+		res.TaxTotal,
+		res.Total,
+		groupID,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertLineItems(cntx, tx, newID, res.LineItems)
+	if err != nil {
+		return 0, err
+	}
+
+	err = deleteExpiredHoldsForRoom(cntx, tx, res.RoomID, res.StartDate, res.EndDate)
+	if err != nil {
+		return 0, err
+	}
+
+	// promote the guest's hold, so nobody can slip in between releasing it and booking
+	var promoted int64
+	if holdID > 0 {
+		stmt = `update room_restrictions set start_date = $1, end_date = $2, reservation_id = $3,
+				restriction_id = $4, confirmed = $5, expires_at = null, updated_at = $6
+				where id = $7 and room_id = $8 and restriction_id = $9`
+
+		result, err := tx.ExecContext(cntx, stmt,
+			res.StartDate,
+			res.EndDate,
+			newID,
+			models.RestrictionReservation,
+			confirmed,
+			time.Now(),
+			holdID,
+			res.RoomID,
+			models.RestrictionHold,
+		)
+		if isOverlapViolation(err) {
+			return 0, repository.ErrRoomUnavailable
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		promoted, err = result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// no hold, or it lapsed and was swept before the guest finished
+	if promoted == 0 {
+		stmt = `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+				created_at, updated_at, restriction_id, confirmed)
+				values
+				($1, $2, $3, $4, $5, $6, $7, $8)`
+
+		_, err = tx.ExecContext(cntx, stmt,
+			res.StartDate,
+			res.EndDate,
+			res.RoomID,
+			newID,
+			time.Now(),
+			time.Now(),
+			models.RestrictionReservation,
+			confirmed,
+		)
+		if isOverlapViolation(err) {
+			return 0, repository.ErrRoomUnavailable
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return newID, nil
 }
 
-func (m *postgresDBRepo) SearchAvailibilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+// Inserts a booking group and a reservation for each of its rooms in a single transaction
+// holdIDs[i], if still live, becomes the restriction of the group's i-th reservation
+// Returns the group with its own and its reservations' ids filled in; if any room was taken
+// in the meantime nothing is written and repository.ErrRoomUnavailable is returned
+func (m *postgresDBRepo) InsertBookingGroup(g models.BookingGroup, holdIDs []int, confirmed bool) (models.BookingGroup, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var rooms []models.Room
-	query := `
-		select
-			r.id, r.room_name
-		from
-			rooms r
-		where r.id not in (select room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date)
-		`
-
-	rows, err := m.DB.QueryContext(cntx, query, start, end)
+	tx, err := m.DB.BeginTx(cntx, nil)
 	if err != nil {
-		return rooms, err
+		return g, err
+	}
+	defer tx.Rollback()
+
+	stmt := `insert into booking_groups (first_name, last_name, email, phone, confirmation_code,
+			created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err = tx.QueryRowContext(cntx, stmt,
+		g.FirstName,
+		g.LastName,
+		g.Email,
+		g.Phone,
+		g.ConfirmationCode,
+		time.Now(),
+		time.Now(),
+	).Scan(&g.ID)
+	if err != nil {
+		return g, err
 	}
 
-	//var room models.Room
-	for rows.Next() {
-		var room models.Room
-		err := rows.Scan(
-			&room.ID,
-			&room.RoomName,
-		)
+	for i := range g.Reservations {
+		g.Reservations[i].BookingGroupID = g.ID
+
+		holdID := 0
+		if i < len(holdIDs) {
+			holdID = holdIDs[i]
+		}
+
+		id, err := insertReservation(cntx, tx, g.Reservations[i], holdID, confirmed)
 		if err != nil {
-			return rooms, err
+			return g, err
 		}
-		rooms = append(rooms, room)
+		g.Reservations[i].ID = id
 	}
 
-	if err = rows.Err(); err != nil {
-		return rooms, err
+	if err = tx.Commit(); err != nil {
+		return g, err
 	}
 
-	return rooms, nil
+	return g, nil
 }
 
-func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
+// Returns a booking group with its reservations, ordered by room
+func (m *postgresDBRepo) GetBookingGroupByID(id int) (models.BookingGroup, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var room models.Room
+	var g models.BookingGroup
 
 	query := `
-		select id, room_name, created_at, updated_at from rooms where id = $1
+		select id, first_name, last_name, email, phone, confirmation_code, created_at, updated_at
+		from booking_groups where id = $1
 	`
 
-	row := m.DB.QueryRowContext(cntx, query, id)
-	err := row.Scan(
-		&room.ID,
-		&room.RoomName,
-		&room.CreatedAt,
-		&room.UpdatedAt,
+	err := m.DB.QueryRowContext(cntx, query, id).Scan(
+		&g.ID,
+		&g.FirstName,
+		&g.LastName,
+		&g.Email,
+		&g.Phone,
+		&g.ConfirmationCode,
+		&g.CreatedAt,
+		&g.UpdatedAt,
 	)
+	if err != nil {
+		return g, err
+	}
+
+	query = `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.status,
+		coalesce(r.confirmation_code, ''), r.confirmed_at, r.checked_in_at, r.checked_out_at, r.cancelled_at, r.no_show_at,
+		r.currency, r.subtotal, r.fee_total, r.tax_total, r.total, coalesce(r.booking_group_id, 0),
+		r.adults, r.children, r.needs_reprice, r.deleted_at, r.delete_reason, rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.booking_group_id = $1 and r.deleted_at is null
+		order by rm.room_name
+	`
 
+	rows, err := m.DB.QueryContext(cntx, query, id)
 	if err != nil {
-		return room, err
+		return g, err
 	}
-	return room, nil
+	defer rows.Close()
+
+	for rows.Next() {
+		res, err := scanReservation(rows)
+		if err != nil {
+			return g, err
+		}
+		g.Reservations = append(g.Reservations, res)
+	}
+
+	if err = rows.Err(); err != nil {
+		return g, err
+	}
+
+	return g, nil
 }
 
-// Returns a User by ID
-func (m *postgresDBRepo) GetUserByID(id int) (models.User, error) {
+// Deletes a booking group; its reservations and their restrictions go with it
+func (m *postgresDBRepo) DeleteBookingGroup(id int) error {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at
-				from users where id = $1`
+	query := `delete from booking_groups where id = $1`
 
-	row := m.DB.QueryRowContext(cntx, query, id)
+	_, err := m.DB.ExecContext(cntx, query, id)
+	return err
+}
 
-	var u models.User
-	err := row.Scan(
-		&u.ID,
-		&u.FirstName,
-		&u.LastName,
-		&u.Email,
-		&u.Password,
-		&u.AccessLevel,
-		&u.CreatedAt,
-		&u.UpdatedAt,
-	)
+// Holds a room for a guest who is checking out, until r.ExpiresAt
+// Returns repository.ErrRoomUnavailable if the room is booked, blocked or held by someone else
+func (m *postgresDBRepo) InsertHold(r models.RoomRestriction) (int, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
+	tx, err := m.DB.BeginTx(cntx, nil)
 	if err != nil {
-		return u, err
+		return 0, err
 	}
-	return u, nil
+	defer tx.Rollback()
+
+	err = deleteExpiredHoldsForRoom(cntx, tx, r.RoomID, r.StartDate, r.EndDate)
+	if err != nil {
+		return 0, err
+	}
+
+	closed, err := closedByRecurringBlock(cntx, tx, r.RoomID, r.StartDate, r.EndDate)
+	if err != nil {
+		return 0, err
+	}
+	if closed {
+		return 0, repository.ErrRoomUnavailable
+	}
+
+	var newID int
+	stmt := `insert into room_restrictions (start_date, end_date, room_id, restriction_id,
+			expires_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err = tx.QueryRowContext(cntx, stmt,
+		r.StartDate,
+		r.EndDate,
+		r.RoomID,
+		models.RestrictionHold,
+		r.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if isOverlapViolation(err) {
+		return 0, repository.ErrRoomUnavailable
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
 }
 
-// update a User in the Database
-func (m *postgresDBRepo) UpdateUser(u models.User) error {
+// Releases a hold; does nothing if it has already lapsed or been promoted
+func (m *postgresDBRepo) DeleteHold(id int) error {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `update users set first_name = $1, last_name = $2, email = $3,
-				access_level = $4, updated_at = $5`
+	query := `delete from room_restrictions where id = $1 and restriction_id = $2`
 
-	_, err := m.DB.ExecContext(cntx, query, u.FirstName, u.LastName, u.Email, u.AccessLevel, time.Now())
+	_, err := m.DB.ExecContext(cntx, query, id, models.RestrictionHold)
+	return err
+}
+
+// Deletes every hold that has lapsed, returning how many were removed
+func (m *postgresDBRepo) DeleteExpiredHolds() (int, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `delete from room_restrictions where restriction_id = $1 and expires_at <= $2`
+
+	result, err := m.DB.ExecContext(cntx, query, models.RestrictionHold, time.Now())
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+
+	n, err := result.RowsAffected()
+	return int(n), err
 }
 
-// Authenticate validates a user
-// Passwords should never be stored as literals in the database -> use hashing
-func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+// deleteExpiredHoldsForRoom clears lapsed holds in the way of a booking that the sweeper hasn't got to yet
+func deleteExpiredHoldsForRoom(cntx context.Context, tx *sql.Tx, roomID int, start, end time.Time) error {
+	_, err := tx.ExecContext(cntx, `
+		delete from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date
+		and restriction_id = $4 and expires_at <= $5`,
+		roomID, start, end, models.RestrictionHold, time.Now(),
+	)
+	return err
+}
+
+// Records the deposit taken for a reservation and confirms its room restriction
+func (m *postgresDBRepo) ConfirmReservationPayment(p models.Payment) (int, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var id int
-	var hashedPassword string
-
-	row := m.DB.QueryRowContext(cntx, `select id, password from users where email = $1`, email)
-	err := row.Scan(&id, &hashedPassword)
+	tx, err := m.DB.BeginTx(cntx, nil)
 	if err != nil {
-		return id, hashedPassword, err
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, "", errors.New("incorrect password")
+	var newID int
+	stmt := `insert into payments (reservation_id, provider, reference, status, amount, currency,
+			created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err = tx.QueryRowContext(cntx, stmt,
+		p.ReservationID,
+		p.Provider,
+		p.Reference,
+		p.Status,
+		p.Amount,
+		p.Currency,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
 	}
+
+	_, err = tx.ExecContext(cntx,
+		`update room_restrictions set confirmed = true, updated_at = $1 where reservation_id = $2`,
+		time.Now(), p.ReservationID,
+	)
 	if err != nil {
-		return 0, "", err
+		return 0, err
 	}
 
-	return id, hashedPassword, nil
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
 }
 
-// Returns a slice of all reservations
-func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
+// Returns the payments taken for a reservation, oldest first
+func (m *postgresDBRepo) PaymentsForReservation(reservationID int) ([]models.Payment, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var reservations []models.Reservation
+	var payments []models.Payment
 
 	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		order by r.start_date asc
+		select id, reservation_id, provider, reference, status, amount, currency, created_at, updated_at
+		from payments
+		where reservation_id = $1
+		order by created_at asc
 	`
 
-	rows, err := m.DB.QueryContext(cntx, query)
+	rows, err := m.DB.QueryContext(cntx, query, reservationID)
 	if err != nil {
-		return reservations, err
+		return payments, err
 	}
-
 	defer rows.Close()
 
 	for rows.Next() {
-		var i models.Reservation
+		var p models.Payment
 		err := rows.Scan(
-			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Email,
-			&i.Phone,
-			&i.StartDate,
-			&i.EndDate,
-			&i.RoomID,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-			&i.Processed,
-			&i.Room.ID,
-			&i.Room.RoomName,
+			&p.ID,
+			&p.ReservationID,
+			&p.Provider,
+			&p.Reference,
+			&p.Status,
+			&p.Amount,
+			&p.Currency,
+			&p.CreatedAt,
+			&p.UpdatedAt,
 		)
 		if err != nil {
-			return reservations, err
+			return payments, err
 		}
-		reservations = append(reservations, i)
+		payments = append(payments, p)
 	}
 
 	if err = rows.Err(); err != nil {
-		return reservations, err
+		return payments, err
 	}
 
-	return reservations, nil
+	return payments, nil
 }
 
-// Returns a slice of all reservations
-func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
+// Returns a payment by the provider's reference for it
+func (m *postgresDBRepo) GetPaymentByReference(provider, reference string) (models.Payment, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var reservations []models.Reservation
+	var p models.Payment
 
 	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at,
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		where processed = 0
-		order by r.start_date asc
+		select id, reservation_id, provider, reference, status, amount, currency, created_at, updated_at
+		from payments
+		where provider = $1 and reference = $2
 	`
 
-	rows, err := m.DB.QueryContext(cntx, query)
+	row := m.DB.QueryRowContext(cntx, query, provider, reference)
+	err := row.Scan(
+		&p.ID,
+		&p.ReservationID,
+		&p.Provider,
+		&p.Reference,
+		&p.Status,
+		&p.Amount,
+		&p.Currency,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
 	if err != nil {
-		return reservations, err
+		return p, err
 	}
 
-	for rows.Next() {
-		var i models.Reservation
+	return p, nil
+}
+
+// Updates the status and amount of a payment
+func (m *postgresDBRepo) UpdatePayment(p models.Payment) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update payments set status = $1, amount = $2, updated_at = $3 where id = $4`
+
+	_, err := m.DB.ExecContext(cntx, query, p.Status, p.Amount, time.Now(), p.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// insertLineItems writes the priced line items of a reservation as part of tx
+func insertLineItems(cntx context.Context, tx *sql.Tx, reservationID int, items []models.ReservationLineItem) error {
+	stmt := `insert into reservation_line_items (reservation_id, kind, description, night_date,
+			amount, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7)`
+
+	for _, i := range items {
+		var nightDate sql.NullTime
+		if !i.Date.IsZero() {
+			nightDate = sql.NullTime{Time: i.Date, Valid: true}
+		}
+
+		_, err := tx.ExecContext(cntx, stmt,
+			reservationID,
+			i.Kind,
+			i.Description,
+			nightDate,
+			i.Amount,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the priced line items of a reservation, nights first
+func (m *postgresDBRepo) LineItemsForReservation(reservationID int) ([]models.ReservationLineItem, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var items []models.ReservationLineItem
+
+	query := `
+		select id, reservation_id, kind, description, night_date, amount, created_at, updated_at
+		from reservation_line_items
+		where reservation_id = $1
+		order by night_date asc nulls last, id asc
+	`
+
+	rows, err := m.DB.QueryContext(cntx, query, reservationID)
+	if err != nil {
+		return items, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.ReservationLineItem
+		var nightDate sql.NullTime
+		err := rows.Scan(
+			&i.ID,
+			&i.ReservationID,
+			&i.Kind,
+			&i.Description,
+			&nightDate,
+			&i.Amount,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		)
+		if err != nil {
+			return items, err
+		}
+		i.Date = nightDate.Time
+		items = append(items, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return items, err
+	}
+
+	return items, nil
+}
+
+// Replaces the price of a reservation with res's totals and line items
+func (m *postgresDBRepo) RepriceReservation(res models.Reservation, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := reservationByID(cntx, tx, res.ID, true)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update reservations set currency = $1, subtotal = $2, fee_total = $3, tax_total = $4,
+			total = $5, needs_reprice = false, updated_at = $6
+			where id = $7`
+
+	_, err = tx.ExecContext(cntx, stmt,
+		res.Currency,
+		res.Subtotal,
+		res.FeeTotal,
+		res.TaxTotal,
+		res.Total,
+		time.Now(),
+		res.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(cntx, `delete from reservation_line_items where reservation_id = $1`, res.ID)
+	if err != nil {
+		return err
+	}
+
+	err = insertLineItems(cntx, tx, res.ID, res.LineItems)
+	if err != nil {
+		return err
+	}
+
+	err = recordReservationChange(cntx, tx, actor, audit.ActionReprice, before)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// returns true if availability exists for roomID and false otherwise
+func (m *postgresDBRepo) SearchAvailibilityByDatesAndRoomID(start, end time.Time, roomID int) (bool, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			count(id)
+		from
+			room_restrictions
+		where
+			room_id = $1
+			and $2 < end_date and $3 > start_date
+			and (expires_at is null or expires_at > $4)`
+
+	row := m.DB.QueryRowContext(cntx, query, roomID, start, end, time.Now())
+
+	var numRows int
+	err := row.Scan(&numRows)
+	if err != nil {
+		return false, err
+	}
+	if numRows > 0 {
+		return false, nil
+	}
+
+	closed, err := closedByRecurringBlock(cntx, m.DB, roomID, start, end)
+	if err != nil {
+		return false, err
+	}
+	return !closed, nil
+}
+
+// Returns the rooms free for the whole stay that sleep at least guests people
+func (m *postgresDBRepo) SearchAvailibilityForAllRooms(start, end time.Time, guests int) ([]models.Room, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rooms []models.Room
+	query := `
+		select
+			` + roomColumns + `
+		from
+			rooms r
+		where r.id not in (select room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date
+			and (rr.expires_at is null or rr.expires_at > $3))
+		and r.max_occupancy >= $4
+		order by r.room_name
+		`
+
+	rows, err := m.DB.QueryContext(cntx, query, start, end, time.Now(), guests)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	var free []models.Room
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+		free = append(free, room)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+	rows.Close()
+
+	for _, room := range free {
+		closed, err := closedByRecurringBlock(cntx, m.DB, room.ID, start, end)
+		if err != nil {
+			return rooms, err
+		}
+		if !closed {
+			rooms = append(rooms, room)
+		}
+	}
+
+	return rooms, nil
+}
+
+func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + roomColumns + ` from rooms where id = $1`
+
+	row := m.DB.QueryRowContext(cntx, query, id)
+	return scanRoom(row)
+}
+
+// Returns the room shown at /rooms/{slug}, with its photos
+func (m *postgresDBRepo) GetRoomBySlug(slug string) (models.Room, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + roomColumns + ` from rooms where slug = $1`
+
+	room, err := scanRoom(m.DB.QueryRowContext(cntx, query, slug))
+	if err != nil {
+		return room, err
+	}
+
+	room.Photos, err = m.PhotosForRoom(room.ID)
+	return room, err
+}
+
+// roomColumns are the columns scanRoom reads, in order
+const roomColumns = `id, room_name, slug, description, max_occupancy, bed_configuration, amenities,
+		nightly_rate, weekend_surcharge, min_nights, feed_token, created_at, updated_at`
+
+// scanRoom reads a room selected with roomColumns
+func scanRoom(row rowScanner) (models.Room, error) {
+	var room models.Room
+	var amenities string
+
+	err := row.Scan(
+		&room.ID,
+		&room.RoomName,
+		&room.Slug,
+		&room.Description,
+		&room.MaxOccupancy,
+		&room.BedConfiguration,
+		&amenities,
+		&room.NightlyRate,
+		&room.WeekendSurcharge,
+		&room.MinNights,
+		&room.FeedToken,
+		&room.CreatedAt,
+		&room.UpdatedAt,
+	)
+	if err != nil {
+		return room, err
+	}
+
+	// amenities are stored one per line
+	for _, a := range strings.Split(amenities, "\n") {
+		if a = strings.TrimSpace(a); a != "" {
+			room.Amenities = append(room.Amenities, a)
+		}
+	}
+
+	return room, nil
+}
+
+// Inserts a room, returning its id
+func (m *postgresDBRepo) InsertRoom(room models.Room, actor models.Actor) (int, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `insert into rooms (room_name, slug, description, max_occupancy, bed_configuration,
+			amenities, nightly_rate, weekend_surcharge, min_nights, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+
+	err = tx.QueryRowContext(cntx, stmt,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.MaxOccupancy,
+		room.BedConfiguration,
+		strings.Join(room.Amenities, "\n"),
+		room.NightlyRate,
+		room.WeekendSurcharge,
+		room.MinNights,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if isUniqueViolation(err) {
+		return 0, repository.ErrSlugTaken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = recordChange(cntx, tx, actor, audit.ActionCreate, models.EntityRoom, newID, nil, audit.Room(room))
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Updates a room's details and rates
+func (m *postgresDBRepo) UpdateRoom(room models.Room, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := scanRoom(tx.QueryRowContext(cntx, `select `+roomColumns+` from rooms where id = $1 for update`, room.ID))
+	if err != nil {
+		return err
+	}
+
+	stmt := `update rooms set room_name = $1, slug = $2, description = $3, max_occupancy = $4,
+			bed_configuration = $5, amenities = $6, nightly_rate = $7, weekend_surcharge = $8,
+			min_nights = $9, updated_at = $10
+			where id = $11`
+
+	_, err = tx.ExecContext(cntx, stmt,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.MaxOccupancy,
+		room.BedConfiguration,
+		strings.Join(room.Amenities, "\n"),
+		room.NightlyRate,
+		room.WeekendSurcharge,
+		room.MinNights,
+		time.Now(),
+		room.ID,
+	)
+	if isUniqueViolation(err) {
+		return repository.ErrSlugTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	err = recordChange(cntx, tx, actor, audit.ActionUpdate, models.EntityRoom, room.ID, audit.Room(before), audit.Room(room))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Deletes a room with its photos and blocks; returns repository.ErrRoomInUse if it has reservations,
+// as those would be deleted along with it
+func (m *postgresDBRepo) DeleteRoom(id int, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the room so a booking can't be made for it while it's being removed
+	room, err := scanRoom(tx.QueryRowContext(cntx, `select `+roomColumns+` from rooms where id = $1 for update`, id))
+	if err != nil {
+		return err
+	}
+
+	var numRows int
+	err = tx.QueryRowContext(cntx, `select count(id) from reservations where room_id = $1`, id).Scan(&numRows)
+	if err != nil {
+		return err
+	}
+	if numRows > 0 {
+		return repository.ErrRoomInUse
+	}
+
+	_, err = tx.ExecContext(cntx, `delete from rooms where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	err = recordChange(cntx, tx, actor, audit.ActionDelete, models.EntityRoom, id, audit.Room(room), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns the photos of a room in the order they are shown
+func (m *postgresDBRepo) PhotosForRoom(roomID int) ([]models.RoomPhoto, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var photos []models.RoomPhoto
+
+	query := `select id, room_id, url, caption, sort_order, created_at, updated_at
+			from room_photos where room_id = $1 order by sort_order, id`
+
+	rows, err := m.DB.QueryContext(cntx, query, roomID)
+	if err != nil {
+		return photos, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.RoomPhoto
+		err := rows.Scan(&p.ID, &p.RoomID, &p.URL, &p.Caption, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt)
+		if err != nil {
+			return photos, err
+		}
+		photos = append(photos, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return photos, err
+	}
+
+	return photos, nil
+}
+
+// Returns one room photo by id
+func (m *postgresDBRepo) GetRoomPhotoByID(id int) (models.RoomPhoto, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var p models.RoomPhoto
+
+	query := `select id, room_id, url, caption, sort_order, created_at, updated_at
+			from room_photos where id = $1`
+
+	err := m.DB.QueryRowContext(cntx, query, id).Scan(
+		&p.ID, &p.RoomID, &p.URL, &p.Caption, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt,
+	)
+	return p, err
+}
+
+// Inserts a room photo after the room's existing photos, returning its id
+func (m *postgresDBRepo) InsertRoomPhoto(p models.RoomPhoto, actor models.Actor) (int, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `insert into room_photos (room_id, url, caption, sort_order, created_at, updated_at)
+			values ($1, $2, $3,
+				(select coalesce(max(sort_order), -1) + 1 from room_photos where room_id = $1),
+				$4, $5)
+			returning id`
+
+	err = tx.QueryRowContext(cntx, stmt, p.RoomID, p.URL, p.Caption, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	p.ID = newID
+	err = recordChange(cntx, tx, actor, audit.ActionAddPhoto, models.EntityRoom, p.RoomID, nil, audit.Photo(p))
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Deletes a room photo
+func (m *postgresDBRepo) DeleteRoomPhoto(id int, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var p models.RoomPhoto
+	err = tx.QueryRowContext(cntx, `delete from room_photos where id = $1 returning id, room_id, url, caption`, id).Scan(
+		&p.ID, &p.RoomID, &p.URL, &p.Caption,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = recordChange(cntx, tx, actor, audit.ActionRemovePhoto, models.EntityRoom, p.RoomID, audit.Photo(p), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// bookingRuleColumns are the columns read by scanBookingRule
+const bookingRuleColumns = `id, room_id, start_date, end_date, min_nights, max_nights,
+		arrival_days, departure_days, lead_days, horizon_days, created_at, updated_at`
+
+// scanBookingRule reads a booking rule selected with bookingRuleColumns
+func scanBookingRule(row rowScanner) (models.BookingRule, error) {
+	var b models.BookingRule
+	var startDate, endDate sql.NullTime
+
+	err := row.Scan(
+		&b.ID,
+		&b.RoomID,
+		&startDate,
+		&endDate,
+		&b.MinNights,
+		&b.MaxNights,
+		&b.ArrivalDays,
+		&b.DepartureDays,
+		&b.LeadDays,
+		&b.HorizonDays,
+		&b.CreatedAt,
+		&b.UpdatedAt,
+	)
+	if err != nil {
+		return b, err
+	}
+
+	b.StartDate = startDate.Time
+	b.EndDate = endDate.Time
+	return b, nil
+}
+
+// Returns every booking rule of a room, year-round rules first
+func (m *postgresDBRepo) BookingRulesForRoom(roomID int) ([]models.BookingRule, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var bookingRules []models.BookingRule
+
+	query := `select ` + bookingRuleColumns + ` from booking_rules
+			where room_id = $1
+			order by start_date nulls first, id`
+
+	rows, err := m.DB.QueryContext(cntx, query, roomID)
+	if err != nil {
+		return bookingRules, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		b, err := scanBookingRule(rows)
+		if err != nil {
+			return bookingRules, err
+		}
+		bookingRules = append(bookingRules, b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return bookingRules, err
+	}
+
+	return bookingRules, nil
+}
+
+// Returns one booking rule by id
+func (m *postgresDBRepo) GetBookingRuleByID(id int) (models.BookingRule, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + bookingRuleColumns + ` from booking_rules where id = $1`
+
+	row := m.DB.QueryRowContext(cntx, query, id)
+	return scanBookingRule(row)
+}
+
+// Inserts a booking rule, returning its id
+func (m *postgresDBRepo) InsertBookingRule(b models.BookingRule, actor models.Actor) (int, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// year-round rules have no dates
+	startDate := sql.NullTime{Time: b.StartDate, Valid: !b.IsYearRound()}
+	endDate := sql.NullTime{Time: b.EndDate, Valid: !b.IsYearRound()}
+
+	var newID int
+	stmt := `insert into booking_rules (room_id, start_date, end_date, min_nights, max_nights,
+			arrival_days, departure_days, lead_days, horizon_days, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+
+	err = tx.QueryRowContext(cntx, stmt,
+		b.RoomID,
+		startDate,
+		endDate,
+		b.MinNights,
+		b.MaxNights,
+		b.ArrivalDays,
+		b.DepartureDays,
+		b.LeadDays,
+		b.HorizonDays,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	b.ID = newID
+	err = recordChange(cntx, tx, actor, audit.ActionAddRule, models.EntityRoom, b.RoomID, nil, audit.BookingRule(b))
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Deletes a booking rule
+func (m *postgresDBRepo) DeleteBookingRule(id int, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	b, err := scanBookingRule(tx.QueryRowContext(cntx, `delete from booking_rules where id = $1 returning `+bookingRuleColumns, id))
+	if err != nil {
+		return err
+	}
+
+	err = recordChange(cntx, tx, actor, audit.ActionRemoveRule, models.EntityRoom, b.RoomID, audit.BookingRule(b), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// queryer is what reading needs from the database or a transaction
+type queryer interface {
+	QueryContext(cntx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(cntx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// recurringBlocksFor returns the recurring blocks of a room, read through q
+func recurringBlocksFor(cntx context.Context, q queryer, roomID int) ([]models.RecurringBlock, error) {
+	var blocks []models.RecurringBlock
+
+	query := `select id, room_id, start_date, nights, rrule, reason, created_at, updated_at
+			from recurring_blocks where room_id = $1 order by start_date, id`
+
+	rows, err := q.QueryContext(cntx, query, roomID)
+	if err != nil {
+		return blocks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b models.RecurringBlock
+		err := rows.Scan(
+			&b.ID,
+			&b.RoomID,
+			&b.StartDate,
+			&b.Nights,
+			&b.RRule,
+			&b.Reason,
+			&b.CreatedAt,
+			&b.UpdatedAt,
+		)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return blocks, err
+	}
+
+	return blocks, nil
+}
+
+// closedByRecurringBlock reports whether a recurring block closes the room for any night from start to end.
+// Recurring blocks have no rows per night for the overlap constraint to catch, so every availability
+// check and booking runs this as well
+func closedByRecurringBlock(cntx context.Context, q queryer, roomID int, start, end time.Time) (bool, error) {
+	blocks, err := recurringBlocksFor(cntx, q, roomID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, b := range blocks {
+		if b.Overlaps(start, end) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns every recurring block of a room
+func (m *postgresDBRepo) RecurringBlocksForRoom(roomID int) ([]models.RecurringBlock, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return recurringBlocksFor(cntx, m.DB, roomID)
+}
+
+// Returns one recurring block by id
+func (m *postgresDBRepo) GetRecurringBlockByID(id int) (models.RecurringBlock, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var b models.RecurringBlock
+	query := `select id, room_id, start_date, nights, rrule, reason, created_at, updated_at
+			from recurring_blocks where id = $1`
+
+	err := m.DB.QueryRowContext(cntx, query, id).Scan(
+		&b.ID,
+		&b.RoomID,
+		&b.StartDate,
+		&b.Nights,
+		&b.RRule,
+		&b.Reason,
+		&b.CreatedAt,
+		&b.UpdatedAt,
+	)
+	return b, err
+}
+
+// Inserts a recurring block, returning its id
+func (m *postgresDBRepo) InsertRecurringBlock(b models.RecurringBlock, actor models.Actor) (int, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `insert into recurring_blocks (room_id, start_date, nights, rrule, reason, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err = tx.QueryRowContext(cntx, stmt,
+		b.RoomID,
+		b.StartDate,
+		b.Nights,
+		b.RRule,
+		b.Reason,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	b.ID = newID
+	err = recordChange(cntx, tx, actor, audit.ActionAddClosure, models.EntityRoom, b.RoomID, nil, audit.RecurringBlock(b))
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Deletes a recurring block
+func (m *postgresDBRepo) DeleteRecurringBlock(id int, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var b models.RecurringBlock
+	err = tx.QueryRowContext(cntx,
+		`delete from recurring_blocks where id = $1 returning id, room_id, start_date, nights, rrule, reason`, id,
+	).Scan(&b.ID, &b.RoomID, &b.StartDate, &b.Nights, &b.RRule, &b.Reason)
+	if err != nil {
+		return err
+	}
+
+	err = recordChange(cntx, tx, actor, audit.ActionRemoveClosure, models.EntityRoom, b.RoomID, audit.RecurringBlock(b), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns the seasonal rates of a room that cover any night between start and end
+func (m *postgresDBRepo) SeasonalRatesForRoom(roomID int, start, end time.Time) ([]models.SeasonalRate, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var seasons []models.SeasonalRate
+
+	query := `
+		select id, room_id, name, start_date, end_date, nightly_rate, min_nights, created_at, updated_at
+		from seasonal_rates
+		where room_id = $1 and $2 < end_date and $3 > start_date
+		order by start_date
+	`
+
+	rows, err := m.DB.QueryContext(cntx, query, roomID, start, end)
+	if err != nil {
+		return seasons, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.SeasonalRate
+		err := rows.Scan(
+			&s.ID,
+			&s.RoomID,
+			&s.Name,
+			&s.StartDate,
+			&s.EndDate,
+			&s.NightlyRate,
+			&s.MinNights,
+			&s.CreatedAt,
+			&s.UpdatedAt,
+		)
+		if err != nil {
+			return seasons, err
+		}
+		seasons = append(seasons, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return seasons, err
+	}
+
+	return seasons, nil
+}
+
+// Returns a User by ID
+func (m *postgresDBRepo) GetUserByID(id int) (models.User, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at
+				from users where id = $1`
+
+	row := m.DB.QueryRowContext(cntx, query, id)
+
+	var u models.User
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.Password,
+		&u.AccessLevel,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	)
+
+	if err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+// update a User in the Database
+func (m *postgresDBRepo) UpdateUser(u models.User) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update users set first_name = $1, last_name = $2, email = $3,
+				access_level = $4, updated_at = $5`
+
+	_, err := m.DB.ExecContext(cntx, query, u.FirstName, u.LastName, u.Email, u.AccessLevel, time.Now())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Authenticate validates a user
+// Passwords should never be stored as literals in the database -> use hashing
+func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+
+	row := m.DB.QueryRowContext(cntx, `select id, password from users where email = $1`, email)
+	err := row.Scan(&id, &hashedPassword)
+	if err != nil {
+		return id, hashedPassword, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, "", errors.New("incorrect password")
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	return id, hashedPassword, nil
+}
+
+// Returns a page of the reservations that match the filter, sorted as it asks
+func (m *postgresDBRepo) AllReservations(f models.ReservationFilter) ([]models.Reservation, error) {
+	return m.listReservations("r.deleted_at is null", f)
+}
+
+// Returns a page of the reservations waiting to be confirmed that match the filter, sorted as it asks
+func (m *postgresDBRepo) AllNewReservations(f models.ReservationFilter) ([]models.Reservation, error) {
+	f.Status = models.StatusPending
+	return m.listReservations("r.deleted_at is null", f)
+}
+
+// reservationSorts are the expressions a list of reservations is ordered by, with the type a cursor's value is cast to
+var reservationSorts = map[string]struct{ expr, cast string }{
+	models.SortID:        {"r.id", "integer"},
+	models.SortLastName:  {"r.last_name", "text"},
+	models.SortRoom:      {"coalesce(rm.room_name, '')", "text"},
+	models.SortGuests:    {"(r.adults + r.children)", "integer"},
+	models.SortArrival:   {"r.start_date", "date"},
+	models.SortDeparture: {"r.end_date", "date"},
+	models.SortBooked:    {"r.created_at", "timestamp"},
+}
+
+// likeEscaper escapes the wildcards of a like pattern, so a search matches them as they are
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// listReservations returns the reservations matching where and the filter, one page at a time.
+// The page starts after the filter's cursor, ordered by the sort column and then the id so each row has its own place;
+// going backward, the rows before the cursor are read in reverse and turned back round
+func (m *postgresDBRepo) listReservations(where string, f models.ReservationFilter) ([]models.Reservation, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	sort, ok := reservationSorts[f.Sort]
+	if !ok {
+		sort = reservationSorts[models.SortArrival]
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions := []string{where}
+	if f.Search != "" {
+		pattern := arg("%" + likeEscaper.Replace(f.Search) + "%")
+		conditions = append(conditions, fmt.Sprintf(
+			"(r.first_name || ' ' || r.last_name ilike %s or r.email ilike %s)", pattern, pattern))
+	}
+	if f.RoomID > 0 {
+		conditions = append(conditions, "r.room_id = "+arg(f.RoomID))
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "r.end_date > "+arg(f.From))
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "r.start_date <= "+arg(f.To))
+	}
+	if f.Status != "" {
+		conditions = append(conditions, "r.status = "+arg(f.Status))
+	}
+
+	// reading backward flips the order, and the comparison with it
+	desc := f.Desc != f.Cursor.Backward
+	order, compare := "asc", ">"
+	if desc {
+		order, compare = "desc", "<"
+	}
+	if !f.Cursor.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("(%s, r.id) %s (%s::%s, %s)",
+			sort.expr, compare, arg(f.Cursor.Value), sort.cast, arg(f.Cursor.ID)))
+	}
+
+	query := fmt.Sprintf(`
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.adults, r.children,
+		r.created_at, r.updated_at, r.status, r.cancelled_at, coalesce(r.confirmation_code, ''), r.currency, r.total,
+		rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where %s
+		order by %s %s, r.id %s
+	`, strings.Join(conditions, " and "), sort.expr, order, order)
+	if f.Limit > 0 {
+		query += " limit " + arg(f.Limit)
+	}
+
+	rows, err := m.DB.QueryContext(cntx, query, args...)
+	if err != nil {
+		return reservations, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		var cancelledAt sql.NullTime
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.Adults,
+			&i.Children,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Status,
+			&cancelledAt,
+			&i.ConfirmationCode,
+			&i.Currency,
+			&i.Total,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		i.CancelledAt = cancelledAt.Time
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	if f.Cursor.Backward {
+		for i, j := 0, len(reservations)-1; i < j; i, j = i+1, j-1 {
+			reservations[i], reservations[j] = reservations[j], reservations[i]
+		}
+	}
+
+	return reservations, nil
+}
+
+// Returns the nights each room was taken in each month from start up to end, counting reservations
+// and stays booked on other channels. Rooms and months with no nights taken are left out
+func (m *postgresDBRepo) NightsBookedByRoomAndMonth(start, end time.Time) ([]models.RoomNights, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var nights []models.RoomNights
+
+	// one row per night, clipped to the period
+	query := `
+		select rr.room_id, date_trunc('month', n.night)::date as month, count(*)
+		from room_restrictions rr
+		cross join lateral generate_series(
+			greatest(rr.start_date, $1::date),
+			least(rr.end_date, $2::date) - 1,
+			interval '1 day'
+		) as n(night)
+		where rr.restriction_id in ($3, $4) and rr.start_date < $2 and rr.end_date > $1
+		group by rr.room_id, month
+		order by month, rr.room_id
+	`
+
+	rows, err := m.DB.QueryContext(cntx, query, start, end, models.RestrictionReservation, models.RestrictionExternal)
+	if err != nil {
+		return nights, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n models.RoomNights
+		err := rows.Scan(&n.RoomID, &n.Month, &n.Nights)
+		if err != nil {
+			return nights, err
+		}
+		nights = append(nights, n)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nights, err
+	}
+
+	return nights, nil
+}
+
+// Returns the total of the reservations arriving in each month from start up to end; cancelled and deleted ones don't count
+func (m *postgresDBRepo) RevenueByMonth(start, end time.Time) ([]models.MonthlyRevenue, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var revenue []models.MonthlyRevenue
+
+	query := `
+		select date_trunc('month', start_date)::date as month, sum(total)
+		from reservations
+		where start_date >= $1 and start_date < $2 and status <> 'cancelled' and deleted_at is null
+		group by month
+		order by month
+	`
+
+	rows, err := m.DB.QueryContext(cntx, query, start, end)
+	if err != nil {
+		return revenue, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.MonthlyRevenue
+		err := rows.Scan(&r.Month, &r.Total)
+		if err != nil {
+			return revenue, err
+		}
+		revenue = append(revenue, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return revenue, err
+	}
+
+	return revenue, nil
+}
+
+// Returns the reservations arriving from start up to end, by arrival date
+func (m *postgresDBRepo) ArrivalsBetween(start, end time.Time) ([]models.Reservation, error) {
+	return m.reservationsByDate("start_date", start, end)
+}
+
+// Returns the reservations leaving from start up to end, by departure date
+func (m *postgresDBRepo) DeparturesBetween(start, end time.Time) ([]models.Reservation, error) {
+	return m.reservationsByDate("end_date", start, end)
+}
+
+// reservationsByDate returns the reservations that aren't cancelled or deleted whose column, start_date or end_date,
+// falls from start up to end
+func (m *postgresDBRepo) reservationsByDate(column string, start, end time.Time) ([]models.Reservation, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.start_date, r.end_date, r.room_id, r.adults, r.children,
+		r.status, rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.` + column + ` >= $1 and r.` + column + ` < $2 and r.status <> 'cancelled' and r.deleted_at is null
+		order by r.` + column + `, rm.room_name
+	`
+
+	rows, err := m.DB.QueryContext(cntx, query, start, end)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.Adults,
+			&i.Children,
+			&i.Status,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// Returns how many reservations are waiting to be confirmed
+func (m *postgresDBRepo) CountNewReservations() (int, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(cntx,
+		`select count(*) from reservations where status = 'pending' and deleted_at is null`).Scan(&n)
+	return n, err
+}
+
+// Sums up the reservations made since since, leaving out deleted ones: how many were cancelled and how far ahead they were booked
+func (m *postgresDBRepo) BookingStatsSince(since time.Time) (models.BookingStats, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var s models.BookingStats
+
+	query := `
+		select count(*), count(*) filter (where status = 'cancelled'),
+			coalesce(avg(start_date - created_at::date), 0),
+			count(*) filter (where start_date - created_at::date <= 7),
+			count(*) filter (where start_date - created_at::date between 8 and 30),
+			count(*) filter (where start_date - created_at::date between 31 and 90),
+			count(*) filter (where start_date - created_at::date > 90)
+		from reservations
+		where created_at >= $1 and deleted_at is null
+	`
+
+	err := m.DB.QueryRowContext(cntx, query, since).Scan(
+		&s.Bookings,
+		&s.Cancelled,
+		&s.AverageLeadDays,
+		&s.LeadDays[0],
+		&s.LeadDays[1],
+		&s.LeadDays[2],
+		&s.LeadDays[3],
+	)
+	return s, err
+}
+
+// Inserts imported reservations with their room restrictions in a single transaction, keeping the status
+// each was given. If one can't be written, nothing is and a *repository.ImportError says which
+func (m *postgresDBRepo) ImportReservations(reservations []models.Reservation, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, res := range reservations {
+		id, err := insertReservation(cntx, tx, res, 0, true)
+		if err != nil {
+			return &repository.ImportError{Index: i, Err: err}
+		}
+
+		_, err = tx.ExecContext(cntx, `update reservations set status = $1 where id = $2`, res.Status, id)
+		if err != nil {
+			return &repository.ImportError{Index: i, Err: err}
+		}
+
+		imported, err := reservationByID(cntx, tx, id, false)
+		if err != nil {
+			return err
+		}
+		err = recordChange(cntx, tx, actor, audit.ActionImport, models.EntityReservation, id, nil, audit.Reservation(imported))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Inserts imported owner blocks in a single transaction. If one can't be written, nothing is
+// and a *repository.ImportError says which
+func (m *postgresDBRepo) ImportBlocks(blocks []models.RoomRestriction, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, b := range blocks {
+		b.ID, err = insertBlock(cntx, tx, b)
+		if err != nil {
+			return &repository.ImportError{Index: i, Err: err}
+		}
+
+		err = recordChange(cntx, tx, actor, audit.ActionImport, models.EntityRoom, b.RoomID, nil, audit.Block(b))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Returns one reservation by ID
+func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return reservationByID(cntx, m.DB, id, false)
+}
+
+// reservationByID reads a reservation through q; locked keeps anyone else from changing it until q's
+// transaction ends
+func reservationByID(cntx context.Context, q queryer, id int, locked bool) (models.Reservation, error) {
+	query := `select ` + reservationColumns + ` from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.id = $1`
+	if locked {
+		query += ` for update of r`
+	}
+
+	return scanReservation(q.QueryRowContext(cntx, query, id))
+}
+
+// recordReservationChange records a change tx made to a reservation, which was before until then
+func recordReservationChange(cntx context.Context, tx *sql.Tx, actor models.Actor, action string, before models.Reservation) error {
+	after, err := reservationByID(cntx, tx, before.ID, false)
+	if err != nil {
+		return err
+	}
+
+	return recordChange(cntx, tx, actor, action, models.EntityReservation, before.ID,
+		audit.Reservation(before), audit.Reservation(after))
+}
+
+// Returns the reservation with the given confirmation code, as long as email matches the guest's
+func (m *postgresDBRepo) GetReservationByConfirmationCode(code, email string) (models.Reservation, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + reservationColumns + ` from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.confirmation_code = upper($1) and lower(r.email) = lower($2) and r.deleted_at is null`
+
+	row := m.DB.QueryRowContext(cntx, query, strings.TrimSpace(code), strings.TrimSpace(email))
+	return scanReservation(row)
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// reservationColumns are the columns scanReservation reads, in order, from reservations r and their rooms rm
+const reservationColumns = `r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+		r.created_at, r.updated_at, r.status, coalesce(r.confirmation_code, ''), r.confirmed_at, r.checked_in_at,
+		r.checked_out_at, r.cancelled_at, r.no_show_at, r.currency, r.subtotal, r.fee_total, r.tax_total, r.total,
+		coalesce(r.booking_group_id, 0), r.adults, r.children, r.needs_reprice, r.deleted_at, r.delete_reason,
+		rm.id, rm.room_name`
+
+// scanReservation reads a single reservation selected with reservationColumns
+func scanReservation(row rowScanner) (models.Reservation, error) {
+	var res models.Reservation
+	var confirmedAt, checkedInAt, checkedOutAt, cancelledAt, noShowAt, deletedAt sql.NullTime
+
+	err := row.Scan(
+		&res.ID,
+		&res.FirstName,
+		&res.LastName,
+		&res.Email,
+		&res.Phone,
+		&res.StartDate,
+		&res.EndDate,
+		&res.RoomID,
+		&res.CreatedAt,
+		&res.UpdatedAt,
+		&res.Status,
+		&res.ConfirmationCode,
+		&confirmedAt,
+		&checkedInAt,
+		&checkedOutAt,
+		&cancelledAt,
+		&noShowAt,
+		&res.Currency,
+		&res.Subtotal,
+		&res.FeeTotal,
+		&res.TaxTotal,
+		&res.Total,
+		&res.BookingGroupID,
+		&res.Adults,
+		&res.Children,
+		&res.NeedsReprice,
+		&deletedAt,
+		&res.DeleteReason,
+		&res.Room.ID,
+		&res.Room.RoomName,
+	)
+	if err != nil {
+		return res, err
+	}
+
+	res.ConfirmedAt = confirmedAt.Time
+	res.CheckedInAt = checkedInAt.Time
+	res.CheckedOutAt = checkedOutAt.Time
+	res.CancelledAt = cancelledAt.Time
+	res.NoShowAt = noShowAt.Time
+	res.DeletedAt = deletedAt.Time
+	return res, nil
+}
+
+// Moves a reservation, and the room restriction holding its room, to new dates, keeping the price it was booked at
+// and marking it for an admin to re-price
+// Returns repository.ErrRoomUnavailable if anything other than the reservation itself is in the way
+func (m *postgresDBRepo) UpdateReservationDates(id int, start, end time.Time, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := reservationByID(cntx, tx, id, true)
+	if err != nil {
+		return err
+	}
+	if !before.IsUpcoming() || before.IsDeleted() {
+		return sql.ErrNoRows
+	}
+	roomID := before.RoomID
+
+	err = deleteExpiredHoldsForRoom(cntx, tx, roomID, start, end)
+	if err != nil {
+		return err
+	}
+
+	// the reservation's own restriction overlaps its old dates, so leave it out of the check
+	var numRows int
+	err = tx.QueryRowContext(cntx, `
+		select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date
+		and coalesce(reservation_id, 0) <> $4`,
+		roomID, start, end, id,
+	).Scan(&numRows)
+	if err != nil {
+		return err
+	}
+	if numRows > 0 {
+		return repository.ErrRoomUnavailable
+	}
+
+	closed, err := closedByRecurringBlock(cntx, tx, roomID, start, end)
+	if err != nil {
+		return err
+	}
+	if closed {
+		return repository.ErrRoomUnavailable
+	}
+
+	_, err = tx.ExecContext(cntx,
+		`update reservations set start_date = $1, end_date = $2, needs_reprice = true, updated_at = $3 where id = $4`,
+		start, end, time.Now(), id,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(cntx,
+		`update room_restrictions set start_date = $1, end_date = $2, updated_at = $3 where reservation_id = $4`,
+		start, end, time.Now(), id,
+	)
+	if isOverlapViolation(err) {
+		return repository.ErrRoomUnavailable
+	}
+	if err != nil {
+		return err
+	}
+
+	err = recordReservationChange(cntx, tx, actor, audit.ActionUpdate, before)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// statusColumns are the columns stamped with when a reservation reached each status
+var statusColumns = map[string]string{
+	models.StatusConfirmed:  "confirmed_at",
+	models.StatusCheckedIn:  "checked_in_at",
+	models.StatusCheckedOut: "checked_out_at",
+	models.StatusCancelled:  "cancelled_at",
+	models.StatusNoShow:     "no_show_at",
+}
+
+// Moves a reservation to a new status, stamping when it did; cancelling it frees its room, though the
+// reservation itself is kept for the records
+// Returns repository.ErrStatusChange if the reservation can't move from the status it's in to that one
+func (m *postgresDBRepo) UpdateReservationStatus(id int, status string, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := reservationByID(cntx, tx, id, true)
+	if err != nil {
+		return err
+	}
+	if before.IsDeleted() {
+		return sql.ErrNoRows
+	}
+	if !models.CanChangeStatus(before.Status, status) {
+		return repository.ErrStatusChange
+	}
+
+	_, err = tx.ExecContext(cntx,
+		fmt.Sprintf(`update reservations set status = $1, %s = $2, updated_at = $2 where id = $3`, statusColumns[status]),
+		status, time.Now(), id,
+	)
+	if err != nil {
+		return err
+	}
+
+	if status == models.StatusCancelled {
+		_, err = tx.ExecContext(cntx, `delete from room_restrictions where reservation_id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = recordReservationChange(cntx, tx, actor, audit.ActionStatus, before)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// update a Reservation in the Database
+func (m *postgresDBRepo) UpdateReservation(u models.Reservation, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := reservationByID(cntx, tx, u.ID, true)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		update reservations set first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5
+		where id = $6
+	`
+
+	_, err = tx.ExecContext(cntx, query, u.FirstName, u.LastName, u.Email, u.Phone, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	err = recordReservationChange(cntx, tx, actor, audit.ActionUpdate, before)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Moves a reservation to the trash, freeing its room; it's kept, with who deleted it and why, so it can be restored
+func (m *postgresDBRepo) DeleteReservation(id int, actor models.Actor, reason string) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := reservationByID(cntx, tx, id, true)
+	if err != nil {
+		return err
+	}
+	if before.IsDeleted() {
+		return nil
+	}
+
+	deletedBy := sql.NullInt64{Int64: int64(actor.UserID), Valid: actor.UserID > 0}
+	_, err = tx.ExecContext(cntx,
+		`update reservations set deleted_at = $1, deleted_by = $2, delete_reason = $3, updated_at = $1
+		where id = $4`,
+		time.Now(), deletedBy, reason, id,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(cntx, `delete from room_restrictions where reservation_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	err = recordReservationChange(cntx, tx, actor, audit.ActionDelete, before)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns the reservations in the trash, the most recently deleted first, with who deleted each
+func (m *postgresDBRepo) DeletedReservations() ([]models.Reservation, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.start_date, r.end_date, r.room_id, r.status, r.cancelled_at,
+		r.total, r.deleted_at, r.delete_reason, coalesce(u.id, 0), coalesce(u.first_name, ''), coalesce(u.last_name, ''),
+		rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		left join users u on (r.deleted_by = u.id)
+		where r.deleted_at is not null
+		order by r.deleted_at desc, r.id desc
+	`
+
+	rows, err := m.DB.QueryContext(cntx, query)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		var cancelledAt sql.NullTime
 		err := rows.Scan(
 			&i.ID,
 			&i.FirstName,
 			&i.LastName,
 			&i.Email,
-			&i.Phone,
 			&i.StartDate,
 			&i.EndDate,
 			&i.RoomID,
-			&i.CreatedAt,
-			&i.UpdatedAt,
+			&i.Status,
+			&cancelledAt,
+			&i.Total,
+			&i.DeletedAt,
+			&i.DeleteReason,
+			&i.DeletedBy.ID,
+			&i.DeletedBy.FirstName,
+			&i.DeletedBy.LastName,
 			&i.Room.ID,
 			&i.Room.RoomName,
 		)
 		if err != nil {
-			return reservations, err
+			return reservations, err
+		}
+		i.CancelledAt = cancelledAt.Time
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// Takes a reservation out of the trash, holding its room again for its dates unless it had been cancelled
+// Returns repository.ErrRoomUnavailable if the room has been booked or blocked for those dates since
+func (m *postgresDBRepo) RestoreReservation(id int, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := reservationByID(cntx, tx, id, true)
+	if err != nil {
+		return err
+	}
+	if !before.IsDeleted() {
+		return sql.ErrNoRows
+	}
+	r := models.RoomRestriction{RoomID: before.RoomID, StartDate: before.StartDate, EndDate: before.EndDate}
+
+	// a cancelled reservation no longer held its room, so there is nothing to take back
+	if before.Status != models.StatusCancelled {
+		err = deleteExpiredHoldsForRoom(cntx, tx, r.RoomID, r.StartDate, r.EndDate)
+		if err != nil {
+			return err
+		}
+
+		var numRows int
+		err = tx.QueryRowContext(cntx, `
+			select count(id) from room_restrictions
+			where room_id = $1 and $2 < end_date and $3 > start_date`,
+			r.RoomID, r.StartDate, r.EndDate,
+		).Scan(&numRows)
+		if err != nil {
+			return err
+		}
+		if numRows > 0 {
+			return repository.ErrRoomUnavailable
+		}
+
+		closed, err := closedByRecurringBlock(cntx, tx, r.RoomID, r.StartDate, r.EndDate)
+		if err != nil {
+			return err
+		}
+		if closed {
+			return repository.ErrRoomUnavailable
+		}
+
+		_, err = tx.ExecContext(cntx, `
+			insert into room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $6)`,
+			r.StartDate, r.EndDate, r.RoomID, id, models.RestrictionReservation, time.Now(),
+		)
+		if isOverlapViolation(err) {
+			return repository.ErrRoomUnavailable
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(cntx,
+		`update reservations set deleted_at = null, deleted_by = null, delete_reason = '', updated_at = $1 where id = $2`,
+		time.Now(), id,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = recordReservationChange(cntx, tx, actor, audit.ActionRestore, before)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Deletes a reservation for good, with its room restriction; only for bookings that never went through
+func (m *postgresDBRepo) PurgeReservation(id int) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `delete from reservations where id = $1`
+
+	_, err := m.DB.ExecContext(cntx, query, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// retrieves all rooms for the calendar to then filter and display
+func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rooms []models.Room
+
+	query := `select ` + roomColumns + ` from rooms order by room_name`
+
+	rows, err := m.DB.QueryContext(cntx, query)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rm, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+		rooms = append(rooms, rm)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	return rooms, nil
+}
+
+// Retrieves all restrictions of a room for a given start and end date, with the status of each reservation
+func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+
+	// because the owner can set 'blocks', there cannot be a reservation
+	// Go enforces type safety -> coalesce -> if non-null, default to 0
+	query := `
+		select rr.id, coalesce(rr.reservation_id, 0), rr.restriction_id, rr.room_id, rr.start_date, rr.end_date, rr.confirmed,
+			rr.reason, rr.notes, coalesce(r.status, '')
+		from room_restrictions rr
+		left join reservations r on (r.id = rr.reservation_id)
+		where $1 < rr.end_date and $2 >= rr.start_date
+		and rr.room_id = $3 and rr.restriction_id <> $4
+		order by rr.start_date
+	`
+
+	// holds come and go within minutes, so they're left off the calendar
+	rows, err := m.DB.QueryContext(cntx, query, start, end, roomID, models.RestrictionHold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.Confirmed,
+			&r.Reason,
+			&r.Notes,
+			&r.Reservation.Status,
+		)
+		if err != nil {
+			return nil, err
+		}
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return restrictions, nil
+}
+
+// inserts an owner block over the restriction's dates, with its reason and notes.
+// Returns repository.ErrRoomUnavailable if the room is booked or held for any of them
+func (m *postgresDBRepo) InsertBlockForRoom(r models.RoomRestriction, actor models.Actor) (int, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	newID, err := insertBlock(cntx, tx, r)
+	if err != nil {
+		return 0, err
+	}
+
+	r.ID = newID
+	err = recordChange(cntx, tx, actor, audit.ActionBlock, models.EntityRoom, r.RoomID, nil, audit.Block(r))
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// insertBlock writes an owner block as part of tx, clearing any lapsed holds in its way
+func insertBlock(cntx context.Context, tx *sql.Tx, r models.RoomRestriction) (int, error) {
+	err := deleteExpiredHoldsForRoom(cntx, tx, r.RoomID, r.StartDate, r.EndDate)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id,
+			reason, notes, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err = tx.QueryRowContext(cntx, query,
+		r.StartDate,
+		r.EndDate,
+		r.RoomID,
+		models.RestrictionOwnerBlock,
+		r.Reason,
+		r.Notes,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if isOverlapViolation(err) {
+		return 0, repository.ErrRoomUnavailable
+	}
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// deletes an owner block, whatever dates it covers; reservations and holds are left alone.
+// Returns sql.ErrNoRows if there is no such block
+func (m *postgresDBRepo) DeleteBlockByID(id int, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var r models.RoomRestriction
+	query := `delete from room_restrictions where id = $1 and restriction_id = $2
+			returning id, room_id, start_date, end_date, reason, notes`
+
+	err = tx.QueryRowContext(cntx, query, id, models.RestrictionOwnerBlock).Scan(
+		&r.ID, &r.RoomID, &r.StartDate, &r.EndDate, &r.Reason, &r.Notes,
+	)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	err = recordChange(cntx, tx, actor, audit.ActionUnblock, models.EntityRoom, r.RoomID, audit.Block(r), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns the reservations and owner blocks of a room between start and end for its calendar feed,
+// with the guest and confirmation code of each reservation
+func (m *postgresDBRepo) FeedRestrictionsForRoom(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+
+	query := `
+		select rr.id, coalesce(rr.reservation_id, 0), rr.restriction_id, rr.room_id, rr.start_date, rr.end_date,
+			rr.reason, rr.notes, rr.updated_at,
+			coalesce(r.first_name, ''), coalesce(r.last_name, ''), coalesce(r.confirmation_code, ''),
+			coalesce(r.adults, 0), coalesce(r.children, 0)
+		from room_restrictions rr
+		left join reservations r on (r.id = rr.reservation_id)
+		where $1 < rr.end_date and $2 >= rr.start_date
+		and rr.room_id = $3 and rr.restriction_id <> $4
+		order by rr.start_date
+	`
+
+	rows, err := m.DB.QueryContext(cntx, query, start, end, roomID, models.RestrictionHold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.Reason,
+			&r.Notes,
+			&r.UpdatedAt,
+			&r.Reservation.FirstName,
+			&r.Reservation.LastName,
+			&r.Reservation.ConfirmationCode,
+			&r.Reservation.Adults,
+			&r.Reservation.Children,
+		)
+		if err != nil {
+			return nil, err
+		}
+		r.Reservation.ID = r.ReservationID
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return restrictions, nil
+}
+
+// sets the secret in the address of a room's calendar feed, so the old address stops working
+func (m *postgresDBRepo) UpdateRoomFeedToken(id int, token string, actor models.Actor) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(cntx,
+		`update rooms set feed_token = $1, updated_at = $2 where id = $3`,
+		token, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	// the address is secret, so the history only has that it changed
+	err = recordChange(cntx, tx, actor, audit.ActionNewFeedAddress, models.EntityRoom, id, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// icalFeedColumns are the columns scanICalFeed reads, in order; r is the feed's room
+const icalFeedColumns = `f.id, f.room_id, f.name, f.url, f.last_synced_at, f.last_error, f.events, f.conflicts,
+		f.created_at, f.updated_at, r.id, r.room_name, r.slug`
+
+// scanICalFeed reads a feed selected with icalFeedColumns
+func scanICalFeed(row rowScanner) (models.ICalFeed, error) {
+	var f models.ICalFeed
+	var lastSynced sql.NullTime
+	var conflicts string
+
+	err := row.Scan(
+		&f.ID,
+		&f.RoomID,
+		&f.Name,
+		&f.URL,
+		&lastSynced,
+		&f.LastError,
+		&f.Events,
+		&conflicts,
+		&f.CreatedAt,
+		&f.UpdatedAt,
+		&f.Room.ID,
+		&f.Room.RoomName,
+		&f.Room.Slug,
+	)
+	if err != nil {
+		return f, err
+	}
+
+	f.LastSyncedAt = lastSynced.Time
+	// conflicts are stored one per line
+	for _, c := range strings.Split(conflicts, "\n") {
+		if c != "" {
+			f.Conflicts = append(f.Conflicts, c)
+		}
+	}
+
+	return f, nil
+}
+
+// Returns every imported calendar feed, by room
+func (m *postgresDBRepo) AllICalFeeds() ([]models.ICalFeed, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var feeds []models.ICalFeed
+
+	query := `select ` + icalFeedColumns + ` from ical_feeds f
+		left join rooms r on (r.id = f.room_id)
+		order by r.room_name, f.name`
+
+	rows, err := m.DB.QueryContext(cntx, query)
+	if err != nil {
+		return feeds, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f, err := scanICalFeed(rows)
+		if err != nil {
+			return feeds, err
 		}
-		reservations = append(reservations, i)
+		feeds = append(feeds, f)
 	}
 
 	if err = rows.Err(); err != nil {
-		return reservations, err
+		return feeds, err
 	}
 
-	return reservations, nil
+	return feeds, nil
 }
 
-// Returns one reservation by ID
-func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
+// Returns the imported calendar feeds of a room
+func (m *postgresDBRepo) ICalFeedsForRoom(roomID int) ([]models.ICalFeed, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var res models.Reservation
+	var feeds []models.ICalFeed
 
-	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		where r.id = $1
-	`
+	query := `select ` + icalFeedColumns + ` from ical_feeds f
+		left join rooms r on (r.id = f.room_id)
+		where f.room_id = $1
+		order by f.name`
 
-	row := m.DB.QueryRowContext(cntx, query, id)
-	err := row.Scan(
-		&res.ID,
-		&res.FirstName,
-		&res.LastName,
-		&res.Email,
-		&res.Phone,
-		&res.StartDate,
-		&res.EndDate,
-		&res.RoomID,
-		&res.CreatedAt,
-		&res.UpdatedAt,
-		&res.Processed,
-		&res.Room.ID,
-		&res.Room.RoomName,
-	)
+	rows, err := m.DB.QueryContext(cntx, query, roomID)
 	if err != nil {
-		return res, err
+		return feeds, err
 	}
-	return res, nil
+	defer rows.Close()
+
+	for rows.Next() {
+		f, err := scanICalFeed(rows)
+		if err != nil {
+			return feeds, err
+		}
+		feeds = append(feeds, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return feeds, err
+	}
+
+	return feeds, nil
 }
 
-// update a Reservation in the Database
-func (m *postgresDBRepo) UpdateReservation(u models.Reservation) error {
+// Returns an imported calendar feed by id
+func (m *postgresDBRepo) GetICalFeedByID(id int) (models.ICalFeed, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `
-		update reservations set first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5
-		where id = $6
-	`
+	query := `select ` + icalFeedColumns + ` from ical_feeds f
+		left join rooms r on (r.id = f.room_id)
+		where f.id = $1`
 
-	_, err := m.DB.ExecContext(cntx, query, u.FirstName, u.LastName, u.Email, u.Phone, time.Now(), u.ID)
-	if err != nil {
-		return err
-	}
-	return nil
+	return scanICalFeed(m.DB.QueryRowContext(cntx, query, id))
 }
 
-// deletes a Reservation from the Database
-func (m *postgresDBRepo) DeleteReservation(id int) error {
+// Inserts a calendar feed to import, returning its id
+func (m *postgresDBRepo) InsertICalFeed(f models.ICalFeed, actor models.Actor) (int, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `delete from reservations where id = $1`
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
-	_, err := m.DB.ExecContext(cntx, query, id)
+	var newID int
+	stmt := `insert into ical_feeds (room_id, name, url, created_at, updated_at)
+			values ($1, $2, $3, $4, $5) returning id`
+
+	err = tx.QueryRowContext(cntx, stmt,
+		f.RoomID,
+		f.Name,
+		f.URL,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+
+	f.ID = newID
+	err = recordChange(cntx, tx, actor, audit.ActionAddCalendar, models.EntityRoom, f.RoomID, nil, audit.Calendar(f))
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
 }
 
-// updates a Reservation from unprocessed to processed
-func (m *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
+// Deletes a calendar feed; the external blocks imported from it go with it
+func (m *postgresDBRepo) DeleteICalFeed(id int, actor models.Actor) error {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `update reservations set processed = $1 where id = $2`
+	tx, err := m.DB.BeginTx(cntx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := m.DB.ExecContext(cntx, query, processed, id)
+	var f models.ICalFeed
+	err = tx.QueryRowContext(cntx, `delete from ical_feeds where id = $1 returning id, room_id, name, url`, id).Scan(
+		&f.ID, &f.RoomID, &f.Name, &f.URL,
+	)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	err = recordChange(cntx, tx, actor, audit.ActionRemoveCalendar, models.EntityRoom, f.RoomID, audit.Calendar(f), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// retrieves all rooms for the calendar to then filter and display
-func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
-	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Makes the external blocks of a feed match blocks, which are keyed by ExternalUID: new events are blocked,
+// moved ones have their dates changed and those no longer in the feed are removed. Events that overlap a
+// booking or block made here can't be blocked and are returned as conflicts. The feed's status is updated to match
+func (m *postgresDBRepo) SyncICalFeed(f models.ICalFeed, blocks []models.RoomRestriction, actor models.Actor) (models.ICalSync, error) {
+	// a feed can hold a few hundred events, each a statement or two
+	cntx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	var rooms []models.Room
-
-	query := `select id, room_name, created_at, updated_at from rooms order by room_name`
+	var result models.ICalSync
 
-	rows, err := m.DB.QueryContext(cntx, query)
+	tx, err := m.DB.BeginTx(cntx, nil)
 	if err != nil {
-		return rooms, err
+		return result, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
+	existing := make(map[string]models.RoomRestriction)
+	rows, err := tx.QueryContext(cntx,
+		`select id, external_uid, start_date, end_date, reason, notes from room_restrictions where ical_feed_id = $1`, f.ID)
+	if err != nil {
+		return result, err
+	}
 	for rows.Next() {
-		var rm models.Room
-		err := rows.Scan(
-			&rm.ID,
-			&rm.RoomName,
-			&rm.CreatedAt,
-			&rm.UpdatedAt,
-		)
+		var r models.RoomRestriction
+		err = rows.Scan(&r.ID, &r.ExternalUID, &r.StartDate, &r.EndDate, &r.Reason, &r.Notes)
 		if err != nil {
-			return rooms, err
+			rows.Close()
+			return result, err
 		}
-		rooms = append(rooms, rm)
+		existing[r.ExternalUID] = r
 	}
-
+	rows.Close()
 	if err = rows.Err(); err != nil {
-		return rooms, err
+		return result, err
 	}
 
-	return rooms, nil
+	// clear out cancelled events first, freeing their nights for the events that moved onto them
+	wanted := make(map[string]bool)
+	for _, b := range blocks {
+		wanted[b.ExternalUID] = true
+	}
+	for uid, r := range existing {
+		if wanted[uid] {
+			continue
+		}
+		_, err = tx.ExecContext(cntx, `delete from room_restrictions where id = $1`, r.ID)
+		if err != nil {
+			return result, err
+		}
+		err = recordChange(cntx, tx, actor, audit.ActionUnblock, models.EntityRoom, f.RoomID, audit.Block(r), nil)
+		if err != nil {
+			return result, err
+		}
+		result.Removed++
+	}
+
+	for _, b := range blocks {
+		old, found := existing[b.ExternalUID]
+		if found && old.StartDate.Equal(b.StartDate) && old.EndDate.Equal(b.EndDate) {
+			continue
+		}
+
+		err = deleteExpiredHoldsForRoom(cntx, tx, f.RoomID, b.StartDate, b.EndDate)
+		if err != nil {
+			return result, err
+		}
+
+		// an overlap aborts the statement, so each event gets a savepoint to roll back to
+		_, err = tx.ExecContext(cntx, `savepoint external_block`)
+		if err != nil {
+			return result, err
+		}
+
+		b.Reason = f.Name
+		if found {
+			b.ID = old.ID
+			_, err = tx.ExecContext(cntx, `
+				update room_restrictions set start_date = $1, end_date = $2, notes = $3, updated_at = $4
+				where id = $5`,
+				b.StartDate, b.EndDate, b.Notes, time.Now(), old.ID)
+		} else {
+			err = tx.QueryRowContext(cntx, `
+				insert into room_restrictions (start_date, end_date, room_id, restriction_id, confirmed,
+					reason, notes, ical_feed_id, external_uid, created_at, updated_at)
+				values ($1, $2, $3, $4, true, $5, $6, $7, $8, $9, $9)
+				returning id`,
+				b.StartDate, b.EndDate, f.RoomID, models.RestrictionExternal,
+				b.Reason, b.Notes, f.ID, b.ExternalUID, time.Now()).Scan(&b.ID)
+		}
+
+		if isOverlapViolation(err) {
+			_, err = tx.ExecContext(cntx, `rollback to savepoint external_block`)
+			if err != nil {
+				return result, err
+			}
+			result.Conflicts = append(result.Conflicts, fmt.Sprintf("%s to %s",
+				b.StartDate.Format("2006-01-02"), b.EndDate.Format("2006-01-02")))
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+
+		if found {
+			err = recordChange(cntx, tx, actor, audit.ActionMoveBlock, models.EntityRoom, f.RoomID, audit.Block(old), audit.Block(b))
+			result.Updated++
+		} else {
+			err = recordChange(cntx, tx, actor, audit.ActionBlock, models.EntityRoom, f.RoomID, nil, audit.Block(b))
+			result.Added++
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	_, err = tx.ExecContext(cntx, `
+		update ical_feeds set last_synced_at = $1, last_error = '', events = $2, conflicts = $3, updated_at = $1
+		where id = $4`,
+		time.Now(), len(blocks)-len(result.Conflicts), strings.Join(result.Conflicts, "\n"), f.ID)
+	if err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit()
 }
 
-// Retrieves all restrictions of a room for a given start and end date
-func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+// Records that a feed couldn't be synced and why. Blocks imported before are left in place
+func (m *postgresDBRepo) UpdateICalFeedError(id int, message string) error {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var restrictions []models.RoomRestriction
+	_, err := m.DB.ExecContext(cntx,
+		`update ical_feeds set last_synced_at = $1, last_error = $2, updated_at = $1 where id = $3`,
+		time.Now(), message, id)
+	return err
+}
+
+// inserts an api token; scopes are stored space separated
+func (m *postgresDBRepo) InsertAPIToken(t models.APIToken) (int, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into api_tokens (user_id, name, token_hash, scopes, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := m.DB.QueryRowContext(cntx, stmt,
+		t.UserID,
+		t.Name,
+		t.TokenHash,
+		strings.Join(t.Scopes, " "),
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Returns a slice of all api tokens, newest first
+func (m *postgresDBRepo) AllAPITokens() ([]models.APIToken, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var apiTokens []models.APIToken
 
-	// because the owner can set 'blocks', there cannot be a reservation
-	// Go enforces type safety -> coalesce -> if non-null, default to 0
 	query := `
-		select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date
-		from room_restrictions where $1 < end_date and $2 >= start_date
-		and room_id = $3
+		select t.id, t.user_id, t.name, t.scopes, t.last_used_at, t.revoked_at, t.created_at, t.updated_at,
+		u.id, u.first_name, u.last_name, u.email
+		from api_tokens t
+		left join users u on (t.user_id = u.id)
+		order by t.created_at desc
 	`
 
-	rows, err := m.DB.QueryContext(cntx, query, start, end, roomID)
+	rows, err := m.DB.QueryContext(cntx, query)
 	if err != nil {
-		return nil, err
+		return apiTokens, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var r models.RoomRestriction
+		var t models.APIToken
+		var scopes string
+		var lastUsed, revoked sql.NullTime
 		err := rows.Scan(
-			&r.ID,
-			&r.ReservationID,
-			&r.RestrictionID,
-			&r.RoomID,
-			&r.StartDate,
-			&r.EndDate,
+			&t.ID,
+			&t.UserID,
+			&t.Name,
+			&scopes,
+			&lastUsed,
+			&revoked,
+			&t.CreatedAt,
+			&t.UpdatedAt,
+			&t.User.ID,
+			&t.User.FirstName,
+			&t.User.LastName,
+			&t.User.Email,
 		)
 		if err != nil {
-			return nil, err
+			return apiTokens, err
 		}
-		restrictions = append(restrictions, r)
+		t.Scopes = strings.Fields(scopes)
+		t.LastUsedAt = lastUsed.Time
+		t.RevokedAt = revoked.Time
+		apiTokens = append(apiTokens, t)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return apiTokens, err
 	}
 
-	return restrictions, nil
+	return apiTokens, nil
 }
 
-// inserts a room restriction (block)
-func (m *postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+// Returns the live (not revoked) api token with the given hash, along with the user who owns it
+func (m *postgresDBRepo) GetAPITokenByHash(hash string) (models.APIToken, error) {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id,
-			created_at, updated_at) values ($1, $2, $3, $4, $5, $6)`
+	var t models.APIToken
+	var scopes string
+	var lastUsed sql.NullTime
 
-	_, err := m.DB.ExecContext(cntx, query, startDate, startDate.AddDate(0, 0, 1), id, 2, time.Now(), time.Now())
+	query := `
+		select t.id, t.user_id, t.name, t.token_hash, t.scopes, t.last_used_at, t.created_at, t.updated_at,
+		u.id, u.first_name, u.last_name, u.email, u.access_level
+		from api_tokens t
+		left join users u on (t.user_id = u.id)
+		where t.token_hash = $1 and t.revoked_at is null
+	`
+
+	row := m.DB.QueryRowContext(cntx, query, hash)
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.Name,
+		&t.TokenHash,
+		&scopes,
+		&lastUsed,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+		&t.User.ID,
+		&t.User.FirstName,
+		&t.User.LastName,
+		&t.User.Email,
+		&t.User.AccessLevel,
+	)
+	if err != nil {
+		return t, err
+	}
+
+	t.Scopes = strings.Fields(scopes)
+	t.LastUsedAt = lastUsed.Time
+	return t, nil
+}
+
+// revokes an api token; revoked tokens are kept so admins can see what existed
+func (m *postgresDBRepo) RevokeAPIToken(id int) error {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `update api_tokens set revoked_at = $1, updated_at = $1 where id = $2 and revoked_at is null`
+
+	_, err := m.DB.ExecContext(cntx, query, time.Now(), id)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 	return nil
 }
 
-// deletes a room restriction (block)
-func (m *postgresDBRepo) DeleteBlockByID(id int) error {
+// records that an api token was just used
+func (m *postgresDBRepo) UpdateAPITokenLastUsed(id int) error {
 	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `delete from room_restrictions where id = $1`
+	query := `update api_tokens set last_used_at = $1 where id = $2`
 
-	_, err := m.DB.ExecContext(cntx, query, id)
+	_, err := m.DB.ExecContext(cntx, query, time.Now(), id)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 	return nil
 }
+
+// recordChange adds a change to the history as part of tx, so the history has every change that was made
+// and nothing that wasn't. before and after are as audit.Event takes them
+func recordChange(cntx context.Context, tx *sql.Tx, actor models.Actor, action, entity string, entityID int, before, after audit.Fields) error {
+	e, ok, err := audit.Event(actor, action, entity, entityID, before, after)
+	if err != nil || !ok {
+		return err
+	}
+
+	changes, err := json.Marshal(e.Changes)
+	if err != nil {
+		return err
+	}
+	userID := sql.NullInt64{Int64: int64(e.UserID), Valid: e.UserID > 0}
+
+	stmt := `insert into audit_events (user_id, actor, action, entity, entity_id, changes, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	_, err = tx.ExecContext(cntx, stmt,
+		userID,
+		e.Actor,
+		e.Action,
+		e.Entity,
+		e.EntityID,
+		string(changes),
+		time.Now(),
+		time.Now(),
+	)
+	return err
+}
+
+// Returns the audit events the filter picks, newest first, along with who made each change
+func (m *postgresDBRepo) AuditEvents(f models.AuditFilter) ([]models.AuditEvent, error) {
+	cntx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var events []models.AuditEvent
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions := []string{"true"}
+	if f.Entity != "" {
+		conditions = append(conditions, "a.entity = "+arg(f.Entity))
+	}
+	if f.EntityID > 0 {
+		conditions = append(conditions, "a.entity_id = "+arg(f.EntityID))
+	}
+	if f.UserID > 0 {
+		conditions = append(conditions, "a.user_id = "+arg(f.UserID))
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "a.action = "+arg(f.Action))
+	}
+	if f.Before > 0 {
+		conditions = append(conditions, "a.id < "+arg(f.Before))
+	}
+
+	query := fmt.Sprintf(`
+		select a.id, coalesce(a.user_id, 0), a.actor, a.action, a.entity, a.entity_id, a.changes, a.created_at,
+		coalesce(u.first_name, ''), coalesce(u.last_name, ''), coalesce(u.email, '')
+		from audit_events a
+		left join users u on (a.user_id = u.id)
+		where %s
+		order by a.id desc
+	`, strings.Join(conditions, " and "))
+	if f.Limit > 0 {
+		query += " limit " + arg(f.Limit)
+	}
+
+	rows, err := m.DB.QueryContext(cntx, query, args...)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.AuditEvent
+		var changes []byte
+		err := rows.Scan(
+			&e.ID,
+			&e.UserID,
+			&e.Actor,
+			&e.Action,
+			&e.Entity,
+			&e.EntityID,
+			&changes,
+			&e.CreatedAt,
+			&e.User.FirstName,
+			&e.User.LastName,
+			&e.User.Email,
+		)
+		if err != nil {
+			return events, err
+		}
+		err = json.Unmarshal(changes, &e.Changes)
+		if err != nil {
+			return events, err
+		}
+		e.User.ID = e.UserID
+		events = append(events, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return events, err
+	}
+
+	return events, nil
+}
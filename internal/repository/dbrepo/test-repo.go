@@ -1,11 +1,15 @@
 package dbrepo
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/repository"
+	"github.com/aparkinlot/Bookings/internal/tokens"
 )
 
 func (m *testDBRepo) AllUsers() bool {
@@ -31,6 +35,104 @@ func (m *testDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
 	return nil
 }
 
+// Inserts a reservation and its room restriction in a single transaction
+func (m *testDBRepo) InsertReservationWithRestriction(res models.Reservation, holdID int, confirmed bool) (int, error) {
+	// if the room id is 2 or 1000, then fail; otherwise, pass
+	if res.RoomID == 2 || res.RoomID == 1000 {
+		return 0, errors.New("some error")
+	}
+
+	// a start date of 2055-01-01 simulates the room being booked by someone else first
+	testDateTaken, err := time.Parse("2006-01-02", "2055-01-01")
+	if err != nil {
+		log.Println(err)
+	}
+	if res.StartDate == testDateTaken {
+		return 0, repository.ErrRoomUnavailable
+	}
+
+	return 1, nil
+}
+
+func (m *testDBRepo) InsertBookingGroup(g models.BookingGroup, holdIDs []int, confirmed bool) (models.BookingGroup, error) {
+	for i, res := range g.Reservations {
+		// room 1000 fails the insert, a start date of 2055-01-01 means the room was taken first
+		if res.RoomID == 1000 {
+			return g, errors.New("some error")
+		}
+		if res.StartDate.Format("2006-01-02") == "2055-01-01" {
+			return g, repository.ErrRoomUnavailable
+		}
+		g.Reservations[i].ID = i + 10
+		g.Reservations[i].BookingGroupID = 1
+	}
+
+	g.ID = 1
+	return g, nil
+}
+
+func (m *testDBRepo) GetBookingGroupByID(id int) (models.BookingGroup, error) {
+	if id > 100 {
+		return models.BookingGroup{}, sql.ErrNoRows
+	}
+
+	start := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := models.BookingGroup{
+		ID:               id,
+		FirstName:        "John",
+		LastName:         "Smith",
+		Email:            "john@smith.com",
+		ConfirmationCode: "GRP123",
+	}
+	// in group 2 the second room is reservation 2, whose deposit can't be captured
+	resIDs := []int{1, 3}
+	if id == 2 {
+		resIDs = []int{1, 2}
+	}
+	for i, roomID := range []int{1, 2} {
+		g.Reservations = append(g.Reservations, models.Reservation{
+			ID:             resIDs[i],
+			FirstName:      "John",
+			LastName:       "Smith",
+			Email:          "john@smith.com",
+			StartDate:      start,
+			EndDate:        start.AddDate(0, 0, 2),
+			RoomID:         roomID,
+			Total:          20000,
+			Status:         models.StatusPending,
+			BookingGroupID: id,
+			Room:           models.Room{ID: roomID, RoomName: fmt.Sprintf("Room %d", roomID)},
+		})
+	}
+
+	return g, nil
+}
+
+func (m *testDBRepo) DeleteBookingGroup(id int) error {
+	return nil
+}
+
+func (m *testDBRepo) InsertHold(r models.RoomRestriction) (int, error) {
+	// a start date of 2055-01-01 simulates another guest holding the room, 2060-01-01 a database error
+	layout := "2006-01-02"
+	if r.StartDate.Format(layout) == "2055-01-01" {
+		return 0, repository.ErrRoomUnavailable
+	}
+	if r.StartDate.Format(layout) == "2060-01-01" {
+		return 0, errors.New("some error")
+	}
+
+	return 1, nil
+}
+
+func (m *testDBRepo) DeleteHold(id int) error {
+	return nil
+}
+
+func (m *testDBRepo) DeleteExpiredHolds() (int, error) {
+	return 0, nil
+}
+
 // returns true if availability exists for roomID and false otherwise
 func (m *testDBRepo) SearchAvailibilityByDatesAndRoomID(start, end time.Time, roomID int) (bool, error) {
 
@@ -62,7 +164,7 @@ func (m *testDBRepo) SearchAvailibilityByDatesAndRoomID(start, end time.Time, ro
 	return true, nil
 }
 
-func (m *testDBRepo) SearchAvailibilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+func (m *testDBRepo) SearchAvailibilityForAllRooms(start, end time.Time, guests int) ([]models.Room, error) {
 
 	var rooms []models.Room
 
@@ -88,12 +190,13 @@ func (m *testDBRepo) SearchAvailibilityForAllRooms(start, end time.Time) ([]mode
 		return rooms, nil
 	}
 
-	// otherwise, put an entry into the slice, indicating that some room is
-	// available for search dates
-	room := models.Room{
-		ID: 1,
+	// otherwise, every room big enough for the guests is available for the search dates
+	all, _ := m.AllRooms()
+	for _, room := range all {
+		if room.MaxOccupancy >= guests {
+			rooms = append(rooms, room)
+		}
 	}
-	rooms = append(rooms, room)
 
 	return rooms, nil
 }
@@ -101,16 +204,98 @@ func (m *testDBRepo) SearchAvailibilityForAllRooms(start, end time.Time) ([]mode
 func (m *testDBRepo) GetRoomByID(id int) (models.Room, error) {
 	var room models.Room
 
-	if id > 2 {
+	// room 3 has never been booked; ids above it fail
+	if id > 3 {
 		return room, errors.New("some error")
 	}
 
+	room.ID = id
+	room.RoomName = "General's Quarters"
+	room.MaxOccupancy = 2
+	room.FeedToken = "gq-feed"
+	if id == 2 {
+		room.RoomName = "Major's Suite"
+		room.MaxOccupancy = 4
+		room.FeedToken = ""
+	}
+	room.NightlyRate = 10000
+	room.WeekendSurcharge = 2500
+	room.MinNights = 1
+
 	return room, nil
 }
 
+func (m *testDBRepo) SeasonalRatesForRoom(roomID int, start, end time.Time) ([]models.SeasonalRate, error) {
+	var seasons []models.SeasonalRate
+
+	switch start.Format("2006-01-02") {
+	case "2045-01-01":
+		// rates can't be loaded for stays starting 2045-01-01
+		return seasons, errors.New("some error")
+	case "2046-01-01":
+		// stays starting 2046-01-01 fall in a season with a three night minimum
+		seasons = append(seasons, models.SeasonalRate{
+			RoomID:      roomID,
+			Name:        "New Year",
+			StartDate:   start,
+			EndDate:     start.AddDate(0, 0, 7),
+			NightlyRate: 20000,
+			MinNights:   3,
+		})
+	}
+
+	return seasons, nil
+}
+
+func (m *testDBRepo) BookingRulesForRoom(roomID int) ([]models.BookingRule, error) {
+	var bookingRules []models.BookingRule
+
+	// during 2041 guests arrive on a Saturday and stay at most a week
+	// 2041-01-05 is a Saturday
+	bookingRules = append(bookingRules, models.BookingRule{
+		ID:          1,
+		RoomID:      roomID,
+		StartDate:   time.Date(2041, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2042, 1, 1, 0, 0, 0, 0, time.UTC),
+		MaxNights:   7,
+		ArrivalDays: models.Weekdays(0).Add(time.Saturday),
+	})
+
+	return bookingRules, nil
+}
+
+func (m *testDBRepo) GetBookingRuleByID(id int) (models.BookingRule, error) {
+	if id > 100 {
+		return models.BookingRule{}, sql.ErrNoRows
+	}
+
+	return models.BookingRule{ID: id, RoomID: 1}, nil
+}
+
+func (m *testDBRepo) InsertBookingRule(b models.BookingRule, actor models.Actor) (int, error) {
+	return 2, nil
+}
+
+func (m *testDBRepo) DeleteBookingRule(id int, actor models.Actor) error {
+	return nil
+}
+
 func (m *testDBRepo) GetUserByID(id int) (models.User, error) {
 	var u models.User
 
+	// ids above 100 don't exist
+	if id > 100 {
+		return u, sql.ErrNoRows
+	}
+
+	u.ID = id
+	u.AccessLevel = models.AccessOwner
+
+	// user 4 has been demoted to read-only
+	if id == 4 {
+		u.AccessLevel = models.AccessReadOnly
+	}
+
 	return u, nil
 }
 
@@ -126,17 +311,45 @@ func (m *testDBRepo) Authenticate(email, testPassword string) (int, string, erro
 }
 
 // Returns a slice of all reservations
-func (m *testDBRepo) AllReservations() ([]models.Reservation, error) {
-
-	var reservations []models.Reservation
-
-	return reservations, nil
+func (m *testDBRepo) AllReservations(f models.ReservationFilter) ([]models.Reservation, error) {
+	return m.listReservations(f)
 }
 
-func (m *testDBRepo) AllNewReservations() ([]models.Reservation, error) {
+func (m *testDBRepo) AllNewReservations(f models.ReservationFilter) ([]models.Reservation, error) {
+	return m.listReservations(f)
+}
 
+// listReservations finds John Smith, in room 1, unless the search is "nobody".
+// Searching for "many" fills each page of a thousand reservations, and "fail" gives a database error
+func (m *testDBRepo) listReservations(f models.ReservationFilter) ([]models.Reservation, error) {
 	var reservations []models.Reservation
 
+	switch f.Search {
+	case "nobody":
+		return reservations, nil
+	case "fail":
+		return reservations, errors.New("some error")
+	}
+
+	n := 1
+	if f.Search == "many" {
+		n = f.Limit
+	}
+	for i := 1; i <= n && f.Cursor.ID+i <= 1000; i++ {
+		reservations = append(reservations, models.Reservation{
+			ID:        f.Cursor.ID + i,
+			FirstName: "John",
+			LastName:  "Smith",
+			Email:     "john@smith.com",
+			StartDate: time.Date(2050, 7, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2050, 7, 4, 0, 0, 0, 0, time.UTC),
+			RoomID:    1,
+			Adults:    2,
+			Status:    models.StatusConfirmed,
+			Room:      models.Room{ID: 1, RoomName: "General's Quarters"},
+		})
+	}
+
 	return reservations, nil
 }
 
@@ -144,31 +357,313 @@ func (m *testDBRepo) GetReservationByID(id int) (models.Reservation, error) {
 
 	var res models.Reservation
 
+	// ids above 100 don't exist
+	if id > 100 {
+		return res, sql.ErrNoRows
+	}
+
+	res.ID = id
+	res.FirstName = "John"
+	res.LastName = "Smith"
+	res.Email = "john@smith.com"
+	res.RoomID = 1
+	res.ConfirmationCode = "ABC123"
+	res.StartDate = time.Now().AddDate(0, 1, 0)
+	res.EndDate = res.StartDate.AddDate(0, 0, 2)
+	res.Currency = "USD"
+	res.Subtotal = 10000
+	res.Total = 10000
+	res.Status = models.StatusPending
+
+	// reservation 4 is confirmed and 5 checked in; 99 has already been cancelled
+	switch id {
+	case 4:
+		res.Status = models.StatusConfirmed
+	case 5:
+		res.Status = models.StatusCheckedIn
+	case 99:
+		res.Status = models.StatusCancelled
+		res.CancelledAt = time.Now()
+	}
+
+	// reservations 95 and 96 are in the trash
+	if id == 95 || id == 96 {
+		res.DeletedAt = time.Now()
+		res.DeleteReason = "Booked twice"
+	}
+
 	return res, nil
 }
 
-func (m *testDBRepo) UpdateReservation(u models.Reservation) error {
+func (m *testDBRepo) ConfirmReservationPayment(p models.Payment) (int, error) {
+	return 1, nil
+}
+
+func (m *testDBRepo) PaymentsForReservation(reservationID int) ([]models.Payment, error) {
+	var payments []models.Payment
+
+	// reservation 2 has a deposit held as fake_1
+	if reservationID == 2 {
+		payments = append(payments, models.Payment{
+			ID:            1,
+			ReservationID: 2,
+			Provider:      "fake",
+			Reference:     "fake_1",
+			Status:        "authorized",
+			Amount:        2500,
+			Currency:      "USD",
+		})
+	}
+
+	return payments, nil
+}
+
+func (m *testDBRepo) GetPaymentByReference(provider, reference string) (models.Payment, error) {
+	payments, _ := m.PaymentsForReservation(2)
+	if reference != payments[0].Reference {
+		return models.Payment{}, sql.ErrNoRows
+	}
+
+	return payments[0], nil
+}
+
+func (m *testDBRepo) UpdatePayment(p models.Payment) error {
+	return nil
+}
+
+func (m *testDBRepo) LineItemsForReservation(reservationID int) ([]models.ReservationLineItem, error) {
+	var items []models.ReservationLineItem
+
+	// line items can't be loaded for reservation 98
+	if reservationID == 98 {
+		return items, errors.New("some error")
+	}
+
+	items = append(items, models.ReservationLineItem{
+		ReservationID: reservationID,
+		Kind:          "night",
+		Description:   "Nightly rate",
+		Date:          time.Now().AddDate(0, 1, 0),
+		Amount:        10000,
+	})
+
+	return items, nil
+}
+
+func (m *testDBRepo) RepriceReservation(res models.Reservation, actor models.Actor) error {
+	// reservation 97 can't be re-priced
+	if res.ID == 97 {
+		return errors.New("some error")
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) GetReservationByConfirmationCode(code, email string) (models.Reservation, error) {
+	if code != "ABC123" || email != "john@smith.com" {
+		return models.Reservation{}, sql.ErrNoRows
+	}
+
+	return m.GetReservationByID(1)
+}
+
+func (m *testDBRepo) UpdateReservationDates(id int, start, end time.Time, actor models.Actor) error {
+	// the room is taken from 2055-01-01
+	if start.Format("2006-01-02") == "2055-01-01" {
+		return repository.ErrRoomUnavailable
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) UpdateReservationStatus(id int, status string, actor models.Actor) error {
+	res, err := m.GetReservationByID(id)
+	if err != nil {
+		return err
+	}
+	if !models.CanChangeStatus(res.Status, status) {
+		return repository.ErrStatusChange
+	}
 
 	return nil
 }
 
-func (m *testDBRepo) DeleteReservation(id int) error {
+func (m *testDBRepo) UpdateReservation(u models.Reservation, actor models.Actor) error {
 
 	return nil
 }
 
-func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+func (m *testDBRepo) DeleteReservation(id int, actor models.Actor, reason string) error {
+	// reservation 93 can't be moved to the trash
+	if id == 93 {
+		return errors.New("some error")
+	}
 
 	return nil
 }
 
+func (m *testDBRepo) DeletedReservations() ([]models.Reservation, error) {
+	res, err := m.GetReservationByID(96)
+	if err != nil {
+		return nil, err
+	}
+	res.DeletedBy = models.User{ID: 1, FirstName: "Admin", LastName: "User"}
+	res.Room.RoomName = "General's Quarters"
+
+	return []models.Reservation{res}, nil
+}
+
+func (m *testDBRepo) RestoreReservation(id int, actor models.Actor) error {
+	// reservation 95's room has been booked since it was deleted
+	if id == 95 {
+		return repository.ErrRoomUnavailable
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) PurgeReservation(id int) error {
+
+	return nil
+}
+
+func (m *testDBRepo) NightsBookedByRoomAndMonth(start, end time.Time) ([]models.RoomNights, error) {
+	// room 1 is half full in the first month
+	month := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []models.RoomNights{{RoomID: 1, Month: month, Nights: 15}}, nil
+}
+
+func (m *testDBRepo) RevenueByMonth(start, end time.Time) ([]models.MonthlyRevenue, error) {
+	month := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []models.MonthlyRevenue{{Month: month, Total: 45000}}, nil
+}
+
+func (m *testDBRepo) ArrivalsBetween(start, end time.Time) ([]models.Reservation, error) {
+	res := models.Reservation{
+		ID:        1,
+		FirstName: "John",
+		LastName:  "Smith",
+		StartDate: start,
+		EndDate:   start.AddDate(0, 0, 3),
+		RoomID:    1,
+		Adults:    2,
+		Status:    models.StatusConfirmed,
+		Room:      models.Room{ID: 1, RoomName: "General's Quarters"},
+	}
+	return []models.Reservation{res}, nil
+}
+
+func (m *testDBRepo) DeparturesBetween(start, end time.Time) ([]models.Reservation, error) {
+	var reservations []models.Reservation
+
+	return reservations, nil
+}
+
+func (m *testDBRepo) CountNewReservations() (int, error) {
+	return 3, nil
+}
+
+func (m *testDBRepo) BookingStatsSince(since time.Time) (models.BookingStats, error) {
+	return models.BookingStats{
+		Bookings:        20,
+		Cancelled:       2,
+		AverageLeadDays: 21.5,
+		LeadDays:        [4]int{5, 8, 4, 3},
+	}, nil
+}
+
+func (m *testDBRepo) ImportReservations(reservations []models.Reservation, actor models.Actor) error {
+	// a stay arriving 2048-01-01 was booked by someone else after the file was checked
+	for i, res := range reservations {
+		if res.StartDate.Equal(time.Date(2048, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			return &repository.ImportError{Index: i, Err: repository.ErrRoomUnavailable}
+		}
+	}
+	return nil
+}
+
+func (m *testDBRepo) ImportBlocks(blocks []models.RoomRestriction, actor models.Actor) error {
+	for i, b := range blocks {
+		if b.StartDate.Equal(time.Date(2048, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			return &repository.ImportError{Index: i, Err: repository.ErrRoomUnavailable}
+		}
+	}
+	return nil
+}
+
 func (m *testDBRepo) AllRooms() ([]models.Room, error) {
 
 	var rooms []models.Room
+	rooms = append(rooms, models.Room{ID: 1, RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2, FeedToken: "gq-feed"})
+	rooms = append(rooms, models.Room{ID: 2, RoomName: "Major's Suite", Slug: "majors-suite", MaxOccupancy: 4})
 
 	return rooms, nil
 }
 
+func (m *testDBRepo) GetRoomBySlug(slug string) (models.Room, error) {
+	rooms, _ := m.AllRooms()
+	for _, room := range rooms {
+		if room.Slug == slug {
+			room.Photos, _ = m.PhotosForRoom(room.ID)
+			return room, nil
+		}
+	}
+
+	return models.Room{}, sql.ErrNoRows
+}
+
+func (m *testDBRepo) InsertRoom(room models.Room, actor models.Actor) (int, error) {
+	// the seeded rooms' slugs are taken
+	if room.Slug == "generals-quarters" || room.Slug == "majors-suite" {
+		return 0, repository.ErrSlugTaken
+	}
+
+	return 3, nil
+}
+
+func (m *testDBRepo) UpdateRoom(room models.Room, actor models.Actor) error {
+	if room.Slug == "majors-suite" && room.ID != 2 {
+		return repository.ErrSlugTaken
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) DeleteRoom(id int, actor models.Actor) error {
+	// the seeded rooms have reservations
+	if id <= 2 {
+		return repository.ErrRoomInUse
+	}
+
+	return nil
+}
+
+func (m *testDBRepo) PhotosForRoom(roomID int) ([]models.RoomPhoto, error) {
+	var photos []models.RoomPhoto
+
+	if roomID == 1 {
+		photos = append(photos, models.RoomPhoto{ID: 1, RoomID: 1, URL: "/static/images/generals-quarters.png"})
+	}
+
+	return photos, nil
+}
+
+func (m *testDBRepo) GetRoomPhotoByID(id int) (models.RoomPhoto, error) {
+	if id > 100 {
+		return models.RoomPhoto{}, sql.ErrNoRows
+	}
+
+	return models.RoomPhoto{ID: id, RoomID: 1, URL: "/static/images/generals-quarters.png"}, nil
+}
+
+func (m *testDBRepo) InsertRoomPhoto(p models.RoomPhoto, actor models.Actor) (int, error) {
+	return 2, nil
+}
+
+func (m *testDBRepo) DeleteRoomPhoto(id int, actor models.Actor) error {
+	return nil
+}
+
 func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
 
 	var restrictions []models.RoomRestriction
@@ -182,6 +677,18 @@ func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Ti
 		RestrictionID: 2,
 	})
 
+	// add a block for a fortnight's renovation
+	restrictions = append(restrictions, models.RoomRestriction{
+		ID:            3,
+		StartDate:     time.Now().AddDate(0, 0, 5),
+		EndDate:       time.Now().AddDate(0, 0, 19),
+		RoomID:        1,
+		ReservationID: 0,
+		RestrictionID: 2,
+		Reason:        "Renovation",
+		Notes:         "New bathroom",
+	})
+
 	// add a reservation
 	restrictions = append(restrictions, models.RoomRestriction{
 		ID:            2,
@@ -190,16 +697,299 @@ func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Ti
 		RoomID:        1,
 		ReservationID: 1,
 		RestrictionID: 1,
+		Reservation:   models.Reservation{Status: models.StatusConfirmed},
 	})
+
+	// the general's quarters was booked on airbnb for the start of july 2050
+	if roomID == 1 {
+		restrictions = append(restrictions, models.RoomRestriction{
+			ID:            4,
+			StartDate:     time.Date(2050, 7, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:       time.Date(2050, 7, 4, 0, 0, 0, 0, time.UTC),
+			RoomID:        1,
+			RestrictionID: models.RestrictionExternal,
+			Reason:        "Airbnb",
+			ICalFeedID:    1,
+			ExternalUID:   "1418fb94e984-a1b2c3@example-channel.com",
+		})
+	}
 	return restrictions, nil
 }
 
-func (m *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+func (m *testDBRepo) InsertBlockForRoom(r models.RoomRestriction, actor models.Actor) (int, error) {
 
+	// the room is taken on 2055-01-01 and the database fails on 2060-01-01
+	switch r.StartDate.Format("2006-01-02") {
+	case "2055-01-01":
+		return 0, repository.ErrRoomUnavailable
+	case "2060-01-01":
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) DeleteBlockByID(id int, actor models.Actor) error {
+
+	// ids above 100 don't exist
+	if id > 100 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
 
-func (m *testDBRepo) DeleteBlockByID(id int) error {
+func (m *testDBRepo) FeedRestrictionsForRoom(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+
+	// the general's quarters is booked by John Smith and then renovated; the major's suite is free
+	if roomID != 1 {
+		return nil, nil
+	}
+	return []models.RoomRestriction{
+		{
+			ID:            2,
+			StartDate:     time.Date(2050, 7, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:       time.Date(2050, 7, 4, 0, 0, 0, 0, time.UTC),
+			RoomID:        1,
+			ReservationID: 1,
+			RestrictionID: models.RestrictionReservation,
+			Reservation:   models.Reservation{ID: 1, FirstName: "John", LastName: "Smith", ConfirmationCode: "ABC234", Adults: 2},
+		},
+		{
+			ID:            3,
+			StartDate:     time.Date(2050, 8, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:       time.Date(2050, 8, 15, 0, 0, 0, 0, time.UTC),
+			RoomID:        1,
+			RestrictionID: models.RestrictionOwnerBlock,
+			Reason:        "Renovation",
+			Notes:         "New bathroom",
+		},
+	}, nil
+}
+
+func (m *testDBRepo) UpdateRoomFeedToken(id int, token string, actor models.Actor) error {
 
 	return nil
 }
+
+func (m *testDBRepo) AllICalFeeds() ([]models.ICalFeed, error) {
+
+	// the general's quarters is synced with one double booking; the major's suite's feed is broken
+	return []models.ICalFeed{
+		{
+			ID:           1,
+			RoomID:       1,
+			Name:         "Airbnb",
+			URL:          "https://www.airbnb.example/calendar/ical/1.ics",
+			LastSyncedAt: time.Now().Add(-10 * time.Minute),
+			Events:       3,
+			Conflicts:    []string{"2050-07-02 to 2050-07-05"},
+			Room:         models.Room{ID: 1, RoomName: "General's Quarters", Slug: "generals-quarters"},
+		},
+		{
+			ID:           2,
+			RoomID:       2,
+			Name:         "Booking.com",
+			URL:          "https://admin.booking.example/ical/2.ics",
+			LastSyncedAt: time.Now().Add(-10 * time.Minute),
+			LastError:    "the feed answered 404 Not Found",
+			Room:         models.Room{ID: 2, RoomName: "Major's Suite", Slug: "majors-suite"},
+		},
+	}, nil
+}
+
+func (m *testDBRepo) ICalFeedsForRoom(roomID int) ([]models.ICalFeed, error) {
+	var feeds []models.ICalFeed
+
+	all, _ := m.AllICalFeeds()
+	for _, f := range all {
+		if f.RoomID == roomID {
+			feeds = append(feeds, f)
+		}
+	}
+	return feeds, nil
+}
+
+func (m *testDBRepo) GetICalFeedByID(id int) (models.ICalFeed, error) {
+
+	if id > 100 {
+		return models.ICalFeed{}, sql.ErrNoRows
+	}
+	return models.ICalFeed{ID: id, RoomID: 1, Name: "Airbnb"}, nil
+}
+
+func (m *testDBRepo) InsertICalFeed(f models.ICalFeed, actor models.Actor) (int, error) {
+
+	// a feed named "fail" fails to insert
+	if f.Name == "fail" {
+		return 0, errors.New("some error")
+	}
+	return 3, nil
+}
+
+func (m *testDBRepo) DeleteICalFeed(id int, actor models.Actor) error {
+
+	return nil
+}
+
+func (m *testDBRepo) SyncICalFeed(f models.ICalFeed, blocks []models.RoomRestriction, actor models.Actor) (models.ICalSync, error) {
+	var result models.ICalSync
+
+	// the room is taken on 2055-01-01 and the database fails on 2060-01-01
+	for _, b := range blocks {
+		switch b.StartDate.Format("2006-01-02") {
+		case "2055-01-01":
+			result.Conflicts = append(result.Conflicts, "2055-01-01 to "+b.EndDate.Format("2006-01-02"))
+		case "2060-01-01":
+			return result, errors.New("some error")
+		default:
+			result.Added++
+		}
+	}
+	return result, nil
+}
+
+func (m *testDBRepo) UpdateICalFeedError(id int, message string) error {
+
+	return nil
+}
+
+func (m *testDBRepo) InsertAPIToken(t models.APIToken) (int, error) {
+
+	// a token named "fail" fails to insert
+	if t.Name == "fail" {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+func (m *testDBRepo) AllAPITokens() ([]models.APIToken, error) {
+
+	var apiTokens []models.APIToken
+
+	return apiTokens, nil
+}
+
+func (m *testDBRepo) GetAPITokenByHash(hash string) (models.APIToken, error) {
+
+	var t models.APIToken
+
+	// "calendar-token" can only read the calendar feeds
+	if hash == tokens.Hash("calendar-token") {
+		t.ID = 2
+		t.UserID = 1
+		t.TokenHash = hash
+		t.Scopes = []string{tokens.ScopeReadCalendar}
+		t.User.ID = 1
+		t.User.AccessLevel = models.AccessFrontDesk
+		return t, nil
+	}
+
+	// otherwise only the token "valid-token" exists, with read access to reservations
+	if hash != tokens.Hash("valid-token") {
+		return t, sql.ErrNoRows
+	}
+
+	t.ID = 1
+	t.UserID = 1
+	t.TokenHash = hash
+	t.Scopes = []string{tokens.ScopeReadReservations}
+	t.User.ID = 1
+	t.User.AccessLevel = models.AccessFrontDesk
+	return t, nil
+}
+
+func (m *testDBRepo) RevokeAPIToken(id int) error {
+
+	return nil
+}
+
+func (m *testDBRepo) UpdateAPITokenLastUsed(id int) error {
+
+	return nil
+}
+
+func (m *testDBRepo) RecurringBlocksForRoom(roomID int) ([]models.RecurringBlock, error) {
+
+	// every room is closed on mondays
+	return []models.RecurringBlock{
+		{
+			ID:        1,
+			RoomID:    roomID,
+			StartDate: time.Date(2020, 1, 6, 0, 0, 0, 0, time.UTC),
+			Nights:    1,
+			RRule:     "FREQ=WEEKLY;BYDAY=MO",
+			Reason:    "Closed on Mondays",
+		},
+	}, nil
+}
+
+func (m *testDBRepo) GetRecurringBlockByID(id int) (models.RecurringBlock, error) {
+
+	if id > 100 {
+		return models.RecurringBlock{}, sql.ErrNoRows
+	}
+	return models.RecurringBlock{ID: id, RoomID: 1}, nil
+}
+
+func (m *testDBRepo) InsertRecurringBlock(b models.RecurringBlock, actor models.Actor) (int, error) {
+
+	return 2, nil
+}
+
+func (m *testDBRepo) DeleteRecurringBlock(id int, actor models.Actor) error {
+
+	return nil
+}
+
+func (m *testDBRepo) AuditEvents(f models.AuditFilter) ([]models.AuditEvent, error) {
+
+	// entity 1000 fails; otherwise it was updated by the admin, then confirmed by somebody since removed,
+	// then cancelled by the guest
+	if f.EntityID == 1000 {
+		return nil, errors.New("some error")
+	}
+	if f.Action == "delete" {
+		return nil, nil
+	}
+
+	admin := models.User{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@admin.com"}
+	events := []models.AuditEvent{
+		{
+			ID:        3,
+			Actor:     models.ActorGuest.Name,
+			Action:    "change status",
+			Entity:    f.Entity,
+			EntityID:  f.EntityID,
+			Changes:   []models.FieldChange{{Field: "status", Before: []byte(`"confirmed"`), After: []byte(`"cancelled"`)}},
+			CreatedAt: time.Date(2050, 6, 3, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			ID:        2,
+			Action:    "change status",
+			Entity:    f.Entity,
+			EntityID:  f.EntityID,
+			Changes:   []models.FieldChange{{Field: "status", Before: []byte(`"pending"`), After: []byte(`"confirmed"`)}},
+			CreatedAt: time.Date(2050, 6, 2, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			ID:        1,
+			UserID:    1,
+			Action:    "update",
+			Entity:    f.Entity,
+			EntityID:  f.EntityID,
+			Changes:   []models.FieldChange{{Field: "email", Before: []byte(`"john@smith.com"`), After: []byte(`"john@example.com"`)}},
+			CreatedAt: time.Date(2050, 6, 1, 9, 0, 0, 0, time.UTC),
+			User:      admin,
+		},
+	}
+
+	var picked []models.AuditEvent
+	for _, e := range events {
+		if (f.Before == 0 || e.ID < f.Before) && (f.Action == "" || e.Action == f.Action) && (f.UserID == 0 || e.UserID == f.UserID) {
+			picked = append(picked, e)
+		}
+	}
+	if f.Limit > 0 && len(picked) > f.Limit {
+		picked = picked[:f.Limit]
+	}
+	return picked, nil
+}
@@ -1,30 +1,123 @@
 package repository
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/aparkinlot/Bookings/internal/models"
 )
 
+// ErrRoomUnavailable is returned when a room is already booked or blocked for the requested dates
+var ErrRoomUnavailable = errors.New("room is not available for the requested dates")
+
+// ErrSlugTaken is returned when saving a room whose slug another room already uses
+var ErrSlugTaken = errors.New("another room already uses that slug")
+
+// ErrRoomInUse is returned when deleting a room that still has reservations
+var ErrRoomInUse = errors.New("room has reservations")
+
+// ErrStatusChange is returned when moving a reservation to a status it can't reach from its own
+var ErrStatusChange = errors.New("reservation can't move to that status")
+
+// ImportError is returned when one row of an import can't be written, so none of them were
+type ImportError struct {
+	Index int // of the row, counting from 0
+	Err   error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Index+1, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
 type DatabaseRepo interface {
 	AllUsers() bool
 
 	InsertReservation(res models.Reservation) (int, error)
 	InsertRoomRestriction(r models.RoomRestriction) error
+	InsertReservationWithRestriction(res models.Reservation, holdID int, confirmed bool) (int, error)
+	InsertBookingGroup(g models.BookingGroup, holdIDs []int, confirmed bool) (models.BookingGroup, error)
+	GetBookingGroupByID(id int) (models.BookingGroup, error)
+	DeleteBookingGroup(id int) error
+	InsertHold(r models.RoomRestriction) (int, error)
+	DeleteHold(id int) error
+	DeleteExpiredHolds() (int, error)
+	ConfirmReservationPayment(p models.Payment) (int, error)
+	PaymentsForReservation(reservationID int) ([]models.Payment, error)
+	GetPaymentByReference(provider, reference string) (models.Payment, error)
+	UpdatePayment(p models.Payment) error
+	LineItemsForReservation(reservationID int) ([]models.ReservationLineItem, error)
+	RepriceReservation(res models.Reservation, actor models.Actor) error
+	GetReservationByConfirmationCode(code, email string) (models.Reservation, error)
+	UpdateReservationDates(id int, start, end time.Time, actor models.Actor) error
+	UpdateReservationStatus(id int, status string, actor models.Actor) error
 	SearchAvailibilityByDatesAndRoomID(start, end time.Time, roomID int) (bool, error)
-	SearchAvailibilityForAllRooms(start, end time.Time) ([]models.Room, error)
+	SearchAvailibilityForAllRooms(start, end time.Time, guests int) ([]models.Room, error)
 	GetRoomByID(id int) (models.Room, error)
+	SeasonalRatesForRoom(roomID int, start, end time.Time) ([]models.SeasonalRate, error)
+	BookingRulesForRoom(roomID int) ([]models.BookingRule, error)
+	GetBookingRuleByID(id int) (models.BookingRule, error)
+	InsertBookingRule(b models.BookingRule, actor models.Actor) (int, error)
+	DeleteBookingRule(id int, actor models.Actor) error
+
+	RecurringBlocksForRoom(roomID int) ([]models.RecurringBlock, error)
+	GetRecurringBlockByID(id int) (models.RecurringBlock, error)
+	InsertRecurringBlock(b models.RecurringBlock, actor models.Actor) (int, error)
+	DeleteRecurringBlock(id int, actor models.Actor) error
 	GetUserByID(id int) (models.User, error)
 	UpdateUser(u models.User) error
 	Authenticate(email, testPassword string) (int, string, error)
-	AllReservations() ([]models.Reservation, error)
-	AllNewReservations() ([]models.Reservation, error)
+	AllReservations(f models.ReservationFilter) ([]models.Reservation, error)
+	AllNewReservations(f models.ReservationFilter) ([]models.Reservation, error)
 	GetReservationByID(id int) (models.Reservation, error)
-	UpdateReservation(u models.Reservation) error
-	DeleteReservation(id int) error
-	UpdateProcessedForReservation(id, processed int) error
+	UpdateReservation(u models.Reservation, actor models.Actor) error
+	DeleteReservation(id int, actor models.Actor, reason string) error
+	DeletedReservations() ([]models.Reservation, error)
+	RestoreReservation(id int, actor models.Actor) error
+	PurgeReservation(id int) error
+
+	NightsBookedByRoomAndMonth(start, end time.Time) ([]models.RoomNights, error)
+	RevenueByMonth(start, end time.Time) ([]models.MonthlyRevenue, error)
+	ArrivalsBetween(start, end time.Time) ([]models.Reservation, error)
+	DeparturesBetween(start, end time.Time) ([]models.Reservation, error)
+	CountNewReservations() (int, error)
+	BookingStatsSince(since time.Time) (models.BookingStats, error)
+
+	ImportReservations(reservations []models.Reservation, actor models.Actor) error
+	ImportBlocks(blocks []models.RoomRestriction, actor models.Actor) error
+
 	AllRooms() ([]models.Room, error)
+	GetRoomBySlug(slug string) (models.Room, error)
+	InsertRoom(room models.Room, actor models.Actor) (int, error)
+	UpdateRoom(room models.Room, actor models.Actor) error
+	DeleteRoom(id int, actor models.Actor) error
+	PhotosForRoom(roomID int) ([]models.RoomPhoto, error)
+	GetRoomPhotoByID(id int) (models.RoomPhoto, error)
+	InsertRoomPhoto(p models.RoomPhoto, actor models.Actor) (int, error)
+	DeleteRoomPhoto(id int, actor models.Actor) error
 	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
-	InsertBlockForRoom(id int, startDate time.Time) error
-	DeleteBlockByID(id int) error
+	InsertBlockForRoom(r models.RoomRestriction, actor models.Actor) (int, error)
+	DeleteBlockByID(id int, actor models.Actor) error
+	FeedRestrictionsForRoom(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
+	UpdateRoomFeedToken(id int, token string, actor models.Actor) error
+
+	AllICalFeeds() ([]models.ICalFeed, error)
+	ICalFeedsForRoom(roomID int) ([]models.ICalFeed, error)
+	GetICalFeedByID(id int) (models.ICalFeed, error)
+	InsertICalFeed(f models.ICalFeed, actor models.Actor) (int, error)
+	DeleteICalFeed(id int, actor models.Actor) error
+	SyncICalFeed(f models.ICalFeed, blocks []models.RoomRestriction, actor models.Actor) (models.ICalSync, error)
+	UpdateICalFeedError(id int, message string) error
+
+	InsertAPIToken(t models.APIToken) (int, error)
+	AllAPITokens() ([]models.APIToken, error)
+	GetAPITokenByHash(hash string) (models.APIToken, error)
+	RevokeAPIToken(id int) error
+	UpdateAPITokenLastUsed(id int) error
+
+	AuditEvents(f models.AuditFilter) ([]models.AuditEvent, error)
 }
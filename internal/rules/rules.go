@@ -0,0 +1,161 @@
+package rules
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/models"
+	"github.com/aparkinlot/Bookings/internal/pricing"
+	"github.com/aparkinlot/Bookings/internal/repository"
+)
+
+// Form fields a violation can be reported against
+const (
+	FieldStart = "start_date"
+	FieldEnd   = "end_date"
+)
+
+// Violation is a booking rule a stay breaks
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Rules are the booking rules in force for a stay in one room; zero values don't limit the stay
+type Rules struct {
+	MinNights     int
+	MaxNights     int
+	ArrivalDays   models.Weekdays
+	DepartureDays models.Weekdays
+	LeadDays      int
+	HorizonDays   int
+}
+
+// For works out the rules for a stay arriving on arrival.
+// The minimum stay starts at the room's, raised by the season covering the night of arrival,
+// and applies unless a rule changes it. Year-round rules apply first, then the rules whose
+// dates cover the arrival in the order they start, so where rules overlap the one that
+// starts latest wins for each limit it sets.
+func For(room models.Room, seasons []models.SeasonalRate, bookingRules []models.BookingRule, arrival time.Time) Rules {
+	r := Rules{MinNights: room.MinNights}
+	if s, ok := pricing.SeasonFor(seasons, arrival); ok && s.MinNights > r.MinNights {
+		r.MinNights = s.MinNights
+	}
+
+	var applying []models.BookingRule
+	for _, b := range bookingRules {
+		if b.Covers(arrival) {
+			applying = append(applying, b)
+		}
+	}
+	sort.SliceStable(applying, func(i, j int) bool {
+		return applying[i].StartDate.Before(applying[j].StartDate)
+	})
+
+	for _, b := range applying {
+		if b.MinNights > 0 {
+			r.MinNights = b.MinNights
+		}
+		if b.MaxNights > 0 {
+			r.MaxNights = b.MaxNights
+		}
+		if b.ArrivalDays != 0 {
+			r.ArrivalDays = b.ArrivalDays
+		}
+		if b.DepartureDays != 0 {
+			r.DepartureDays = b.DepartureDays
+		}
+		if b.LeadDays > 0 {
+			r.LeadDays = b.LeadDays
+		}
+		if b.HorizonDays > 0 {
+			r.HorizonDays = b.HorizonDays
+		}
+	}
+
+	return r
+}
+
+// Check returns every rule the stay from start to end breaks when booked on today
+func (r Rules) Check(start, end, today time.Time) []Violation {
+	var vs []Violation
+
+	if !end.After(start) {
+		return append(vs, Violation{FieldEnd, "Departure must be after arrival"})
+	}
+
+	daysAhead := daysBetween(today, start)
+	switch {
+	case daysAhead < 0:
+		vs = append(vs, Violation{FieldStart, "Arrival can't be in the past"})
+	case daysAhead < r.LeadDays:
+		vs = append(vs, Violation{FieldStart, fmt.Sprintf("This room must be booked at least %s before arrival", days(r.LeadDays))})
+	case r.HorizonDays > 0 && daysAhead > r.HorizonDays:
+		vs = append(vs, Violation{FieldStart, fmt.Sprintf("This room can only be booked up to %s ahead", days(r.HorizonDays))})
+	}
+
+	if r.ArrivalDays != 0 && !r.ArrivalDays.Has(start.Weekday()) {
+		vs = append(vs, Violation{FieldStart, fmt.Sprintf("Arrivals are only possible on %s", r.ArrivalDays)})
+	}
+
+	nights := daysBetween(start, end)
+	if nights < r.MinNights {
+		vs = append(vs, Violation{FieldEnd, fmt.Sprintf("This room has a minimum stay of %d nights", r.MinNights)})
+	}
+	if r.MaxNights > 0 && nights > r.MaxNights {
+		vs = append(vs, Violation{FieldEnd, fmt.Sprintf("This room has a maximum stay of %d nights", r.MaxNights)})
+	}
+
+	if r.DepartureDays != 0 && !r.DepartureDays.Has(end.Weekday()) {
+		vs = append(vs, Violation{FieldEnd, fmt.Sprintf("Departures are only possible on %s", r.DepartureDays)})
+	}
+
+	return vs
+}
+
+// daysBetween counts the calendar days from a to b
+func daysBetween(a, b time.Time) int {
+	a = time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	b = time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(b.Sub(a).Hours() / 24)
+}
+
+// days formats a number of days, e.g. 1 day, 3 days
+func days(n int) string {
+	if n == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", n)
+}
+
+// Service checks stays against the rules stored in the database
+type Service struct {
+	DB repository.DatabaseRepo
+
+	// Now tells the service what day it is
+	Now func() time.Time
+}
+
+// NewService creates a booking rules service
+func NewService(db repository.DatabaseRepo) *Service {
+	return &Service{
+		DB:  db,
+		Now: time.Now,
+	}
+}
+
+// Check returns every rule a stay in a room breaks
+func (s *Service) Check(room models.Room, start, end time.Time) ([]Violation, error) {
+	seasons, err := s.DB.SeasonalRatesForRoom(room.ID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	bookingRules, err := s.DB.BookingRulesForRoom(room.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return For(room, seasons, bookingRules, start).Check(start, end, s.Now()), nil
+}
@@ -0,0 +1,127 @@
+package rules
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aparkinlot/Bookings/internal/models"
+)
+
+var room = models.Room{ID: 1, MinNights: 2}
+
+func date(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+var saturdays = models.Weekdays(0).Add(time.Saturday)
+
+var forTests = []struct {
+	name     string
+	seasons  []models.SeasonalRate
+	rules    []models.BookingRule
+	arrival  string
+	expected Rules
+}{
+	{"no rules keeps room minimum", nil, nil, "2025-06-02", Rules{MinNights: 2}},
+	{
+		"season on arrival raises minimum stay",
+		[]models.SeasonalRate{{StartDate: date("2025-06-01"), EndDate: date("2025-06-30"), MinNights: 5}},
+		nil, "2025-06-02", Rules{MinNights: 5},
+	},
+	{
+		"season after arrival keeps room minimum stay",
+		[]models.SeasonalRate{{StartDate: date("2025-06-03"), EndDate: date("2025-06-30"), MinNights: 5}},
+		nil, "2025-06-02", Rules{MinNights: 2},
+	},
+	{
+		"season doesn't lower room minimum",
+		[]models.SeasonalRate{{StartDate: date("2025-06-01"), EndDate: date("2025-06-30"), MinNights: 1}},
+		nil, "2025-06-02", Rules{MinNights: 2},
+	},
+	{
+		"rule overrides season minimum",
+		[]models.SeasonalRate{{StartDate: date("2025-06-01"), EndDate: date("2025-06-30"), MinNights: 5}},
+		[]models.BookingRule{{StartDate: date("2025-06-01"), EndDate: date("2025-09-01"), MinNights: 7}},
+		"2025-06-02", Rules{MinNights: 7},
+	},
+	{
+		"year-round rule",
+		nil, []models.BookingRule{{MaxNights: 14, LeadDays: 1}},
+		"2025-06-02", Rules{MinNights: 2, MaxNights: 14, LeadDays: 1},
+	},
+	{
+		"dated rule overrides only what it sets",
+		nil, []models.BookingRule{
+			{StartDate: date("2025-06-01"), EndDate: date("2025-09-01"), MinNights: 7, ArrivalDays: saturdays},
+			{MaxNights: 14, LeadDays: 1},
+		},
+		"2025-06-02", Rules{MinNights: 7, MaxNights: 14, ArrivalDays: saturdays, LeadDays: 1},
+	},
+	{
+		"dated rule doesn't cover arrival",
+		nil, []models.BookingRule{{StartDate: date("2025-06-03"), EndDate: date("2025-09-01"), MinNights: 7}},
+		"2025-06-02", Rules{MinNights: 2},
+	},
+	{
+		"later rule wins where rules overlap",
+		nil, []models.BookingRule{
+			{StartDate: date("2025-12-20"), EndDate: date("2026-01-03"), MinNights: 5},
+			{StartDate: date("2025-12-01"), EndDate: date("2026-02-01"), MinNights: 3, MaxNights: 10},
+		},
+		"2025-12-24", Rules{MinNights: 5, MaxNights: 10},
+	},
+}
+
+func TestFor(t *testing.T) {
+	for _, e := range forTests {
+		got := For(room, e.seasons, e.rules, date(e.arrival))
+		if got != e.expected {
+			t.Errorf("%s: expected %+v but got %+v", e.name, e.expected, got)
+		}
+	}
+}
+
+var checkTests = []struct {
+	name     string
+	rules    Rules
+	start    string
+	end      string
+	expected []Violation
+}{
+	// today is 2025-06-02, a Monday
+	{"allowed", Rules{MinNights: 2}, "2025-06-10", "2025-06-12", nil},
+	{"departure before arrival", Rules{}, "2025-06-10", "2025-06-10", []Violation{{FieldEnd, "Departure must be after arrival"}}},
+	{"in the past", Rules{}, "2025-06-01", "2025-06-03", []Violation{{FieldStart, "Arrival can't be in the past"}}},
+	{"same day allowed", Rules{}, "2025-06-02", "2025-06-03", nil},
+	{"too soon", Rules{LeadDays: 2}, "2025-06-03", "2025-06-05", []Violation{{FieldStart, "This room must be booked at least 2 days before arrival"}}},
+	{"too far ahead", Rules{HorizonDays: 365}, "2026-06-03", "2026-06-05", []Violation{{FieldStart, "This room can only be booked up to 365 days ahead"}}},
+	{"too short", Rules{MinNights: 3}, "2025-06-10", "2025-06-12", []Violation{{FieldEnd, "This room has a minimum stay of 3 nights"}}},
+	{"too long", Rules{MaxNights: 7}, "2025-06-10", "2025-06-20", []Violation{{FieldEnd, "This room has a maximum stay of 7 nights"}}},
+	{
+		"wrong days",
+		Rules{ArrivalDays: saturdays, DepartureDays: saturdays.Add(time.Sunday)},
+		"2025-06-09", "2025-06-13",
+		[]Violation{{FieldStart, "Arrivals are only possible on Sat"}, {FieldEnd, "Departures are only possible on Sat, Sun"}},
+	},
+	{"right days", Rules{ArrivalDays: saturdays, DepartureDays: saturdays}, "2025-06-07", "2025-06-14", nil},
+}
+
+func TestCheck(t *testing.T) {
+	today := time.Date(2025, 6, 2, 15, 30, 0, 0, time.Local)
+
+	for _, e := range checkTests {
+		got := e.rules.Check(date(e.start), date(e.end), today)
+		if !reflect.DeepEqual(got, e.expected) {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestWeekdaysString(t *testing.T) {
+	w := models.Weekdays(0).Add(time.Sunday).Add(time.Friday).Add(time.Monday)
+	if w.String() != "Mon, Fri, Sun" {
+		t.Errorf("expected Mon, Fri, Sun but got %q", w.String())
+	}
+}
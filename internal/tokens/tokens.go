@@ -0,0 +1,89 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Scopes an api token can be granted
+const (
+	ScopeReadReservations  = "reservations:read"
+	ScopeWriteReservations = "reservations:write"
+	ScopeManageBlocks      = "blocks:manage"
+	ScopeReadCalendar      = "calendar:read"
+)
+
+// AllScopes lists every scope, in the order they are offered to admins
+var AllScopes = []string{
+	ScopeReadReservations,
+	ScopeWriteReservations,
+	ScopeManageBlocks,
+	ScopeReadCalendar,
+}
+
+// prefix makes leaked tokens easy to recognise in logs and secret scanners
+const prefix = "bk_"
+
+// Generate creates a new random token, returning the plaintext to hand to the user once
+// and the hash to store in the database
+func Generate() (string, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+
+	plaintext := prefix + base64.RawURLEncoding.EncodeToString(b)
+	return plaintext, Hash(plaintext), nil
+}
+
+// Hash returns the value stored for a token
+// Tokens carry 256 bits of randomness, so a fast hash is enough and lets us look them up directly
+func Hash(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// FeedToken returns a random secret for the address of a room's calendar feed.
+// Feed addresses are shown again whenever they're needed, so unlike api tokens they are stored as they are
+func FeedToken() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// IsValidScope reports whether scope is one we know about
+func IsValidScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// codeAlphabet leaves out 0/O and 1/I so codes can be read over the phone
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// ConfirmationCodeLength is the number of characters in a booking confirmation code
+const ConfirmationCodeLength = 10
+
+// ConfirmationCode creates a random booking confirmation code for guests to find their reservation with
+func ConfirmationCode() (string, error) {
+	b := make([]byte, ConfirmationCodeLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	// the alphabet has 32 characters, so every byte maps onto it without bias
+	for i := range b {
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+	return string(b), nil
+}
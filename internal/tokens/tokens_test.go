@@ -0,0 +1,97 @@
+package tokens
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	plaintext, hash, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(plaintext, prefix) {
+		t.Errorf("token %s is missing prefix %s", plaintext, prefix)
+	}
+
+	if hash != Hash(plaintext) {
+		t.Error("returned hash does not match the hash of the token")
+	}
+
+	other, _, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == plaintext {
+		t.Error("generated the same token twice")
+	}
+}
+
+func TestHash(t *testing.T) {
+	if Hash("abc") != Hash("abc") {
+		t.Error("hash is not stable")
+	}
+
+	if Hash("abc") == Hash("abd") {
+		t.Error("different tokens have the same hash")
+	}
+
+	if len(Hash("abc")) != 64 {
+		t.Errorf("expected a 64 character hash, got %d", len(Hash("abc")))
+	}
+}
+
+func TestIsValidScope(t *testing.T) {
+	if !IsValidScope(ScopeReadReservations) {
+		t.Error("known scope reported as invalid")
+	}
+
+	if IsValidScope("everything") {
+		t.Error("unknown scope reported as valid")
+	}
+}
+
+func TestConfirmationCode(t *testing.T) {
+	code, err := ConfirmationCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(code) != ConfirmationCodeLength {
+		t.Errorf("expected a code of length %d, got %s", ConfirmationCodeLength, code)
+	}
+
+	for _, c := range code {
+		if !strings.ContainsRune(codeAlphabet, c) {
+			t.Errorf("code %s contains %c, which is not in the alphabet", code, c)
+		}
+	}
+
+	other, err := ConfirmationCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == code {
+		t.Error("generated the same code twice")
+	}
+}
+
+func TestFeedToken(t *testing.T) {
+	token, err := FeedToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(token) != 32 {
+		t.Errorf("expected a 32 character token, got %s", token)
+	}
+
+	other, err := FeedToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == token {
+		t.Error("generated the same feed token twice")
+	}
+}
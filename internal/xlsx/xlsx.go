@@ -0,0 +1,204 @@
+// Package xlsx writes spreadsheets in the Office Open XML format Excel and the other spreadsheet apps open,
+// one sheet streamed a row at a time
+package xlsx
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType is the media type of an xlsx file
+const ContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// the styles cells are given, by their place in styles.xml
+const (
+	styleDate  = 1 // yyyy-mm-dd
+	styleMoney = 2 // two decimal places
+)
+
+// Money is an amount in cents, shown with two decimal places
+type Money int
+
+// the parts of the file that don't depend on what's in the sheet
+var fixedParts = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>`},
+	{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy\-mm\-dd"/></numFmts>
+<fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="3">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="2" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+</cellXfs>
+</styleSheet>`},
+}
+
+// Writer writes a workbook of one sheet. Rows are written as they come, so a long sheet isn't held in memory
+type Writer struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+	err   error
+}
+
+// NewWriter starts a workbook on w whose one sheet is called name
+func NewWriter(w io.Writer, name string) (*Writer, error) {
+	z := zip.NewWriter(w)
+
+	for _, part := range fixedParts {
+		f, err := z.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(f, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := z.Create("xl/workbook.xml")
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(f, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`, escape(sheetName(name)))
+	if err != nil {
+		return nil, err
+	}
+
+	// the sheet is written last, so it can stay open while the rows come
+	f, err = z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x := &Writer{zip: z, sheet: bufio.NewWriter(f)}
+	x.write(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return x, x.err
+}
+
+// Write adds a row. Cells may be strings, ints, float64s, Money, bools or dates; a zero date leaves the cell empty
+func (x *Writer) Write(cells []interface{}) error {
+	x.rows++
+	x.write(fmt.Sprintf(`<row r="%d">`, x.rows))
+
+	for i, cell := range cells {
+		ref := Column(i) + strconv.Itoa(x.rows)
+
+		switch v := cell.(type) {
+		case string:
+			if v != "" {
+				x.write(fmt.Sprintf(`<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, escape(v)))
+			}
+		case int:
+			x.write(fmt.Sprintf(`<c r="%s"><v>%d</v></c>`, ref, v))
+		case float64:
+			x.write(fmt.Sprintf(`<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(v, 'f', -1, 64)))
+		case Money:
+			x.write(fmt.Sprintf(`<c r="%s" s="%d"><v>%s</v></c>`, ref, styleMoney, strconv.FormatFloat(float64(v)/100, 'f', 2, 64)))
+		case bool:
+			b := 0
+			if v {
+				b = 1
+			}
+			x.write(fmt.Sprintf(`<c r="%s" t="b"><v>%d</v></c>`, ref, b))
+		case time.Time:
+			if !v.IsZero() {
+				x.write(fmt.Sprintf(`<c r="%s" s="%d"><v>%d</v></c>`, ref, styleDate, serial(v)))
+			}
+		case nil:
+		default:
+			x.err = fmt.Errorf("xlsx: can't write a %T to a cell", cell)
+		}
+	}
+
+	x.write("</row>")
+	return x.err
+}
+
+// Close ends the sheet and the workbook. It doesn't close the underlying writer
+func (x *Writer) Close() error {
+	x.write("</sheetData></worksheet>")
+	if x.err != nil {
+		return x.err
+	}
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+// write writes to the sheet, keeping the first error
+func (x *Writer) write(s string) {
+	if x.err != nil {
+		return
+	}
+	_, x.err = x.sheet.WriteString(s)
+}
+
+// Column is the letters of a column counting from 0, e.g. 0 is A and 27 is AB
+func Column(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// serial is a date as spreadsheets count them, in days since 30 December 1899
+func serial(t time.Time) int {
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return int(day.Sub(time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)).Hours() / 24)
+}
+
+// sheetName makes name fit the rules for sheet names: at most 31 characters, none of them []:*?/\
+func sheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '-'
+		}
+		return r
+	}, name)
+	if r := []rune(name); len(r) > 31 {
+		name = string(r[:31])
+	}
+	if name == "" {
+		name = "Sheet1"
+	}
+	return name
+}
+
+// escape escapes text for XML, replacing the control characters XML can't hold
+func escape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
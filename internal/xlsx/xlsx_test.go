@@ -0,0 +1,102 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+	x, err := NewWriter(&b, "Reservations: July")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := [][]interface{}{
+		{"ID", "Name", "Arrival", "Total", "Processed"},
+		{7, "Smith & Sons <Ltd>", time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC), Money(45050), true},
+		{8, "", time.Time{}, 1.5, false},
+	}
+	for _, row := range rows {
+		if err := x.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := make(map[string]string)
+	for _, f := range z.File {
+		r, _ := f.Open()
+		body, _ := io.ReadAll(r)
+		parts[f.Name] = string(body)
+
+		// every part must be well formed
+		d := xml.NewDecoder(bytes.NewReader(body))
+		for {
+			_, err := d.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s isn't well formed: %s", f.Name, err)
+			}
+		}
+	}
+
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("expected the workbook to have %s", name)
+		}
+	}
+
+	if !strings.Contains(parts["xl/workbook.xml"], `name="Reservations- July"`) {
+		t.Errorf("expected the sheet name to be cleaned up, got %s", parts["xl/workbook.xml"])
+	}
+
+	sheet := parts["xl/worksheets/sheet1.xml"]
+	for _, want := range []string{
+		`<c r="A1" t="inlineStr"><is><t xml:space="preserve">ID</t></is></c>`,
+		`<c r="A2"><v>7</v></c>`,
+		`<t xml:space="preserve">Smith &amp; Sons &lt;Ltd&gt;</t>`,
+		`<c r="C2" s="1"><v>45839</v></c>`,
+		`<c r="D2" s="2"><v>450.50</v></c>`,
+		`<c r="E2" t="b"><v>1</v></c>`,
+		`<row r="3"><c r="A3"><v>8</v></c><c r="D3"><v>1.5</v></c><c r="E3" t="b"><v>0</v></c></row>`,
+	} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("expected the sheet to contain %s, got\n%s", want, sheet)
+		}
+	}
+}
+
+func TestWriteUnknownCell(t *testing.T) {
+	x, err := NewWriter(io.Discard, "Sheet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Write([]interface{}{struct{}{}}); err == nil {
+		t.Error("expected an error writing a cell of an unknown type")
+	}
+}
+
+func TestColumn(t *testing.T) {
+	tests := map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"}
+
+	for i, expected := range tests {
+		if got := Column(i); got != expected {
+			t.Errorf("column %d: expected %s but got %s", i, expected, got)
+		}
+	}
+}
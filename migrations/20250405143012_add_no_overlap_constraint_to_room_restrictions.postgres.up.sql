@@ -0,0 +1,5 @@
+create extension if not exists btree_gist;
+
+alter table room_restrictions
+    add constraint room_restrictions_no_overlap
+    exclude using gist (room_id with =, daterange(start_date, end_date) with &&);
@@ -0,0 +1 @@
+update rooms set nightly_rate = 0, weekend_surcharge = 0, min_nights = 1;
@@ -0,0 +1,2 @@
+update rooms set nightly_rate = 8900, weekend_surcharge = 2000, min_nights = 1 where room_name = 'General''s Quarters';
+update rooms set nightly_rate = 12900, weekend_surcharge = 3000, min_nights = 2 where room_name = 'Major''s Suite';
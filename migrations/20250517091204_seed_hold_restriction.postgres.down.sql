@@ -0,0 +1,2 @@
+delete from room_restrictions where restriction_id = (select id from restrictions where restriction_name = 'Hold');
+delete from restrictions where restriction_name = 'Hold';
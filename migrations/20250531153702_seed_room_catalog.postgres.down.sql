@@ -0,0 +1,3 @@
+drop index if exists rooms_slug_idx;
+delete from room_photos where url like '/static/images/%';
+update rooms set slug = '', description = '', bed_configuration = '', amenities = '';
@@ -0,0 +1,28 @@
+update rooms set
+    slug = 'generals-quarters',
+    description = 'Your home away from home, set on the majestic waters of the Atlantic Ocean, this will be a vacation to remember.',
+    max_occupancy = 2,
+    bed_configuration = '1 queen bed',
+    amenities = E'Ocean view\nPrivate bathroom\nWi-Fi'
+where room_name = 'General''s Quarters';
+
+update rooms set
+    slug = 'majors-suite',
+    description = 'Your home away from home, set on the majestic waters of the Atlantic Ocean, this will be a vacation to remember.',
+    max_occupancy = 4,
+    bed_configuration = '1 king bed, 1 sofa bed',
+    amenities = E'Ocean view\nPrivate bathroom\nSitting room\nWi-Fi'
+where room_name = 'Major''s Suite';
+
+-- rooms added later without a slug get one from their id
+update rooms set slug = 'room-' || id where slug = '';
+
+insert into room_photos (room_id, url, caption, sort_order, created_at, updated_at)
+select id, '/static/images/generals-quarters.png', 'General''s Quarters', 0, now(), now()
+from rooms where slug = 'generals-quarters';
+
+insert into room_photos (room_id, url, caption, sort_order, created_at, updated_at)
+select id, '/static/images/marjors-suite.png', 'Major''s Suite', 0, now(), now()
+from rooms where slug = 'majors-suite';
+
+create unique index rooms_slug_idx on rooms (slug);
@@ -0,0 +1,2 @@
+INSERT INTO public.restrictions (restriction_name,created_at,updated_at) VALUES
+('External','2025-07-12 00:00:00.000','2025-07-12 00:00:00.000');
@@ -0,0 +1 @@
+UPDATE public.reservations SET processed = 1 WHERE confirmed_at IS NOT NULL OR status NOT IN ('pending', 'cancelled');
@@ -0,0 +1,2 @@
+UPDATE public.reservations SET status = 'confirmed', confirmed_at = updated_at WHERE processed = 1;
+UPDATE public.reservations SET status = 'cancelled' WHERE cancelled_at IS NOT NULL;
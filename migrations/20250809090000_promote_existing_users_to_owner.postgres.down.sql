@@ -0,0 +1,2 @@
+-- intentionally left empty: owners can't be told apart from the users the up migration promoted,
+-- and demoting every owner would lock the real ones out of managing roles and tokens
@@ -0,0 +1 @@
+UPDATE public.users SET access_level = 4 WHERE access_level = 1;